@@ -0,0 +1,659 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+
+	"github.com/containers/image/v5/transports/alltransports"
+)
+
+const (
+	OutputFormatJSON  = "json"
+	OutputFormatTable = "table"
+	OutputFormatTree  = "tree"
+
+	OutputFormatPackages     = "packages"
+	OutputFormatDependencies = "dependencies"
+	OutputFormatCategories   = "categories"
+
+	OutputFormatRecommendations = "recommendations"
+)
+
+/// The output formats of the analyze command that are not provided by an
+/// exporter
+var outputFormats = []string{
+	OutputFormatJSON, OutputFormatTable, OutputFormatTree,
+	OutputFormatPackages, OutputFormatDependencies, OutputFormatCategories,
+	OutputFormatRecommendations,
+}
+
+/// Returns all output formats of the analyze command including the formats
+/// of the exporters
+func allOutputFormats() []string {
+	formats := make([]string, 0, len(outputFormats)+len(internal.Exporters))
+	formats = append(formats, outputFormats...)
+	return append(formats, internal.ExportFormats()...)
+}
+
+/// Returns true if `format` is one of the output formats of the analyze
+/// command
+func isOutputFormat(format string) bool {
+	for _, f := range allOutputFormats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+/// Maximum length of the command that created a layer in the table output
+const maxCreatedByLength = 60
+
+/// Returns `imageUrl` with the `docker://` transport prepended if it does not
+/// specify a transport.
+func imageUrlWithTransport(imageUrl string) string {
+	if _, err := alltransports.ParseImageName(imageUrl); err != nil {
+		if _, err := alltransports.ParseImageName("docker://" + imageUrl); err == nil {
+			return "docker://" + imageUrl
+		}
+	}
+	return imageUrl
+}
+
+/// Analyzes the image with the url `imageUrl` in the foreground.
+///
+/// The task is returned if it could be created, even if the analysis failed,
+/// so that the results can be inspected if the image did not meet the
+/// efficiency threshold. The caller is responsible for cleaning up the task.
+func AnalyzeImage(imageUrl string, opts *analyzerOptions, minEfficiency float64, layerCache *internal.LayerCache) (*Task, error) {
+	t, err := newTask(imageUrlWithTransport(imageUrl), opts.stream, opts.registry)
+	if err != nil {
+		return nil, err
+	}
+	t.layerWorkers = opts.layerWorkers
+	t.layerCache = layerCache
+	t.signaturePolicy = opts.signaturePolicy
+	t.MinEfficiency = minEfficiency
+	t.HashFiles = opts.hashFiles
+
+	t.Process()
+	if err := t.Err(); err != nil {
+		return t, err
+	}
+	return t, t.ThresholdErr()
+}
+
+/// Analyzes the images with the urls `oldImageUrl` and `newImageUrl` one after
+/// another and compares their final root filesystems, see internal.DiffDirs.
+func DiffImages(oldImageUrl string, newImageUrl string, opts *analyzerOptions, layerCache *internal.LayerCache, includeUnchanged bool) (internal.DirDiff, error) {
+	roots := make([]internal.Dir, 0, 2)
+	for _, imageUrl := range []string{oldImageUrl, newImageUrl} {
+		t, err := AnalyzeImage(imageUrl, opts, 0, layerCache)
+		if t != nil {
+			defer t.Cleanup()
+		}
+		if err != nil {
+			return internal.DirDiff{}, errors.New(fmt.Sprintf("Failed to analyze %s: %s", imageUrl, err))
+		}
+		roots = append(roots, t.Analysis().MergedRoot)
+	}
+	return internal.DiffDirs(&roots[0], &roots[1], includeUnchanged), nil
+}
+
+/// Writes the analysis of the image of the finished task `t` to `w` in the
+/// output format `format`.
+///
+/// `depth` is the number of directory levels that are printed in the tree
+/// format. If `layer` is not empty, the tree format and the exporters show the
+/// layer whose digest starts with it instead of the final root filesystem.
+func PrintAnalysis(w io.Writer, t *Task, format string, depth int, layer string) error {
+	switch format {
+	case OutputFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.Analysis())
+	case OutputFormatTable:
+		return PrintLayerTable(w, t.Image.Manifest, t.Analysis())
+	case OutputFormatTree:
+		root, _, err := rootOfAnalysis(t.Analysis(), layer)
+		if err != nil {
+			return err
+		}
+		return PrintTree(w, root, depth)
+	case OutputFormatPackages:
+		return PrintPackageTable(w, t.Analysis().Packages)
+	case OutputFormatDependencies:
+		return PrintDependencyTable(w, t.Analysis().Dependencies)
+	case OutputFormatCategories:
+		return PrintCategoryTable(w, t.Image.Manifest, t.Analysis())
+	case OutputFormatRecommendations:
+		return PrintRecommendations(w, t.Analysis().Recommendations)
+	default:
+		exporter, ok := internal.Exporters[format]
+		if !ok {
+			return errors.New(fmt.Sprintf("Invalid output format: %s", format))
+		}
+		image, err := exportedImageOfTask(t, layer)
+		if err != nil {
+			return err
+		}
+		return exporter.Export(w, image)
+	}
+}
+
+/// Returns the data of the finished task `t` for the exporters, with the
+/// tree of the layer whose digest starts with `layer` if it is not empty.
+func exportedImageOfTask(t *Task, layer string) (internal.ExportedImage, error) {
+	analysis := t.Analysis()
+	root, digest, err := rootOfAnalysis(analysis, layer)
+	if err != nil {
+		return internal.ExportedImage{}, err
+	}
+
+	image := internal.ExportedImage{
+		Name:         t.Image.Image,
+		LayerDigests: LayerDigestsOfManifest(t.Image.Manifest),
+		Layers:       analysis.Layers,
+		Root:         root,
+		Timestamp:    time.Now(),
+	}
+	if t.Image.Tag != "" {
+		image.Name += ":" + t.Image.Tag
+	}
+	if layer != "" {
+		image.Layer = digest
+	}
+	return image, nil
+}
+
+/// Writes a table of the layers of an image with the manifest `manifest` and
+/// the analysis `analysis` to `w`, in the order in which they are applied.
+func PrintLayerTable(w io.Writer, manifest Manifest, analysis internal.ImageAnalysis) error {
+	wastedBytes := make(map[string]int64, len(analysis.Efficiency.Layers))
+	for _, l := range analysis.Efficiency.Layers {
+		wastedBytes[l.Digest] = l.WastedBytes
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tCOMPRESSED\tWASTED\tCREATED BY")
+
+	var totalSize, totalCompressed int64
+	for _, digest := range LayerDigestsOfManifest(manifest) {
+		layer, ok := analysis.Layers[digest]
+		if !ok {
+			continue
+		}
+		totalSize += layer.TotalSize
+		totalCompressed += layer.CompressedSize
+
+		shortDigest := digest
+		if len(shortDigest) > 12 {
+			shortDigest = shortDigest[:12]
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\n",
+			shortDigest,
+			FormatSize(layer.TotalSize),
+			FormatSize(layer.CompressedSize),
+			FormatSize(wastedBytes[digest]),
+			shortenCreatedBy(layer.CreatedBy),
+		)
+	}
+	fmt.Fprintf(
+		tw, "TOTAL\t%s\t%s\t%s\tefficiency: %.2f%%\n",
+		FormatSize(totalSize),
+		FormatSize(totalCompressed),
+		FormatSize(analysis.Efficiency.WastedBytes),
+		analysis.Efficiency.Efficiency*100,
+	)
+	if d := analysis.Duplicates; d != nil {
+		fmt.Fprintf(
+			tw, "DUPLICATES\t%s\t\t\t%d groups of identical files\n",
+			FormatSize(d.ReclaimableBytes), len(d.Groups),
+		)
+	}
+	if p := analysis.Packages; p != nil {
+		var packagedSize int64
+		for _, pkg := range p.Packages {
+			packagedSize += pkg.Size
+		}
+		fmt.Fprintf(
+			tw, "PACKAGES\t%s\t\t\t%d packages, %s in unowned files\n",
+			FormatSize(packagedSize), len(p.Packages), FormatSize(p.UnownedBytes),
+		)
+	}
+	if d := analysis.Dependencies; d != nil {
+		var dependencySize int64
+		for _, e := range d.Merged.Ecosystems {
+			dependencySize += e.Size
+		}
+		fmt.Fprintf(
+			tw, "DEPENDENCIES\t%s\t\t\t%d language dependencies\n",
+			FormatSize(dependencySize), len(d.Merged.Dependencies),
+		)
+	}
+	if r := analysis.Recommendations; len(r.Recommendations) > 0 {
+		fmt.Fprintf(
+			tw, "SAVABLE\t%s\t\t\t%d recommendations\n",
+			FormatSize(r.SavableBytes), len(r.Recommendations),
+		)
+	}
+
+	return tw.Flush()
+}
+
+/// Writes a table of the installed packages in `report` to `w`, the largest
+/// first, followed by the files that do not belong to any package.
+func PrintPackageTable(w io.Writer, report *internal.PackageReport) error {
+	if report == nil {
+		_, err := fmt.Fprintln(w, "No package database found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tVERSION\tARCH\tSIZE\tFILES\tMANAGER")
+	for _, p := range report.Packages {
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			p.Name, p.Version, p.Arch, FormatSize(p.Size), p.FileCount, p.Manager,
+		)
+	}
+	fmt.Fprintf(
+		tw, "UNOWNED\t\t\t%s\t%d\n",
+		FormatSize(report.UnownedBytes), len(report.UnownedFiles),
+	)
+	for _, e := range report.Errors {
+		fmt.Fprintf(tw, "ERROR\t%s\n", e)
+	}
+
+	return tw.Flush()
+}
+
+/// Writes a table of the language dependencies of the final image in
+/// `report` to `w`, the largest first, preceded by the size of each
+/// ecosystem.
+func PrintDependencyTable(w io.Writer, report *internal.DependencyReport) error {
+	if report == nil {
+		_, err := fmt.Fprintln(w, "No language dependencies found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ECOSYSTEM\tSIZE\tDEPENDENCIES")
+	for _, e := range report.Merged.Ecosystems {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", e.Ecosystem, FormatSize(e.Size), e.Dependencies)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "DEPENDENCY\tVERSION\tSIZE\tFILES\tCOPIES\tECOSYSTEM")
+	for _, d := range report.Merged.Dependencies {
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			d.Name, d.Version, FormatSize(d.Size), d.FileCount, len(d.Paths), d.Ecosystem,
+		)
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(tw, "ERROR\t%s\n", e)
+	}
+
+	return tw.Flush()
+}
+
+/// Writes the total size of each file category in the final image and in
+/// each layer of the image with the manifest `manifest` and the analysis
+/// `analysis` to `w`, the largest category first.
+func PrintCategoryTable(w io.Writer, manifest Manifest, analysis internal.ImageAnalysis) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "CATEGORY\tSIZE\tSHARE")
+	for _, c := range sortedCategories(analysis.MergedRoot.CategorySizes) {
+		share := 0.0
+		if analysis.MergedRoot.TotalSize > 0 {
+			share = float64(c.size) / float64(analysis.MergedRoot.TotalSize) * 100
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f%%\n", c.category, FormatSize(c.size), share)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "LAYER\tCATEGORY\tSIZE")
+	for _, digest := range LayerDigestsOfManifest(manifest) {
+		layer, ok := analysis.Layers[digest]
+		if !ok {
+			continue
+		}
+		shortDigest := digest
+		if len(shortDigest) > 12 {
+			shortDigest = shortDigest[:12]
+		}
+		for _, c := range sortedCategories(layer.CategorySizes) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", shortDigest, c.category, FormatSize(c.size))
+		}
+	}
+
+	return tw.Flush()
+}
+
+/// Writes the recommendations of `report` to `w`, each with its savings, kind,
+/// layer and suggestion followed by the affected paths.
+func PrintRecommendations(w io.Writer, report internal.RecommendationReport) error {
+	if len(report.Recommendations) == 0 {
+		_, err := fmt.Fprintln(w, "No recommendations")
+		return err
+	}
+
+	fmt.Fprintf(w, "Up to %s can be saved\n", FormatSize(report.SavableBytes))
+	for _, r := range report.Recommendations {
+		shortDigest := r.Layer
+		if len(shortDigest) > 12 {
+			shortDigest = shortDigest[:12]
+		}
+		fmt.Fprintf(w, "\n%s  %s  layer %s", FormatSize(r.Bytes), r.Kind, shortDigest)
+		if r.CreatedBy != "" {
+			fmt.Fprintf(w, " (%s)", shortenCreatedBy(r.CreatedBy))
+		}
+		fmt.Fprintf(w, "\n  %s\n", r.Suggestion)
+		for _, p := range r.Paths {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+		if r.FileCount > len(r.Paths) {
+			fmt.Fprintf(w, "  (%d files in total)\n", r.FileCount)
+		}
+	}
+	return nil
+}
+
+/// Checks the image of the finished task `t` against `budget`.
+///
+/// If `historyDb` is not empty, the growth of the image is checked against
+/// the most recent other version of the image stored in the SQLite database
+/// at this path.
+func CheckBudget(t *Task, budget internal.Budget, historyDb string) (internal.BudgetReport, error) {
+	var previous *internal.ImageHistoryEntry
+	if historyDb != "" && budget.MaxGrowthPercent != nil {
+		backend, err := internal.CreateSQLiteBackend(historyDb)
+		if err != nil {
+			return internal.BudgetReport{}, err
+		}
+		defer backend.Destroy()
+
+		histories, err := backend.Read(t.Image.Image)
+		if err != nil {
+			return internal.BudgetReport{}, err
+		}
+		if len(histories) > 0 {
+			previous = internal.PreviousHistoryEntry(histories[0], t.Image.OciImageDigest)
+		}
+	}
+
+	analysis := t.Analysis()
+	return internal.EvaluateBudget(
+		budget, LayerDigestsOfManifest(t.Image.Manifest), analysis.Layers, &analysis.MergedRoot, previous,
+	), nil
+}
+
+/// Writes the exceeded limits of `report` to `w`, or a single line stating
+/// that the budget is met.
+func PrintBudgetReport(w io.Writer, report internal.BudgetReport) error {
+	if !report.Exceeded() {
+		_, err := fmt.Fprintf(w, "All %d budget limits are met\n", report.Checks)
+		return err
+	}
+
+	fmt.Fprintf(w, "%d of %d budget limits are exceeded:\n", len(report.Violations), report.Checks)
+	for _, v := range report.Violations {
+		switch v.Kind {
+		case internal.BudgetKindGrowth:
+			fmt.Fprintf(
+				w, "  growth: %.1f%% > %.1f%% (previous version: %s)\n",
+				v.Actual, v.Limit, FormatSize(report.PreviousTotalSize),
+			)
+		case internal.BudgetKindLayerSize:
+			shortDigest := v.Subject
+			if len(shortDigest) > 12 {
+				shortDigest = shortDigest[:12]
+			}
+			fmt.Fprintf(w, "  layer %s: %s > %s\n", shortDigest, FormatSize(int64(v.Actual)), FormatSize(int64(v.Limit)))
+		case internal.BudgetKindPath:
+			fmt.Fprintf(w, "  %s: %s > %s\n", v.Subject, FormatSize(int64(v.Actual)), FormatSize(int64(v.Limit)))
+		default:
+			fmt.Fprintf(w, "  %s size: %s > %s\n", v.Kind, FormatSize(int64(v.Actual)), FormatSize(int64(v.Limit)))
+		}
+	}
+	return nil
+}
+
+/// Writes whether the image has been verified by the signature policy and by
+/// which keys to `w`
+func PrintSignatureVerification(w io.Writer, v *SignatureVerification) error {
+	if v == nil {
+		_, err := fmt.Fprintln(w, "The signatures of the image have not been checked")
+		return err
+	}
+
+	policy := v.Policy
+	if policy == "" {
+		policy = "the default policy"
+	}
+	if !v.Allowed {
+		_, err := fmt.Fprintf(w, "The image %s is rejected by %s\n", v.ManifestDigest, policy)
+		return err
+	}
+	if !v.Verified {
+		_, err := fmt.Fprintf(w, "The image %s is accepted by %s without a verified signature\n", v.ManifestDigest, policy)
+		return err
+	}
+
+	fmt.Fprintf(w, "The image %s is accepted by %s and signed by:\n", v.ManifestDigest, policy)
+	for _, s := range v.Signatures {
+		fmt.Fprintf(w, "  key %s for %s", s.KeyIdentifier, s.DockerReference)
+		if s.Timestamp != nil {
+			fmt.Fprintf(w, " at %s", s.Timestamp.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+/// Returns the tree of the layer of `analysis` whose digest starts with
+/// `layer` and its full digest, or the final root filesystem and "/" if
+/// `layer` is empty.
+func rootOfAnalysis(analysis internal.ImageAnalysis, layer string) (*internal.Dir, string, error) {
+	if layer == "" {
+		return &analysis.MergedRoot, "/", nil
+	}
+
+	layer = strings.TrimPrefix(layer, "sha256:")
+	var found []string
+	for digest := range analysis.Layers {
+		if strings.HasPrefix(digest, layer) {
+			found = append(found, digest)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, "", errors.New(fmt.Sprintf("The image has no layer with the digest %s", layer))
+	case 1:
+		l := analysis.Layers[found[0]]
+		return &l.Dir, found[0], nil
+	default:
+		return nil, "", errors.New(fmt.Sprintf("The digest %s matches %d layers", layer, len(found)))
+	}
+}
+
+type categorySize struct {
+	category internal.FileCategory
+	size     int64
+}
+
+/// Returns the entries of `sizes` sorted by their size in descending order
+func sortedCategories(sizes map[internal.FileCategory]int64) []categorySize {
+	res := make([]categorySize, 0, len(sizes))
+	for category, size := range sizes {
+		res = append(res, categorySize{category: category, size: size})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].size != res[j].size {
+			return res[i].size > res[j].size
+		}
+		return res[i].category < res[j].category
+	})
+	return res
+}
+
+/// Collapses the whitespace in `createdBy` and truncates it to
+/// `maxCreatedByLength` characters.
+func shortenCreatedBy(createdBy string) string {
+	createdBy = strings.Join(strings.Fields(createdBy), " ")
+	if r := []rune(createdBy); len(r) > maxCreatedByLength {
+		return string(r[:maxCreatedByLength-1]) + "…"
+	}
+	return createdBy
+}
+
+/// Writes the directory tree `root` to `w`, up to `depth` levels below the
+/// root.
+///
+/// The entries of each directory are sorted by their size in descending order.
+func PrintTree(w io.Writer, root *internal.Dir, depth int) error {
+	if _, err := fmt.Fprintf(w, "%10s  %s\n", FormatSize(root.TotalSize), root.DirName); err != nil {
+		return err
+	}
+	return printTreeEntries(w, root, 1, depth)
+}
+
+type treeEntry struct {
+	name string
+	size int64
+	dir  *internal.Dir
+}
+
+func printTreeEntries(w io.Writer, d *internal.Dir, level int, depth int) error {
+	if level > depth {
+		return nil
+	}
+
+	entries := make([]treeEntry, 0, len(d.Files)+len(d.Directiories))
+	for name, size := range d.Files {
+		entries = append(entries, treeEntry{name: name, size: size})
+	}
+	for name := range d.Directiories {
+		subdir := d.Directiories[name]
+		entries = append(entries, treeEntry{name: name + "/", size: subdir.TotalSize, dir: &subdir})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].size != entries[j].size {
+			return entries[i].size > entries[j].size
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	indent := strings.Repeat("  ", level)
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%10s  %s%s\n", FormatSize(e.size), indent, e.name); err != nil {
+			return err
+		}
+		if e.dir != nil {
+			if err := printTreeEntries(w, e.dir, level+1, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/// Writes the changed entries of `diff` to `w` up to `depth` levels below the
+/// root with their size difference and status.
+///
+/// The entries of each directory are sorted by the absolute value of their
+/// size difference in descending order.
+func PrintDiffTree(w io.Writer, diff internal.DirDiff, depth int) error {
+	if _, err := fmt.Fprintf(w, "%10s  %-9s  %s\n", formatDelta(diff.Delta), diff.Status, diff.DirName); err != nil {
+		return err
+	}
+	return printDiffEntries(w, &diff, 1, depth)
+}
+
+type diffEntry struct {
+	name   string
+	status internal.DiffStatus
+	delta  int64
+	dir    *internal.DirDiff
+}
+
+func printDiffEntries(w io.Writer, d *internal.DirDiff, level int, depth int) error {
+	if level > depth {
+		return nil
+	}
+
+	entries := make([]diffEntry, 0, len(d.Files)+len(d.Directories))
+	for _, f := range d.Files {
+		if f.Status != internal.DiffStatusUnchanged {
+			entries = append(entries, diffEntry{name: f.Name, status: f.Status, delta: f.Delta})
+		}
+	}
+	for i := range d.Directories {
+		subdir := &d.Directories[i]
+		if subdir.Status != internal.DiffStatusUnchanged {
+			entries = append(entries, diffEntry{name: subdir.DirName + "/", status: subdir.Status, delta: subdir.Delta, dir: subdir})
+		}
+	}
+	abs := func(v int64) int64 {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if abs(entries[i].delta) != abs(entries[j].delta) {
+			return abs(entries[i].delta) > abs(entries[j].delta)
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	indent := strings.Repeat("  ", level)
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%10s  %-9s  %s%s\n", formatDelta(e.delta), e.status, indent, e.name); err != nil {
+			return err
+		}
+		if e.dir != nil {
+			if err := printDiffEntries(w, e.dir, level+1, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/// Returns the size difference `delta` in a human readable form with a
+/// leading + if it is positive
+func formatDelta(delta int64) string {
+	if delta > 0 {
+		return "+" + FormatSize(delta)
+	}
+	return FormatSize(delta)
+}
+
+/// Returns `size` in a human readable form using binary prefixes
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit && size > -unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	prefixes := "KMGTPE"
+	i := -1
+	for (value >= unit || value <= -unit) && i < len(prefixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, prefixes[i])
+}
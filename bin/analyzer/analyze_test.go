@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSize(t *testing.T) {
+	for size, expected := range map[int64]string{
+		0:                  "0 B",
+		1023:               "1023 B",
+		1024:               "1.0 KiB",
+		1536:               "1.5 KiB",
+		5 * 1024 * 1024:    "5.0 MiB",
+		3 << 30:            "3.0 GiB",
+		-2048:              "-2.0 KiB",
+		1<<62 + 1<<61:      "6.0 EiB",
+		1024*1024*1024 - 1: "1024.0 MiB",
+	} {
+		assert.Equal(t, expected, FormatSize(size))
+	}
+}
+
+func TestShortenCreatedBy(t *testing.T) {
+	assert.Equal(t, "RUN zypper -n in python3", shortenCreatedBy("RUN  zypper -n\n\tin python3"))
+
+	long := shortenCreatedBy("/bin/sh -c " + strings.Repeat("x", 100))
+	assert.Equal(t, maxCreatedByLength, len([]rune(long)))
+	assert.True(t, strings.HasSuffix(long, "…"))
+}
+
+func TestImageUrlWithTransport(t *testing.T) {
+	assert.Equal(t, "docker://docker.io/library/alpine:3.15", imageUrlWithTransport("docker.io/library/alpine:3.15"))
+	assert.Equal(t, "docker://alpine", imageUrlWithTransport("alpine"))
+	assert.Equal(t, "docker://alpine", imageUrlWithTransport("docker://alpine"))
+	assert.Equal(t, "docker-archive:/tmp/img.tar", imageUrlWithTransport("docker-archive:/tmp/img.tar"))
+}
+
+/// Returns an image with a base layer and a layer that removes a file of it
+func testAnalysis() (Manifest, internal.ImageAnalysis) {
+	base := internal.NewLayer()
+	base.InsertIntoDir("/usr/bin/bash", 4096)
+	base.InsertIntoDir("/usr/lib/libc.so", 2048)
+	base.InsertIntoDir("/etc/os-release", 100)
+	base.CreatedBy = "ADD rootfs.tar /"
+	base.CompressedSize = 3000
+
+	top := internal.NewLayer()
+	top.InsertIntoDir("/usr/lib/.wh.libc.so", 0)
+	top.InsertIntoDir("/app/main", 512)
+	top.CreatedBy = "RUN rm /usr/lib/libc.so &&   install app"
+	top.CompressedSize = 400
+
+	baseDigest := strings.Repeat("a", 64)
+	topDigest := strings.Repeat("b", 64)
+
+	manifest := Manifest{Layers: []ExtractedDigest{
+		{Digest: "sha256:" + baseDigest},
+		{Digest: "sha256:" + topDigest},
+	}}
+	layers := internal.LayerSizes{baseDigest: base, topDigest: top}
+
+	return manifest, internal.ImageAnalysis{
+		Layers:     layers,
+		MergedRoot: MergeLayersOfManifest(manifest, layers),
+		Efficiency: internal.CalculateEfficiency(LayerDigestsOfManifest(manifest), layers),
+	}
+}
+
+func TestPrintLayerTable(t *testing.T) {
+	manifest, analysis := testAnalysis()
+
+	var out bytes.Buffer
+	require.NoError(t, PrintLayerTable(&out, manifest, analysis))
+
+	assert.Equal(t, `LAYER         SIZE     COMPRESSED  WASTED   CREATED BY
+aaaaaaaaaaaa  6.1 KiB  2.9 KiB     2.0 KiB  ADD rootfs.tar /
+bbbbbbbbbbbb  512 B    400 B       0 B      RUN rm /usr/lib/libc.so && install app
+TOTAL         6.6 KiB  3.3 KiB     2.0 KiB  efficiency: 69.69%
+`, out.String())
+}
+
+func TestPrintTree(t *testing.T) {
+	_, analysis := testAnalysis()
+
+	var out bytes.Buffer
+	require.NoError(t, PrintTree(&out, &analysis.MergedRoot, 1))
+	assert.Equal(t, `   4.6 KiB  /
+   4.0 KiB    usr/
+     512 B    app/
+     100 B    etc/
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintTree(&out, &analysis.MergedRoot, 3))
+	assert.Equal(t, `   4.6 KiB  /
+   4.0 KiB    usr/
+   4.0 KiB      bin/
+   4.0 KiB        bash
+       0 B      lib/
+     512 B    app/
+     512 B      main
+     100 B    etc/
+     100 B      os-release
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintTree(&out, &analysis.MergedRoot, 0))
+	assert.Equal(t, "   4.6 KiB  /\n", out.String())
+}
+
+func TestPrintAnalysisInvalidFormat(t *testing.T) {
+	assert.Error(t, PrintAnalysis(&bytes.Buffer{}, &Task{}, "yaml", 1, ""))
+}
+
+func TestPrintPackageTable(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, PrintPackageTable(&out, &internal.PackageReport{
+		Packages: []internal.PackageSize{
+			{
+				PackageRef: internal.PackageRef{Manager: internal.PackageManagerRpm, Name: "bash", Version: "5.1-1", Arch: "x86_64"},
+				Size:       4096,
+				FileCount:  2,
+			},
+			{
+				PackageRef: internal.PackageRef{Manager: internal.PackageManagerDpkg, Name: "tzdata", Version: "2021a"},
+				Size:       100,
+				FileCount:  1,
+			},
+		},
+		UnownedFiles: []internal.UnownedFile{{Path: "/app/main", Size: 512}},
+		UnownedBytes: 512,
+	}))
+
+	assert.Equal(t, `PACKAGE  VERSION  ARCH    SIZE     FILES  MANAGER
+bash     5.1-1    x86_64  4.0 KiB  2      rpm
+tzdata   2021a            100 B    1      dpkg
+UNOWNED                   512 B    1
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintPackageTable(&out, nil))
+	assert.Equal(t, "No package database found\n", out.String())
+}
+
+func TestPrintDependencyTable(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, PrintDependencyTable(&out, &internal.DependencyReport{
+		Merged: internal.DependencyBreakdown{
+			Ecosystems: []internal.EcosystemSize{
+				{Ecosystem: internal.EcosystemNpm, Size: 2048, Dependencies: 2},
+			},
+			Dependencies: []internal.Dependency{
+				{
+					Ecosystem: internal.EcosystemNpm, Name: "lodash", Version: "4.17.21",
+					Size: 2000, FileCount: 4, Paths: []string{"/app/node_modules/lodash", "/node_modules/lodash"},
+				},
+				{
+					Ecosystem: internal.EcosystemNpm, Name: "@babel/core", Version: "7.19.0",
+					Size: 48, FileCount: 1, Paths: []string{"/app/node_modules/@babel/core"},
+				},
+			},
+		},
+	}))
+
+	assert.Equal(t, `ECOSYSTEM  SIZE     DEPENDENCIES
+npm        2.0 KiB  2
+
+DEPENDENCY   VERSION  SIZE     FILES  COPIES  ECOSYSTEM
+lodash       4.17.21  2.0 KiB  4      2       npm
+@babel/core  7.19.0   48 B     1      1       npm
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintDependencyTable(&out, nil))
+	assert.Equal(t, "No language dependencies found\n", out.String())
+}
+
+func TestPrintCategoryTable(t *testing.T) {
+	base := internal.NewLayer()
+	base.InsertFileIntoDir("/usr/bin/bash", 3072, internal.FileInfo{Category: internal.FileCategoryExecutable})
+	base.InsertFileIntoDir("/usr/share/doc/bash/README", 1024, internal.FileInfo{Category: internal.FileCategoryDocumentation})
+
+	top := internal.NewLayer()
+	top.InsertFileIntoDir("/usr/share/doc/.wh.bash", 0, internal.FileInfo{})
+
+	baseDigest := strings.Repeat("a", 64)
+	topDigest := strings.Repeat("b", 64)
+	manifest := Manifest{Layers: []ExtractedDigest{
+		{Digest: "sha256:" + baseDigest},
+		{Digest: "sha256:" + topDigest},
+	}}
+	layers := internal.LayerSizes{baseDigest: base, topDigest: top}
+
+	var out bytes.Buffer
+	require.NoError(t, PrintCategoryTable(&out, manifest, internal.ImageAnalysis{
+		Layers:     layers,
+		MergedRoot: MergeLayersOfManifest(manifest, layers),
+	}))
+
+	assert.Equal(t, `CATEGORY    SIZE     SHARE
+executable  3.0 KiB  100.00%
+
+LAYER         CATEGORY       SIZE
+aaaaaaaaaaaa  executable     3.0 KiB
+aaaaaaaaaaaa  documentation  1.0 KiB
+`, out.String())
+}
+
+func TestIsOutputFormat(t *testing.T) {
+	for _, format := range outputFormats {
+		assert.True(t, isOutputFormat(format), format)
+	}
+	assert.False(t, isOutputFormat("yaml"))
+	assert.False(t, isOutputFormat(""))
+}
+
+func TestPrintRecommendations(t *testing.T) {
+	_, analysis := testAnalysis()
+	digests := []string{strings.Repeat("a", 64), strings.Repeat("b", 64)}
+	report := internal.Recommend(digests, analysis.Layers, &analysis.MergedRoot, analysis.Efficiency)
+
+	var out bytes.Buffer
+	analysis.Recommendations = report
+	require.NoError(t, PrintLayerTable(&out, Manifest{}, analysis))
+	assert.Contains(t, out.String(), "SAVABLE  2.0 KiB                       1 recommendations\n")
+
+	out.Reset()
+	require.NoError(t, PrintRecommendations(&out, report))
+	assert.Equal(t, `Up to 2.0 KiB can be saved
+
+2.0 KiB  removed_later  layer aaaaaaaaaaaa (ADD rootfs.tar /)
+  The files are removed by a later layer but still occupy space in this one, remove them in the same step that creates them
+  /usr/lib/libc.so
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintRecommendations(&out, internal.RecommendationReport{}))
+	assert.Equal(t, "No recommendations\n", out.String())
+}
+
+func TestPrintBudgetReport(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, PrintBudgetReport(&out, internal.BudgetReport{Checks: 3}))
+	assert.Equal(t, "All 3 budget limits are met\n", out.String())
+
+	out.Reset()
+	require.NoError(t, PrintBudgetReport(&out, internal.BudgetReport{
+		Checks: 4,
+		Violations: []internal.BudgetViolation{
+			{Kind: internal.BudgetKindTotalSize, Limit: 1024, Actual: 2048},
+			{Kind: internal.BudgetKindLayerSize, Subject: strings.Repeat("a", 64), Limit: 1024, Actual: 1536},
+			{Kind: internal.BudgetKindPath, Subject: "/usr/share/doc/**", Limit: 0, Actual: 100},
+			{Kind: internal.BudgetKindGrowth, Limit: 10, Actual: 12.5},
+		},
+		PreviousTotalSize: 2048,
+	}))
+	assert.Equal(t, `4 of 4 budget limits are exceeded:
+  total size: 2.0 KiB > 1.0 KiB
+  layer aaaaaaaaaaaa: 1.5 KiB > 1.0 KiB
+  /usr/share/doc/**: 100 B > 0 B
+  growth: 12.5% > 10.0% (previous version: 2.0 KiB)
+`, out.String())
+}
+
+func TestRootOfAnalysis(t *testing.T) {
+	_, analysis := testAnalysis()
+
+	root, name, err := rootOfAnalysis(analysis, "")
+	require.NoError(t, err)
+	assert.Equal(t, "/", name)
+	assert.Equal(t, &analysis.MergedRoot, root)
+
+	root, name, err = rootOfAnalysis(analysis, "sha256:bbbb")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 64), name)
+	assert.Equal(t, int64(512), root.TotalSize)
+
+	_, _, err = rootOfAnalysis(analysis, "cccc")
+	assert.Error(t, err)
+
+	analysis.Layers["abcdef"] = internal.NewLayer()
+	_, _, err = rootOfAnalysis(analysis, "a")
+	assert.Error(t, err)
+}
+
+func TestPrintAnalysisWithExporter(t *testing.T) {
+	manifest, analysis := testAnalysis()
+	task := &Task{Image: ContainerImage{
+		Image:      "registry.example.com/app",
+		Tag:        "1",
+		Manifest:   manifest,
+		layers:     &analysis.Layers,
+		mergedRoot: &analysis.MergedRoot,
+	}}
+
+	var out bytes.Buffer
+	require.NoError(t, PrintAnalysis(&out, task, internal.ExportFormatFolded, 0, ""))
+	assert.Equal(t, "app;main 512\netc;os-release 100\nusr;bin;bash 4096\n", out.String())
+
+	out.Reset()
+	require.NoError(t, PrintAnalysis(&out, task, internal.ExportFormatCSV, 0, "bbbb"))
+	assert.Equal(t, fmt.Sprintf("layer,path,size,type\n%[1]s,/app/main,512,\n%[1]s,/usr/lib/.wh.libc.so,0,whiteout\n", strings.Repeat("b", 64)), out.String())
+
+	image, err := exportedImageOfTask(task, "")
+	require.NoError(t, err)
+	assert.Equal(t, "registry.example.com/app:1", image.Name)
+	assert.Equal(t, "", image.Layer)
+	assert.Equal(t, LayerDigestsOfManifest(manifest), image.LayerDigests)
+
+	assert.Error(t, PrintAnalysis(&out, task, internal.ExportFormatNcdu, 0, "cccc"))
+}
+
+func TestPrintDiffTree(t *testing.T) {
+	_, analysis := testAnalysis()
+	base := analysis.Layers[strings.Repeat("a", 64)]
+	diff := internal.DiffDirs(&base.Dir, &analysis.MergedRoot, true)
+
+	var out bytes.Buffer
+	require.NoError(t, PrintDiffTree(&out, diff, 3))
+	assert.Equal(t, `  -1.5 KiB  shrunk     /
+  -2.0 KiB  shrunk       usr/
+  -2.0 KiB  shrunk         lib/
+  -2.0 KiB  removed          libc.so
+    +512 B  added        app/
+    +512 B  added          main
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, PrintDiffTree(&out, diff, 0))
+	assert.Equal(t, "  -1.5 KiB  shrunk     /\n", out.String())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// Default maximum size of the layer cache in bytes
+const DefaultLayerCacheSize = 1 << 30
+
+/// Returns the analysis of the layer with the digest `digest` from `cache` if
+/// it is present and has been analyzed with at least the options `opts`,
+/// otherwise the layer is analyzed via `analyze` and the result is added to
+/// the cache. `cached` is true if the layer was taken from the cache.
+///
+/// `cache` may be nil, then the layer is always analyzed. Errors of the cache
+/// are only logged, as the layer can always be analyzed again.
+func analyzeLayerCached(
+	cache *internal.LayerCache,
+	digest string,
+	opts internal.LayerAnalysisOptions,
+	analyze func() (internal.Layer, error),
+) (layer internal.Layer, cached bool, err error) {
+	if layer, ok := cachedLayer(cache, digest, opts); ok {
+		return layer, true, nil
+	}
+
+	if layer, err = analyze(); err != nil || cache == nil {
+		return layer, false, err
+	}
+
+	if err := cache.Put(digest, layer); err != nil {
+		log.WithFields(
+			logrus.Fields{"digest": digest, "error": err},
+		).Error("Failed to add the layer to the cache")
+	}
+	return layer, false, nil
+}
+
+/// Returns the analysis of the layer with the digest `digest` from `cache` if
+/// it is present and has been analyzed with at least the options `opts`.
+///
+/// `cache` may be nil, errors of the cache are only logged.
+func cachedLayer(cache *internal.LayerCache, digest string, opts internal.LayerAnalysisOptions) (internal.Layer, bool) {
+	if cache == nil {
+		return internal.NewLayer(), false
+	}
+
+	layer, ok, err := cache.Get(digest)
+	if err != nil {
+		log.WithFields(
+			logrus.Fields{"digest": digest, "error": err},
+		).Error("Failed to read the layer from the cache")
+		return internal.NewLayer(), false
+	}
+	if !ok || (!layer.ContentsHashed && opts.HashContents) {
+		return internal.NewLayer(), false
+	}
+
+	log.WithFields(logrus.Fields{"digest": digest}).Debug("Using the cached layer")
+	return layer, true
+}
+
+/// Returns true if all layers with the digests `digests` are present in
+/// `cache`.
+///
+/// The options with which the layers have been analyzed are not checked, so
+/// `analyzeLayerCached` might still have to analyze some of them.
+func allLayersCached(cache *internal.LayerCache, digests []string) bool {
+	if cache == nil {
+		return false
+	}
+	for _, digest := range digests {
+		if ok, err := cache.Has(digest); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+
+	"github.com/docker/distribution/reference"
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// The sizes of a single platform of a multi-arch image
+type PlatformSizes struct {
+	/// The platform of the image
+	Platform Platform `json:"platform"`
+
+	/// The digest of the manifest of the image of this platform
+	Digest string `json:"digest"`
+
+	/// The number of layers of the image
+	Layers int `json:"layers"`
+
+	/// The sum of the sizes of the compressed layer blobs in bytes
+	CompressedSize int64 `json:"compressed_size"`
+
+	/// The sum of the sizes of the files in all layers in bytes
+	LayersSize int64 `json:"layers_size"`
+
+	/// The size of the final root filesystem in bytes
+	MergedSize int64 `json:"merged_size"`
+
+	/// The bytes of the layers that are overwritten or removed by subsequent
+	/// layers
+	WastedBytes int64 `json:"wasted_bytes"`
+}
+
+/// The space that an image index occupies in a registry
+type IndexFootprint struct {
+	/// The size of the index, all manifests, configurations and layers in
+	/// bytes, blobs that are shared by several platforms are counted once
+	TotalSize int64 `json:"total_size"`
+
+	/// The size that the index would occupy if no blobs were shared between
+	/// the platforms
+	UnsharedSize int64 `json:"unshared_size"`
+
+	/// The number of blobs that are used by more than one platform
+	SharedBlobs int `json:"shared_blobs"`
+}
+
+/// The analysis of the image of a single platform of an index
+type PlatformAnalysis struct {
+	/// The platform of the image
+	Platform Platform `json:"platform"`
+
+	/// The digest of the manifest of the image of this platform
+	Digest string `json:"digest"`
+
+	/// The result of the analysis of the image
+	Analysis internal.ImageAnalysis `json:"analysis"`
+}
+
+/// The result of the analysis of all platforms of a multi-arch image
+type IndexAnalysis struct {
+	/// The analysis of every platform in the order of the index
+	Platforms []PlatformAnalysis `json:"platforms"`
+
+	/// The sizes of every platform in the order of the index
+	Sizes []PlatformSizes `json:"sizes"`
+
+	/// The space occupied by the whole index
+	Footprint IndexFootprint `json:"footprint"`
+}
+
+/// A task that analyzes the images of all platforms of a multi-arch image.
+///
+/// The platforms are analyzed one after another, so that layers that are
+/// shared between them are only analyzed once and are taken from the layer
+/// cache afterwards.
+type IndexTask struct {
+	/// URL of the image index including the transport
+	ImageUrl string `json:"image_url"`
+
+	/// Current state of this task, can be converted to a string via `TaskStateToStr`
+	State TaskState `json:"state"`
+
+	/// The images of the platforms of the index
+	Manifests []ExtractedDigest `json:"manifests"`
+
+	/// The tasks analyzing the image of each platform, a task is only added
+	/// once its analysis starts
+	Platforms []*Task `json:"platforms"`
+
+	/// If true, the layers are streamed directly from the registry
+	Stream bool `json:"stream"`
+
+	/// If true, the contents of all files are hashed to find duplicate files
+	HashFiles bool `json:"hash_files"`
+
+	/// an error if any occurred
+	error error
+
+	// name of the image without the transport, tag and digest
+	name string
+
+	// url of the image with a resolved short name
+	url string
+
+	// settings for fetching the images from the registry, including the
+	// credentials, see Task.registry
+	registry *RegistryOptions
+
+	// contains the temporary layer cache, if one had to be created
+	tempdir string
+
+	// number of layers of each image that are analyzed in parallel
+	layerWorkers int
+
+	// cache of already analyzed layers, a temporary one is created if this is
+	// nil
+	layerCache *internal.LayerCache
+
+	// path to the signature policy, empty for the default policy
+	signaturePolicy string
+
+	// true if layerCache has been created by this task
+	ownsLayerCache bool
+
+	analysis *IndexAnalysis
+
+	created time.Time
+
+	// guards all fields that are written while the task is processed
+	mu sync.RWMutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+/// Creates a new task that analyzes every platform of the multi-arch image
+/// with the url `imageUrl`, which has to refer to an image in a registry.
+///
+/// If `stream` is true, the layers are streamed directly from the registry.
+/// The registry is accessed with the settings `registry`.
+func NewIndexTask(imageUrl string, stream bool, registry RegistryOptions) (*IndexTask, error) {
+	ref, err := alltransports.ParseImageName(imageUrl)
+	if err != nil {
+		return nil, err
+	}
+	if transport := ref.Transport().Name(); transport != "docker" {
+		return nil, errors.New(
+			fmt.Sprintf("Only images in a registry can be analyzed per platform, got the transport %s", transport),
+		)
+	}
+
+	named, err := resolveImageName(strings.TrimPrefix(ref.StringWithinTransport(), "//"), registry.SystemContext())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(backgroundContext)
+
+	t := IndexTask{
+		ImageUrl:     imageUrl,
+		State:        TaskStateNew,
+		Stream:       stream,
+		name:         reference.TrimNamed(named).String(),
+		url:          "docker://" + reference.TagNameOnly(named).String(),
+		registry:     &registry,
+		layerWorkers: DefaultLayerWorkers,
+		created:      time.Now(),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+
+	log.WithFields(logrus.Fields{"IndexTask": &t}).Info("Created index task")
+
+	return &t, nil
+}
+
+func (t *IndexTask) MarshalJSON() ([]byte, error) {
+	type Alias IndexTask
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var errMsg string
+	if t.error != nil {
+		errMsg = t.error.Error()
+	}
+	return json.Marshal(&struct {
+		Error string `json:"error"`
+		*Alias
+	}{Error: errMsg, Alias: (*Alias)(t)})
+}
+
+/// Returns the current state of the task
+func (t *IndexTask) GetState() TaskState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.State
+}
+
+/// Returns the error that occurred while processing the task, if any
+func (t *IndexTask) Err() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.error
+}
+
+func (t *IndexTask) setState(s TaskState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.State = s
+}
+
+/// Returns the analysis of all platforms, nil unless the task has finished
+func (t *IndexTask) Analysis() *IndexAnalysis {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.analysis
+}
+
+func (t *IndexTask) Process() {
+	setError := func(e error) {
+		log.WithFields(
+			logrus.Fields{"error": e, "task": t},
+		).Error("Error occurred when processing the index task")
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.error = e
+		t.State = TaskStateError
+	}
+
+	t.setState(TaskStatePulling)
+
+	rawIndex, index, err := fetchManifest(t.ctx, t.url, t.registry.SystemContext())
+	if err != nil {
+		setError(err)
+		return
+	}
+	manifests := platformManifests(index)
+	if len(manifests) == 0 {
+		setError(errors.New(fmt.Sprintf("The image %s is not a multi-arch image", t.ImageUrl)))
+		return
+	}
+
+	t.mu.Lock()
+	t.Manifests = manifests
+	t.mu.Unlock()
+
+	if t.layerCache == nil {
+		if err := t.createLayerCache(); err != nil {
+			setError(err)
+			return
+		}
+	}
+
+	t.setState(TaskStateAnalyzing)
+
+	analysis := IndexAnalysis{
+		Platforms: make([]PlatformAnalysis, 0, len(manifests)),
+		Sizes:     make([]PlatformSizes, 0, len(manifests)),
+	}
+	imageManifests := make([]Manifest, 0, len(manifests))
+
+	for _, m := range manifests {
+		if err := t.ctx.Err(); err != nil {
+			setError(err)
+			return
+		}
+
+		pt, err := newTask(fmt.Sprintf("docker://%s@%s", t.name, m.Digest), t.Stream, *t.registry)
+		if err != nil {
+			setError(err)
+			return
+		}
+		pt.layerWorkers = t.layerWorkers
+		pt.layerCache = t.layerCache
+		pt.signaturePolicy = t.signaturePolicy
+		pt.HashFiles = t.HashFiles
+
+		t.mu.Lock()
+		t.Platforms = append(t.Platforms, pt)
+		t.mu.Unlock()
+
+		pt.Process()
+		if err := pt.Err(); err != nil {
+			setError(errors.New(fmt.Sprintf("Failed to analyze the platform %s: %s", m.Platform, err)))
+			return
+		}
+
+		platformAnalysis := pt.Analysis()
+		analysis.Platforms = append(analysis.Platforms, PlatformAnalysis{
+			Platform: m.Platform,
+			Digest:   m.Digest,
+			Analysis: platformAnalysis,
+		})
+		analysis.Sizes = append(analysis.Sizes, SizesOfPlatform(m, pt.Image.Manifest, platformAnalysis))
+		imageManifests = append(imageManifests, pt.Image.Manifest)
+
+		// the analysis has been copied, the temporary files of the platform
+		// are no longer needed
+		if err := pt.Cleanup(); err != nil {
+			log.WithFields(
+				logrus.Fields{"error": err, "task": pt},
+			).Error("Failed to clean up the task of a platform")
+		}
+	}
+
+	analysis.Footprint = FootprintOfIndex(int64(len(rawIndex)), manifests, imageManifests)
+
+	t.mu.Lock()
+	t.analysis = &analysis
+	t.State = TaskStateFinished
+	t.mu.Unlock()
+}
+
+/// Creates a temporary layer cache that is shared by the tasks of all
+/// platforms
+func (t *IndexTask) createLayerCache() error {
+	tempdir, err := createTaskTempdir()
+	if err != nil {
+		return err
+	}
+	cache, err := internal.CreateLayerCache(filepath.Join(tempdir, "layer-cache.sqlite3"), DefaultLayerCacheSize)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tempdir = tempdir
+	t.layerCache = cache
+	t.ownsLayerCache = true
+	return nil
+}
+
+func (t *IndexTask) Cleanup() error {
+	t.cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var firstErr error
+	for _, pt := range t.Platforms {
+		if err := pt.Cleanup(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if t.ownsLayerCache {
+		if err := t.layerCache.Destroy(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		t.layerCache = nil
+		t.ownsLayerCache = false
+	}
+	if err := os.RemoveAll(t.tempdir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+/// Fetches and parses the manifest of the image with the url `imageUrl` using
+/// the system context `sys`, the manifest is returned in its raw form as well.
+func fetchManifest(ctx context.Context, imageUrl string, sys *types.SystemContext) ([]byte, Manifest, error) {
+	var manifest Manifest
+
+	remoteReference, err := alltransports.ParseImageName(imageUrl)
+	if err != nil {
+		return nil, manifest, err
+	}
+
+	imgSrc, err := remoteReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer imgSrc.Close()
+
+	raw, _, err := imgSrc.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, manifest, err
+	}
+
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, manifest, err
+	}
+	return raw, manifest, nil
+}
+
+/// Annotation of the attestation manifests that buildx adds to an index,
+/// which refers to the manifest of the image that the attestation describes
+const dockerReferenceTypeAnnotation = "vnd.docker.reference.type"
+
+/// Returns the entries of the manifest list `index` that have a platform.
+///
+/// Attestation manifests are skipped, as they do not contain a root
+/// filesystem.
+func platformManifests(index Manifest) []ExtractedDigest {
+	manifests := make([]ExtractedDigest, 0)
+	for _, manifestPerArch := range index.Manifests {
+		p := manifestPerArch.Platform
+		// don't add digests where the platform field is empty
+		if p.Architecture == "" && p.Os == "" && p.Variant == "" {
+			continue
+		}
+		// buildx adds attestations with the unknown/unknown platform
+		if p.Os == "unknown" && p.Architecture == "unknown" {
+			continue
+		}
+		if _, ok := manifestPerArch.Annotations[dockerReferenceTypeAnnotation]; ok {
+			continue
+		}
+		manifests = append(manifests, manifestPerArch)
+	}
+	return manifests
+}
+
+/// Returns the sizes of the image of the platform `platform` of an index
+/// with the manifest `manifest` and the analysis `analysis`.
+func SizesOfPlatform(platform ExtractedDigest, manifest Manifest, analysis internal.ImageAnalysis) PlatformSizes {
+	sizes := PlatformSizes{
+		Platform:    platform.Platform,
+		Digest:      platform.Digest,
+		Layers:      len(manifest.Layers),
+		MergedSize:  analysis.MergedRoot.TotalSize,
+		WastedBytes: analysis.Efficiency.WastedBytes,
+	}
+	for _, l := range manifest.Layers {
+		sizes.CompressedSize += int64(l.Size)
+	}
+	for _, digest := range LayerDigestsOfManifest(manifest) {
+		sizes.LayersSize += analysis.Layers[digest].TotalSize
+	}
+	return sizes
+}
+
+/// Calculates the space that an index of the size `indexSize` with the
+/// entries `platforms` occupies in a registry. `manifests` are the manifests
+/// of the images that `platforms` refer to in the same order.
+///
+/// Configurations and layers that are used by several platforms are only
+/// counted once in the total size.
+func FootprintOfIndex(indexSize int64, platforms []ExtractedDigest, manifests []Manifest) IndexFootprint {
+	footprint := IndexFootprint{TotalSize: indexSize, UnsharedSize: indexSize}
+
+	blobSizes := make(map[string]int64)
+	blobUsers := make(map[string]int)
+	for i, m := range manifests {
+		footprint.TotalSize += int64(platforms[i].Size)
+		footprint.UnsharedSize += int64(platforms[i].Size)
+
+		// a blob is only stored once per image as well
+		blobs := make(map[string]int64, len(m.Layers)+1)
+		blobs[m.Config.Digest] = int64(m.Config.Size)
+		for _, l := range m.Layers {
+			blobs[l.Digest] = int64(l.Size)
+		}
+		for digest, size := range blobs {
+			footprint.UnsharedSize += size
+			blobSizes[digest] = size
+			blobUsers[digest]++
+		}
+	}
+
+	for digest, size := range blobSizes {
+		footprint.TotalSize += size
+		if blobUsers[digest] > 1 {
+			footprint.SharedBlobs++
+		}
+	}
+
+	return footprint
+}
+
+/// Analyzes every platform of the multi-arch image with the url `imageUrl`
+/// in the foreground.
+///
+/// The task is returned if it could be created, even if the analysis failed.
+/// The caller is responsible for cleaning up the task.
+func AnalyzeIndex(imageUrl string, opts *analyzerOptions, layerCache *internal.LayerCache) (*IndexTask, error) {
+	t, err := NewIndexTask(imageUrlWithTransport(imageUrl), opts.stream, opts.registry)
+	if err != nil {
+		return nil, err
+	}
+	t.layerWorkers = opts.layerWorkers
+	t.layerCache = layerCache
+	t.signaturePolicy = opts.signaturePolicy
+	t.HashFiles = opts.hashFiles
+
+	t.Process()
+	return t, t.Err()
+}
+
+/// Writes the analysis of all platforms of an image `analysis` to `w` in the
+/// output format `format`, which is either json or table.
+func PrintIndexAnalysis(w io.Writer, analysis *IndexAnalysis, format string) error {
+	switch format {
+	case OutputFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(analysis)
+	case OutputFormatTable:
+		return PrintPlatformTable(w, analysis)
+	default:
+		return errors.New(
+			fmt.Sprintf("Invalid output format for the analysis of all platforms: %s", format),
+		)
+	}
+}
+
+/// Writes a table comparing the sizes of the platforms of the analysis
+/// `analysis` and the footprint of the whole index to `w`.
+func PrintPlatformTable(w io.Writer, analysis *IndexAnalysis) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tLAYERS\tCOMPRESSED\tLAYERS SIZE\tMERGED\tWASTED")
+	for _, s := range analysis.Sizes {
+		fmt.Fprintf(
+			tw, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			s.Platform,
+			s.Layers,
+			FormatSize(s.CompressedSize),
+			FormatSize(s.LayersSize),
+			FormatSize(s.MergedSize),
+			FormatSize(s.WastedBytes),
+		)
+	}
+	f := analysis.Footprint
+	fmt.Fprintf(
+		tw, "INDEX\t\t%s\t\t\t%d shared blobs, %s without sharing\n",
+		FormatSize(f.TotalSize), f.SharedBlobs, FormatSize(f.UnsharedSize),
+	)
+	return tw.Flush()
+}
+
+/// Returns the platform in the form os/architecture/variant
+func (p Platform) String() string {
+	parts := []string{p.Os, p.Architecture}
+	if p.Variant != "" {
+		parts = append(parts, p.Variant)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIndexTask(t *testing.T) {
+	task, err := NewIndexTask("docker://registry.opensuse.org/opensuse/tumbleweed:latest", true, RegistryOptions{})
+	require.NoError(t, err)
+	defer task.Cleanup()
+	assert.Equal(t, "registry.opensuse.org/opensuse/tumbleweed", task.name)
+
+	task, err = NewIndexTask("docker://busybox", false, RegistryOptions{})
+	require.NoError(t, err)
+	defer task.Cleanup()
+	assert.Equal(t, "docker.io/library/busybox", task.name)
+
+	_, err = NewIndexTask("docker-archive:/tmp/image.tar", false, RegistryOptions{})
+	assert.Error(t, err)
+}
+
+func TestPlatformManifests(t *testing.T) {
+	index := Manifest{Manifests: []ExtractedDigest{
+		{Digest: "sha256:amd64", Platform: Platform{Os: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:attestation"},
+		{Digest: "sha256:arm64", Platform: Platform{Os: "linux", Architecture: "arm64", Variant: "v8"}},
+	}}
+
+	manifests := platformManifests(index)
+	require.Len(t, manifests, 2)
+	assert.Equal(t, "linux/amd64", manifests[0].Platform.String())
+	assert.Equal(t, "linux/arm64/v8", manifests[1].Platform.String())
+}
+
+func TestPlatformManifestsSkipsAttestations(t *testing.T) {
+	var index Manifest
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:amd64",
+      "size": 673,
+      "platform": {"architecture": "amd64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:attestation-amd64",
+      "size": 566,
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:amd64",
+        "vnd.docker.reference.type": "attestation-manifest"
+      },
+      "platform": {"architecture": "unknown", "os": "unknown"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:attestation-linux",
+      "size": 566,
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:amd64",
+        "vnd.docker.reference.type": "attestation-manifest"
+      },
+      "platform": {"architecture": "amd64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:unknown",
+      "size": 566,
+      "platform": {"architecture": "unknown", "os": "unknown"}
+    }
+  ]
+}`), &index))
+
+	manifests := platformManifests(index)
+	require.Len(t, manifests, 1)
+	assert.Equal(t, "sha256:amd64", manifests[0].Digest)
+}
+
+/// Returns the manifests of a two platform index whose images share their
+/// base layer
+func testIndex() ([]ExtractedDigest, []Manifest) {
+	platforms := []ExtractedDigest{
+		{Digest: "sha256:amd64", Size: 500, Platform: Platform{Os: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:arm64", Size: 600, Platform: Platform{Os: "linux", Architecture: "arm64"}},
+	}
+	manifests := []Manifest{
+		{
+			Config: ExtractedDigest{Digest: "sha256:config-amd64", Size: 1000},
+			Layers: []ExtractedDigest{
+				{Digest: "sha256:base", Size: 10000},
+				{Digest: "sha256:amd64-app", Size: 2000},
+			},
+		},
+		{
+			Config: ExtractedDigest{Digest: "sha256:config-arm64", Size: 1100},
+			Layers: []ExtractedDigest{
+				{Digest: "sha256:base", Size: 10000},
+				{Digest: "sha256:arm64-app", Size: 3000},
+				// the same layer twice is stored once
+				{Digest: "sha256:arm64-app", Size: 3000},
+			},
+		},
+	}
+	return platforms, manifests
+}
+
+func TestFootprintOfIndex(t *testing.T) {
+	platforms, manifests := testIndex()
+
+	assert.Equal(t, IndexFootprint{
+		TotalSize:    300 + 500 + 600 + 1000 + 1100 + 10000 + 2000 + 3000,
+		UnsharedSize: 300 + 500 + 600 + 1000 + 1100 + 2*10000 + 2000 + 3000,
+		SharedBlobs:  1,
+	}, FootprintOfIndex(300, platforms, manifests))
+}
+
+func TestSizesOfPlatform(t *testing.T) {
+	platforms, manifests := testIndex()
+
+	base := internal.NewLayer()
+	base.InsertIntoDir("/usr/bin/bash", 20000)
+	app := internal.NewLayer()
+	app.InsertIntoDir("/usr/bin/bash", 15000)
+	layers := internal.LayerSizes{"base": base, "amd64-app": app}
+	merged := internal.MergeLayers([]internal.Dir{base.Dir, app.Dir})
+	analysis := internal.ImageAnalysis{
+		Layers:     layers,
+		MergedRoot: merged,
+		Efficiency: internal.CalculateEfficiency([]string{"base", "amd64-app"}, layers),
+	}
+
+	assert.Equal(t, PlatformSizes{
+		Platform:       platforms[0].Platform,
+		Digest:         "sha256:amd64",
+		Layers:         2,
+		CompressedSize: 12000,
+		LayersSize:     35000,
+		MergedSize:     15000,
+		WastedBytes:    20000,
+	}, SizesOfPlatform(platforms[0], manifests[0], analysis))
+}
+
+func TestPrintPlatformTable(t *testing.T) {
+	platforms, manifests := testIndex()
+	analysis := IndexAnalysis{
+		Sizes: []PlatformSizes{
+			{Platform: platforms[0].Platform, Layers: 2, CompressedSize: 12000, LayersSize: 35000, MergedSize: 15000, WastedBytes: 20000},
+			{Platform: platforms[1].Platform, Layers: 3, CompressedSize: 16000, LayersSize: 40000, MergedSize: 30000},
+		},
+		Footprint: FootprintOfIndex(300, platforms, manifests),
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, PrintPlatformTable(&out, &analysis))
+	assert.Equal(t, `PLATFORM     LAYERS  COMPRESSED  LAYERS SIZE  MERGED    WASTED
+linux/amd64  2       11.7 KiB    34.2 KiB     14.6 KiB  19.5 KiB
+linux/arm64  3       15.6 KiB    39.1 KiB     29.3 KiB  0 B
+INDEX                18.1 KiB                           1 shared blobs, 27.8 KiB without sharing
+`, out.String())
+
+	assert.Error(t, PrintIndexAnalysis(&out, &analysis, OutputFormatTree))
+}
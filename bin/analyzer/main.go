@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
 	"path/filepath"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/containers/image/v5/docker"
 	dockerArchiveTransport "github.com/containers/image/v5/docker/archive"
 	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/storage"
@@ -35,9 +38,9 @@ import (
 
 	"github.com/docker/distribution/reference"
 	"github.com/google/uuid"
-	archiver "github.com/mholt/archiver/v4"
 	logrus "github.com/sirupsen/logrus"
 	"github.com/syndtr/gocapability/capability"
+	cli "github.com/urfave/cli/v2"
 )
 
 // capabilities for running in a user namespace
@@ -65,7 +68,7 @@ func reexecForRootlessStorage() error {
 }
 
 const (
-	addr = ":5050"
+	defaultAddr = ":5050"
 )
 
 var log = logrus.New()
@@ -131,6 +134,29 @@ type ContainerImage struct {
 
 	layers *internal.LayerSizes
 
+	// the final root filesystem with all layers applied
+	mergedRoot *internal.Dir
+
+	// the wasted space of each layer
+	efficiency *internal.EfficiencyReport
+
+	// files whose contents are stored more than once, nil unless the contents
+	// have been hashed
+	duplicates *internal.DuplicateReport
+
+	// the size of each installed package, nil if the image contains no
+	// package database
+	packages *internal.PackageReport
+
+	// the size of each language dependency, nil if the image contains none
+	dependencies *internal.DependencyReport
+
+	// the build steps of the image including those without a layer
+	history []internal.HistoryStep
+
+	// suggestions how to make the image smaller
+	recommendations *internal.RecommendationReport
+
 	// the reference to the "remote" image (usually this is expected to
 	// exist on a registry, but it can actually be a local one as well ;-))
 	remoteReference types.ImageReference
@@ -152,11 +178,55 @@ type Task struct {
 	/// created by `podman pull`
 	PullProgress map[string]LayerDownloadProgress `json:"pull_progress"`
 
+	/// If true, the layers are streamed directly from the image source instead
+	/// of pulling the image into the local containers storage
+	Stream bool `json:"stream"`
+
+	/// The efficiency of the image is checked against this value once it
+	/// has been analyzed, 0 disables the check
+	MinEfficiency float64 `json:"min_efficiency"`
+
+	/// If true, the contents of all files are hashed to find duplicate files
+	HashFiles bool `json:"hash_files"`
+
+	/// The result of checking the image against the signature policy, nil
+	/// until the image has been checked
+	Signature *SignatureVerification `json:"signature"`
+
 	/// an error if any occurred
 	error error
 
+	/// an error if the image did not meet the efficiency threshold
+	/// `MinEfficiency`. The task is finished nevertheless, so that the
+	/// analysis explaining the violation can be retrieved.
+	thresholdError error
+
 	tempdir string
 
+	// path to the signature policy, the default policy of the system is used
+	// if empty
+	signaturePolicy string
+
+	// settings for fetching the image from a registry, including the
+	// credentials. A pointer, so that printing the task with %v does not
+	// print the credentials.
+	registry *RegistryOptions
+
+	// number of layers of the image that are analyzed in parallel
+	layerWorkers int
+
+	// cache of already analyzed layers, may be nil
+	layerCache *internal.LayerCache
+
+	// the url with which the task has been created
+	imageUrl string
+
+	created time.Time
+
+	// guards the State, PullProgress, error and Image of the task, which are
+	// written while the task is processed and read by the http handlers
+	mu sync.RWMutex
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -164,16 +234,65 @@ type Task struct {
 func (t *Task) MarshalJSON() ([]byte, error) {
 	type Alias Task
 
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	var errMsg string
 	if t.error == nil {
 		errMsg = ""
 	} else {
 		errMsg = t.error.Error()
 	}
+	var thresholdErrMsg string
+	if t.thresholdError != nil {
+		thresholdErrMsg = t.thresholdError.Error()
+	}
 	return json.Marshal(&struct {
-		Error string `json:"error"`
+		Error          string `json:"error"`
+		ThresholdError string `json:"threshold_error"`
 		*Alias
-	}{Error: errMsg, Alias: (*Alias)(t)})
+	}{Error: errMsg, ThresholdError: thresholdErrMsg, Alias: (*Alias)(t)})
+}
+
+/// Returns the current state of the task
+func (t *Task) GetState() TaskState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.State
+}
+
+/// Returns the error that occurred while processing the task, if any
+func (t *Task) Err() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.error
+}
+
+/// Returns an error wrapping internal.ErrInefficientImage if the image of the
+/// finished task did not meet the efficiency threshold
+func (t *Task) ThresholdErr() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.thresholdError
+}
+
+func (t *Task) setState(s TaskState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.State = s
+}
+
+func (t *Task) getPullProgress(layerDigest string) (LayerDownloadProgress, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.PullProgress[layerDigest]
+	return p, ok
+}
+
+func (t *Task) setPullProgress(layerDigest string, p LayerDownloadProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.PullProgress[layerDigest] = p
 }
 
 func getNameTagDigestFromUrl(u string) (name string, tag string, digest *string, err error) {
@@ -198,14 +317,32 @@ func getNameTagDigestFromUrl(u string) (name string, tag string, digest *string,
 	}
 }
 
+/// Creates a new task that pulls the image with the url `imageUrl` into the
+/// local containers storage and analyzes it.
 func NewTask(imageUrl string) (*Task, error) {
-	tempdir, err := ioutil.TempDir("", "")
-	if err != nil {
-		return nil, err
+	return newTask(imageUrl, false, RegistryOptions{})
+}
+
+/// Creates a new task that streams the layers of the image with the url
+/// `imageUrl` directly from its source without writing the image to disk.
+func NewStreamingTask(imageUrl string) (*Task, error) {
+	return newTask(imageUrl, true, RegistryOptions{})
+}
+
+/// Creates a new task for the image with the url `imageUrl`, which is fetched
+/// from registries with the settings `registry`.
+func newTask(imageUrl string, stream bool, registry RegistryOptions) (*Task, error) {
+	var tempdir string
+	var err error
+	if !stream {
+		tempdir, err = createTaskTempdir()
+		if err != nil {
+			return nil, err
+		}
 	}
 	layers := make(internal.LayerSizes)
 
-	var remoteReference, localReference types.ImageReference
+	var remoteReference, localReference, ociLocalReference types.ImageReference
 	var remoteDigest *string
 
 	parts := strings.Split(imageUrl, ":")
@@ -230,19 +367,25 @@ func NewTask(imageUrl string) (*Task, error) {
 		// docker transport urls contain // after `docker:`, drop that one as well
 		urlWithoutTransport = urlWithoutTransport[2:]
 
-		ref, err := reference.ParseNormalizedNamed(urlWithoutTransport)
+		ref, err := resolveImageName(urlWithoutTransport, registry.SystemContext())
 		if err != nil {
 			return nil, err
 		}
+		// use the name that a short name alias resolves to
+		if isShortName(urlWithoutTransport) {
+			urlWithoutTransport = reference.FamiliarString(ref)
+		}
 
 		remoteReference, err = docker.NewReference(reference.TagNameOnly(ref))
 		if err != nil {
 			return nil, err
 		}
 
-		localReference, err = storage.Transport.ParseReference(urlWithoutTransport)
-		if err != nil {
-			return nil, err
+		if !stream {
+			localReference, err = storage.Transport.ParseReference(urlWithoutTransport)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		urlWithoutTransport, tag, remoteDigest, err = getNameTagDigestFromUrl(urlWithoutTransport)
@@ -277,6 +420,8 @@ func NewTask(imageUrl string) (*Task, error) {
 			if dockerRef := localRef.DockerReference(); dockerRef != nil {
 				imageName = dockerRef.Name()
 			}
+		} else if imageName, err = inferLocalImageName(remoteReference); err != nil {
+			return nil, err
 		}
 		if imageName == "" {
 			return nil, errors.New(
@@ -292,12 +437,12 @@ func NewTask(imageUrl string) (*Task, error) {
 		// => if imageName has a tag => use it
 		// => if imageName has no tag => take the one from imageUrl
 		var name string
-		name, tag, remoteDigest, err = getNameTagDigestFromUrl(imageName)
+		name, tag, remoteDigest, err = parseLocalImageName(imageName)
 		if err != nil {
 			return nil, err
 		}
 
-		if tag == "" {
+		if tag == "" && remoteDigest == nil {
 			_, tag, remoteDigest, err = getNameTagDigestFromUrl(urlWithoutTransport)
 			if err != nil {
 				return nil, err
@@ -306,9 +451,11 @@ func NewTask(imageUrl string) (*Task, error) {
 
 		urlWithoutTransport = name
 
-		localReference, err = storage.Transport.ParseReference(urlWithoutTransport)
-		if err != nil {
-			return nil, err
+		if !stream {
+			localReference, err = storage.Transport.ParseReference(urlWithoutTransport)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -316,9 +463,11 @@ func NewTask(imageUrl string) (*Task, error) {
 		tag = "latest"
 	}
 
-	ociLocalReference, err := layout.Transport.ParseReference(tempdir + ":" + tag)
-	if err != nil {
-		return nil, err
+	if !stream {
+		ociLocalReference, err = layout.Transport.ParseReference(tempdir + ":" + tag)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ctx, cancel := context.WithTimeout(backgroundContext, 5*time.Minute)
@@ -335,15 +484,20 @@ func NewTask(imageUrl string) (*Task, error) {
 	}
 
 	task := Task{
-		Image:   Image,
-		State:   TaskStateNew,
-		tempdir: tempdir,
-		error:   nil,
-		ctx:     ctx,
-		cancel:  cancel,
+		Image:        Image,
+		State:        TaskStateNew,
+		Stream:       stream,
+		registry:     &registry,
+		tempdir:      tempdir,
+		layerWorkers: DefaultLayerWorkers,
+		imageUrl:     imageUrl,
+		created:      time.Now(),
+		error:        nil,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 
-	log.WithFields(logrus.Fields{"Task": task}).Info("Created task")
+	log.WithFields(logrus.Fields{"Task": &task}).Info("Created task")
 
 	return &task, nil
 }
@@ -351,30 +505,13 @@ func NewTask(imageUrl string) (*Task, error) {
 /// Fetches the digests of a image with the given url and returns an array of
 /// Digests where the `platform` field is not empty.
 /// This can be used to get the digests of all available architectures of this
-/// image.
-func FetchImagePlatformDigests(imageUrl string) ([]ExtractedDigest, error) {
+/// image. The image is fetched with the settings `registry`.
+func FetchImagePlatformDigests(imageUrl string, registry RegistryOptions) ([]ExtractedDigest, error) {
 	log.WithFields(logrus.Fields{"image url": imageUrl}).Info(
 		"Fetching image platforms",
 	)
 
-	remoteReference, err := alltransports.ParseImageName(imageUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	imgSrc, err := remoteReference.NewImageSource(backgroundContext, &types.SystemContext{})
-	if err != nil {
-		return nil, err
-	}
-	defer imgSrc.Close()
-
-	remoteManifest, _, err := imgSrc.GetManifest(backgroundContext, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	var manifest Manifest
-	err = json.Unmarshal(remoteManifest, &manifest)
+	_, manifest, err := fetchManifest(backgroundContext, imageUrl, registry.SystemContext())
 	if err != nil {
 		return nil, err
 	}
@@ -383,16 +520,7 @@ func FetchImagePlatformDigests(imageUrl string) ([]ExtractedDigest, error) {
 		"received and parsed a manifest",
 	)
 
-	availableDigests := make([]ExtractedDigest, 0)
-	for _, manifestPerArch := range manifest.Manifests {
-		p := manifestPerArch.Platform
-		// don't add digests where the platform field is empty
-		if p.Architecture != "" || p.Os != "" || p.Variant != "" {
-			availableDigests = append(availableDigests, manifestPerArch)
-		}
-	}
-
-	return availableDigests, nil
+	return platformManifests(manifest), nil
 }
 
 func (t *Task) Process() {
@@ -403,33 +531,94 @@ func (t *Task) Process() {
 			logrus.Fields{"error": e, "task": t},
 		).Error("Error occurred when processing the task")
 
+		t.mu.Lock()
+		defer t.mu.Unlock()
 		t.error = e
 		t.State = TaskStateError
 	}
 
-	t.State = TaskStatePulling
+	t.setState(TaskStatePulling)
 
-	if t.Image.ImageInfo == nil {
-		t.Image.ImageInfo, err = InspectImage(t.Image.remoteReference, t.ctx, t.Image.RemoteDigest)
+	imageInfo := t.Image.ImageInfo
+	if imageInfo == nil {
+		imageInfo, err = InspectImage(t.Image.remoteReference, t.ctx, t.Image.RemoteDigest, t.registry.SystemContext())
 		if err != nil {
 			setError(err)
 			return
 		}
 	}
 
-	t.PullProgress = make(map[string]LayerDownloadProgress, len(t.Image.ImageInfo.Layers))
-	for _, layerDigest := range t.Image.ImageInfo.Layers {
-		t.PullProgress[layerDigest] = LayerDownloadProgress{TotalSize: int64(-1), Downloaded: 0}
+	pullProgress := make(map[string]LayerDownloadProgress, len(imageInfo.Layers))
+	for _, layerDigest := range imageInfo.Layers {
+		pullProgress[layerDigest] = LayerDownloadProgress{TotalSize: int64(-1), Downloaded: 0}
+	}
+
+	t.mu.Lock()
+	t.Image.ImageInfo = imageInfo
+	t.PullProgress = pullProgress
+	t.mu.Unlock()
+
+	var manifest Manifest
+	var layers internal.LayerSizes
+	var history []internal.HistoryStep
+	var ok bool
+	// if all layers have been analyzed before, then there is no need to pull
+	// the image, only its manifest and configuration are fetched
+	if t.Stream || allLayersCached(t.layerCache, imageInfo.Layers) {
+		manifest, layers, history, ok = t.streamLayers(setError)
+	} else {
+		manifest, layers, history, ok = t.pullAndExtractLayers(setError)
 	}
+	if !ok {
+		return
+	}
+
+	mergedRoot := MergeLayersOfManifest(manifest, layers)
+	efficiency := internal.CalculateEfficiency(LayerDigestsOfManifest(manifest), layers)
 
+	var duplicates *internal.DuplicateReport
+	if t.HashFiles {
+		d := internal.FindDuplicates(LayerDigestsOfManifest(manifest), layers)
+		duplicates = &d
+	}
+	packages := internal.AnalyzePackages(LayerDigestsOfManifest(manifest), layers, &mergedRoot)
+	dependencies := internal.AnalyzeDependencies(LayerDigestsOfManifest(manifest), layers, &mergedRoot)
+	recommendations := internal.Recommend(LayerDigestsOfManifest(manifest), layers, &mergedRoot, efficiency)
+
+	t.mu.Lock()
+	t.Image.Manifest = manifest
+	t.Image.OciImageDigest = manifest.Config.Digest
+	t.Image.layers = &layers
+	t.Image.mergedRoot = &mergedRoot
+	t.Image.efficiency = &efficiency
+	t.Image.duplicates = duplicates
+	t.Image.packages = packages
+	t.Image.dependencies = dependencies
+	t.Image.history = history
+	t.Image.recommendations = &recommendations
+	if t.MinEfficiency > 0 {
+		t.thresholdError = efficiency.CheckThreshold(t.MinEfficiency)
+	}
+	t.mu.Unlock()
+
+	t.setState(TaskStateFinished)
+}
+
+/// Pulls the image into the local containers storage, converts it into an oci
+/// archive in the task's temporary directory and analyzes its layers.
+///
+/// Errors are reported via `setError`, `ok` is false if the task did not
+/// succeed.
+func (t *Task) pullAndExtractLayers(setError func(error)) (manifest Manifest, layers internal.LayerSizes, history []internal.HistoryStep, ok bool) {
 	opts := copy.Options{
 		ProgressInterval: time.Second,
 		Progress:         make(chan types.ProgressProperties),
+		SourceCtx:        t.registry.SystemContext(),
 	}
 
 	go func() {
 		for p := range opts.Progress {
-			curProgress, ok := t.PullProgress[string(p.Artifact.Digest)]
+			curProgress, ok := t.getPullProgress(string(p.Artifact.Digest))
 			f := logrus.Fields{"task": t, "progress_report": p}
 			if !ok {
 				log.WithFields(f).Error("Received progress report for an unknown layer")
@@ -449,13 +638,31 @@ func (t *Task) Process() {
 				downloaded = uint64(p.Artifact.Size)
 			}
 
-			t.PullProgress[string(p.Artifact.Digest)] = LayerDownloadProgress{
+			t.setPullProgress(string(p.Artifact.Digest), LayerDownloadProgress{
 				TotalSize:  p.Artifact.Size,
 				Downloaded: downloaded,
-			}
+			})
 		}
 	}()
 
+	// copying the image checks the signature policy again, so that only an
+	// accepted image ends up in the local storage
+	sourceLayers, err := t.verifyRemoteImage()
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+	policy, err := loadSignaturePolicy(t.signaturePolicy)
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+	verifiedReference, err := t.verifiedRemoteReference()
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+
 	if t.Image.remoteReference.Transport().Name() == t.Image.localReference.Transport().Name() {
 		log.WithFields(
 			logrus.Fields{
@@ -463,79 +670,182 @@ func (t *Task) Process() {
 				"local reference":  t.Image.localReference.StringWithinTransport(),
 			},
 		).Trace("Not pulling image into local storage, as it is already present locally")
-	} else if _, err := CopyImage(t.Image.remoteReference, t.Image.localReference, &t.ctx, &opts); err != nil {
+	} else if _, err := CopyImage(verifiedReference, t.Image.localReference, &t.ctx, &opts, policy); err != nil {
 		if ctxErr := t.ctx.Err(); ctxErr == context.Canceled {
 			log.WithFields(
 				logrus.Fields{"error": err, "context_error": ctxErr, "task": t},
 			).Error("Task has been canceled")
-			return
+			return manifest, nil, nil, false
 		} else if ctxErr == context.DeadlineExceeded {
 			log.WithFields(
 				logrus.Fields{"error": err, "context_error": ctxErr, "task": t},
 			).Error("Task has exceeded the deadline")
-			return
+			return manifest, nil, nil, false
 		} else {
 			if ctxErr != nil {
 				setError(ctxErr)
 			} else {
 				setError(err)
 			}
-			return
+			return manifest, nil, nil, false
 		}
 	}
 
-	t.State = TaskStateExtracting
+	t.setState(TaskStateExtracting)
+	// the image in the local storage has already been checked
 	m, err := CopyImage(
 		t.Image.localReference,
 		t.Image.ociLocalReference,
 		&t.ctx,
 		&copy.Options{RemoveSignatures: true},
+		acceptAnythingPolicy(),
 	)
 	if err != nil {
 		setError(err)
-		return
+		return manifest, nil, nil, false
 	}
 
-	var manifest Manifest
 	err = json.Unmarshal(m, &manifest)
 	if err != nil {
 		setError(err)
-		return
+		return manifest, nil, nil, false
 	}
-	t.Image.OciImageDigest = manifest.Config.Digest
 
-	t.State = TaskStateAnalyzing
-	layers, err := CalculateContainerLayerSizes(t.tempdir, manifest)
+	t.setState(TaskStateAnalyzing)
+	sourceLayers = t.matchSourceLayers(sourceLayers, manifest)
+	layers, err = CalculateContainerLayerSizes(t.tempdir, manifest, sourceLayers, t.layerWorkers, t.layerCache, t.analysisOptions())
 	if err != nil {
 		setError(err)
-		return
+		return manifest, nil, nil, false
+	}
+	// the layers are identified by their digests in the source like streamed
+	// layers, see CalculateContainerLayerSizes
+	if sourceLayers != nil {
+		manifest.Layers = sourceLayers
 	}
 
-	history, err := ReadHistoryFromOciArchive(t.tempdir, t.Image.Tag)
+	configHistory, err := ReadHistoryFromOciArchive(t.tempdir, t.Image.Tag)
 	if err != nil {
 		setError(err)
-		return
+		return manifest, nil, nil, false
 	}
-	for digest, createdBy := range history {
-		d := strings.Split(digest, ":")
-		if len(d) != 2 || d[0] != "sha256" {
-			log.WithFields(
-				logrus.Fields{"digest": digest},
-			).Error("Umoci found an invalid digest")
-			continue
-		}
-		if layer, ok := layers[d[1]]; ok {
-			layer.CreatedBy = createdBy
-			layers[d[1]] = layer
-		} else {
-			log.WithFields(
-				logrus.Fields{"digest": digest},
-			).Error("Umoci found a digest that is not present in the extracted layers")
-		}
+	history = internal.NewHistory(configHistory, LayerDigestsOfManifest(manifest))
+	SetCreatedByOfLayers(history, layers)
+
+	return manifest, layers, history, true
+}
+
+/// Returns `sourceLayers`, the layers of the task's image in its source (e.g.
+/// on the registry), if they can be matched with the layers of the oci layout
+/// with the manifest `manifest`, otherwise nil.
+func (t *Task) matchSourceLayers(sourceLayers []ExtractedDigest, manifest Manifest) []ExtractedDigest {
+	if len(sourceLayers) != len(manifest.Layers) {
+		log.WithFields(
+			logrus.Fields{"task": t, "manifest": manifest, "source_layers": sourceLayers},
+		).Warn("Cannot match the layers of the source with the extracted layers")
+		return nil
 	}
+	return sourceLayers
+}
 
-	t.Image.layers = &layers
-	t.State = TaskStateFinished
+/// Checks the image `img` against the task's signature policy and records the
+/// result in the task, an error is returned if the policy rejects the image.
+func (t *Task) verifySignatures(img types.UnparsedImage) error {
+	verification, err := VerifySignatures(t.ctx, img, t.signaturePolicy)
+
+	t.mu.Lock()
+	t.Signature = &verification
+	t.mu.Unlock()
+
+	return err
+}
+
+/// Checks the image at the task's remote reference against the signature
+/// policy, see verifySignatures, and returns the layers of the checked
+/// manifest.
+func (t *Task) verifyRemoteImage() ([]ExtractedDigest, error) {
+	sys := t.registry.SystemContext()
+
+	imgSrc, err := t.Image.remoteReference.NewImageSource(t.ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer imgSrc.Close()
+
+	unparsed := image.UnparsedInstance(imgSrc, (*digest.Digest)(t.Image.RemoteDigest))
+	if err := t.verifySignatures(unparsed); err != nil {
+		return nil, err
+	}
+
+	img, err := image.FromUnparsedImage(t.ctx, sys, unparsed)
+	if err != nil {
+		return nil, err
+	}
+	return LayersOfBlobInfos(img.LayerInfos()), nil
+}
+
+/// Returns the task's remote reference pinned to the digest of the manifest
+/// that has been checked by verifyRemoteImage, so that a tag which is moved in
+/// the meantime cannot change the copied image.
+///
+/// Only references of the docker transport are resolved via a tag on a
+/// registry, the references of all other transports are returned as is.
+func (t *Task) verifiedRemoteReference() (types.ImageReference, error) {
+	ref := t.Image.remoteReference
+	if ref.Transport().Name() != docker.Transport.Name() || ref.DockerReference() == nil {
+		return ref, nil
+	}
+
+	t.mu.RLock()
+	verification := t.Signature
+	t.mu.RUnlock()
+	if verification == nil || verification.ManifestDigest == "" {
+		return nil, errors.New("The manifest of the image has not been verified")
+	}
+
+	manifestDigest, err := digest.Parse(verification.ManifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(ref.DockerReference()), manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewReference(pinned)
+}
+
+/// Returns the options for the analysis of each layer of the task's image
+func (t *Task) analysisOptions() internal.LayerAnalysisOptions {
+	return internal.LayerAnalysisOptions{HashContents: t.HashFiles}
+}
+
+/// Returns the analysis result of the task's image
+func (t *Task) Analysis() internal.ImageAnalysis {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Image.Analysis()
+}
+
+/// Returns the analysis result of this image
+func (i *ContainerImage) Analysis() internal.ImageAnalysis {
+	var a internal.ImageAnalysis
+	if i.layers != nil {
+		a.Layers = *i.layers
+	}
+	if i.mergedRoot != nil {
+		a.MergedRoot = *i.mergedRoot
+	}
+	if i.efficiency != nil {
+		a.Efficiency = *i.efficiency
+	}
+	a.Duplicates = i.duplicates
+	a.Packages = i.packages
+	a.Dependencies = i.dependencies
+	a.History = i.history
+	if i.recommendations != nil {
+		a.Recommendations = *i.recommendations
+	}
+	return a
 }
 
 func (t *Task) Cleanup() error {
@@ -545,34 +855,97 @@ func (t *Task) Cleanup() error {
 
 type TaskQueue struct {
 	tasks map[string]*Task
+
+	// tasks analyzing all platforms of an image
+	indexTasks map[string]*IndexTask
+
+	// number of layers of each image that are analyzed in parallel
+	layerWorkers int
+
+	// cache of already analyzed layers that is shared by all tasks, may be nil
+	layerCache *internal.LayerCache
+
+	// path to the signature policy of all tasks, empty for the default policy
+	signaturePolicy string
+
+	// persistent storage of the tasks, may be nil
+	store *internal.TaskStore
+
+	// true once the queue has been cleaned up, the tasks are no longer
+	// stored afterwards so that tasks canceled on shutdown are resumed
+	closed bool
+
+	mu sync.Mutex
 }
 
-func NewTaskQueue() TaskQueue {
-	return TaskQueue{tasks: make(map[string]*Task)}
+/// Creates a new task queue whose tasks analyze up to `layerWorkers` layers of
+/// their image in parallel.
+///
+/// Layers that are present in `layerCache` are not analyzed again, it may be
+/// nil to disable caching. The images are checked against the signature
+/// policy at `signaturePolicy`, or the default policy if it is empty.
+///
+/// The tasks are persisted in `store` so that they can be restored after a
+/// restart, it may be nil to keep the tasks only in memory.
+func NewTaskQueue(layerWorkers int, layerCache *internal.LayerCache, signaturePolicy string, store *internal.TaskStore) *TaskQueue {
+	return &TaskQueue{
+		tasks:           make(map[string]*Task),
+		indexTasks:      make(map[string]*IndexTask),
+		layerWorkers:    layerWorkers,
+		layerCache:      layerCache,
+		signaturePolicy: signaturePolicy,
+		store:           store,
+	}
 }
 
 func (tq *TaskQueue) CleanupQueue() []error {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.closed = true
+
 	errors := make([]error, 1)
 	for _, t := range tq.tasks {
 		if err := t.Cleanup(); err != nil {
 			errors = append(errors, err)
 		}
 	}
+	for _, t := range tq.indexTasks {
+		if err := t.Cleanup(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	return errors
 }
 
-func (tq *TaskQueue) AddTask(imageUrl string) (string, *Task, error) {
+/// Adds a task analyzing the image `imageUrl`, which is fetched with the
+/// registry settings `registry`.
+func (tq *TaskQueue) AddTask(imageUrl string, stream bool, registry RegistryOptions) (string, *Task, error) {
 	id := fmt.Sprint(uuid.New())
 
-	if t, err := NewTask(imageUrl); err != nil {
+	if t, err := newTask(imageUrl, stream, registry); err != nil {
 		return "", nil, err
 	} else {
-		tq.tasks[id] = t
+		tq.addTask(id, t)
 		return id, t, nil
 	}
 }
 
+/// Adds the task `t` with the id `id` using the settings of the queue
+func (tq *TaskQueue) addTask(id string, t *Task) {
+	t.layerWorkers = tq.layerWorkers
+	t.layerCache = tq.layerCache
+	t.signaturePolicy = tq.signaturePolicy
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.tasks[id] = t
+}
+
 func (tq *TaskQueue) GetTask(id string) (*Task, error) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
 	if t, ok := tq.tasks[id]; !ok {
 		return nil, errors.New(fmt.Sprintf("Non existing task id %s", id))
 	} else {
@@ -581,13 +954,64 @@ func (tq *TaskQueue) GetTask(id string) (*Task, error) {
 }
 
 func (tq *TaskQueue) RemoveTask(id string) error {
-	if t, ok := tq.tasks[id]; !ok {
+	tq.mu.Lock()
+	t, ok := tq.tasks[id]
+	delete(tq.tasks, id)
+	tq.deleteStoredTask(id)
+	tq.mu.Unlock()
+
+	if !ok {
 		return errors.New(fmt.Sprintf("Non existing task id %s", id))
+	}
+	return t.Cleanup()
+}
+
+/// Adds a task analyzing all platforms of the multi-arch image `imageUrl`,
+/// which shares the layer workers and the layer cache of the queue.
+func (tq *TaskQueue) AddIndexTask(imageUrl string, stream bool, registry RegistryOptions) (string, *IndexTask, error) {
+	id := fmt.Sprint(uuid.New())
+
+	t, err := NewIndexTask(imageUrl, stream, registry)
+	if err != nil {
+		return "", nil, err
+	}
+	tq.addIndexTask(id, t)
+	return id, t, nil
+}
+
+/// Adds the index task `t` with the id `id` using the settings of the queue
+func (tq *TaskQueue) addIndexTask(id string, t *IndexTask) {
+	t.layerWorkers = tq.layerWorkers
+	t.layerCache = tq.layerCache
+	t.signaturePolicy = tq.signaturePolicy
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.indexTasks[id] = t
+}
+
+func (tq *TaskQueue) GetIndexTask(id string) (*IndexTask, error) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if t, ok := tq.indexTasks[id]; !ok {
+		return nil, errors.New(fmt.Sprintf("Non existing index task id %s", id))
 	} else {
-		err := t.Cleanup()
-		delete(tq.tasks, id)
-		return err
+		return t, nil
+	}
+}
+
+func (tq *TaskQueue) RemoveIndexTask(id string) error {
+	tq.mu.Lock()
+	t, ok := tq.indexTasks[id]
+	delete(tq.indexTasks, id)
+	tq.deleteStoredTask(id)
+	tq.mu.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("Non existing index task id %s", id))
 	}
+	return t.Cleanup()
 }
 
 type Platform struct {
@@ -601,6 +1025,8 @@ type ExtractedDigest struct {
 	Size      int      `json:"size"`
 	Digest    string   `json:"digest"`
 	Platform  Platform `json:"platform"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 type Manifest struct {
@@ -611,20 +1037,33 @@ type Manifest struct {
 	Manifests     []ExtractedDigest `json:"manifests"`
 }
 
-func InspectImage(ref types.ImageReference, ctx context.Context, imageDigest *string) (*types.ImageInspectInfo, error) {
-	sys := types.SystemContext{}
+/// Returns the layers of a manifest from the layer blobs `infos` of an image
+func LayersOfBlobInfos(infos []types.BlobInfo) []ExtractedDigest {
+	layers := make([]ExtractedDigest, 0, len(infos))
+	for _, info := range infos {
+		layers = append(layers, ExtractedDigest{
+			MediaType: info.MediaType,
+			Size:      int(info.Size),
+			Digest:    info.Digest.String(),
+		})
+	}
+	return layers
+}
 
+/// Fetches the configuration of the image with the reference `ref` using the
+/// system context `sys`, which may be nil.
+func InspectImage(ref types.ImageReference, ctx context.Context, imageDigest *string, sys *types.SystemContext) (*types.ImageInspectInfo, error) {
 	log.WithFields(
 		logrus.Fields{"reference": ref.StringWithinTransport()},
 	).Info("Inspecting image")
 
-	imgSrc, err := ref.NewImageSource(ctx, &sys)
+	imgSrc, err := ref.NewImageSource(ctx, sys)
 	if err != nil {
 		return nil, err
 	}
 	defer imgSrc.Close()
 
-	img, err := image.FromUnparsedImage(ctx, nil, image.UnparsedInstance(imgSrc, (*digest.Digest)(imageDigest)))
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(imgSrc, (*digest.Digest)(imageDigest)))
 	if err != nil {
 		log.Trace("Failed to generate a new image from an unparsed image")
 		return nil, err
@@ -637,8 +1076,9 @@ func InspectImage(ref types.ImageReference, ctx context.Context, imageDigest *st
 /// If `ctx` is non-nil, then it is used for the actual copy process.
 /// If it is nil, then the backgroundContext is used instead.
 ///
-/// `opts` are forwarded to the call of `copy.Image`
-func CopyImage(sourceRef types.ImageReference, destRef types.ImageReference, ctx *context.Context, opts *copy.Options) ([]byte, error) {
+/// `opts` are forwarded to the call of `copy.Image`, the source image has to be
+/// accepted by the signature policy `policy`.
+func CopyImage(sourceRef types.ImageReference, destRef types.ImageReference, ctx *context.Context, opts *copy.Options, policy *signature.Policy) ([]byte, error) {
 	log.WithFields(
 		logrus.Fields{
 			"source reference":      sourceRef.StringWithinTransport(),
@@ -646,10 +1086,6 @@ func CopyImage(sourceRef types.ImageReference, destRef types.ImageReference, ctx
 		},
 	).Info("Copying an image")
 
-	policy, err := signature.DefaultPolicy(nil)
-	if err != nil {
-		return nil, err
-	}
 	policyCtx, err := signature.NewPolicyContext(policy)
 	if err != nil {
 		return nil, err
@@ -669,55 +1105,166 @@ func CopyImage(sourceRef types.ImageReference, destRef types.ImageReference, ctx
 	}
 }
 
-func CalculateContainerLayerSizes(unpackedImageDest string, manifest Manifest) (internal.LayerSizes, error) {
-	layers := make(internal.LayerSizes)
+/// Returns the compression of a layer with the given media type.
+///
+/// Uncompressed, gzip and zstd compressed layers are supported, both with the
+/// OCI and the Docker v2 media types.
+func LayerCompression(mediaType string) (internal.Compression, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer,
+		ispec.MediaTypeImageLayerNonDistributable,
+		manifest.DockerV2SchemaLayerMediaTypeUncompressed,
+		manifest.DockerV2Schema2ForeignLayerMediaType:
+		return internal.CompressionNone, nil
+	case ispec.MediaTypeImageLayerGzip,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		manifest.DockerV2Schema2LayerMediaType,
+		manifest.DockerV2Schema2ForeignLayerMediaTypeGzip:
+		return internal.CompressionGzip, nil
+	case ispec.MediaTypeImageLayerZstd,
+		ispec.MediaTypeImageLayerNonDistributableZstd:
+		return internal.CompressionZstd, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid media type: %s", mediaType))
+	}
+}
 
-	for _, layer := range manifest.Layers {
-		mediatype := layer.MediaType
-		if mediatype != "application/vnd.oci.image.layer.v1.tar+gzip" {
-			return nil, errors.New(fmt.Sprintf("Invalid media type: %s", mediatype))
-		}
+/// Calculates the directory sizes of the layer blob at `archivePath` which has
+/// the media type `mediaType` and has been recompressed from a blob with the
+/// media type `sourceMediaType`, see internal.AnalyzeRecompressedLayer.
+func calculateLayerSize(ctx context.Context, archivePath string, mediaType string, sourceMediaType string, opts internal.LayerAnalysisOptions) (internal.Layer, error) {
+	compression, err := LayerCompression(mediaType)
+	if err != nil {
+		return internal.NewLayer(), err
+	}
+	original, err := LayerCompression(sourceMediaType)
+	if err != nil {
+		return internal.NewLayer(), err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return internal.NewLayer(), err
+	}
+	defer f.Close()
 
+	return internal.AnalyzeRecompressedLayer(ctx, f, compression, original, opts)
+}
+
+/// Analyzes the layers of the image with the manifest `manifest` that has been
+/// unpacked into the oci layout at `unpackedImageDest`.
+///
+/// Up to `workers` layers are analyzed in parallel with the options `opts`.
+/// Layers present in `cache` are not analyzed again, `cache` may be nil. The
+/// analyzed layers are not added to `cache`, as it only contains layers that
+/// have been analyzed from their blob in the source, see streamLayers.
+///
+/// The oci layout contains recompressed layers, so `sourceLayers` are the
+/// layers of the image in its source (e.g. on the registry) in the order of
+/// the manifest. The layers are looked up in `cache` and returned under the
+/// digests of `sourceLayers`, their compressed size is taken from
+/// `sourceLayers` and the compressed size of their files is estimated with the
+/// compression of the source layer. The layers of `manifest` are used on their
+/// own if `sourceLayers` is nil.
+func CalculateContainerLayerSizes(unpackedImageDest string, manifest Manifest, sourceLayers []ExtractedDigest, workers int, cache *internal.LayerCache, opts internal.LayerAnalysisOptions) (internal.LayerSizes, error) {
+	if sourceLayers != nil && len(sourceLayers) != len(manifest.Layers) {
+		return nil, errors.New(
+			fmt.Sprintf("Got %d source layers for %d layers", len(sourceLayers), len(manifest.Layers)),
+		)
+	}
+
+	digests := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
 		digest := strings.Split(layer.Digest, ":")
 		if len(digest) != 2 {
 			return nil, errors.New(fmt.Sprintf("invalid digest: %s", digest))
 		}
+		digests[i] = digest[1]
+	}
+	recompressed := sourceLayers != nil
+	if !recompressed {
+		sourceLayers = manifest.Layers
+	}
 
-		root := internal.NewLayer()
-
-		archivePath := filepath.Join(unpackedImageDest, "blobs", "sha256", digest[1])
-		f, err := os.Open(archivePath)
-		if err != nil {
-			return nil, err
-		}
-
-		format, archiveReader, err := archiver.Identify(archivePath, f)
-		if err != nil {
-			return nil, err
-		}
+	analyzed, err := analyzeLayersConcurrently(
+		backgroundContext, len(digests), workers,
+		func(ctx context.Context, i int) (internal.Layer, error) {
+			if layer, ok := cachedLayer(cache, sourceLayers[i].Digest, opts); ok {
+				return layer, nil
+			}
 
-		if ex, ok := format.(archiver.Extractor); ok {
-			err := ex.Extract(backgroundContext, archiveReader, nil, func(ctx context.Context, f archiver.File) error {
-				if f.IsDir() {
-					return nil
-				}
-				root.InsertIntoDir(f.NameInArchive, f.Size())
-				return nil
-			})
+			archivePath := filepath.Join(unpackedImageDest, "blobs", "sha256", digests[i])
+			layer, err := calculateLayerSize(ctx, archivePath, manifest.Layers[i].MediaType, sourceLayers[i].MediaType, opts)
 			if err != nil {
-				return nil, err
+				return layer, err
 			}
-		} else {
-			return nil, errors.New(fmt.Sprintf("%u is not an Extractor", ex))
-		}
+			if recompressed {
+				layer.CompressedSize = int64(sourceLayers[i].Size)
+			}
+			return layer, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
 
-		layers[digest[1]] = root
+	sourceManifest := manifest
+	sourceManifest.Layers = sourceLayers
+	layers := make(internal.LayerSizes, len(digests))
+	for i, digest := range LayerDigestsOfManifest(sourceManifest) {
+		layers[digest] = analyzed[i]
 	}
 
+	AccountHardlinksOfManifest(sourceManifest, layers)
+
 	return layers, nil
 }
 
-func ReadHistoryFromOciArchive(imagePath string, tagName string) (map[string]string, error) {
+/// Attributes the bytes of the hardlinks in `layers` in the order in which the
+/// layers appear in the manifest.
+///
+/// Hardlinks can point into lower layers, so they can only be accounted once
+/// all layers have been analyzed.
+func AccountHardlinksOfManifest(manifest Manifest, layers internal.LayerSizes) {
+	digests := LayerDigestsOfManifest(manifest)
+	orderedLayers := make([]internal.Layer, len(digests))
+	orderedDirs := make([]*internal.Dir, len(digests))
+	for i, digest := range digests {
+		orderedLayers[i] = layers[digest]
+		orderedDirs[i] = &orderedLayers[i].Dir
+	}
+	internal.AccountHardlinks(orderedDirs)
+	for i, digest := range digests {
+		layers[digest] = orderedLayers[i]
+	}
+}
+
+/// Returns the hex encoded digests of the layers in the order in which they
+/// appear in the manifest.
+func LayerDigestsOfManifest(manifest Manifest) []string {
+	digests := make([]string, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		digest := strings.Split(layer.Digest, ":")
+		digests = append(digests, digest[len(digest)-1])
+	}
+	return digests
+}
+
+/// Creates the final root filesystem from the layers in the order in which they
+/// appear in the manifest.
+func MergeLayersOfManifest(manifest Manifest, layers internal.LayerSizes) internal.Dir {
+	orderedLayers := make([]internal.Dir, 0, len(manifest.Layers))
+	for _, digest := range LayerDigestsOfManifest(manifest) {
+		if l, ok := layers[digest]; ok {
+			orderedLayers = append(orderedLayers, l.Dir)
+		}
+	}
+	return internal.MergeLayers(orderedLayers)
+}
+
+/// Reads the history of the image with the tag `tagName` from the oci
+/// archive in `imagePath`, including the entries without a layer.
+func ReadHistoryFromOciArchive(imagePath string, tagName string) ([]ispec.History, error) {
 	// this is mostly stolen from the umoci stat command
 	engine, err := dir.Open(imagePath)
 	if err != nil {
@@ -747,42 +1294,459 @@ func ReadHistoryFromOciArchive(imagePath string, tagName string) (map[string]str
 		return nil, err
 	}
 
-	res := make(map[string]string, len(ms.History))
+	res := make([]ispec.History, 0, len(ms.History))
 	for _, histEntry := range ms.History {
-		if histEntry.Layer != nil {
-			res[string(histEntry.Layer.Digest)] = histEntry.CreatedBy
-		}
+		res = append(res, histEntry.History)
 	}
 	return res, nil
 }
 
+/// Settings of the analyzer that are shared by the web server and the analyze
+/// command
+type analyzerOptions struct {
+	noRootless     bool
+	stream         bool
+	hashFiles      bool
+	taskWorkers    int
+	layerWorkers   int
+	layerCachePath string
+	layerCacheSize int64
+	noLayerCache   bool
+	verbosity      string
+
+	// path to the sqlite database in which the web server stores its tasks,
+	// empty to keep the tasks only in memory
+	taskDbPath string
+
+	// settings for fetching images from registries, the credentials are
+	// set by setup
+	registry    RegistryOptions
+	creds       string
+	noTLSVerify bool
+
+	// path to the signature policy, empty for the default policy
+	signaturePolicy string
+}
+
+func (o *analyzerOptions) flags() []cli.Flag {
+	layerCachePath, taskDbPath := "", ""
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		layerCachePath = filepath.Join(cacheDir, "container-layer-sizes", "layer-cache.sqlite3")
+		taskDbPath = filepath.Join(cacheDir, "container-layer-sizes", "tasks.sqlite3")
+	}
+
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:        "no-rootless",
+			Usage:       "Do not create a user namespace for the containers storage",
+			Destination: &o.noRootless,
+		},
+		&cli.BoolFlag{
+			Name:        "stream",
+			Usage:       "Stream the layers directly from the image source instead of pulling the image into the local containers storage",
+			Destination: &o.stream,
+		},
+		&cli.BoolFlag{
+			Name:        "hash-files",
+			Usage:       "Hash the contents of all files to find duplicate files, this requires additional CPU time",
+			Destination: &o.hashFiles,
+		},
+		&cli.IntFlag{
+			Name:        "task-workers",
+			Usage:       "Number of tasks that are processed in parallel",
+			Value:       DefaultTaskWorkers,
+			Destination: &o.taskWorkers,
+		},
+		&cli.IntFlag{
+			Name:        "layer-workers",
+			Usage:       "Number of layers of an image that are analyzed in parallel",
+			Value:       DefaultLayerWorkers,
+			Destination: &o.layerWorkers,
+		},
+		&cli.StringFlag{
+			Name:        "layer-cache",
+			Usage:       "Path to the sqlite database in which the analyzed layers are cached",
+			Value:       layerCachePath,
+			Destination: &o.layerCachePath,
+		},
+		&cli.Int64Flag{
+			Name:        "layer-cache-size",
+			Usage:       "Maximum size of the layer cache in bytes",
+			Value:       DefaultLayerCacheSize,
+			Destination: &o.layerCacheSize,
+		},
+		&cli.BoolFlag{
+			Name:        "no-layer-cache",
+			Usage:       "Do not cache the analyzed layers",
+			Destination: &o.noLayerCache,
+		},
+		&cli.StringFlag{
+			Name:        "task-db",
+			Usage:       "Path to the sqlite database in which the web server stores its tasks, so that they survive a restart. An empty path keeps the tasks only in memory",
+			Value:       taskDbPath,
+			Destination: &o.taskDbPath,
+		},
+		&cli.StringFlag{
+			Name:        "authfile",
+			Usage:       "Path to the authentication file with the credentials of registries, as written by podman login",
+			Destination: &o.registry.AuthFile,
+		},
+		&cli.StringFlag{
+			Name:        "creds",
+			Usage:       "Credentials for the registry in the form username[:password]",
+			EnvVars:     []string{"ANALYZER_REGISTRY_CREDS"},
+			Destination: &o.creds,
+		},
+		&cli.StringFlag{
+			Name:        "registry-token",
+			Usage:       "Bearer token for the registry, used instead of the credentials",
+			EnvVars:     []string{"ANALYZER_REGISTRY_TOKEN"},
+			Destination: &o.registry.Token,
+		},
+		&cli.BoolFlag{
+			Name:        "no-tls-verify",
+			Usage:       "Do not verify the TLS certificates of registries",
+			Destination: &o.noTLSVerify,
+		},
+		&cli.StringFlag{
+			Name:        "cert-dir",
+			Usage:       "Directory with the certificates (*.crt) and the client certificate and key (*.cert, *.key) for the registry",
+			Destination: &o.registry.CertDir,
+		},
+		&cli.StringFlag{
+			Name:        "registries-conf",
+			Usage:       "Path to the registries.conf with the mirrors and short name aliases of registries",
+			Destination: &o.registry.RegistriesConf,
+		},
+		&cli.StringFlag{
+			Name:        "signature-policy",
+			Usage:       "Path to the policy.json that images have to satisfy, defaults to the policy of the system",
+			Destination: &o.signaturePolicy,
+		},
+		&cli.StringFlag{
+			Name:        "verbosity",
+			Aliases:     []string{"v"},
+			Usage:       "Set the verbosity, defaults to trace for the server and warning for the analyze command",
+			Destination: &o.verbosity,
+		},
+	}
+}
+
+/// Validates the options, sets up the logging and the user namespace and
+/// opens the layer cache.
+///
+/// The returned layer cache is nil if caching is disabled.
+func (o *analyzerOptions) setup(defaultVerbosity logrus.Level) (*internal.LayerCache, error) {
+	if o.verbosity == "" {
+		log.SetLevel(defaultVerbosity)
+	} else if v, err := logrus.ParseLevel(o.verbosity); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid verbosity: %s", o.verbosity))
+	} else {
+		log.SetLevel(v)
+	}
+
+	if o.taskWorkers < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid number of task workers: %d", o.taskWorkers))
+	}
+	if o.layerWorkers < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid number of layer workers: %d", o.layerWorkers))
+	}
+
+	if o.creds != "" {
+		if o.registry.Token != "" {
+			return nil, errors.New("Either credentials or a registry token can be provided, not both")
+		}
+		var err error
+		if o.registry.Username, o.registry.Password, err = ParseCredentials(o.creds); err != nil {
+			return nil, err
+		}
+	}
+	if o.noTLSVerify {
+		verify := false
+		o.registry.TLSVerify = &verify
+	}
+	if o.signaturePolicy != "" {
+		if _, err := loadSignaturePolicy(o.signaturePolicy); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid signature policy %s: %s", o.signaturePolicy, err))
+		}
+	}
+
+	// streaming the layers does not require a user namespace
+	if !o.noRootless && !o.stream {
+		if err := reexecForRootlessStorage(); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.noLayerCache || o.layerCachePath == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(o.layerCachePath), 0755); err != nil {
+		return nil, err
+	}
+	return internal.CreateLayerCache(o.layerCachePath, o.layerCacheSize)
+}
+
 func main() {
+	reexec.Init()
 	log.SetFormatter(&logrus.JSONFormatter{})
-	log.SetLevel(logrus.TraceLevel)
 
-	rootless := true
-	if len(os.Args[1:]) == 1 && os.Args[1] == "--no-rootless" {
-		rootless = false
+	var opts analyzerOptions
+	var addr, format string
+	var depth int
+	var minEfficiency float64
+	var allPlatforms bool
+	var budgetFile, historyDb string
+	var layer string
+	var diffFormat string
+	var diffDepth int
+	var includeUnchanged bool
+
+	app := cli.App{
+		Name:  "analyzer",
+		Usage: "Analyzes the layers of container images",
+		Flags: append(opts.flags(), &cli.StringFlag{
+			Name:        "addr",
+			Aliases:     []string{"a"},
+			Usage:       "The address to which the web server binds",
+			Value:       defaultAddr,
+			Destination: &addr,
+		}),
+		Action: func(c *cli.Context) error {
+			layerCache, err := opts.setup(logrus.TraceLevel)
+			if err != nil {
+				return err
+			}
+			if layerCache != nil {
+				defer layerCache.Destroy()
+			}
+
+			return serve(addr, &opts, layerCache)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "analyze",
+				Usage:     "Analyzes a single image and prints the result",
+				ArgsUsage: "<image-ref>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Aliases:     []string{"f"},
+						Usage:       fmt.Sprintf("The output format, one of %s", strings.Join(allOutputFormats(), ", ")),
+						Value:       OutputFormatTable,
+						Destination: &format,
+					},
+					&cli.IntFlag{
+						Name:        "depth",
+						Aliases:     []string{"d"},
+						Usage:       "Number of directory levels that are printed in the tree format",
+						Value:       2,
+						Destination: &depth,
+					},
+					&cli.StringFlag{
+						Name:        "layer",
+						Usage:       fmt.Sprintf("Show the layer with this digest (or a prefix of it) instead of the final root filesystem in the %s format and the formats %s", OutputFormatTree, strings.Join(internal.ExportFormats(), ", ")),
+						Destination: &layer,
+					},
+					&cli.Float64Flag{
+						Name:        "min-efficiency",
+						Usage:       "Fail if the efficiency of the image is below this value (between 0 and 1)",
+						Destination: &minEfficiency,
+					},
+					&cli.BoolFlag{
+						Name:        "all-platforms",
+						Usage:       fmt.Sprintf("Analyze every platform of a multi-arch image, only the %s and %s formats are supported", OutputFormatJSON, OutputFormatTable),
+						Destination: &allPlatforms,
+					},
+					&cli.StringFlag{
+						Name:        "budget",
+						Usage:       "Fail with the exit code 2 if the image exceeds the size limits in this file",
+						Destination: &budgetFile,
+					},
+					&cli.StringFlag{
+						Name:        "history-db",
+						Usage:       "SQLite database of the storage server with the previous versions of the image, used for the growth limit of the budget",
+						Destination: &historyDb,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("Expected exactly one image reference")
+					}
+					if !isOutputFormat(format) {
+						return errors.New(fmt.Sprintf("Invalid output format: %s", format))
+					}
+					if allPlatforms && format != OutputFormatJSON && format != OutputFormatTable {
+						return errors.New(fmt.Sprintf("Invalid output format for the analysis of all platforms: %s", format))
+					}
+					if allPlatforms && budgetFile != "" {
+						return errors.New("Budgets are not supported for the analysis of all platforms")
+					}
+
+					var budget *internal.Budget
+					if budgetFile != "" {
+						var err error
+						if budget, err = internal.ReadBudgetFile(budgetFile); err != nil {
+							return errors.New(fmt.Sprintf("Failed to read the budget %s: %s", budgetFile, err))
+						}
+					}
+
+					layerCache, err := opts.setup(logrus.WarnLevel)
+					if err != nil {
+						return err
+					}
+					if layerCache != nil {
+						defer layerCache.Destroy()
+					}
+
+					if allPlatforms {
+						t, err := AnalyzeIndex(c.Args().First(), &opts, layerCache)
+						if t != nil {
+							defer t.Cleanup()
+						}
+						if err != nil {
+							return err
+						}
+						return PrintIndexAnalysis(c.App.Writer, t.Analysis(), format)
+					}
+
+					t, err := AnalyzeImage(c.Args().First(), &opts, minEfficiency, layerCache)
+					if t != nil {
+						defer t.Cleanup()
+					}
+					// print the results of images that are below the
+					// efficiency threshold nevertheless
+					if err != nil && !errors.Is(err, internal.ErrInefficientImage) {
+						return err
+					}
+					if printErr := PrintAnalysis(c.App.Writer, t, format, depth, layer); printErr != nil {
+						return printErr
+					}
+
+					if opts.signaturePolicy != "" {
+						if printErr := PrintSignatureVerification(c.App.ErrWriter, t.Signature); printErr != nil {
+							return printErr
+						}
+					}
+
+					if budget != nil {
+						// the report goes to stderr to keep the output
+						// machine readable
+						report, budgetErr := CheckBudget(t, *budget, historyDb)
+						if budgetErr != nil {
+							return budgetErr
+						}
+						if printErr := PrintBudgetReport(c.App.ErrWriter, report); printErr != nil {
+							return printErr
+						}
+						if err == nil && report.Exceeded() {
+							err = internal.ErrBudgetExceeded
+						}
+					}
+					return err
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Compares the final root filesystems of two images",
+				ArgsUsage: "<old-image-ref> <new-image-ref>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Aliases:     []string{"f"},
+						Usage:       fmt.Sprintf("The output format, one of %s or %s", OutputFormatJSON, OutputFormatTree),
+						Value:       OutputFormatTree,
+						Destination: &diffFormat,
+					},
+					&cli.IntFlag{
+						Name:        "depth",
+						Aliases:     []string{"d"},
+						Usage:       "Number of directory levels that are printed in the tree format",
+						Value:       2,
+						Destination: &diffDepth,
+					},
+					&cli.BoolFlag{
+						Name:        "unchanged",
+						Usage:       "Include the unchanged files and directories in the json format",
+						Destination: &includeUnchanged,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("Expected exactly two image references")
+					}
+					if diffFormat != OutputFormatJSON && diffFormat != OutputFormatTree {
+						return errors.New(fmt.Sprintf("Invalid output format: %s", diffFormat))
+					}
+
+					layerCache, err := opts.setup(logrus.WarnLevel)
+					if err != nil {
+						return err
+					}
+					if layerCache != nil {
+						defer layerCache.Destroy()
+					}
+
+					diff, err := DiffImages(c.Args().Get(0), c.Args().Get(1), &opts, layerCache, includeUnchanged)
+					if err != nil {
+						return err
+					}
+					if diffFormat == OutputFormatJSON {
+						enc := json.NewEncoder(c.App.Writer)
+						enc.SetIndent("", "  ")
+						return enc.Encode(diff)
+					}
+					return PrintDiffTree(c.App.Writer, diff, diffDepth)
+				},
+			},
+		},
 	}
 
-	reexec.Init()
-	if rootless {
-		err := reexecForRootlessStorage()
-		if err != nil {
-			panic(err)
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, internal.ErrBudgetExceeded) {
+			os.Exit(2)
 		}
+		os.Exit(1)
 	}
+}
 
+/// Launches the web server on `addr` which analyzes the images that it
+/// receives.
+func serve(addr string, opts *analyzerOptions, layerCache *internal.LayerCache) error {
 	fileServer := http.FileServer(http.Dir("./public"))
 	http.Handle("/", fileServer)
 
-	tq := NewTaskQueue()
+	var store *internal.TaskStore
+	if opts.taskDbPath != "" {
+		var err error
+		if store, err = openTaskStore(opts.taskDbPath); err != nil {
+			return err
+		}
+		defer store.Destroy()
+	}
+
+	tq := NewTaskQueue(opts.layerWorkers, layerCache, opts.signaturePolicy, store)
 	defer tq.CleanupQueue()
 
-	jobs := make(chan *Task)
+	// tasks and index tasks share the workers
+	jobs := make(chan queuedTask)
+	for i := 0; i < opts.taskWorkers; i++ {
+		go func() {
+			for j := range jobs {
+				j.task.Process()
+				tq.SaveTask(j.id)
+			}
+		}()
+	}
+
+	restored, err := tq.Restore(opts.registry)
+	if err != nil {
+		return err
+	}
 	go func() {
-		for t := range jobs {
-			t.Process()
+		for _, j := range restored {
+			jobs <- j
 		}
 	}()
 
@@ -796,8 +1760,13 @@ func main() {
 			http.Error(w, "Parameter url was not provided", http.StatusBadRequest)
 			return
 		}
+		registry, err := registryOptionsOfRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		platformDigests, err := FetchImagePlatformDigests(url)
+		platformDigests, err := FetchImagePlatformDigests(url, opts.registry.Override(registry))
 		if err != nil {
 			http.Error(
 				w,
@@ -835,22 +1804,50 @@ func main() {
 			return
 		}
 
-		if t.State != TaskStateFinished {
+		if state := t.GetState(); state != TaskStateFinished {
 			http.Error(
 				w,
 				fmt.Sprintf(
 					"Cannot get data from task %s, task is not in finished state (got state %s)",
-					id, TaskStateToStr(t.State)),
+					id, TaskStateToStr(state)),
 				http.StatusInternalServerError,
 			)
 			return
 		}
 
-		if j, err := json.Marshal(t.Image.layers); err != nil {
+		if format := r.FormValue("format"); format != "" && format != OutputFormatJSON {
+			exporter, ok := internal.Exporters[format]
+			if !ok {
+				http.Error(w, fmt.Sprintf("Invalid format: %s", format), http.StatusBadRequest)
+				return
+			}
+			image, err := exportedImageOfTask(t, r.FormValue("layer"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var buf bytes.Buffer
+			if err := exporter.Export(&buf, image); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", exporter.ContentType)
+			w.Write(buf.Bytes())
+			log.WithFields(logrus.Fields{"id": id, "format": format}).Trace("send data, removing task from queue")
+			tq.RemoveTask(id)
+			return
+		}
+
+		if j, err := json.Marshal(t.Analysis()); err != nil {
+			t.mu.RLock()
+			layers := t.Image.layers
+			t.mu.RUnlock()
+
 			log.WithFields(logrus.Fields{
-				"layers": t.Image.layers,
+				"layers": layers,
 				"id":     id,
-				"state":  t.State,
+				"state":  t.GetState(),
 				"error":  err,
 			}).Error("Failed to marshal the layers to json")
 
@@ -876,10 +1873,51 @@ func main() {
 				return
 			}
 
-			if id, t, err := tq.AddTask(img); err != nil {
+			var minEfficiency float64
+			if e := r.PostFormValue("min_efficiency"); e != "" {
+				var err error
+				if minEfficiency, err = strconv.ParseFloat(e, 64); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid min_efficiency: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			stream := opts.stream
+			if st := r.PostFormValue("stream"); st != "" {
+				var err error
+				if stream, err = strconv.ParseBool(st); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid stream parameter: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			hashFiles := opts.hashFiles
+			if h := r.PostFormValue("hash_files"); h != "" {
+				var err error
+				if hashFiles, err = strconv.ParseBool(h); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid hash_files parameter: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			registry, err := registryOptionsOfRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if t, err := newTask(img, stream, opts.registry.Override(registry)); err != nil {
 				http.Error(w, fmt.Sprintf("Error creating task: %s", err), http.StatusBadRequest)
 			} else {
-				jobs <- t
+				// the settings must be in place before the task is visible to
+				// the workers and to GET /task
+				t.MinEfficiency = minEfficiency
+				t.HashFiles = hashFiles
+				id := fmt.Sprint(uuid.New())
+				tq.addTask(id, t)
+				tq.SaveTask(id)
+				// don't block the request until a worker is available
+				go func() { jobs <- queuedTask{id: id, task: t} }()
 				fmt.Fprintf(w, id)
 			}
 			return
@@ -920,8 +1958,118 @@ func main() {
 			return
 		}
 	})
+	http.HandleFunc("/index-task", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing form data: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case "POST":
+			img := r.PostFormValue("image")
+			if img == "" {
+				http.Error(w, "No image provided", http.StatusBadRequest)
+				return
+			}
+
+			stream := opts.stream
+			if st := r.PostFormValue("stream"); st != "" {
+				var err error
+				if stream, err = strconv.ParseBool(st); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid stream parameter: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			hashFiles := opts.hashFiles
+			if h := r.PostFormValue("hash_files"); h != "" {
+				var err error
+				if hashFiles, err = strconv.ParseBool(h); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid hash_files parameter: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			registry, err := registryOptionsOfRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if t, err := NewIndexTask(img, stream, opts.registry.Override(registry)); err != nil {
+				http.Error(w, fmt.Sprintf("Error creating index task: %s", err), http.StatusBadRequest)
+			} else {
+				t.HashFiles = hashFiles
+				id := fmt.Sprint(uuid.New())
+				tq.addIndexTask(id, t)
+				tq.SaveTask(id)
+				// don't block the request until a worker is available
+				go func() { jobs <- queuedTask{id: id, task: t} }()
+				fmt.Fprintf(w, id)
+			}
+			return
+		case "GET":
+			fallthrough
+		case "DELETE":
+			id := r.FormValue("id")
+			if id == "" {
+				http.Error(w, "No task id provided", http.StatusBadRequest)
+				return
+			}
+			if task, err := tq.GetIndexTask(id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else if r.Method == "GET" {
+				if j, err := json.Marshal(task); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				} else {
+					fmt.Fprint(w, string(j))
+				}
+			} else if err := tq.RemoveIndexTask(id); err != nil {
+				log.WithFields(
+					logrus.Fields{"error": err, "id": id},
+				).Error("Failed to remove the index task")
+			}
+			return
+		}
+	})
+
+	http.HandleFunc("/index-data", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing form data: %s", err), http.StatusBadRequest)
+			return
+		}
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "Parameter id was not provided", http.StatusBadRequest)
+			return
+		}
+
+		t, err := tq.GetIndexTask(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Got an error fetching the index task with the id %s: %s", id, err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		if state := t.GetState(); state != TaskStateFinished {
+			http.Error(
+				w,
+				fmt.Sprintf(
+					"Cannot get data from index task %s, task is not in finished state (got state %s)",
+					id, TaskStateToStr(state)),
+				http.StatusInternalServerError,
+			)
+			return
+		}
+
+		if j, err := json.Marshal(t.Analysis()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			fmt.Fprint(w, string(j))
+		}
+		log.WithFields(logrus.Fields{"id": id}).Trace("send data, removing index task from queue")
+		tq.RemoveIndexTask(id)
+	})
+
 	fmt.Printf("Ready. Listening on %s\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		panic(err)
-	}
+	return http.ListenAndServe(addr, nil)
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// Directory in which the temporary directories of the tasks are created, the
+/// default directory for temporary files is used if empty.
+///
+/// The web server uses a directory of its own when the tasks are persisted, so
+/// that directories of tasks that were interrupted by a restart can be
+/// removed.
+var taskTempRoot string
+
+/// Creates a temporary directory for a task in `taskTempRoot`
+func createTaskTempdir() (string, error) {
+	return ioutil.TempDir(taskTempRoot, "")
+}
+
+/// Opens the task store at `dbPath` for the web server.
+///
+/// The temporary directories of the tasks are created next to the database
+/// from then on. Directories that are left over from a previous run, e.g.
+/// because the server was killed while processing a task, are removed.
+func openTaskStore(dbPath string) (*internal.TaskStore, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, err
+	}
+
+	tempRoot := dbPath + ".tmp"
+	if err := os.RemoveAll(tempRoot); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tempRoot, 0700); err != nil {
+		return nil, err
+	}
+	taskTempRoot = tempRoot
+
+	return internal.CreateTaskStore(dbPath)
+}
+
+/// The settings of a task that are persisted in the task store.
+///
+/// The credentials are deliberately not stored, only whether the task used
+/// any.
+type taskSettings struct {
+	Stream        bool    `json:"stream"`
+	HashFiles     bool    `json:"hash_files"`
+	MinEfficiency float64 `json:"min_efficiency"`
+	TLSVerify     *bool   `json:"tls_verify,omitempty"`
+	Credentials   bool    `json:"credentials"`
+}
+
+/// The persisted result of a finished or failed task
+type taskResult struct {
+	Image     ContainerImage         `json:"image"`
+	Signature *SignatureVerification `json:"signature"`
+	Analysis  internal.ImageAnalysis `json:"analysis"`
+}
+
+/// The persisted result of a finished or failed index task
+type indexTaskResult struct {
+	Manifests []ExtractedDigest `json:"manifests"`
+	Analysis  *IndexAnalysis    `json:"analysis"`
+}
+
+/// A task or index task waiting for a worker of the web server
+type queuedTask struct {
+	id   string
+	task interface{ Process() }
+}
+
+/// Returns true if a task in the state `s` will not change anymore
+func isFinalTaskState(s TaskState) bool {
+	return s == TaskStateFinished || s == TaskStateError
+}
+
+/// Creates the record of the task `t` with the id `id` for the task store,
+/// the result is only included once the task is finished or failed.
+func (t *Task) record(id string) (internal.TaskRecord, error) {
+	analysis := t.Analysis()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	settings, err := json.Marshal(taskSettings{
+		Stream:        t.Stream,
+		HashFiles:     t.HashFiles,
+		MinEfficiency: t.MinEfficiency,
+		TLSVerify:     t.registry.TLSVerify,
+		Credentials:   t.registry.Username != "" || t.registry.Token != "",
+	})
+	if err != nil {
+		return internal.TaskRecord{}, err
+	}
+
+	record := internal.TaskRecord{
+		ID:       id,
+		Kind:     internal.TaskKindImage,
+		ImageUrl: t.imageUrl,
+		Settings: settings,
+		State:    uint(t.State),
+		Created:  t.created,
+	}
+	if t.error != nil {
+		record.Error = t.error.Error()
+	}
+	if isFinalTaskState(t.State) {
+		if record.Result, err = json.Marshal(taskResult{Image: t.Image, Signature: t.Signature, Analysis: analysis}); err != nil {
+			return internal.TaskRecord{}, err
+		}
+	}
+	return record, nil
+}
+
+/// Creates the record of the index task `t` with the id `id` for the task
+/// store, see Task.record
+func (t *IndexTask) record(id string) (internal.TaskRecord, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	settings, err := json.Marshal(taskSettings{
+		Stream:      t.Stream,
+		HashFiles:   t.HashFiles,
+		TLSVerify:   t.registry.TLSVerify,
+		Credentials: t.registry.Username != "" || t.registry.Token != "",
+	})
+	if err != nil {
+		return internal.TaskRecord{}, err
+	}
+
+	record := internal.TaskRecord{
+		ID:       id,
+		Kind:     internal.TaskKindIndex,
+		ImageUrl: t.ImageUrl,
+		Settings: settings,
+		State:    uint(t.State),
+		Created:  t.created,
+	}
+	if t.error != nil {
+		record.Error = t.error.Error()
+	}
+	if isFinalTaskState(t.State) {
+		if record.Result, err = json.Marshal(indexTaskResult{Manifests: t.Manifests, Analysis: t.analysis}); err != nil {
+			return internal.TaskRecord{}, err
+		}
+	}
+	return record, nil
+}
+
+/// Writes the current state of the task or index task with the id `id` to the
+/// task store of the queue.
+///
+/// Nothing is written if the queue has no store, if the task has been removed
+/// or if the queue has been cleaned up. Errors are only logged, as the task
+/// itself is not affected by them.
+func (tq *TaskQueue) SaveTask(id string) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if tq.store == nil || tq.closed {
+		return
+	}
+
+	var record internal.TaskRecord
+	var err error
+	if t, ok := tq.tasks[id]; ok {
+		record, err = t.record(id)
+	} else if t, ok := tq.indexTasks[id]; ok {
+		record, err = t.record(id)
+	} else {
+		return
+	}
+
+	if err == nil {
+		err = tq.store.Put(record)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"id": id, "error": err}).Error("Failed to store the task")
+	}
+}
+
+/// Removes the task with the id `id` from the task store of the queue, the
+/// caller has to hold the lock of the queue
+func (tq *TaskQueue) deleteStoredTask(id string) {
+	if tq.store == nil {
+		return
+	}
+	if err := tq.store.Delete(id); err != nil {
+		log.WithFields(logrus.Fields{"id": id, "error": err}).Error("Failed to remove the task from the store")
+	}
+}
+
+/// Restores the tasks from the task store of the queue after a restart.
+///
+/// Finished and failed tasks are restored together with their results.
+/// Unfinished tasks start over with the registry settings `registry`, they are
+/// returned in the order of their creation and have to be processed again.
+/// The credentials of tasks are not stored, so tasks that used credentials can
+/// only be resumed if `registry` contains credentials as well.
+func (tq *TaskQueue) Restore(registry RegistryOptions) ([]queuedTask, error) {
+	if tq.store == nil {
+		return nil, nil
+	}
+
+	records, err := tq.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	queued := make([]queuedTask, 0)
+	for _, record := range records {
+		var settings taskSettings
+		if err := json.Unmarshal(record.Settings, &settings); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid settings of the stored task %s: %s", record.ID, err))
+		}
+		taskRegistry := registry.Override(RegistryOptions{TLSVerify: settings.TLSVerify})
+
+		var resumeErr error
+		if isFinalTaskState(TaskState(record.State)) && record.Result != nil {
+			resumeErr = tq.restoreFinishedTask(record, settings)
+		} else if settings.Credentials && registry.Username == "" && registry.Token == "" {
+			resumeErr = errors.New("The credentials of the task are not stored, it has to be submitted again")
+		} else {
+			var t queuedTask
+			if t, resumeErr = tq.requeueTask(record, settings, taskRegistry); resumeErr == nil {
+				queued = append(queued, t)
+			}
+		}
+
+		if resumeErr != nil {
+			log.WithFields(
+				logrus.Fields{"id": record.ID, "image_url": record.ImageUrl, "error": resumeErr},
+			).Error("Failed to resume the task")
+
+			record.State, record.Error, record.Result = TaskStateError, resumeErr.Error(), nil
+			if err := tq.restoreFailedTask(record, settings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	log.WithFields(
+		logrus.Fields{"tasks": len(records), "requeued": len(queued)},
+	).Info("Restored the stored tasks")
+
+	return queued, nil
+}
+
+/// Adds the task of `record` that had finished before the restart
+func (tq *TaskQueue) restoreFinishedTask(record internal.TaskRecord, settings taskSettings) error {
+	ctx, cancel := context.WithCancel(backgroundContext)
+
+	var taskErr error
+	if record.Error != "" {
+		taskErr = errors.New(record.Error)
+	}
+
+	switch record.Kind {
+	case internal.TaskKindIndex:
+		var result indexTaskResult
+		if err := json.Unmarshal(record.Result, &result); err != nil {
+			cancel()
+			return err
+		}
+		tq.addIndexTask(record.ID, &IndexTask{
+			ImageUrl:  record.ImageUrl,
+			State:     TaskState(record.State),
+			Manifests: result.Manifests,
+			Stream:    settings.Stream,
+			HashFiles: settings.HashFiles,
+			error:     taskErr,
+			analysis:  result.Analysis,
+			registry:  &RegistryOptions{},
+			created:   record.Created,
+			ctx:       ctx,
+			cancel:    cancel,
+		})
+	default:
+		var result taskResult
+		if err := json.Unmarshal(record.Result, &result); err != nil {
+			cancel()
+			return err
+		}
+		t := &Task{
+			Image:         result.Image,
+			State:         TaskState(record.State),
+			Stream:        settings.Stream,
+			MinEfficiency: settings.MinEfficiency,
+			HashFiles:     settings.HashFiles,
+			Signature:     result.Signature,
+			error:         taskErr,
+			imageUrl:      record.ImageUrl,
+			registry:      &RegistryOptions{},
+			created:       record.Created,
+			ctx:           ctx,
+			cancel:        cancel,
+		}
+		t.Image.setAnalysis(result.Analysis)
+		if t.State == TaskStateFinished && t.MinEfficiency > 0 {
+			t.thresholdError = result.Analysis.Efficiency.CheckThreshold(t.MinEfficiency)
+		}
+		tq.addTask(record.ID, t)
+	}
+	return nil
+}
+
+/// Adds the task of `record` in the failed state with its error message
+func (tq *TaskQueue) restoreFailedTask(record internal.TaskRecord, settings taskSettings) error {
+	var err error
+	switch record.Kind {
+	case internal.TaskKindIndex:
+		record.Result, err = json.Marshal(indexTaskResult{Manifests: make([]ExtractedDigest, 0)})
+	default:
+		record.Result, err = json.Marshal(taskResult{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := tq.restoreFinishedTask(record, settings); err != nil {
+		return err
+	}
+	tq.SaveTask(record.ID)
+	return nil
+}
+
+/// Creates the unfinished task of `record` again under the same id, so that
+/// it can be processed from the start
+func (tq *TaskQueue) requeueTask(record internal.TaskRecord, settings taskSettings, registry RegistryOptions) (queuedTask, error) {
+	var task interface{ Process() }
+
+	switch record.Kind {
+	case internal.TaskKindIndex:
+		t, err := NewIndexTask(record.ImageUrl, settings.Stream, registry)
+		if err != nil {
+			return queuedTask{}, err
+		}
+		t.HashFiles = settings.HashFiles
+		t.created = record.Created
+		tq.addIndexTask(record.ID, t)
+		task = t
+	default:
+		t, err := newTask(record.ImageUrl, settings.Stream, registry)
+		if err != nil {
+			return queuedTask{}, err
+		}
+		t.HashFiles = settings.HashFiles
+		t.MinEfficiency = settings.MinEfficiency
+		t.created = record.Created
+		tq.addTask(record.ID, t)
+		task = t
+	}
+
+	tq.SaveTask(record.ID)
+	return queuedTask{id: record.ID, task: task}, nil
+}
+
+/// Sets the analysis result of this image, the counterpart of Analysis
+func (i *ContainerImage) setAnalysis(a internal.ImageAnalysis) {
+	i.layers = &a.Layers
+	i.mergedRoot = &a.MergedRoot
+	i.efficiency = &a.Efficiency
+	i.duplicates = a.Duplicates
+	i.packages = a.Packages
+	i.dependencies = a.Dependencies
+	i.history = a.History
+	i.recommendations = &a.Recommendations
+}
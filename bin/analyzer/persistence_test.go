@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestTaskStore(t *testing.T) *internal.TaskStore {
+	store, err := internal.CreateTaskStore(filepath.Join(t.TempDir(), "tasks.sqlite3"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Destroy() })
+	return store
+}
+
+func TestRestoreFinishedTask(t *testing.T) {
+	store := createTestTaskStore(t)
+	url := "dir:" + t.TempDir()
+
+	tq := NewTaskQueue(2, nil, "", store)
+	id, task, err := tq.AddTask(url, true, RegistryOptions{})
+	require.NoError(t, err)
+
+	layers := internal.LayerSizes{"sha256:abc": internal.NewLayer()}
+	task.HashFiles = true
+	task.Image.setAnalysis(internal.ImageAnalysis{Layers: layers, MergedRoot: rootDir})
+	task.Signature = &SignatureVerification{Allowed: true, ManifestDigest: "sha256:def"}
+	task.setState(TaskStateFinished)
+	tq.SaveTask(id)
+
+	restoredQueue := NewTaskQueue(3, nil, "", store)
+	queued, err := restoredQueue.Restore(RegistryOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, queued)
+
+	restored, err := restoredQueue.GetTask(id)
+	require.NoError(t, err)
+	assert.Equal(t, TaskState(TaskStateFinished), restored.GetState())
+	assert.NoError(t, restored.Err())
+	assert.True(t, restored.HashFiles)
+	assert.Equal(t, url, restored.imageUrl)
+	assert.Equal(t, task.Image.Image, restored.Image.Image)
+	assert.Equal(t, task.Signature, restored.Signature)
+	assert.Equal(t, task.Analysis(), restored.Analysis())
+	assert.Equal(t, 3, restored.layerWorkers)
+
+	// the restored task is stored again with its result
+	restoredQueue.SaveTask(id)
+	record, err := store.Get(id)
+	require.NoError(t, err)
+	assert.NotNil(t, record.Result)
+}
+
+func TestRestoreFinishedTaskBelowEfficiencyThreshold(t *testing.T) {
+	store := createTestTaskStore(t)
+
+	tq := NewTaskQueue(2, nil, "", store)
+	id, task, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{})
+	require.NoError(t, err)
+
+	task.MinEfficiency = 0.8
+	task.Image.setAnalysis(internal.ImageAnalysis{
+		Layers:     internal.LayerSizes{"sha256:abc": internal.NewLayer()},
+		MergedRoot: rootDir,
+		Efficiency: internal.EfficiencyReport{Efficiency: 0.5},
+	})
+	task.setState(TaskStateFinished)
+	tq.SaveTask(id)
+
+	restoredQueue := NewTaskQueue(2, nil, "", store)
+	_, err = restoredQueue.Restore(RegistryOptions{})
+	require.NoError(t, err)
+
+	restored, err := restoredQueue.GetTask(id)
+	require.NoError(t, err)
+	assert.Equal(t, TaskState(TaskStateFinished), restored.GetState())
+	assert.NoError(t, restored.Err())
+	assert.ErrorIs(t, restored.ThresholdErr(), internal.ErrInefficientImage)
+
+	j, err := json.Marshal(restored)
+	require.NoError(t, err)
+	assert.Contains(t, string(j), `"threshold_error":"The image efficiency is below the threshold`)
+}
+
+func TestRestoreRequeuesUnfinishedTasks(t *testing.T) {
+	store := createTestTaskStore(t)
+	verify := false
+
+	tq := NewTaskQueue(2, nil, "", store)
+	firstId, first, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{TLSVerify: &verify})
+	require.NoError(t, err)
+	first.MinEfficiency = 0.8
+	tq.SaveTask(firstId)
+
+	secondId, second, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{})
+	require.NoError(t, err)
+	second.setState(TaskStateAnalyzing)
+	tq.SaveTask(secondId)
+
+	restoredQueue := NewTaskQueue(2, nil, "", store)
+	queued, err := restoredQueue.Restore(RegistryOptions{CertDir: "/etc/certs"})
+	require.NoError(t, err)
+	require.Len(t, queued, 2)
+	assert.Equal(t, firstId, queued[0].id)
+	assert.Equal(t, secondId, queued[1].id)
+
+	restored, err := restoredQueue.GetTask(firstId)
+	require.NoError(t, err)
+	assert.Same(t, restored, queued[0].task)
+	assert.Equal(t, TaskState(TaskStateNew), restored.GetState())
+	assert.Equal(t, 0.8, restored.MinEfficiency)
+	assert.Equal(t, "/etc/certs", restored.registry.CertDir)
+	require.NotNil(t, restored.registry.TLSVerify)
+	assert.False(t, *restored.registry.TLSVerify)
+
+	restored, err = restoredQueue.GetTask(secondId)
+	require.NoError(t, err)
+	assert.Equal(t, TaskState(TaskStateNew), restored.GetState())
+	assert.Nil(t, restored.registry.TLSVerify)
+}
+
+func TestRestoreTaskWithCredentials(t *testing.T) {
+	store := createTestTaskStore(t)
+
+	tq := NewTaskQueue(2, nil, "", store)
+	id, _, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{Username: "user", Password: "secret"})
+	require.NoError(t, err)
+	tq.SaveTask(id)
+
+	record, err := store.Get(id)
+	require.NoError(t, err)
+	assert.NotContains(t, string(record.Settings), "secret")
+	assert.NotContains(t, string(record.Settings), "user")
+
+	// the task can be resumed with the credentials of the server
+	restoredQueue := NewTaskQueue(2, nil, "", store)
+	queued, err := restoredQueue.Restore(RegistryOptions{Token: "token"})
+	require.NoError(t, err)
+	assert.Len(t, queued, 1)
+
+	// but fails without them
+	restoredQueue = NewTaskQueue(2, nil, "", store)
+	queued, err = restoredQueue.Restore(RegistryOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, queued)
+
+	restored, err := restoredQueue.GetTask(id)
+	require.NoError(t, err)
+	assert.Equal(t, TaskState(TaskStateError), restored.GetState())
+	assert.Error(t, restored.Err())
+
+	record, err = store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint(TaskStateError), record.State)
+}
+
+func TestRestoreFinishedIndexTask(t *testing.T) {
+	store := createTestTaskStore(t)
+
+	tq := NewTaskQueue(2, nil, "", store)
+	id, task, err := tq.AddIndexTask("docker://registry.opensuse.org/opensuse/tumbleweed:latest", true, RegistryOptions{})
+	require.NoError(t, err)
+
+	task.Manifests = []ExtractedDigest{{Digest: "sha256:abc", MediaType: "application/vnd.oci.image.manifest.v1+json"}}
+	task.analysis = &IndexAnalysis{Platforms: make([]PlatformAnalysis, 0)}
+	task.setState(TaskStateFinished)
+	tq.SaveTask(id)
+
+	restoredQueue := NewTaskQueue(2, nil, "", store)
+	queued, err := restoredQueue.Restore(RegistryOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, queued)
+
+	restored, err := restoredQueue.GetIndexTask(id)
+	require.NoError(t, err)
+	assert.Equal(t, TaskState(TaskStateFinished), restored.GetState())
+	assert.Equal(t, task.ImageUrl, restored.ImageUrl)
+	assert.Equal(t, task.Manifests, restored.Manifests)
+	assert.Equal(t, task.Analysis(), restored.Analysis())
+}
+
+func TestRemovedTasksAreNotStored(t *testing.T) {
+	store := createTestTaskStore(t)
+
+	tq := NewTaskQueue(2, nil, "", store)
+	id, _, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{})
+	require.NoError(t, err)
+	tq.SaveTask(id)
+
+	require.NoError(t, tq.RemoveTask(id))
+	_, err = store.Get(id)
+	assert.ErrorIs(t, err, internal.ErrNonExistent)
+
+	// tasks that are canceled on shutdown keep their stored state
+	id, task, err := tq.AddTask("dir:"+t.TempDir(), true, RegistryOptions{})
+	require.NoError(t, err)
+	tq.SaveTask(id)
+	tq.CleanupQueue()
+
+	task.setState(TaskStateError)
+	tq.SaveTask(id)
+	record, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint(TaskStateNew), record.State)
+}
+
+func TestOpenTaskStoreRemovesOrphanedTempdirs(t *testing.T) {
+	defer func() { taskTempRoot = "" }()
+
+	dbPath := filepath.Join(t.TempDir(), "state", "tasks.sqlite3")
+	orphan := filepath.Join(dbPath+".tmp", "orphan")
+	require.NoError(t, os.MkdirAll(orphan, 0755))
+
+	store, err := openTaskStore(dbPath)
+	require.NoError(t, err)
+	defer store.Destroy()
+
+	assert.NoDirExists(t, orphan)
+	assert.Equal(t, dbPath+".tmp", taskTempRoot)
+
+	tempdir, err := createTaskTempdir()
+	require.NoError(t, err)
+	assert.Equal(t, dbPath+".tmp", filepath.Dir(tempdir))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/reference"
+)
+
+/// Settings for fetching images from registries.
+///
+/// The credentials are neither serialized nor included in the string
+/// representation, so that they do not end up in the logs or in the responses
+/// of the web server.
+type RegistryOptions struct {
+	Username string `json:"-"`
+	Password string `json:"-"`
+
+	/// Bearer token that is sent instead of the username and password
+	Token string `json:"-"`
+
+	/// Path to an auth.json file as written by `podman login`, the default
+	/// locations of the containers tools are used if empty
+	AuthFile string `json:"-"`
+
+	/// Whether the TLS certificates of registries are verified, nil uses the
+	/// setting of the registry in registries.conf
+	TLSVerify *bool `json:"-"`
+
+	/// Directory with the CA certificates (*.crt) and the client certificate
+	/// and key (*.cert, *.key) for the registry
+	CertDir string `json:"-"`
+
+	/// Path to registries.conf with the mirrors and short name aliases, the
+	/// system wide file is used if empty
+	RegistriesConf string `json:"-"`
+}
+
+func (o RegistryOptions) String() string {
+	verify := "default"
+	if o.TLSVerify != nil {
+		verify = strconv.FormatBool(*o.TLSVerify)
+	}
+	return fmt.Sprintf(
+		"{credentials: %t, token: %t, authfile: %s, tls-verify: %s, cert-dir: %s, registries-conf: %s}",
+		o.Username != "", o.Token != "", o.AuthFile, verify, o.CertDir, o.RegistriesConf,
+	)
+}
+
+/// Returns a copy of `o` in which the settings that are set in `overrides`
+/// are replaced.
+///
+/// Credentials are replaced as a whole, so that a token in `overrides`
+/// replaces a username and password in `o` and vice versa.
+func (o RegistryOptions) Override(overrides RegistryOptions) RegistryOptions {
+	if overrides.Username != "" || overrides.Token != "" {
+		o.Username, o.Password, o.Token = overrides.Username, overrides.Password, overrides.Token
+	}
+	if overrides.AuthFile != "" {
+		o.AuthFile = overrides.AuthFile
+	}
+	if overrides.TLSVerify != nil {
+		verify := *overrides.TLSVerify
+		o.TLSVerify = &verify
+	}
+	if overrides.CertDir != "" {
+		o.CertDir = overrides.CertDir
+	}
+	if overrides.RegistriesConf != "" {
+		o.RegistriesConf = overrides.RegistriesConf
+	}
+	return o
+}
+
+/// Creates the system context for fetching images with these settings
+func (o RegistryOptions) SystemContext() *types.SystemContext {
+	sys := &types.SystemContext{
+		AuthFilePath:              o.AuthFile,
+		DockerCertPath:            o.CertDir,
+		DockerBearerRegistryToken: o.Token,
+		SystemRegistriesConfPath:  o.RegistriesConf,
+	}
+	if o.Username != "" {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{Username: o.Username, Password: o.Password}
+	}
+	if o.TLSVerify != nil {
+		sys.DockerInsecureSkipTLSVerify = types.NewOptionalBool(!*o.TLSVerify)
+	}
+	return sys
+}
+
+/// Splits the credentials `creds` in the form `username[:password]`
+func ParseCredentials(creds string) (username string, password string, err error) {
+	parts := strings.SplitN(creds, ":", 2)
+	if parts[0] == "" {
+		return "", "", errors.New("The credentials contain no username")
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+/// Reads the registry settings of a single task from the form values
+/// username, password, registry_token and tls_verify of the request `r`.
+///
+/// Paths on the server (the authfile, certificates and registries.conf) can
+/// only be configured globally.
+func registryOptionsOfRequest(r *http.Request) (RegistryOptions, error) {
+	o := RegistryOptions{
+		Username: r.PostFormValue("username"),
+		Password: r.PostFormValue("password"),
+		Token:    r.PostFormValue("registry_token"),
+	}
+	if o.Password != "" && o.Username == "" {
+		return o, errors.New("A password requires a username")
+	}
+	if o.Username != "" && o.Token != "" {
+		return o, errors.New("Either a username or a registry token can be provided, not both")
+	}
+	if v := r.PostFormValue("tls_verify"); v != "" {
+		verify, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, errors.New(fmt.Sprintf("Invalid tls_verify parameter: %s", err))
+		}
+		o.TLSVerify = &verify
+	}
+	return o, nil
+}
+
+/// Returns true if the image name `name` does not contain a registry, like
+/// `alpine:3` or `library/fedora`
+func isShortName(name string) bool {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return false
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return false
+	}
+	registry := reference.Domain(named)
+	return !strings.ContainsAny(registry, ".:") && registry != "localhost"
+}
+
+/// Parses the name `name` of an image in a registry.
+///
+/// Short names without a registry are resolved via the aliases in
+/// registries.conf of `sys`, names without an alias are normalized to
+/// docker.io.
+func resolveImageName(name string, sys *types.SystemContext) (reference.Named, error) {
+	if !isShortName(name) {
+		return reference.ParseNormalizedNamed(name)
+	}
+
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid image name: %s", name))
+	}
+
+	alias, _, err := sysregistriesv2.ResolveShortNameAlias(sys, named.Name())
+	if err != nil {
+		return nil, err
+	}
+	if alias == nil {
+		return reference.ParseNormalizedNamed(name)
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		if alias, err = reference.WithTag(alias, tagged.Tag()); err != nil {
+			return nil, err
+		}
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		if alias, err = reference.WithDigest(alias, digested.Digest()); err != nil {
+			return nil, err
+		}
+	}
+	return alias, nil
+}
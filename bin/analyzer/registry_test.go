@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryOptionsOverride(t *testing.T) {
+	verify := true
+	global := RegistryOptions{
+		Username: "ci", Password: "secret", AuthFile: "/etc/auth.json", TLSVerify: &verify, CertDir: "/etc/certs",
+	}
+
+	assert.Equal(t, global, global.Override(RegistryOptions{}))
+
+	noVerify := false
+	o := global.Override(RegistryOptions{Token: "token", TLSVerify: &noVerify})
+	assert.Equal(t, "", o.Username)
+	assert.Equal(t, "", o.Password)
+	assert.Equal(t, "token", o.Token)
+	assert.Equal(t, "/etc/auth.json", o.AuthFile)
+	assert.Equal(t, "/etc/certs", o.CertDir)
+	require.NotNil(t, o.TLSVerify)
+	assert.False(t, *o.TLSVerify)
+	assert.True(t, *global.TLSVerify)
+
+	o = RegistryOptions{Token: "token"}.Override(RegistryOptions{Username: "user", Password: "pw"})
+	assert.Equal(t, RegistryOptions{Username: "user", Password: "pw"}, o)
+}
+
+func TestRegistryOptionsSystemContext(t *testing.T) {
+	sys := RegistryOptions{}.SystemContext()
+	assert.Equal(t, &types.SystemContext{}, sys)
+
+	noVerify := false
+	sys = RegistryOptions{
+		Username: "user", Password: "pw", AuthFile: "auth.json", TLSVerify: &noVerify, CertDir: "certs", RegistriesConf: "registries.conf",
+	}.SystemContext()
+	assert.Equal(t, &types.DockerAuthConfig{Username: "user", Password: "pw"}, sys.DockerAuthConfig)
+	assert.Equal(t, "auth.json", sys.AuthFilePath)
+	assert.Equal(t, types.OptionalBoolTrue, sys.DockerInsecureSkipTLSVerify)
+	assert.Equal(t, "certs", sys.DockerCertPath)
+	assert.Equal(t, "registries.conf", sys.SystemRegistriesConfPath)
+
+	sys = RegistryOptions{Token: "token"}.SystemContext()
+	assert.Nil(t, sys.DockerAuthConfig)
+	assert.Equal(t, "token", sys.DockerBearerRegistryToken)
+}
+
+func TestCredentialsAreNotExposed(t *testing.T) {
+	o := RegistryOptions{Username: "user", Password: "hunter2", Token: "sometoken"}
+	assert.NotContains(t, o.String(), "hunter2")
+	assert.NotContains(t, o.String(), "sometoken")
+	assert.NotContains(t, fmt.Sprintf("%v", o), "hunter2")
+
+	j, err := json.Marshal(o)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(j))
+
+	task, err := newTask("dir:"+t.TempDir(), true, o)
+	require.NoError(t, err)
+	defer task.Cleanup()
+	j, err = json.Marshal(task)
+	require.NoError(t, err)
+	assert.NotContains(t, string(j), "hunter2")
+	assert.NotContains(t, string(j), "sometoken")
+
+	// the text formatter of logrus prints the fields of the task
+	assert.NotContains(t, fmt.Sprintf("%v", task), "hunter2")
+	assert.NotContains(t, fmt.Sprintf("%+v", task), "sometoken")
+}
+
+func TestParseCredentials(t *testing.T) {
+	for creds, expected := range map[string][2]string{
+		"user":         {"user", ""},
+		"user:pw":      {"user", "pw"},
+		"user:pw:with": {"user", "pw:with"},
+	} {
+		username, password, err := ParseCredentials(creds)
+		require.NoError(t, err, creds)
+		assert.Equal(t, expected[0], username, creds)
+		assert.Equal(t, expected[1], password, creds)
+	}
+
+	_, _, err := ParseCredentials(":pw")
+	assert.Error(t, err)
+}
+
+func TestRegistryOptionsOfRequest(t *testing.T) {
+	request := func(values url.Values) *http.Request {
+		r, err := http.NewRequest("POST", "/task", strings.NewReader(values.Encode()))
+		require.NoError(t, err)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	o, err := registryOptionsOfRequest(request(url.Values{"username": {"user"}, "password": {"pw"}, "tls_verify": {"false"}}))
+	require.NoError(t, err)
+	assert.Equal(t, "user", o.Username)
+	assert.Equal(t, "pw", o.Password)
+	require.NotNil(t, o.TLSVerify)
+	assert.False(t, *o.TLSVerify)
+
+	o, err = registryOptionsOfRequest(request(url.Values{"registry_token": {"token"}}))
+	require.NoError(t, err)
+	assert.Equal(t, RegistryOptions{Token: "token"}, o)
+
+	// paths on the server cannot be set by clients
+	o, err = registryOptionsOfRequest(request(url.Values{"authfile": {"/etc/shadow"}, "cert_dir": {"/"}}))
+	require.NoError(t, err)
+	assert.Equal(t, RegistryOptions{}, o)
+
+	for _, values := range []url.Values{
+		{"password": {"pw"}},
+		{"username": {"user"}, "registry_token": {"token"}},
+		{"tls_verify": {"maybe"}},
+	} {
+		_, err = registryOptionsOfRequest(request(values))
+		assert.Error(t, err, values)
+	}
+}
+
+func TestResolveImageName(t *testing.T) {
+	tmp := t.TempDir()
+	registriesConf := filepath.Join(tmp, "registries.conf")
+	require.NoError(t, os.WriteFile(registriesConf, []byte(`
+[aliases]
+"myapp" = "registry.example.com/team/myapp"
+`), 0644))
+	sys := &types.SystemContext{
+		SystemRegistriesConfPath:    registriesConf,
+		SystemRegistriesConfDirPath: filepath.Join(tmp, "registries.conf.d"),
+		UserShortNameAliasConfPath:  filepath.Join(tmp, "short-name-aliases.conf"),
+	}
+
+	for name, expected := range map[string]string{
+		"myapp":                           "registry.example.com/team/myapp",
+		"myapp:1.0":                       "registry.example.com/team/myapp:1.0",
+		"busybox":                         "docker.io/library/busybox",
+		"library/busybox:1":               "docker.io/library/busybox:1",
+		"quay.io/myapp":                   "quay.io/myapp",
+		"localhost/myapp:2":               "localhost/myapp:2",
+		"registry.example.com:5000/myapp": "registry.example.com:5000/myapp",
+	} {
+		named, err := resolveImageName(name, sys)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, named.String(), name)
+	}
+
+	_, err := resolveImageName("Invalid Name", sys)
+	assert.Error(t, err)
+}
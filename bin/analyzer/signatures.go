@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// A signature of an image that has been verified by a key that the signature
+/// policy accepts
+type VerifiedSignature struct {
+	/// The image reference that has been signed
+	DockerReference string `json:"docker_reference"`
+
+	/// Digest of the signed manifest
+	ManifestDigest string `json:"manifest_digest"`
+
+	/// Short identifier of the key that created the signature
+	KeyIdentifier string `json:"key_identifier"`
+
+	/// The tool that created the signature, if recorded in the signature
+	Creator string `json:"creator,omitempty"`
+
+	/// Time when the signature was created, if recorded in the signature
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+/// The result of checking an image against the signature policy
+type SignatureVerification struct {
+	/// Path to the policy.json, empty if the default policy of the system was
+	/// used
+	Policy string `json:"policy"`
+
+	/// true if the policy accepts the image
+	Allowed bool `json:"allowed"`
+
+	/// true if at least one signature of the image has been verified
+	Verified bool `json:"verified"`
+
+	/// Digest of the manifest that has been checked, the layers of exactly
+	/// this manifest are analyzed
+	ManifestDigest string `json:"manifest_digest"`
+
+	/// The signatures that have been verified
+	Signatures []VerifiedSignature `json:"signatures"`
+}
+
+/// Reads the signature policy from `policyPath`, or the default policy of the
+/// system if it is empty
+func loadSignaturePolicy(policyPath string) (*signature.Policy, error) {
+	if policyPath == "" {
+		return signature.DefaultPolicy(nil)
+	}
+	return signature.NewPolicyFromFile(policyPath)
+}
+
+/// Policy that accepts every image, used for copying images that have already
+/// been checked
+func acceptAnythingPolicy() *signature.Policy {
+	return &signature.Policy{
+		Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+	}
+}
+
+/// Checks the image `img` against the signature policy at `policyPath` (the
+/// default policy if it is empty) and reports its verified signatures.
+///
+/// An error is returned if the policy rejects the image, e.g. because it
+/// requires signatures that the image lacks. The returned verification is
+/// valid nevertheless.
+func VerifySignatures(ctx context.Context, img types.UnparsedImage, policyPath string) (SignatureVerification, error) {
+	verification := SignatureVerification{Policy: policyPath, Signatures: make([]VerifiedSignature, 0)}
+
+	policy, err := loadSignaturePolicy(policyPath)
+	if err != nil {
+		return verification, err
+	}
+	policyCtx, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return verification, err
+	}
+	defer policyCtx.Destroy()
+
+	rawManifest, _, err := img.Manifest(ctx)
+	if err != nil {
+		return verification, err
+	}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return verification, err
+	}
+	verification.ManifestDigest = manifestDigest.String()
+
+	if allowed, err := policyCtx.IsRunningImageAllowed(ctx, img); !allowed {
+		return verification, errors.New(fmt.Sprintf("The image is rejected by the signature policy: %s", err))
+	}
+	verification.Allowed = true
+
+	accepted, err := policyCtx.GetSignaturesWithAcceptedAuthor(ctx, img)
+	if err != nil {
+		return verification, err
+	}
+	if len(accepted) == 0 {
+		return verification, nil
+	}
+
+	// the accepted signatures do not contain the key, it is read from the
+	// signature with the same contents
+	rawSignatures, err := img.Signatures(ctx)
+	if err != nil {
+		return verification, err
+	}
+	for _, raw := range rawSignatures {
+		info, err := signature.GetUntrustedSignatureInformationWithoutVerifying(raw)
+		if err != nil {
+			continue
+		}
+		for _, sig := range accepted {
+			if sig.DockerManifestDigest != info.UntrustedDockerManifestDigest || sig.DockerReference != info.UntrustedDockerReference {
+				continue
+			}
+			verified := VerifiedSignature{
+				DockerReference: sig.DockerReference,
+				ManifestDigest:  sig.DockerManifestDigest.String(),
+				KeyIdentifier:   info.UntrustedShortKeyIdentifier,
+				Timestamp:       info.UntrustedTimestamp,
+			}
+			if info.UntrustedCreatorID != nil {
+				verified.Creator = *info.UntrustedCreatorID
+			}
+			verification.Signatures = append(verification.Signatures, verified)
+			break
+		}
+	}
+	verification.Verified = len(verification.Signatures) > 0
+
+	log.WithFields(logrus.Fields{
+		"reference": img.Reference().StringWithinTransport(), "signatures": len(verification.Signatures),
+	}).Debug("Verified the signatures of the image")
+
+	return verification, nil
+}
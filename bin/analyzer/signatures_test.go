@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/// Image whose manifest and signatures are read from the files of the signed
+/// test image, referenced as docker.io/testing/manifest:latest
+type testSignedImage struct {
+	ref        types.ImageReference
+	signatures [][]byte
+}
+
+func newTestSignedImage(t *testing.T, signatureFiles ...string) *testSignedImage {
+	ref, err := docker.ParseReference("//testing/manifest:latest")
+	require.NoError(t, err)
+
+	img := testSignedImage{ref: ref}
+	for _, f := range signatureFiles {
+		sig, err := os.ReadFile(f)
+		require.NoError(t, err)
+		img.signatures = append(img.signatures, sig)
+	}
+	return &img
+}
+
+func (i *testSignedImage) Reference() types.ImageReference {
+	return i.ref
+}
+
+func (i *testSignedImage) Manifest(ctx context.Context) ([]byte, string, error) {
+	m, err := os.ReadFile(filepath.Join("testdata", "signed-image", "manifest.json"))
+	return m, "application/vnd.docker.distribution.manifest.v2+json", err
+}
+
+func (i *testSignedImage) Signatures(ctx context.Context) ([][]byte, error) {
+	return i.signatures, nil
+}
+
+func writePolicy(t *testing.T, policy string) string {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyPath, []byte(policy), 0644))
+	return policyPath
+}
+
+const testManifestDigest = "sha256:20bf21ed457b390829cdbeec8795a7bea1626991fda603e0d01b4e7f60427e55"
+
+func TestVerifySignatures(t *testing.T) {
+	keyPath, err := filepath.Abs(filepath.Join("testdata", "signing-key.gpg"))
+	require.NoError(t, err)
+	signedBy := writePolicy(t, `{
+  "default": [{"type": "reject"}],
+  "transports": {
+    "docker": {
+      "docker.io/testing/manifest": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "`+keyPath+`"}]
+    }
+  }
+}`)
+	validSignature := filepath.Join("testdata", "signed-image", "signature-1")
+	unknownKeySignature := filepath.Join("testdata", "unknown-key.signature")
+
+	v, err := VerifySignatures(context.Background(), newTestSignedImage(t, validSignature), signedBy)
+	require.NoError(t, err)
+	assert.Equal(t, signedBy, v.Policy)
+	assert.True(t, v.Allowed)
+	assert.True(t, v.Verified)
+	assert.Equal(t, testManifestDigest, v.ManifestDigest)
+	require.Len(t, v.Signatures, 1)
+	assert.Equal(t, "DB72F2188BB46CC8", v.Signatures[0].KeyIdentifier)
+	assert.Equal(t, "testing/manifest:latest", v.Signatures[0].DockerReference)
+	assert.Equal(t, testManifestDigest, v.Signatures[0].ManifestDigest)
+
+	// signatures by unknown keys are ignored as long as one signature is valid
+	v, err = VerifySignatures(context.Background(), newTestSignedImage(t, unknownKeySignature, validSignature), signedBy)
+	require.NoError(t, err)
+	assert.True(t, v.Verified)
+	assert.Len(t, v.Signatures, 1)
+
+	for _, img := range []*testSignedImage{newTestSignedImage(t), newTestSignedImage(t, unknownKeySignature)} {
+		v, err = VerifySignatures(context.Background(), img, signedBy)
+		assert.Error(t, err)
+		assert.False(t, v.Allowed)
+		assert.False(t, v.Verified)
+		assert.Equal(t, testManifestDigest, v.ManifestDigest)
+	}
+
+	acceptAnything := writePolicy(t, `{"default": [{"type": "insecureAcceptAnything"}]}`)
+	v, err = VerifySignatures(context.Background(), newTestSignedImage(t), acceptAnything)
+	require.NoError(t, err)
+	assert.True(t, v.Allowed)
+	assert.False(t, v.Verified)
+	assert.Empty(t, v.Signatures)
+
+	_, err = VerifySignatures(context.Background(), newTestSignedImage(t), filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestStreamingTaskIsRejectedByPolicy(t *testing.T) {
+	imagePath, err := filepath.Abs(filepath.Join("testdata", "signed-image"))
+	require.NoError(t, err)
+
+	task, err := newTask("dir:"+imagePath, true, RegistryOptions{})
+	require.NoError(t, err)
+	defer task.Cleanup()
+	task.signaturePolicy = writePolicy(t, `{"default": [{"type": "reject"}]}`)
+	// the image info is already known, so that only the manifest is read
+	task.Image.ImageInfo = &types.ImageInspectInfo{}
+
+	task.Process()
+	assert.Equal(t, TaskState(TaskStateError), task.GetState())
+	assert.Error(t, task.Err())
+	require.NotNil(t, task.Signature)
+	assert.False(t, task.Signature.Allowed)
+	assert.Equal(t, testManifestDigest, task.Signature.ManifestDigest)
+}
+
+func TestVerifiedRemoteReferenceIsPinnedToTheManifestDigest(t *testing.T) {
+	task, err := NewStreamingTask("docker://docker.io/library/alpine:3.15")
+	require.NoError(t, err)
+	defer task.Cleanup()
+
+	_, err = task.verifiedRemoteReference()
+	assert.Error(t, err)
+
+	task.Signature = &SignatureVerification{ManifestDigest: testManifestDigest}
+	ref, err := task.verifiedRemoteReference()
+	require.NoError(t, err)
+	assert.Equal(t, "//docker.io/library/alpine@"+testManifestDigest, ref.StringWithinTransport())
+
+	imagePath, err := filepath.Abs(filepath.Join("testdata", "signed-image"))
+	require.NoError(t, err)
+	local, err := newTask("dir:"+imagePath, true, RegistryOptions{})
+	require.NoError(t, err)
+	defer local.Cleanup()
+
+	ref, err = local.verifiedRemoteReference()
+	require.NoError(t, err)
+	assert.Equal(t, local.Image.remoteReference, ref)
+}
+
+func TestPrintSignatureVerification(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, PrintSignatureVerification(&out, nil))
+	assert.Equal(t, "The signatures of the image have not been checked\n", out.String())
+
+	out.Reset()
+	require.NoError(t, PrintSignatureVerification(&out, &SignatureVerification{ManifestDigest: "sha256:aaaa"}))
+	assert.Equal(t, "The image sha256:aaaa is rejected by the default policy\n", out.String())
+
+	out.Reset()
+	require.NoError(t, PrintSignatureVerification(&out, &SignatureVerification{
+		Policy: "/etc/policy.json", Allowed: true, ManifestDigest: "sha256:aaaa",
+	}))
+	assert.Equal(t, "The image sha256:aaaa is accepted by /etc/policy.json without a verified signature\n", out.String())
+
+	out.Reset()
+	signed := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, PrintSignatureVerification(&out, &SignatureVerification{
+		Policy: "/etc/policy.json", Allowed: true, Verified: true, ManifestDigest: "sha256:aaaa",
+		Signatures: []VerifiedSignature{
+			{KeyIdentifier: "DB72F2188BB46CC8", DockerReference: "example.com/app:1", Timestamp: &signed},
+			{KeyIdentifier: "0123456789ABCDEF", DockerReference: "example.com/app:1"},
+		},
+	}))
+	assert.Equal(t, `The image sha256:aaaa is accepted by /etc/policy.json and signed by:
+  key DB72F2188BB46CC8 for example.com/app:1 at 2022-03-01T12:00:00Z
+  key 0123456789ABCDEF for example.com/app:1
+`, out.String())
+}
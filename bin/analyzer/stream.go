@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+
+	"github.com/opencontainers/go-digest"
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// Reader that records the number of read bytes of a layer in the pull
+/// progress of a task
+type progressReader struct {
+	r        io.Reader
+	t        *Task
+	digest   string
+	size     int64
+	progress uint64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.progress += uint64(n)
+	p.t.setPullProgress(p.digest, LayerDownloadProgress{
+		TotalSize:  p.size,
+		Downloaded: p.progress,
+	})
+	return n, err
+}
+
+/// Analyzes the layers of the task's image by streaming them directly from
+/// the image source, without storing the image on disk.
+///
+/// The compression of each layer is detected from its contents, as some
+/// transports (e.g. docker-archive) report a media type that does not match
+/// the blob.
+///
+/// Errors are reported via `setError`, `ok` is false if the task did not
+/// succeed.
+func (t *Task) streamLayers(setError func(error)) (manifest Manifest, layers internal.LayerSizes, history []internal.HistoryStep, ok bool) {
+	sys := t.registry.SystemContext()
+
+	imgSrc, err := t.Image.remoteReference.NewImageSource(t.ctx, sys)
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+	defer imgSrc.Close()
+
+	// the manifest is only fetched once, so that the layers of exactly the
+	// checked image are analyzed: every layer is verified against the digest
+	// in this manifest by streamLayer (or has been so before it was cached)
+	unparsed := image.UnparsedInstance(imgSrc, (*digest.Digest)(t.Image.RemoteDigest))
+	if err := t.verifySignatures(unparsed); err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+
+	img, err := image.FromUnparsedImage(t.ctx, sys, unparsed)
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+
+	configInfo := img.ConfigInfo()
+	manifest = Manifest{
+		SchemaVersion: 2,
+		Config: ExtractedDigest{
+			MediaType: configInfo.MediaType,
+			Size:      int(configInfo.Size),
+			Digest:    configInfo.Digest.String(),
+		},
+	}
+	layerInfos := img.LayerInfos()
+	manifest.Layers = LayersOfBlobInfos(layerInfos)
+
+	config, err := img.OCIConfig(t.ctx)
+	if err != nil {
+		setError(err)
+		return manifest, nil, nil, false
+	}
+	history = internal.NewHistory(config.History, LayerDigestsOfManifest(manifest))
+
+	workers := t.layerWorkers
+	if !imgSrc.HasThreadSafeGetBlob() {
+		workers = 1
+	}
+
+	t.setState(TaskStateAnalyzing)
+	analyzed, err := analyzeLayersConcurrently(
+		t.ctx, len(layerInfos), workers,
+		func(ctx context.Context, i int) (internal.Layer, error) {
+			info := layerInfos[i]
+			layer, cached, err := analyzeLayerCached(t.layerCache, info.Digest.String(), t.analysisOptions(), func() (internal.Layer, error) {
+				return t.streamLayer(ctx, imgSrc, info)
+			})
+			if cached {
+				// the layer did not have to be downloaded at all
+				t.setPullProgress(info.Digest.String(), LayerDownloadProgress{
+					TotalSize:  info.Size,
+					Downloaded: uint64(info.Size),
+				})
+			}
+			return layer, err
+		},
+	)
+	if err != nil {
+		if ctxErr := t.ctx.Err(); ctxErr != nil {
+			setError(ctxErr)
+		} else {
+			setError(err)
+		}
+		return manifest, nil, nil, false
+	}
+
+	layers = make(internal.LayerSizes, len(layerInfos))
+	for i, info := range layerInfos {
+		layers[info.Digest.Hex()] = analyzed[i]
+	}
+	SetCreatedByOfLayers(history, layers)
+
+	AccountHardlinksOfManifest(manifest, layers)
+
+	return manifest, layers, history, true
+}
+
+/// Fetches the layer blob `info` from `imgSrc` and analyzes it on the fly.
+///
+/// The blob is verified against `info.Digest` like it is done when pulling
+/// the image, the analysis fails if the contents do not match the digest.
+func (t *Task) streamLayer(ctx context.Context, imgSrc types.ImageSource, info types.BlobInfo) (internal.Layer, error) {
+	log.WithFields(
+		logrus.Fields{"digest": info.Digest, "task": t},
+	).Debug("Streaming layer")
+
+	if err := info.Digest.Validate(); err != nil {
+		return internal.NewLayer(), err
+	}
+
+	blob, size, err := imgSrc.GetBlob(ctx, info, none.NoCache)
+	if err != nil {
+		return internal.NewLayer(), err
+	}
+	defer blob.Close()
+
+	verifier := info.Digest.Verifier()
+	r := bufio.NewReader(&progressReader{
+		r: io.TeeReader(blob, verifier), t: t, digest: info.Digest.String(), size: size,
+	})
+	compression, err := internal.DetectCompression(r)
+	if err != nil {
+		return internal.NewLayer(), err
+	}
+
+	layer, err := internal.AnalyzeLayer(ctx, r, compression, t.analysisOptions())
+	if err != nil {
+		return layer, err
+	}
+
+	// the tar reader stops at the end-of-archive marker, the remainder of the
+	// blob has to be read nevertheless to verify its digest
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return internal.NewLayer(), err
+	}
+	if !verifier.Verified() {
+		return internal.NewLayer(), errors.New(
+			fmt.Sprintf("The contents of the layer %s do not match its digest", info.Digest),
+		)
+	}
+
+	return layer, nil
+}
+
+/// Sets the command that created each layer in `layers` from the build steps
+/// `history`.
+///
+/// Layers that are created by more than one step, as they share the same
+/// digest, get the command of the first of these steps.
+func SetCreatedByOfLayers(history []internal.HistoryStep, layers internal.LayerSizes) {
+	assigned := make(map[string]bool, len(layers))
+	for _, step := range history {
+		if step.Layer == "" || assigned[step.Layer] {
+			continue
+		}
+		layer, ok := layers[step.Layer]
+		if !ok {
+			log.WithFields(
+				logrus.Fields{"digest": step.Layer},
+			).Error("Image history refers to a layer that has not been analyzed")
+			continue
+		}
+		layer.CreatedBy = step.CreatedBy
+		layers[step.Layer] = layer
+		assigned[step.Layer] = true
+	}
+}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
 	"github.com/containers/storage/pkg/reexec"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	internal "github.com/dcermak/container-layer-sizes/pkg"
 	"github.com/stretchr/testify/assert"
@@ -124,12 +137,13 @@ type ImageSizeSuite struct {
 	suite.Suite
 	imagePath   string
 	expectedTag string
+	stream      bool
 	task        *Task
 }
 
 func (s *ImageSizeSuite) SetupSuite() {
 	var err error
-	s.task, err = NewTask(s.imagePath)
+	s.task, err = newTask(s.imagePath, s.stream, RegistryOptions{})
 	require.NoErrorf(s.T(), err, "Expected to create the task with the image %s, but got %s", s.imagePath, err)
 }
 
@@ -153,20 +167,42 @@ func (s *ImageSizeSuite) TestCreatedSizes() {
 	}
 
 	assert.Equal(s.T(), 1, layerCount)
-	createdBy := (*s.task.Image.layers)[layerDigest].CreatedBy
+	layer := (*s.task.Image.layers)[layerDigest]
+
+	// all files in the test images are regular files
+	layer.WalkFiles(func(filePath string, size int64) {
+		info := layer.FindSubdir(filepath.Dir(filePath)).FileInfos[filepath.Base(filePath)]
+		assert.Equalf(s.T(), internal.FileTypeRegular, info.Type, "%s is not a regular file", filePath)
+	})
 
 	if s.expectedTag == "3.0" {
 		assert.Equal(s.T(), internal.Layer{
 			Dir:       rootDir,
-			CreatedBy: createdBy,
-		}, (*s.task.Image.layers)[layerDigest])
+			CreatedBy: layer.CreatedBy,
+		}, internal.Layer{Dir: withoutFileInfos(layer.Dir), CreatedBy: layer.CreatedBy})
 	} else {
 		assert.Equal(s.T(), internal.Layer{
 			Dir:       subDir,
-			CreatedBy: createdBy,
-		}, (*s.task.Image.layers)[layerDigest])
+			CreatedBy: layer.CreatedBy,
+		}, internal.Layer{Dir: withoutFileInfos(layer.Dir), CreatedBy: layer.CreatedBy})
 	}
 
+	// the images consist of a single layer without whiteouts
+	require.NotNil(s.T(), s.task.Image.mergedRoot)
+	assert.Equal(s.T(), (*s.task.Image.layers)[layerDigest].Dir, *s.task.Image.mergedRoot)
+}
+
+/// Returns a copy of `d` without the metadata of the files
+func withoutFileInfos(d internal.Dir) internal.Dir {
+	res := internal.MakeDir(d.DirName)
+	res.TotalSize = d.TotalSize
+	for fname, size := range d.Files {
+		res.Files[fname] = size
+	}
+	for dirname, subdir := range d.Directiories {
+		res.Directiories[dirname] = withoutFileInfos(subdir)
+	}
+	return res
 }
 
 func (s *ImageSizeSuite) TestImageMetadata() {
@@ -191,13 +227,17 @@ func TestIntegration(t *testing.T) {
 	}
 
 	for _, tag := range []string{"3.0", "latest"} {
-		s := *new(ImageSizeSuite)
-		s.expectedTag = tag
-		s.imagePath = strings.ReplaceAll(
+		archivePath := strings.ReplaceAll(
 			fmt.Sprintf("docker-archive:%s/%s/testimage.tar.gz", dir, tag),
 			"//", "/",
 		)
-		suite.Run(t, &s)
+		for _, stream := range []bool{false, true} {
+			s := *new(ImageSizeSuite)
+			s.expectedTag = tag
+			s.imagePath = archivePath
+			s.stream = stream
+			suite.Run(t, &s)
+		}
 
 		for _, img := range []string{
 			// FIXME: re-enable oci image support again
@@ -242,3 +282,347 @@ func TestGetNameTagFromUrlWithDigest(t *testing.T) {
 	assert.Equal(t, "", tag)
 	assert.Equal(t, expectedDigest, *digest)
 }
+
+type testFile struct {
+	name     string
+	contents []byte
+}
+
+var testFileModTime = time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+/// Returns the tar header that `createTarArchive` uses for `f`
+func (f testFile) header() *tar.Header {
+	return &tar.Header{
+		Name:     f.name,
+		Mode:     0644,
+		Size:     int64(len(f.contents)),
+		Typeflag: tar.TypeReg,
+		ModTime:  testFileModTime,
+	}
+}
+
+/// Creates an uncompressed tar archive containing `files`
+func createTarArchive(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		require.NoError(t, tw.WriteHeader(f.header()))
+		_, err := tw.Write(f.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+/// Compresses `data` with the compression matching `mediaType`
+func compressLayer(t *testing.T, mediaType string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		w = gzip.NewWriter(&buf)
+	case strings.HasSuffix(mediaType, "zstd"):
+		w, err = zstd.NewWriter(&buf)
+		require.NoError(t, err)
+	default:
+		return data
+	}
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCalculateContainerLayerSizesMediaTypes(t *testing.T) {
+	files := []testFile{
+		{name: "etc/os-release", contents: []byte("NAME=test")},
+		{name: "usr/bin/foo", contents: bytes.Repeat([]byte("a"), 1024)},
+	}
+	expected := internal.NewLayer()
+	for _, f := range files {
+		expected.InsertIntoDir(f.name, int64(len(f.contents)))
+	}
+
+	layer := createTarArchive(t, files)
+
+	for i, mediaType := range []string{
+		ispec.MediaTypeImageLayer,
+		ispec.MediaTypeImageLayerGzip,
+		ispec.MediaTypeImageLayerZstd,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		manifest.DockerV2SchemaLayerMediaTypeUncompressed,
+		manifest.DockerV2Schema2LayerMediaType,
+		manifest.DockerV2Schema2ForeignLayerMediaTypeGzip,
+	} {
+		dest := t.TempDir()
+		blobDir := filepath.Join(dest, "blobs", "sha256")
+		require.NoError(t, os.MkdirAll(blobDir, 0755))
+
+		hash := fmt.Sprintf("%064d", i)
+		blob := compressLayer(t, mediaType, layer)
+		require.NoError(t, os.WriteFile(filepath.Join(blobDir, hash), blob, 0644))
+
+		layers, err := CalculateContainerLayerSizes(dest, Manifest{
+			Layers: []ExtractedDigest{{MediaType: mediaType, Digest: "sha256:" + hash}},
+		}, nil, DefaultLayerWorkers, nil, internal.LayerAnalysisOptions{})
+		require.NoErrorf(t, err, "Failed to analyze a layer with the media type %s", mediaType)
+
+		res := layers[hash]
+		assert.Equalf(t, expected.Dir, withoutFileInfos(res.Dir), "Invalid layer contents for the media type %s", mediaType)
+
+		for _, f := range files {
+			_, info, ok := res.FindFile(f.name)
+			assert.True(t, ok)
+			assert.Equal(t, internal.FileTypeRegular, info.Type)
+			assert.Equal(t, testFileModTime, info.ModTime)
+			assert.Greater(t, info.EstimatedCompressedSize, int64(0))
+		}
+
+		assert.Equal(t, int64(len(blob)), res.CompressedSize)
+		assert.Equal(t, int64(len(layer)), res.UncompressedSize)
+		assert.Equal(t, expected.TotalSize, res.PayloadSize)
+		assert.Equal(t, res.UncompressedSize-res.PayloadSize, res.TarOverhead)
+		assert.Greater(t, res.EstimatedCompressedSize, int64(0))
+		if strings.HasSuffix(mediaType, "tar") {
+			assert.Equal(t, expected.TotalSize, res.EstimatedCompressedSize)
+		} else {
+			// 1024 times the same character compresses well
+			assert.Less(t, res.EstimatedCompressedSize, expected.TotalSize)
+		}
+	}
+}
+
+func TestCalculateContainerLayerSizesIsDeterministic(t *testing.T) {
+	dest := t.TempDir()
+	blobDir := filepath.Join(dest, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobDir, 0755))
+
+	var m Manifest
+	for i := 0; i < 16; i++ {
+		files := []testFile{
+			{name: fmt.Sprintf("layer%d/file", i), contents: bytes.Repeat([]byte("a"), 512*(i+1))},
+			{name: "common/file", contents: bytes.Repeat([]byte("b"), i)},
+		}
+		hash := fmt.Sprintf("%064d", i)
+		blob := compressLayer(t, ispec.MediaTypeImageLayerGzip, createTarArchive(t, files))
+		require.NoError(t, os.WriteFile(filepath.Join(blobDir, hash), blob, 0644))
+		m.Layers = append(m.Layers, ExtractedDigest{MediaType: ispec.MediaTypeImageLayerGzip, Digest: "sha256:" + hash})
+	}
+
+	sequential, err := CalculateContainerLayerSizes(dest, m, nil, 1, nil, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+	assert.Len(t, sequential, 16)
+
+	for _, workers := range []int{2, 5, 16, 32} {
+		concurrent, err := CalculateContainerLayerSizes(dest, m, nil, workers, nil, internal.LayerAnalysisOptions{})
+		require.NoError(t, err)
+		assert.Equalf(t, sequential, concurrent, "Got different results with %d workers", workers)
+		assert.Equal(t, MergeLayersOfManifest(m, sequential), MergeLayersOfManifest(m, concurrent))
+	}
+}
+
+func TestCalculateContainerLayerSizesUsesCache(t *testing.T) {
+	dest := t.TempDir()
+	blobDir := filepath.Join(dest, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobDir, 0755))
+
+	cache, err := internal.CreateLayerCache(filepath.Join(t.TempDir(), "cache.sqlite3"), 0)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	var m Manifest
+	for i, files := range [][]testFile{
+		{{name: "usr/bin/foo", contents: bytes.Repeat([]byte("a"), 1024)}},
+		{{name: "usr/bin/bar", contents: []byte("bar")}},
+	} {
+		hash := fmt.Sprintf("%064d", i)
+		blob := compressLayer(t, ispec.MediaTypeImageLayerZstd, createTarArchive(t, files))
+		require.NoError(t, os.WriteFile(filepath.Join(blobDir, hash), blob, 0644))
+		m.Layers = append(m.Layers, ExtractedDigest{MediaType: ispec.MediaTypeImageLayerZstd, Digest: "sha256:" + hash})
+	}
+
+	uncached, err := CalculateContainerLayerSizes(dest, m, nil, 2, cache, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+	// only layers analyzed from their source blob are cached
+	assert.False(t, allLayersCached(cache, []string{m.Layers[0].Digest}))
+	for i, digest := range LayerDigestsOfManifest(m) {
+		require.NoError(t, cache.Put(m.Layers[i].Digest, uncached[digest]))
+	}
+
+	// the layers must not be read again
+	require.NoError(t, os.RemoveAll(blobDir))
+
+	cached, err := CalculateContainerLayerSizes(dest, m, nil, 2, cache, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, uncached, cached)
+
+	// the cached layers lack the digests of the files and have to be analyzed
+	// again, which fails without the blobs
+	_, err = CalculateContainerLayerSizes(dest, m, nil, 2, cache, internal.LayerAnalysisOptions{HashContents: true})
+	assert.Error(t, err)
+
+	assert.False(t, allLayersCached(cache, []string{m.Layers[0].Digest, "sha256:unknown"}))
+	assert.False(t, allLayersCached(nil, []string{m.Layers[0].Digest}))
+}
+
+func TestCalculateContainerLayerSizesUsesSourceLayers(t *testing.T) {
+	dest := t.TempDir()
+	blobDir := filepath.Join(dest, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobDir, 0755))
+
+	cache, err := internal.CreateLayerCache(filepath.Join(t.TempDir(), "cache.sqlite3"), 0)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	layer := createTarArchive(t, []testFile{
+		{name: "usr/bin/foo", contents: bytes.Repeat([]byte("foo"), 1024)},
+	})
+
+	// the layer is gzip compressed in the source but zstd compressed in the
+	// oci layout
+	hash := fmt.Sprintf("%064d", 0)
+	blob := compressLayer(t, ispec.MediaTypeImageLayerZstd, layer)
+	require.NoError(t, os.WriteFile(filepath.Join(blobDir, hash), blob, 0644))
+	m := Manifest{Layers: []ExtractedDigest{{MediaType: ispec.MediaTypeImageLayerZstd, Digest: "sha256:" + hash}}}
+
+	sourceBlob := compressLayer(t, ispec.MediaTypeImageLayerGzip, layer)
+	source, err := internal.AnalyzeLayer(context.Background(), bytes.NewReader(sourceBlob), internal.CompressionGzip, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+
+	sourceLayers := []ExtractedDigest{{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Size:      len(sourceBlob),
+		Digest:    "sha256:" + fmt.Sprintf("%064d", 1),
+	}}
+	layers, err := CalculateContainerLayerSizes(dest, m, sourceLayers, 1, cache, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+	sourceHash := fmt.Sprintf("%064d", 1)
+	require.Contains(t, layers, sourceHash)
+	assert.NotContains(t, layers, hash)
+	assert.Equal(t, int64(len(sourceBlob)), layers[sourceHash].CompressedSize)
+	assert.Equal(t, source.EstimatedCompressedSize, layers[sourceHash].EstimatedCompressedSize)
+
+	// the layer has not been analyzed from the source blob
+	assert.False(t, allLayersCached(cache, []string{sourceLayers[0].Digest}))
+	assert.False(t, allLayersCached(cache, []string{m.Layers[0].Digest}))
+
+	// but a layer that has been streamed from the source is used
+	require.NoError(t, cache.Put(sourceLayers[0].Digest, source))
+	require.NoError(t, os.RemoveAll(blobDir))
+	cached, err := CalculateContainerLayerSizes(dest, m, sourceLayers, 1, cache, internal.LayerAnalysisOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, source.CompressedSize, cached[sourceHash].CompressedSize)
+
+	_, err = CalculateContainerLayerSizes(dest, m, []ExtractedDigest{}, 1, cache, internal.LayerAnalysisOptions{})
+	assert.Error(t, err)
+}
+
+func TestAnalyzeLayersConcurrentlyReturnsErrorOfFirstFailingLayer(t *testing.T) {
+	for _, workers := range []int{1, 3, 10} {
+		_, err := analyzeLayersConcurrently(
+			context.Background(), 10, workers,
+			func(ctx context.Context, i int) (internal.Layer, error) {
+				if i == 7 || i == 3 {
+					return internal.NewLayer(), fmt.Errorf("layer %d is broken", i)
+				}
+				return internal.NewLayer(), ctx.Err()
+			},
+		)
+		assert.EqualError(t, err, "layer 3 is broken")
+	}
+}
+
+func TestTaskQueueConcurrentAccess(t *testing.T) {
+	tq := NewTaskQueue(2, nil, "", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, task, err := tq.AddTask("docker://docker.io/library/alpine:3.15", true, RegistryOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, 2, task.layerWorkers)
+
+			got, err := tq.GetTask(id)
+			require.NoError(t, err)
+			assert.Same(t, task, got)
+			assert.Equal(t, TaskState(TaskStateNew), got.GetState())
+
+			assert.NoError(t, tq.RemoveTask(id))
+			assert.Error(t, tq.RemoveTask(id))
+		}()
+	}
+	wg.Wait()
+
+	assert.Empty(t, tq.tasks)
+}
+
+func TestLayerCompressionInvalidMediaType(t *testing.T) {
+	_, err := LayerCompression("application/vnd.oci.image.layer.v1.tar+bzip2")
+	assert.Error(t, err)
+}
+
+func TestStreamingTaskHasNoLocalReferences(t *testing.T) {
+	task, err := NewStreamingTask("docker://docker.io/library/alpine:3.15")
+	require.NoError(t, err)
+	defer task.Cleanup()
+
+	assert.True(t, task.Stream)
+	assert.Equal(t, "docker.io/library/alpine", task.Image.Image)
+	assert.Equal(t, "3.15", task.Image.Tag)
+	assert.NotNil(t, task.Image.remoteReference)
+	assert.Nil(t, task.Image.localReference)
+	assert.Nil(t, task.Image.ociLocalReference)
+	assert.Equal(t, "", task.tempdir)
+}
+
+func TestSetCreatedByOfLayers(t *testing.T) {
+	history := internal.NewHistory([]ispec.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{CreatedBy: "RUN zypper -n in python3"},
+		{CreatedBy: "RUN mkdir -p /app"},
+		{CreatedBy: "LABEL foo=bar", EmptyLayer: true},
+	}, []string{"base", "python", "base"})
+
+	layers := internal.LayerSizes{"base": internal.NewLayer(), "python": internal.NewLayer()}
+	SetCreatedByOfLayers(history, layers)
+
+	assert.Equal(t, "ADD rootfs.tar /", layers["base"].CreatedBy)
+	assert.Equal(t, "RUN zypper -n in python3", layers["python"].CreatedBy)
+}
+
+/// Image source that only serves the blob `blob`
+type blobImageSource struct {
+	types.ImageSource
+	blob []byte
+}
+
+func (s blobImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	return io.NopCloser(bytes.NewReader(s.blob)), int64(len(s.blob)), nil
+}
+
+func TestStreamLayerVerifiesDigest(t *testing.T) {
+	blob := compressLayer(t, ispec.MediaTypeImageLayerGzip, createTarArchive(t, []testFile{
+		{name: "bin/sh", contents: bytes.Repeat([]byte{'a'}, 1024)},
+	}))
+	task := &Task{PullProgress: make(map[string]LayerDownloadProgress)}
+
+	layer, err := task.streamLayer(
+		context.Background(), blobImageSource{blob: blob},
+		types.BlobInfo{Digest: digest.FromBytes(blob)},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), layer.PayloadSize)
+	assert.Equal(t, uint64(len(blob)), task.PullProgress[digest.FromBytes(blob).String()].Downloaded)
+
+	_, err = task.streamLayer(
+		context.Background(), blobImageSource{blob: blob},
+		types.BlobInfo{Digest: digest.FromString("something else")},
+	)
+	assert.ErrorContains(t, err, "do not match its digest")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/reference"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	logrus "github.com/sirupsen/logrus"
+)
+
+/// Annotation with the full name of an image in OCI layouts exported by
+/// containerd
+const containerdImageNameAnnotation = "io.containerd.image.name"
+
+/// Characters that are not allowed in the name of an image
+var invalidImageNameChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+/// Infers the name of the image with the reference `ref` from a transport
+/// that reads the image from a local file or the local docker daemon: oci,
+/// oci-archive, dir and docker-daemon.
+///
+/// The name may include a tag or a digest, see parseLocalImageName. For OCI
+/// layouts the name is taken from the annotations of the manifest in the
+/// layout's index, an org.opencontainers.image.ref.name that is only a tag is
+/// combined with the name of the layout. Images without any name are named
+/// after their path.
+func inferLocalImageName(ref types.ImageReference) (string, error) {
+	transportName := ref.Transport().Name()
+
+	switch transportName {
+	case "docker-daemon":
+		if dockerRef := ref.DockerReference(); dockerRef != nil {
+			return dockerRef.String(), nil
+		}
+		return "", errors.New("Images in the docker daemon must be referenced by their name")
+	case "dir":
+		return imageNameOfPath(ref.StringWithinTransport()), nil
+	case "oci", "oci-archive":
+		layoutPath, refName := ref.StringWithinTransport(), ""
+		if parts := strings.SplitN(layoutPath, ":", 2); len(parts) == 2 {
+			layoutPath, refName = parts[0], parts[1]
+		}
+
+		var index *ispec.Index
+		var err error
+		if transportName == "oci" {
+			index, err = readOciIndex(layoutPath)
+		} else {
+			index, err = readOciIndexFromArchive(layoutPath)
+		}
+		if err != nil {
+			// the name is not essential, the analysis fails anyway if the
+			// layout cannot be read
+			log.WithFields(logrus.Fields{
+				"path": layoutPath, "error": err,
+			}).Warn("Failed to read the index of the OCI layout")
+		} else if name := imageNameOfOciIndex(index, refName); name != "" {
+			refName = name
+		}
+
+		if refName == "" {
+			return imageNameOfPath(layoutPath), nil
+		}
+		// a reference name without a repository is only a tag
+		if !strings.ContainsAny(refName, "/:") {
+			return imageNameOfPath(layoutPath) + ":" + refName, nil
+		}
+		// the tag must not be taken from the url, which contains the path
+		if !strings.Contains(refName[strings.LastIndex(refName, "/")+1:], ":") {
+			refName += ":latest"
+		}
+		return refName, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Unsupported transport %s", transportName))
+	}
+}
+
+/// Splits the image name `imageName` as returned by inferLocalImageName into
+/// its name, tag and digest. The name may contain a registry with a port and
+/// is returned as written in `imageName`, i.e. it is not normalized.
+func parseLocalImageName(imageName string) (name string, tag string, digest *string, err error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", "", nil, errors.New(
+			fmt.Sprintf("Invalid image name %s: %s", imageName, err),
+		)
+	}
+
+	name = imageName
+	if digested, ok := named.(reference.Digested); ok {
+		d := digested.Digest().String()
+		digest = &d
+		name = strings.TrimSuffix(name, "@"+d)
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+		name = strings.TrimSuffix(name, ":"+tag)
+	}
+	return name, tag, digest, nil
+}
+
+/// Returns the name of the image that is referenced by `refName` in `index`
+/// from the annotations of its manifest, `refName` may be empty if the index
+/// contains only a single manifest.
+///
+/// An empty string is returned if the manifest has no name.
+func imageNameOfOciIndex(index *ispec.Index, refName string) string {
+	var manifest *ispec.Descriptor
+	for i, m := range index.Manifests {
+		if refName == "" && len(index.Manifests) == 1 || refName != "" && m.Annotations[ispec.AnnotationRefName] == refName {
+			manifest = &index.Manifests[i]
+			break
+		}
+	}
+	if manifest == nil {
+		return ""
+	}
+
+	if name := manifest.Annotations[containerdImageNameAnnotation]; name != "" {
+		return name
+	}
+	return manifest.Annotations[ispec.AnnotationRefName]
+}
+
+/// Reads the index of the OCI layout in the directory `layoutPath`
+func readOciIndex(layoutPath string) (*ispec.Index, error) {
+	f, err := os.Open(filepath.Join(layoutPath, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var index ispec.Index
+	if err := json.NewDecoder(f).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+/// Reads the index of the OCI layout in the tar archive `archivePath`
+func readOciIndexFromArchive(archivePath string) (*ispec.Index, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("The archive %s contains no index.json", archivePath))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Clean(hdr.Name) != "index.json" {
+			continue
+		}
+
+		var index ispec.Index
+		if err := json.NewDecoder(tr).Decode(&index); err != nil {
+			return nil, err
+		}
+		return &index, nil
+	}
+}
+
+/// Returns a valid image name derived from the file or directory name of
+/// `p` without the extensions of archives
+func imageNameOfPath(p string) string {
+	name := strings.ToLower(filepath.Base(filepath.Clean(p)))
+	for _, ext := range []string{".gz", ".tgz", ".tar"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = strings.Trim(invalidImageNameChars.ReplaceAllString(name, "-"), "-._")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
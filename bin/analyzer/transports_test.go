@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/// Writes an OCI layout index with a manifest for each of the annotations
+/// `manifestAnnotations` to `dir`
+func writeOciIndex(t *testing.T, dir string, manifestAnnotations ...map[string]string) []byte {
+	index := ispec.Index{}
+	for _, annotations := range manifestAnnotations {
+		index.Manifests = append(index.Manifests, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest, Annotations: annotations,
+		})
+	}
+	b, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), b, 0644))
+	return b
+}
+
+func TestInferLocalImageName(t *testing.T) {
+	tmp := t.TempDir()
+
+	single := filepath.Join(tmp, "My_App")
+	writeOciIndex(t, single, map[string]string{ispec.AnnotationRefName: "1.0"})
+
+	multi := filepath.Join(tmp, "multi")
+	writeOciIndex(
+		t, multi,
+		map[string]string{ispec.AnnotationRefName: "latest"},
+		map[string]string{
+			ispec.AnnotationRefName:       "stable",
+			containerdImageNameAnnotation: "registry.example.com/app:stable",
+		},
+		map[string]string{ispec.AnnotationRefName: "registry.example.com/tool"},
+	)
+
+	unnamed := filepath.Join(tmp, "unnamed")
+	writeOciIndex(t, unnamed, nil)
+
+	archivePath := filepath.Join(tmp, "kaniko.tar")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	index := writeOciIndex(t, filepath.Join(tmp, "archive"), map[string]string{ispec.AnnotationRefName: "2.1"})
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "oci-layout", Size: 2, Mode: 0644}))
+	_, err = tw.Write([]byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./index.json", Size: int64(len(index)), Mode: 0644}))
+	_, err = tw.Write(index)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	for url, expected := range map[string]string{
+		"oci:" + single:                               "my_app:1.0",
+		"oci:" + single + ":1.0":                      "my_app:1.0",
+		"oci:" + multi + ":latest":                    "multi:latest",
+		"oci:" + multi + ":stable":                    "registry.example.com/app:stable",
+		"oci:" + multi + ":registry.example.com/tool": "registry.example.com/tool:latest",
+		"oci:" + unnamed:                              "unnamed",
+		"oci:" + filepath.Join(tmp, "missing"):        "missing",
+		"oci-archive:" + archivePath:                  "kaniko:2.1",
+		"dir:" + filepath.Join(tmp, "Some Image"):     "some-image",
+		"docker-daemon:alpine:3.15":                   "docker.io/library/alpine:3.15",
+		"docker-daemon:localhost:5000/app:1.0":        "localhost:5000/app:1.0",
+	} {
+		ref, err := alltransports.ParseImageName(url)
+		require.NoError(t, err, url)
+
+		name, err := inferLocalImageName(ref)
+		require.NoError(t, err, url)
+		assert.Equal(t, expected, name, url)
+	}
+
+	ref, err := alltransports.ParseImageName("docker-daemon:sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	_, err = inferLocalImageName(ref)
+	assert.Error(t, err)
+}
+
+func TestNewTaskWithLocalTransports(t *testing.T) {
+	tmp := t.TempDir()
+	layout := filepath.Join(tmp, "layout")
+	writeOciIndex(t, layout, map[string]string{ispec.AnnotationRefName: "registry.example.com/app:1.0"})
+
+	task, err := newTask("oci:"+layout, true, RegistryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "registry.example.com/app", task.Image.Image)
+	assert.Equal(t, "1.0", task.Image.Tag)
+	assert.Equal(t, "oci", task.Image.Transport)
+
+	task, err = newTask("dir:"+tmp, true, RegistryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Base(tmp), task.Image.Image)
+	assert.Equal(t, "latest", task.Image.Tag)
+
+	withPort := filepath.Join(tmp, "with-port")
+	writeOciIndex(t, withPort, map[string]string{
+		ispec.AnnotationRefName:       "1.0",
+		containerdImageNameAnnotation: "localhost:5000/app:1.0",
+	})
+	task, err = newTask("oci:"+withPort, true, RegistryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:5000/app", task.Image.Image)
+	assert.Equal(t, "1.0", task.Image.Tag)
+}
+
+func TestParseLocalImageName(t *testing.T) {
+	d := "sha256:" + strings.Repeat("a", 64)
+
+	for imageName, expected := range map[string]struct {
+		name   string
+		tag    string
+		digest *string
+	}{
+		"my_app":                        {name: "my_app"},
+		"my_app:1.0":                    {name: "my_app", tag: "1.0"},
+		"docker.io/library/alpine:3.15": {name: "docker.io/library/alpine", tag: "3.15"},
+		"localhost:5000/app":            {name: "localhost:5000/app"},
+		"localhost:5000/app:1.0":        {name: "localhost:5000/app", tag: "1.0"},
+		"localhost:5000/app@" + d:       {name: "localhost:5000/app", digest: &d},
+		"localhost:5000/app:1.0@" + d:   {name: "localhost:5000/app", tag: "1.0", digest: &d},
+	} {
+		name, tag, digest, err := parseLocalImageName(imageName)
+		require.NoError(t, err, imageName)
+		assert.Equal(t, expected.name, name, imageName)
+		assert.Equal(t, expected.tag, tag, imageName)
+		assert.Equal(t, expected.digest, digest, imageName)
+	}
+
+	_, _, _, err := parseLocalImageName("localhost:5000/app:1.0:2.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+
+	internal "github.com/dcermak/container-layer-sizes/pkg"
+)
+
+/// Default number of layers of a single image that are analyzed in parallel
+var DefaultLayerWorkers = runtime.NumCPU()
+
+/// Default number of tasks that are processed in parallel
+const DefaultTaskWorkers = 4
+
+/// Calls `analyze` for every index in [0, count) using at most `workers`
+/// goroutines and returns the analyzed layers in the order of their indices.
+///
+/// Once an invocation of `analyze` fails, the context passed to the remaining
+/// ones is canceled. `analyze` is nevertheless called for every index and is
+/// expected to return promptly once its context is canceled. The error of the
+/// layer with the lowest index is returned, errors caused by this cancellation
+/// are only reported if no other error occurred, so that the result does not
+/// depend on the order in which the layers were processed.
+func analyzeLayersConcurrently(
+	ctx context.Context,
+	count int,
+	workers int,
+	analyze func(ctx context.Context, i int) (internal.Layer, error),
+) ([]internal.Layer, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	layers := make([]internal.Layer, count)
+	errs := make([]error, count)
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if layers[i], errs[i] = analyze(ctx, i); errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var canceled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, context.Canceled) {
+			if canceled == nil {
+				canceled = err
+			}
+			continue
+		}
+		return nil, err
+	}
+	if canceled != nil {
+		return nil, canceled
+	}
+
+	return layers, nil
+}
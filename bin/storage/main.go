@@ -202,6 +202,99 @@ func backend(s *internal.SQLiteBackend) func(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+/// Reads the entry with the digest `digest` of the image history with the id
+/// `id` from `s`, or its most recent entry if `digest` is empty.
+///
+/// On failure the HTTP status code that matches the error is returned.
+func readHistoryEntry(s *internal.SQLiteBackend, id string, digest string) (*internal.ImageHistoryEntry, int, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New(fmt.Sprintf("could not parse the id %s as int64", id))
+	}
+
+	history, err := s.ReadById(i)
+	if err != nil {
+		if errors.Is(err, internal.ErrNonExistent) {
+			return nil, http.StatusNotFound, errors.New(fmt.Sprintf("No image history with the id %s is present in the database", id))
+		}
+		return nil, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not retrieve image with the id %s, got %s", id, err))
+	}
+
+	if digest == "" {
+		if entry := internal.PreviousHistoryEntry(*history, ""); entry != nil {
+			return entry, http.StatusOK, nil
+		}
+		return nil, http.StatusNotFound, errors.New(fmt.Sprintf("The image history with the id %s has no entries", id))
+	}
+	entry, ok := history.History[digest]
+	if !ok {
+		return nil, http.StatusNotFound, errors.New(fmt.Sprintf("The image history with the id %s has no entry with the digest %s", id, digest))
+	}
+	return &entry, http.StatusOK, nil
+}
+
+/// Compares the final root filesystems of two stored image history entries.
+///
+/// The entries are selected via the parameters old_id and new_id and
+/// optionally old_digest and new_digest, the most recent entry is used if
+/// the digest is omitted. Unchanged entries are included if the parameter
+/// unchanged is true.
+func diff(s *internal.SQLiteBackend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+		if r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("Unsupported method %s", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(
+				w,
+				fmt.Sprintf("Error parsing form values %s", err),
+				http.StatusBadRequest,
+			)
+			return
+		}
+
+		oldId, newId := r.FormValue("old_id"), r.FormValue("new_id")
+		if oldId == "" || newId == "" {
+			http.Error(w, "The parameters old_id and new_id must be present", http.StatusBadRequest)
+			return
+		}
+
+		includeUnchanged := false
+		if u := r.FormValue("unchanged"); u != "" {
+			var err error
+			if includeUnchanged, err = strconv.ParseBool(u); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid unchanged parameter: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		oldEntry, status, err := readHistoryEntry(s, oldId, r.FormValue("old_digest"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		newEntry, status, err := readHistoryEntry(s, newId, r.FormValue("new_digest"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		b, err := json.Marshal(internal.DiffHistoryEntries(oldEntry, newEntry, includeUnchanged))
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err, "old_id": oldId, "new_id": newId,
+			}).Error("Failed to marshal the diff to json")
+			http.Error(w, "Failed to marshal the diff to json", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, string(b))
+	}
+}
+
 func main() {
 	var addr, dbPath, verbosity string
 
@@ -255,6 +348,7 @@ func main() {
 				return err
 			}
 			http.HandleFunc("/", backend(s))
+			http.HandleFunc("/diff", diff(s))
 
 			fmt.Printf("Ready. Listening on %s\n", addr)
 			if err := http.ListenAndServe(addr, nil); err != nil {
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 
 	internal "github.com/dcermak/container-layer-sizes/pkg"
@@ -51,6 +53,58 @@ func (b *BackendTestSuite) TestSimpleGetByName404() {
 	b.Equalf(http.StatusNotFound, b.rr.Code, "requesting an invalid name must result in a 404, body: %s", b.rr.Body)
 }
 
+func (b *BackendTestSuite) TestDiff() {
+	oldLayer := internal.NewLayer()
+	oldLayer.InsertIntoDir("/usr/bin/bash", 1000)
+	newLayer := internal.NewLayer()
+	newLayer.InsertIntoDir("/usr/bin/bash", 1200)
+	newLayer.InsertIntoDir("/app/main", 512)
+
+	hist, err := b.s.Create(&internal.ImageHistory{
+		ImageEntry: internal.ImageEntry{Name: "registry.example.com/diff"},
+		History: map[string]internal.ImageHistoryEntry{
+			"sha256:old": {Tags: []string{"1"}, Contents: internal.LayerSizes{"old": oldLayer}},
+			"sha256:new": {Tags: []string{"2"}, Contents: internal.LayerSizes{"new": newLayer}},
+		},
+	})
+	b.Require().NoError(err)
+	defer b.s.Delete(hist)
+	id := strconv.FormatInt(hist.ID, 10)
+
+	handler := http.HandlerFunc(diff(b.s))
+	get := func(params map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/diff", nil)
+		b.Require().NoError(err)
+		q := req.URL.Query()
+		for k, v := range params {
+			q.Add(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(map[string]string{
+		"old_id": id, "old_digest": "sha256:old", "new_id": id, "new_digest": "sha256:new",
+	})
+	b.Require().Equalf(http.StatusOK, rr.Code, "body: %s", rr.Body)
+
+	var d internal.DirDiff
+	b.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &d))
+	b.Equal(int64(712), d.Delta)
+	b.Equal(internal.DiffCounts{Added: 1, Grown: 1}, d.Counts)
+
+	rr = get(map[string]string{
+		"old_id": id, "old_digest": "sha256:old", "new_id": id, "new_digest": "sha256:missing",
+	})
+	b.Equalf(http.StatusNotFound, rr.Code, "body: %s", rr.Body)
+
+	rr = get(map[string]string{"old_id": id})
+	b.Equalf(http.StatusBadRequest, rr.Code, "body: %s", rr.Body)
+}
+
 func TestBackendTestSuite(t *testing.T) {
 	suite.Run(t, new(BackendTestSuite))
 }
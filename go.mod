@@ -7,6 +7,7 @@ require (
 	github.com/containers/storage v1.41.0
 	github.com/docker/distribution v2.8.1+incompatible
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.5
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/mholt/archiver/v4 v4.0.0-alpha.7
 	github.com/opencontainers/go-digest v1.0.0
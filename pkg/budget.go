@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBudgetExceeded = errors.New("The image exceeds its size budget")
+)
+
+/// The kind of limit of a size budget
+type BudgetKind string
+
+const (
+	/// Sum of the uncompressed sizes of all layers
+	BudgetKindTotalSize BudgetKind = "total"
+
+	/// Sum of the compressed sizes of all layers
+	BudgetKindCompressedSize BudgetKind = "compressed"
+
+	/// Uncompressed size of each individual layer
+	BudgetKindLayerSize BudgetKind = "layer"
+
+	/// Size of the files in the final image matching a glob
+	BudgetKindPath BudgetKind = "path"
+
+	/// Growth of the total size compared to the previous version of the image
+	BudgetKindGrowth BudgetKind = "growth"
+)
+
+/// The maximum size of the files matching a glob in the final image
+type PathBudget struct {
+	/// Absolute path glob, `**` matches any number of directories
+	Pattern string `json:"pattern"`
+
+	/// Maximum size in bytes, a limit of 0 forbids any non-empty file
+	/// matching the glob
+	Limit int64 `json:"limit"`
+}
+
+/// Size limits of an image.
+///
+/// The total, compressed and layer limits are not checked if they are 0 and
+/// the growth is not checked if it is nil. Path limits are always checked.
+type Budget struct {
+	/// Maximum sum of the uncompressed sizes of all layers in bytes
+	TotalSize int64 `json:"total_size,omitempty"`
+
+	/// Maximum sum of the compressed sizes of all layers in bytes
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+
+	/// Maximum uncompressed size of each layer in bytes
+	LayerSize int64 `json:"layer_size,omitempty"`
+
+	/// Maximum sizes of paths in the final image
+	Paths []PathBudget `json:"paths,omitempty"`
+
+	/// Maximum growth of the total size in percent compared to the previous
+	/// version of the image
+	MaxGrowthPercent *float64 `json:"max_growth_percent,omitempty"`
+}
+
+/// A limit of a budget that is exceeded
+type BudgetViolation struct {
+	Kind BudgetKind `json:"kind"`
+
+	/// The layer digest for layer limits, the glob for path limits
+	Subject string `json:"subject,omitempty"`
+
+	/// The limit in bytes, or in percent for the growth
+	Limit float64 `json:"limit"`
+
+	/// The actual value in bytes, or in percent for the growth
+	Actual float64 `json:"actual"`
+}
+
+/// The result of checking an image against a budget
+type BudgetReport struct {
+	/// Number of limits that were checked
+	Checks int `json:"checks"`
+
+	/// The exceeded limits in the order of the budget
+	Violations []BudgetViolation `json:"violations"`
+
+	/// Total size of the previous version of the image in bytes, 0 if it
+	/// was not compared to a previous version
+	PreviousTotalSize int64 `json:"previous_total_size,omitempty"`
+}
+
+/// Returns true if any limit of the budget is exceeded
+func (r *BudgetReport) Exceeded() bool {
+	return len(r.Violations) > 0
+}
+
+/// Parses a size like `512`, `5MB`, `1.5 GiB` into bytes.
+///
+/// SI prefixes (kB, MB, GB, TB) are powers of 1000 and binary prefixes
+/// (KiB, MiB, GiB, TiB) are powers of 1024, the unit is case insensitive.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := s, ""
+	if i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid size: %s", s))
+	}
+
+	multipliers := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1e3, "kb": 1e3, "m": 1e6, "mb": 1e6, "g": 1e9, "gb": 1e9, "t": 1e12, "tb": 1e12,
+		"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+	}
+	multiplier, ok := multipliers[strings.ToLower(unit)]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Invalid size unit %s in %s", unit, s))
+	}
+	return int64(value * multiplier), nil
+}
+
+/// Parses a budget from `r`.
+///
+/// Each line contains a single limit in the form `<subject> <= <limit>`,
+/// empty lines and lines starting with # are ignored:
+///
+///     total <= 500MB
+///     compressed <= 200MB
+///     layer <= 100MB
+///     growth <= 10%
+///     /usr/share/doc/** <= 5MB
+func ParseBudget(r io.Reader) (*Budget, error) {
+	var budget Budget
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "<=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid budget in line %d, expected '<subject> <= <limit>': %s", lineNo, line))
+		}
+		subject, limit := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		if BudgetKind(subject) == BudgetKindGrowth {
+			percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(limit, "%")), 64)
+			if err != nil || percent < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid growth percentage in line %d: %s", lineNo, limit))
+			}
+			budget.MaxGrowthPercent = &percent
+			continue
+		}
+
+		size, err := ParseSize(limit)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid budget in line %d: %s", lineNo, err))
+		}
+		switch {
+		case BudgetKind(subject) == BudgetKindTotalSize:
+			budget.TotalSize = size
+		case BudgetKind(subject) == BudgetKindCompressedSize:
+			budget.CompressedSize = size
+		case BudgetKind(subject) == BudgetKindLayerSize:
+			budget.LayerSize = size
+		case strings.HasPrefix(subject, "/"):
+			if _, err := path.Match(subject, ""); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid path glob in line %d: %s", lineNo, subject))
+			}
+			budget.Paths = append(budget.Paths, PathBudget{Pattern: subject, Limit: size})
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid budget subject in line %d: %s", lineNo, subject))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &budget, nil
+}
+
+/// Reads the budget from the file `budgetPath`, see ParseBudget for its
+/// format
+func ReadBudgetFile(budgetPath string) (*Budget, error) {
+	f, err := os.Open(budgetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseBudget(f)
+}
+
+/// Checks the image with the layers `layers` and the final root filesystem
+/// `mergedRoot` against `budget`.
+///
+/// `layerDigests` are the digests of the layers ordered from the lowest to
+/// the topmost layer, a layer that occurs multiple times is counted each time
+/// in the total and compressed size. The growth is only checked if
+/// `previous`, the last stored version of the image, is not nil.
+func EvaluateBudget(budget Budget, layerDigests []string, layers LayerSizes, mergedRoot *Dir, previous *ImageHistoryEntry) BudgetReport {
+	report := BudgetReport{Violations: make([]BudgetViolation, 0)}
+	check := func(kind BudgetKind, subject string, limit float64, actual float64) {
+		report.Checks++
+		if actual > limit {
+			report.Violations = append(report.Violations, BudgetViolation{
+				Kind: kind, Subject: subject, Limit: limit, Actual: actual,
+			})
+		}
+	}
+
+	var totalSize, compressedSize int64
+	for _, digest := range layerDigests {
+		if l, ok := layers[digest]; ok {
+			totalSize += l.TotalSize
+			compressedSize += l.CompressedSize
+		}
+	}
+
+	if budget.TotalSize > 0 {
+		check(BudgetKindTotalSize, "", float64(budget.TotalSize), float64(totalSize))
+	}
+	if budget.CompressedSize > 0 {
+		check(BudgetKindCompressedSize, "", float64(budget.CompressedSize), float64(compressedSize))
+	}
+	if budget.LayerSize > 0 {
+		checked := make(map[string]bool, len(layerDigests))
+		for _, digest := range layerDigests {
+			if l, ok := layers[digest]; ok && !checked[digest] {
+				checked[digest] = true
+				check(BudgetKindLayerSize, digest, float64(budget.LayerSize), float64(l.TotalSize))
+			}
+		}
+	}
+
+	if len(budget.Paths) > 0 {
+		pathSizes := make([]int64, len(budget.Paths))
+		if mergedRoot != nil {
+			mergedRoot.WalkFiles(func(filePath string, size int64) {
+				for i, p := range budget.Paths {
+					if matchPathGlob(p.Pattern, filePath) {
+						pathSizes[i] += size
+					}
+				}
+			})
+		}
+		for i, p := range budget.Paths {
+			check(BudgetKindPath, p.Pattern, float64(p.Limit), float64(pathSizes[i]))
+		}
+	}
+
+	if budget.MaxGrowthPercent != nil && previous != nil {
+		for _, l := range previous.Contents {
+			report.PreviousTotalSize += l.TotalSize
+		}
+		if report.PreviousTotalSize > 0 {
+			growth := float64(totalSize-report.PreviousTotalSize) / float64(report.PreviousTotalSize) * 100
+			check(BudgetKindGrowth, "", *budget.MaxGrowthPercent, growth)
+		}
+	}
+
+	return report
+}
+
+/// Checks whether the absolute path `filePath` or one of its parent
+/// directories matches the glob `pattern`, in which `**` matches any number
+/// of directories.
+func matchPathGlob(pattern string, filePath string) bool {
+	return matchPathSegments(dropEmptyStrings(strings.Split(pattern, "/")), dropEmptyStrings(strings.Split(filePath, "/")))
+}
+
+func matchPathSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		// the remaining segments are below a matching directory
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchPathSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchPathSegments(pattern[1:], segments[1:])
+}
+
+/// Returns the most recently created entry of `history`, skipping the entry
+/// with the key `excludeDigest`, or nil if there is none.
+func PreviousHistoryEntry(history ImageHistory, excludeDigest string) *ImageHistoryEntry {
+	keys := make([]string, 0, len(history.History))
+	for k := range history.History {
+		if k != excludeDigest {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// entries without a creation date are treated as the oldest ones
+	created := func(key string) time.Time {
+		if c := history.History[key].InspectInfo.Created; c != nil {
+			return *c
+		}
+		return time.Time{}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := created(keys[i]), created(keys[j])
+		if ci.Equal(cj) {
+			return keys[i] < keys[j]
+		}
+		return ci.Before(cj)
+	})
+	entry := history.History[keys[len(keys)-1]]
+	return &entry
+}
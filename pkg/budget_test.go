@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"512":     512,
+		"5MB":     5000000,
+		"5 mb":    5000000,
+		"1.5GiB":  1610612736,
+		"100 KiB": 102400,
+		"0":       0,
+	} {
+		size, err := ParseSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, size, s)
+	}
+
+	for _, s := range []string{"", "MB", "5 parsecs", "-1"} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseBudget(t *testing.T) {
+	budget, err := ParseBudget(strings.NewReader(`
+# limits of the production image
+total <= 500MB
+compressed <= 200 MB
+layer <= 100MiB
+growth <= 10%
+/usr/share/doc/** <= 5MB
+/usr/lib/**/*.a <= 0
+`))
+	require.NoError(t, err)
+
+	growth := 10.0
+	assert.Equal(t, Budget{
+		TotalSize:      500000000,
+		CompressedSize: 200000000,
+		LayerSize:      100 << 20,
+		Paths: []PathBudget{
+			{Pattern: "/usr/share/doc/**", Limit: 5000000},
+			{Pattern: "/usr/lib/**/*.a", Limit: 0},
+		},
+		MaxGrowthPercent: &growth,
+	}, *budget)
+
+	for _, invalid := range []string{
+		"total 500MB",
+		"weight <= 5kg",
+		"usr/share/doc <= 5MB",
+		"/usr/[ <= 5MB",
+		"growth <= lots",
+	} {
+		_, err := ParseBudget(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMatchPathGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern  string
+		filePath string
+		expected bool
+	}{
+		{pattern: "/usr/share/doc/**", filePath: "/usr/share/doc/bash/README", expected: true},
+		{pattern: "/usr/share/doc/**", filePath: "/usr/share/man/man1/bash.1.gz", expected: false},
+		{pattern: "/usr/share/doc", filePath: "/usr/share/doc/bash/README", expected: true},
+		{pattern: "/usr/lib/**/*.a", filePath: "/usr/lib/libc.a", expected: true},
+		{pattern: "/usr/lib/**/*.a", filePath: "/usr/lib/gcc/12/libgcc.a", expected: true},
+		{pattern: "/usr/lib/**/*.a", filePath: "/usr/lib/gcc/12/libgcc.so", expected: false},
+		{pattern: "/usr/*/locale", filePath: "/usr/share/locale/de/bash.mo", expected: true},
+		{pattern: "/usr/*/locale", filePath: "/usr/share/i18n/locale", expected: false},
+	} {
+		assert.Equal(t, c.expected, matchPathGlob(c.pattern, c.filePath), "%s %s", c.pattern, c.filePath)
+	}
+}
+
+func TestEvaluateBudget(t *testing.T) {
+	base := NewLayer()
+	base.InsertIntoDir("/usr/bin/bash", 1000)
+	base.InsertIntoDir("/usr/share/doc/bash/README", 400)
+	base.CompressedSize = 600
+
+	top := NewLayer()
+	top.InsertIntoDir("/usr/share/doc/app/README", 300)
+	top.InsertIntoDir("/usr/share/doc/bash/.wh.README", 0)
+	top.CompressedSize = 200
+
+	digests := []string{"base", "top"}
+	layers := LayerSizes{"base": base, "top": top}
+	merged := MergeLayers([]Dir{base.Dir, top.Dir})
+
+	growth := 20.0
+	budget := Budget{
+		TotalSize:      1500,
+		CompressedSize: 1000,
+		LayerSize:      1200,
+		Paths: []PathBudget{
+			{Pattern: "/usr/share/doc/**", Limit: 200},
+			{Pattern: "/usr/bin", Limit: 1000},
+		},
+		MaxGrowthPercent: &growth,
+	}
+
+	previousLayer := NewLayer()
+	previousLayer.InsertIntoDir("/usr/bin/bash", 1000)
+	previous := ImageHistoryEntry{Contents: LayerSizes{"previous": previousLayer}}
+
+	report := EvaluateBudget(budget, digests, layers, &merged, &previous)
+	assert.Equal(t, 7, report.Checks)
+	assert.True(t, report.Exceeded())
+	assert.Equal(t, int64(1000), report.PreviousTotalSize)
+	assert.Equal(t, []BudgetViolation{
+		{Kind: BudgetKindTotalSize, Limit: 1500, Actual: 1700},
+		{Kind: BudgetKindLayerSize, Subject: "base", Limit: 1200, Actual: 1400},
+		{Kind: BudgetKindPath, Subject: "/usr/share/doc/**", Limit: 200, Actual: 300},
+		{Kind: BudgetKindGrowth, Limit: 20, Actual: 70},
+	}, report.Violations)
+
+	// the growth is not checked without a previous version
+	report = EvaluateBudget(Budget{MaxGrowthPercent: &growth, TotalSize: 2000}, digests, layers, &merged, nil)
+	assert.Equal(t, 1, report.Checks)
+	assert.False(t, report.Exceeded())
+}
+
+func TestEvaluateBudgetCountsRepeatedLayers(t *testing.T) {
+	layer := NewLayer()
+	layer.InsertIntoDir("/usr/bin/app", 1000)
+	layer.CompressedSize = 400
+
+	report := EvaluateBudget(
+		Budget{TotalSize: 1500, CompressedSize: 600},
+		[]string{"app", "app"}, LayerSizes{"app": layer}, nil, nil,
+	)
+	assert.Equal(t, 2, report.Checks)
+	assert.Equal(t, []BudgetViolation{
+		{Kind: BudgetKindTotalSize, Limit: 1500, Actual: 2000},
+		{Kind: BudgetKindCompressedSize, Limit: 600, Actual: 800},
+	}, report.Violations)
+}
+
+func TestEvaluateBudgetZeroLimits(t *testing.T) {
+	layer := NewLayer()
+	layer.InsertIntoDir("/usr/share/doc/app/README", 100)
+	merged := MergeLayers([]Dir{layer.Dir})
+
+	// a path limit of 0 forbids the path, the other limits are disabled
+	report := EvaluateBudget(
+		Budget{Paths: []PathBudget{{Pattern: "/usr/share/doc", Limit: 0}, {Pattern: "/usr/share/man", Limit: 0}}},
+		[]string{"app"}, LayerSizes{"app": layer}, &merged, nil,
+	)
+	assert.Equal(t, 2, report.Checks)
+	assert.Equal(t, []BudgetViolation{
+		{Kind: BudgetKindPath, Subject: "/usr/share/doc", Limit: 0, Actual: 100},
+	}, report.Violations)
+}
+
+func TestPreviousHistoryEntry(t *testing.T) {
+	older := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(24 * time.Hour)
+	newest := newer.Add(24 * time.Hour)
+
+	history := ImageHistory{History: map[string]ImageHistoryEntry{
+		"sha256:old":     {Tags: []string{"1"}, InspectInfo: types.ImageInspectInfo{Created: &older}},
+		"sha256:new":     {Tags: []string{"2"}, InspectInfo: types.ImageInspectInfo{Created: &newer}},
+		"sha256:current": {Tags: []string{"3"}, InspectInfo: types.ImageInspectInfo{Created: &newest}},
+		"sha256:unknown": {Tags: []string{"4"}},
+	}}
+
+	previous := PreviousHistoryEntry(history, "sha256:current")
+	require.NotNil(t, previous)
+	assert.Equal(t, []string{"2"}, previous.Tags)
+
+	assert.Nil(t, PreviousHistoryEntry(ImageHistory{}, "sha256:current"))
+}
@@ -9,6 +9,30 @@ type Layer struct {
 
 	/// The command that was used to create this layer
 	CreatedBy string
+
+	/// Size of the compressed layer blob in bytes
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+
+	/// Size of the uncompressed tar archive of this layer in bytes
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+
+	/// Bytes of the uncompressed tar archive that are not file contents,
+	/// i.e. the tar headers and padding
+	TarOverhead int64 `json:"tar_overhead,omitempty"`
+
+	/// Sum of the sizes of the contents of all files in the tar archive
+	PayloadSize int64 `json:"payload_size,omitempty"`
+
+	/// true if the digest of each non-empty regular file has been recorded
+	ContentsHashed bool `json:"contents_hashed,omitempty"`
+
+	/// The package database files in this layer, the keys are their absolute
+	/// paths
+	PackageDatabases map[string]PackageDatabaseFile `json:"package_databases,omitempty"`
+
+	/// The manifests of the language dependencies in this layer, the keys are
+	/// their absolute paths
+	DependencyManifests map[string]DependencyManifest `json:"dependency_manifests,omitempty"`
 }
 
 func NewLayer() Layer {
@@ -20,6 +44,37 @@ func NewLayer() Layer {
 /// The key is the hash of each layer, the value is the calculated directory sizes
 type LayerSizes map[string]Layer
 
+/// The result of the analysis of a container image
+type ImageAnalysis struct {
+	/// The size trees of the individual layers
+	Layers LayerSizes `json:"layers"`
+
+	/// The final root filesystem as seen by a container of this image
+	MergedRoot Dir `json:"merged_root"`
+
+	/// The space in each layer that is wasted by subsequent layers
+	Efficiency EfficiencyReport `json:"efficiency"`
+
+	/// Files whose contents are stored more than once, only present if the
+	/// contents of the files have been hashed
+	Duplicates *DuplicateReport `json:"duplicates,omitempty"`
+
+	/// The size of each installed package, only present if the image
+	/// contains a package database
+	Packages *PackageReport `json:"packages,omitempty"`
+
+	/// The size of each language dependency, only present if the image
+	/// contains any
+	Dependencies *DependencyReport `json:"dependencies,omitempty"`
+
+	/// Suggestions how to make the image smaller
+	Recommendations RecommendationReport `json:"recommendations"`
+
+	/// The build steps of the image in their order, including those that
+	/// did not create a layer
+	History []HistoryStep `json:"history"`
+}
+
 /// A single entry in the history of an image
 type ImageHistoryEntry struct {
 	// database primary key
@@ -28,6 +83,14 @@ type ImageHistoryEntry struct {
 	Tags        []string
 	Contents    LayerSizes
 	InspectInfo types.ImageInspectInfo
+
+	/// The final root filesystem of the image with all whiteouts applied,
+	/// nil for entries that were stored without it
+	MergedContents *Dir
+
+	/// The ordered build steps of the image including those without a
+	/// layer, nil for entries that were stored without it
+	History []HistoryStep
 }
 
 type ImageEntry struct {
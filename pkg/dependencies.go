@@ -0,0 +1,524 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+/// The package ecosystem of a programming language
+type Ecosystem string
+
+const (
+	EcosystemNpm    Ecosystem = "npm"
+	EcosystemPython Ecosystem = "python"
+	EcosystemRuby   Ecosystem = "ruby"
+	EcosystemMaven  Ecosystem = "maven"
+	EcosystemGradle Ecosystem = "gradle"
+	EcosystemGo     Ecosystem = "go"
+)
+
+/// The parsed contents of a file that describes an installed dependency,
+/// i.e. the `package.json` of a package in `node_modules` or the `RECORD`
+/// of a Python distribution
+type DependencyManifest struct {
+	Ecosystem Ecosystem `json:"ecosystem"`
+
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	/// Absolute paths of the files that belong to the dependency, only
+	/// recorded for Python distributions
+	Files []string `json:"files,omitempty"`
+
+	/// Set if the file could not be parsed
+	Error string `json:"error,omitempty"`
+}
+
+/// Returns the ecosystem whose dependencies are described by the file with
+/// the absolute path `filePath`. `ok` is false if the file is not a
+/// dependency manifest.
+func DependencyManifestEcosystem(filePath string) (ecosystem Ecosystem, ok bool) {
+	dir, fname := path.Split(path.Clean(filePath))
+	dir = path.Clean(dir)
+
+	switch {
+	case fname == "package.json" && npmPackageRoot(dir) == dir && dir != "/":
+		return EcosystemNpm, true
+	case fname == "RECORD" && strings.HasSuffix(dir, ".dist-info"):
+		return EcosystemPython, true
+	}
+	return "", false
+}
+
+/// Parses the dependency manifest with the absolute path `filePath` and the
+/// contents `contents`.
+///
+/// Errors are recorded in the returned manifest, like for package databases.
+func ParseDependencyManifest(filePath string, contents []byte) DependencyManifest {
+	ecosystem, ok := DependencyManifestEcosystem(filePath)
+	m := DependencyManifest{Ecosystem: ecosystem}
+	if !ok {
+		m.Error = fmt.Sprintf("%s is not a dependency manifest", filePath)
+		return m
+	}
+
+	var err error
+	switch ecosystem {
+	case EcosystemNpm:
+		var pkg struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if err = json.Unmarshal(contents, &pkg); err == nil {
+			m.Name, m.Version = pkg.Name, pkg.Version
+		}
+	case EcosystemPython:
+		distInfo := path.Dir(filePath)
+		m.Name, m.Version = splitNameVersion(strings.TrimSuffix(path.Base(distInfo), ".dist-info"))
+		m.Files, err = parsePythonRecord(path.Dir(distInfo), contents)
+	}
+
+	if err != nil {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+/// Returns the files listed in the `RECORD` of a Python distribution that is
+/// installed into the directory `sitePackages`
+func parsePythonRecord(sitePackages string, contents []byte) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(contents))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	files := make([]string, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 || record[0] == "" {
+			return nil, errors.New("Found an entry without a path in the RECORD")
+		}
+		files = append(files, path.Join(sitePackages, record[0]))
+	}
+}
+
+/// Splits `s` of the form `name-version` at the first dash that is followed
+/// by a digit. The version is empty if there is no such dash.
+func splitNameVersion(s string) (name string, version string) {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '-' && s[i+1] >= '0' && s[i+1] <= '9' {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+/// Returns the root directory of the npm package in `node_modules` that
+/// contains the file or directory `filePath`, or an empty string if it is not
+/// part of such a package.
+func npmPackageRoot(filePath string) string {
+	root, _ := npmPackage(filePath)
+	return root
+}
+
+/// Returns the root directory and the name of the npm package in
+/// `node_modules` that contains `filePath`, see `npmPackageRoot`. The name
+/// includes the scope of the package.
+func npmPackage(filePath string) (root string, name string) {
+	components := dropEmptyStrings(strings.Split(filePath, "/"))
+
+	for i := len(components) - 2; i >= 0; i-- {
+		if components[i] != "node_modules" {
+			continue
+		}
+		name := components[i+1]
+		if strings.HasPrefix(name, ".") {
+			return "", ""
+		}
+		end := i + 2
+		if strings.HasPrefix(name, "@") {
+			if end >= len(components) {
+				return "", ""
+			}
+			name += "/" + components[end]
+			end++
+		}
+		return "/" + strings.Join(components[:end], "/"), name
+	}
+	return "", ""
+}
+
+/// Decodes a module path or version of the Go module cache, which escapes
+/// upper case letters as an exclamation mark followed by the lower case
+/// letter.
+func decodeGoModulePath(escaped string) string {
+	var b strings.Builder
+	bang := false
+	for _, r := range escaped {
+		if r == '!' {
+			bang = true
+			continue
+		}
+		if bang {
+			r = []rune(strings.ToUpper(string(r)))[0]
+			bang = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+/// Identifies a single version of a dependency
+type dependencyKey struct {
+	ecosystem Ecosystem
+	name      string
+	version   string
+}
+
+/// Assigns the files of a directory tree to the dependencies that they
+/// belong to
+type dependencyClassifier struct {
+	tree *Dir
+
+	/// npm packages by their root directory
+	npmPackages map[string]DependencyManifest
+
+	/// Python distributions by the paths of their files
+	pythonFiles map[string]dependencyKey
+
+	/// The `dist-info` directories of the Python distributions by the paths
+	/// of their files
+	pythonRoots map[string]string
+}
+
+func newDependencyClassifier(tree *Dir, manifests map[string]DependencyManifest) *dependencyClassifier {
+	c := &dependencyClassifier{
+		tree:        tree,
+		npmPackages: make(map[string]DependencyManifest),
+		pythonFiles: make(map[string]dependencyKey),
+		pythonRoots: make(map[string]string),
+	}
+
+	for manifestPath, m := range manifests {
+		switch m.Ecosystem {
+		case EcosystemNpm:
+			c.npmPackages[path.Dir(manifestPath)] = m
+		case EcosystemPython:
+			key := dependencyKey{ecosystem: EcosystemPython, name: m.Name, version: m.Version}
+			for _, f := range m.Files {
+				c.pythonFiles[f] = key
+				c.pythonRoots[f] = path.Dir(manifestPath)
+			}
+		}
+	}
+	return c
+}
+
+/// Returns the dependency that the file `filePath` belongs to and the root
+/// directory of this copy of the dependency. `ok` is false if the file does
+/// not belong to any dependency.
+func (c *dependencyClassifier) classify(filePath string) (key dependencyKey, root string, ok bool) {
+	if key, ok := c.pythonFiles[filePath]; ok {
+		return key, c.pythonRoots[filePath], true
+	}
+
+	if root, name := npmPackage(filePath); root != "" && root != filePath {
+		key := dependencyKey{ecosystem: EcosystemNpm, name: name}
+		if m, ok := c.npmPackages[root]; ok && m.Name != "" {
+			key.name, key.version = m.Name, m.Version
+		}
+		return key, root, true
+	}
+
+	components := dropEmptyStrings(strings.Split(filePath, "/"))
+	join := func(end int) string {
+		return "/" + strings.Join(components[:end], "/")
+	}
+	last := len(components) - 1
+
+	for i := 0; i < last; i++ {
+		c0, next := components[i], components[i+1]
+
+		switch {
+		case strings.HasSuffix(c0, ".dist-info"):
+			name, version := splitNameVersion(strings.TrimSuffix(c0, ".dist-info"))
+			return dependencyKey{ecosystem: EcosystemPython, name: name, version: version}, join(i + 1), true
+
+		case c0 == "gems" && i+1 < last && c.tree.FindSubdir(join(i)+"/specifications") != nil:
+			name, version := splitNameVersion(next)
+			return dependencyKey{ecosystem: EcosystemRuby, name: name, version: version}, join(i + 2), true
+
+		case c0 == "specifications" && i+1 == last && strings.HasSuffix(next, ".gemspec") &&
+			c.tree.FindSubdir(join(i)+"/gems") != nil:
+			name, version := splitNameVersion(strings.TrimSuffix(next, ".gemspec"))
+			return dependencyKey{ecosystem: EcosystemRuby, name: name, version: version}, join(i) + "/gems/" + name + "-" + version, true
+
+		case c0 == ".m2" && next == "repository":
+			// group/id/artifact/version/file
+			rest := components[i+2:]
+			if len(rest) < 4 || strings.HasPrefix(rest[len(rest)-1], "maven-metadata") {
+				return key, "", false
+			}
+			name := strings.Join(rest[:len(rest)-3], ".") + ":" + rest[len(rest)-3]
+			return dependencyKey{ecosystem: EcosystemMaven, name: name, version: rest[len(rest)-2]}, join(last), true
+
+		case c0 == "modules-2" && next == "files-2.1":
+			// group/artifact/version/hash/file
+			rest := components[i+2:]
+			if len(rest) < 5 {
+				return key, "", false
+			}
+			name := rest[0] + ":" + rest[1]
+			return dependencyKey{ecosystem: EcosystemGradle, name: name, version: rest[2]}, join(i + 5), true
+
+		case c0 == "pkg" && next == "mod":
+			return c.classifyGoModule(components, i+2)
+		}
+	}
+
+	return key, "", false
+}
+
+/// Extensions of the files of a module version in the download cache of Go
+var goModuleCacheExtensions = []string{".zip", ".ziphash", ".mod", ".info", ".lock"}
+
+/// Classifies the file with the path `components` in the Go module cache,
+/// whose contents start at the index `start`.
+func (c *dependencyClassifier) classifyGoModule(components []string, start int) (key dependencyKey, root string, ok bool) {
+	rest := components[start:]
+	join := func(end int) string {
+		return "/" + strings.Join(components[:start+end], "/")
+	}
+
+	if len(rest) > 2 && rest[0] == "cache" && rest[1] == "download" {
+		// cache/download/module/@v/version.zip
+		for j := 2; j < len(rest)-1; j++ {
+			if rest[j] != "@v" || j != len(rest)-2 {
+				continue
+			}
+			for _, ext := range goModuleCacheExtensions {
+				if strings.HasSuffix(rest[j+1], ext) {
+					return dependencyKey{
+						ecosystem: EcosystemGo,
+						name:      decodeGoModulePath(strings.Join(rest[2:j], "/")),
+						version:   decodeGoModulePath(strings.TrimSuffix(rest[j+1], ext)),
+					}, join(j + 1), true
+				}
+			}
+		}
+		return key, "", false
+	}
+
+	// module@version/file
+	for j := 0; j < len(rest)-1; j++ {
+		if at := strings.Index(rest[j], "@"); at > 0 {
+			name := strings.Join(append(append([]string{}, rest[:j]...), rest[j][:at]), "/")
+			return dependencyKey{
+				ecosystem: EcosystemGo,
+				name:      decodeGoModulePath(name),
+				version:   decodeGoModulePath(rest[j][at+1:]),
+			}, join(j + 1), true
+		}
+	}
+	return key, "", false
+}
+
+/// The space that a single version of a dependency occupies
+type Dependency struct {
+	Ecosystem Ecosystem `json:"ecosystem"`
+	Name      string    `json:"name"`
+
+	/// The version of the dependency, empty if it is unknown
+	Version string `json:"version"`
+
+	/// Sum of the sizes of the files of all copies of this dependency
+	Size int64 `json:"size"`
+
+	/// Number of files of all copies of this dependency
+	FileCount int `json:"file_count"`
+
+	/// The root directories of all copies of this dependency
+	Paths []string `json:"paths"`
+}
+
+/// The space that all dependencies of an ecosystem occupy
+type EcosystemSize struct {
+	Ecosystem Ecosystem `json:"ecosystem"`
+
+	/// Sum of the sizes of all dependencies of this ecosystem
+	Size int64 `json:"size"`
+
+	/// Number of distinct dependencies of this ecosystem
+	Dependencies int `json:"dependencies"`
+}
+
+/// The language dependencies in a directory tree
+type DependencyBreakdown struct {
+	/// The size of each ecosystem, the largest first
+	Ecosystems []EcosystemSize `json:"ecosystems"`
+
+	/// The size of each dependency, the largest first
+	Dependencies []Dependency `json:"dependencies"`
+}
+
+/// The language dependencies that a layer adds
+type LayerDependencies struct {
+	/// Digest of the layer
+	Digest string `json:"digest"`
+
+	DependencyBreakdown
+}
+
+/// The language dependencies of an image
+type DependencyReport struct {
+	/// The dependencies of the final image
+	Merged DependencyBreakdown `json:"merged"`
+
+	/// The dependencies in each layer in the order of the manifest
+	Layers []LayerDependencies `json:"layers"`
+
+	/// Dependency manifests of the final image that could not be parsed
+	Errors []string `json:"errors,omitempty"`
+}
+
+/// Calculates the size of each language dependency in the tree `tree`, whose
+/// dependency manifests are `manifests` with their absolute paths as keys.
+///
+/// npm packages in `node_modules` and Python distributions are recognized
+/// via their manifests, Ruby gems, the Maven and Gradle caches and the Go
+/// module cache via their paths.
+func ClassifyDependencies(tree *Dir, manifests map[string]DependencyManifest) DependencyBreakdown {
+	c := newDependencyClassifier(tree, manifests)
+
+	deps := make(map[dependencyKey]*Dependency)
+	roots := make(map[dependencyKey]map[string]bool)
+	tree.WalkFiles(func(filePath string, size int64) {
+		if IsWhiteout(path.Base(filePath)) {
+			return
+		}
+		key, root, ok := c.classify(filePath)
+		if !ok {
+			return
+		}
+
+		dep, ok := deps[key]
+		if !ok {
+			dep = &Dependency{Ecosystem: key.ecosystem, Name: key.name, Version: key.version}
+			deps[key] = dep
+			roots[key] = make(map[string]bool)
+		}
+		dep.Size += size
+		dep.FileCount++
+		roots[key][root] = true
+	})
+
+	breakdown := DependencyBreakdown{
+		Ecosystems:   make([]EcosystemSize, 0),
+		Dependencies: make([]Dependency, 0, len(deps)),
+	}
+	ecosystems := make(map[Ecosystem]*EcosystemSize)
+	for key, dep := range deps {
+		for root := range roots[key] {
+			dep.Paths = append(dep.Paths, root)
+		}
+		sort.Strings(dep.Paths)
+		breakdown.Dependencies = append(breakdown.Dependencies, *dep)
+
+		e, ok := ecosystems[dep.Ecosystem]
+		if !ok {
+			e = &EcosystemSize{Ecosystem: dep.Ecosystem}
+			ecosystems[dep.Ecosystem] = e
+		}
+		e.Size += dep.Size
+		e.Dependencies++
+	}
+	for _, e := range ecosystems {
+		breakdown.Ecosystems = append(breakdown.Ecosystems, *e)
+	}
+
+	sort.Slice(breakdown.Dependencies, func(i, j int) bool {
+		a, b := breakdown.Dependencies[i], breakdown.Dependencies[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		if a.Ecosystem != b.Ecosystem {
+			return a.Ecosystem < b.Ecosystem
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	sort.Slice(breakdown.Ecosystems, func(i, j int) bool {
+		a, b := breakdown.Ecosystems[i], breakdown.Ecosystems[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Ecosystem < b.Ecosystem
+	})
+
+	return breakdown
+}
+
+/// Calculates the language dependencies of each layer in `layers` and of the
+/// final root filesystem `mergedRoot`.
+///
+/// `layerDigests` are the digests of the layers in `layers` ordered from the
+/// lowest to the topmost layer. The dependency manifests are merged like the
+/// file system, so that files of a layer are classified with the manifests of
+/// the lower layers if the layer does not contain them itself. Returns nil if
+/// the image contains no language dependencies.
+func AnalyzeDependencies(layerDigests []string, layers LayerSizes, mergedRoot *Dir) *DependencyReport {
+	report := DependencyReport{Layers: make([]LayerDependencies, 0, len(layerDigests))}
+
+	found := false
+	visible := make(map[string]DependencyManifest)
+	for _, digest := range layerDigests {
+		l := layers[digest]
+		for manifestPath := range visible {
+			if hidden, _ := l.hides(manifestPath); hidden {
+				delete(visible, manifestPath)
+			}
+		}
+		for manifestPath, m := range l.DependencyManifests {
+			visible[manifestPath] = m
+		}
+
+		breakdown := ClassifyDependencies(&l.Dir, visible)
+		found = found || len(breakdown.Dependencies) > 0
+		report.Layers = append(report.Layers, LayerDependencies{Digest: digest, DependencyBreakdown: breakdown})
+	}
+
+	report.Merged = ClassifyDependencies(mergedRoot, visible)
+	if !found && len(report.Merged.Dependencies) == 0 {
+		return nil
+	}
+
+	for manifestPath, m := range visible {
+		if m.Error != "" {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", manifestPath, m.Error))
+		}
+	}
+	sort.Strings(report.Errors)
+
+	return &report
+}
+
+/// Calculates the language dependencies of this history entry, see
+/// `AnalyzeDependencies`.
+func (e *ImageHistoryEntry) Dependencies() *DependencyReport {
+	digests := e.orderedLayerDigests()
+	return AnalyzeDependencies(digests, e.Contents, e.mergedRoot(digests))
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyManifestEcosystem(t *testing.T) {
+	for filePath, expected := range map[string]Ecosystem{
+		"/app/node_modules/lodash/package.json":                           EcosystemNpm,
+		"/app/node_modules/@babel/core/package.json":                      EcosystemNpm,
+		"/app/node_modules/a/node_modules/b/package.json":                 EcosystemNpm,
+		"/usr/lib/python3/site-packages/requests-2.28.1.dist-info/RECORD": EcosystemPython,
+		"/app/package.json":                                                 "",
+		"/app/node_modules/lodash/fp/package.json":                          "",
+		"/app/node_modules/@babel/package.json":                             "",
+		"/usr/lib/python3/site-packages/requests-2.28.1.dist-info/METADATA": "",
+	} {
+		ecosystem, ok := DependencyManifestEcosystem(filePath)
+		assert.Equal(t, expected != "", ok, filePath)
+		assert.Equal(t, expected, ecosystem, filePath)
+	}
+}
+
+func TestParseDependencyManifest(t *testing.T) {
+	assert.Equal(t, DependencyManifest{Ecosystem: EcosystemNpm, Name: "@babel/core", Version: "7.19.0"}, ParseDependencyManifest(
+		"/app/node_modules/@babel/core/package.json",
+		[]byte(`{"name": "@babel/core", "version": "7.19.0", "dependencies": {"debug": "^4.1.0"}}`),
+	))
+
+	assert.Equal(t, DependencyManifest{
+		Ecosystem: EcosystemPython,
+		Name:      "requests",
+		Version:   "2.28.1",
+		Files: []string{
+			"/site-packages/requests/__init__.py",
+			"/site-packages/requests-2.28.1.dist-info/RECORD",
+			"/usr/bin/requests",
+		},
+	}, ParseDependencyManifest("/site-packages/requests-2.28.1.dist-info/RECORD", []byte(`requests/__init__.py,sha256=abc,4924
+requests-2.28.1.dist-info/RECORD,,
+../usr/bin/requests,sha256=def,10
+`)))
+
+	invalid := ParseDependencyManifest("/app/node_modules/lodash/package.json", []byte("{"))
+	assert.Equal(t, EcosystemNpm, invalid.Ecosystem)
+	assert.NotEmpty(t, invalid.Error)
+}
+
+func TestSplitNameVersion(t *testing.T) {
+	for s, expected := range map[string][2]string{
+		"rack-2.2.4":                   {"rack", "2.2.4"},
+		"nokogiri-1.13.8-x86_64-linux": {"nokogiri", "1.13.8-x86_64-linux"},
+		"ruby-progressbar-1.11.0":      {"ruby-progressbar", "1.11.0"},
+		"typing_extensions-4.3.0":      {"typing_extensions", "4.3.0"},
+		"no-version":                   {"no-version", ""},
+	} {
+		name, version := splitNameVersion(s)
+		assert.Equal(t, expected, [2]string{name, version}, s)
+	}
+}
+
+func TestClassifyDependencies(t *testing.T) {
+	root := MakeDir("/")
+	for filePath, size := range map[string]int64{
+		"/app/node_modules/lodash/package.json":                                                     100,
+		"/app/node_modules/lodash/lodash.js":                                                        900,
+		"/app/node_modules/@babel/core/package.json":                                                50,
+		"/app/node_modules/@babel/core/lib/index.js":                                                450,
+		"/app/node_modules/debug/node_modules/ms/index.js":                                          30,
+		"/app/node_modules/.package-lock.json":                                                      20,
+		"/other/node_modules/lodash/package.json":                                                   100,
+		"/other/node_modules/lodash/lodash.js":                                                      900,
+		"/usr/lib/python3.10/site-packages/requests/__init__.py":                                    4000,
+		"/usr/lib/python3.10/site-packages/requests-2.28.1.dist-info/RECORD":                        100,
+		"/usr/lib/python3.10/site-packages/requests-2.28.1.dist-info/METADATA":                      200,
+		"/usr/lib/ruby/gems/3.1.0/gems/rack-2.2.4/lib/rack.rb":                                      3000,
+		"/usr/lib/ruby/gems/3.1.0/specifications/rack-2.2.4.gemspec":                                10,
+		"/root/.m2/repository/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.12.0.jar":     5000,
+		"/root/.m2/repository/org/apache/commons/commons-lang3/maven-metadata-central.xml":          1,
+		"/root/.gradle/caches/modules-2/files-2.1/com.google.guava/guava/31.1-jre/abc123/guava.jar": 6000,
+		"/go/pkg/mod/github.com/!burnt!sushi/toml@v1.2.0/decode.go":                                 700,
+		"/go/pkg/mod/cache/download/github.com/!burnt!sushi/toml/@v/v1.2.0.zip":                     300,
+		"/go/pkg/mod/cache/download/github.com/!burnt!sushi/toml/@v/list":                           5,
+		"/usr/bin/bash": 1000,
+	} {
+		root.InsertIntoDir(filePath, size)
+	}
+
+	manifests := map[string]DependencyManifest{
+		"/app/node_modules/lodash/package.json":      {Ecosystem: EcosystemNpm, Name: "lodash", Version: "4.17.21"},
+		"/app/node_modules/@babel/core/package.json": {Ecosystem: EcosystemNpm, Name: "@babel/core", Version: "7.19.0"},
+		"/other/node_modules/lodash/package.json":    {Ecosystem: EcosystemNpm, Name: "lodash", Version: "4.17.21"},
+		"/usr/lib/python3.10/site-packages/requests-2.28.1.dist-info/RECORD": {
+			Ecosystem: EcosystemPython,
+			Name:      "requests",
+			Version:   "2.28.1",
+			Files: []string{
+				"/usr/lib/python3.10/site-packages/requests/__init__.py",
+				"/usr/lib/python3.10/site-packages/requests-2.28.1.dist-info/RECORD",
+			},
+		},
+	}
+
+	breakdown := ClassifyDependencies(&root, manifests)
+
+	assert.Equal(t, []Dependency{
+		{Ecosystem: EcosystemGradle, Name: "com.google.guava:guava", Version: "31.1-jre", Size: 6000, FileCount: 1,
+			Paths: []string{"/root/.gradle/caches/modules-2/files-2.1/com.google.guava/guava/31.1-jre"}},
+		{Ecosystem: EcosystemMaven, Name: "org.apache.commons:commons-lang3", Version: "3.12.0", Size: 5000, FileCount: 1,
+			Paths: []string{"/root/.m2/repository/org/apache/commons/commons-lang3/3.12.0"}},
+		{Ecosystem: EcosystemPython, Name: "requests", Version: "2.28.1", Size: 4300, FileCount: 3,
+			Paths: []string{"/usr/lib/python3.10/site-packages/requests-2.28.1.dist-info"}},
+		{Ecosystem: EcosystemRuby, Name: "rack", Version: "2.2.4", Size: 3010, FileCount: 2,
+			Paths: []string{"/usr/lib/ruby/gems/3.1.0/gems/rack-2.2.4"}},
+		{Ecosystem: EcosystemNpm, Name: "lodash", Version: "4.17.21", Size: 2000, FileCount: 4,
+			Paths: []string{"/app/node_modules/lodash", "/other/node_modules/lodash"}},
+		{Ecosystem: EcosystemGo, Name: "github.com/BurntSushi/toml", Version: "v1.2.0", Size: 1000, FileCount: 2,
+			Paths: []string{
+				"/go/pkg/mod/cache/download/github.com/!burnt!sushi/toml/@v",
+				"/go/pkg/mod/github.com/!burnt!sushi/toml@v1.2.0",
+			}},
+		{Ecosystem: EcosystemNpm, Name: "@babel/core", Version: "7.19.0", Size: 500, FileCount: 2,
+			Paths: []string{"/app/node_modules/@babel/core"}},
+		{Ecosystem: EcosystemNpm, Name: "ms", Version: "", Size: 30, FileCount: 1,
+			Paths: []string{"/app/node_modules/debug/node_modules/ms"}},
+	}, breakdown.Dependencies)
+
+	assert.Equal(t, []EcosystemSize{
+		{Ecosystem: EcosystemGradle, Size: 6000, Dependencies: 1},
+		{Ecosystem: EcosystemMaven, Size: 5000, Dependencies: 1},
+		{Ecosystem: EcosystemPython, Size: 4300, Dependencies: 1},
+		{Ecosystem: EcosystemRuby, Size: 3010, Dependencies: 1},
+		{Ecosystem: EcosystemNpm, Size: 2530, Dependencies: 3},
+		{Ecosystem: EcosystemGo, Size: 1000, Dependencies: 1},
+	}, breakdown.Ecosystems)
+}
+
+func TestAnalyzeDependencies(t *testing.T) {
+	base := NewLayer()
+	base.InsertIntoDir("/app/node_modules/lodash/package.json", 100)
+	base.InsertIntoDir("/app/node_modules/lodash/lodash.js", 900)
+	base.DependencyManifests = map[string]DependencyManifest{
+		"/app/node_modules/lodash/package.json": {Ecosystem: EcosystemNpm, Name: "lodash", Version: "4.17.20"},
+	}
+
+	// only modifies a file of a package of the lower layer
+	patch := NewLayer()
+	patch.InsertIntoDir("/app/node_modules/lodash/lodash.js", 1000)
+
+	// upgrades the package
+	upgrade := NewLayer()
+	upgrade.InsertIntoDir("/app/node_modules/lodash/package.json", 110)
+	upgrade.DependencyManifests = map[string]DependencyManifest{
+		"/app/node_modules/lodash/package.json": {Ecosystem: EcosystemNpm, Name: "lodash", Version: "4.17.21"},
+	}
+
+	digests := []string{"base", "patch", "upgrade"}
+	layers := LayerSizes{"base": base, "patch": patch, "upgrade": upgrade}
+	merged := MergeLayers([]Dir{base.Dir, patch.Dir, upgrade.Dir})
+
+	report := AnalyzeDependencies(digests, layers, &merged)
+	require.NotNil(t, report)
+	require.Len(t, report.Layers, 3)
+
+	lodash := func(version string, size int64, fileCount int) []Dependency {
+		return []Dependency{{
+			Ecosystem: EcosystemNpm, Name: "lodash", Version: version, Size: size, FileCount: fileCount,
+			Paths: []string{"/app/node_modules/lodash"},
+		}}
+	}
+	assert.Equal(t, "base", report.Layers[0].Digest)
+	assert.Equal(t, lodash("4.17.20", 1000, 2), report.Layers[0].Dependencies)
+	assert.Equal(t, lodash("4.17.20", 1000, 1), report.Layers[1].Dependencies)
+	assert.Equal(t, lodash("4.17.21", 110, 1), report.Layers[2].Dependencies)
+	assert.Equal(t, lodash("4.17.21", 1110, 2), report.Merged.Dependencies)
+	assert.Empty(t, report.Errors)
+}
+
+func TestAnalyzeDependenciesWithoutDependencies(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/usr/bin/bash", 1000)
+	merged := MergeLayers([]Dir{l.Dir})
+
+	assert.Nil(t, AnalyzeDependencies([]string{"l"}, LayerSizes{"l": l}, &merged))
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"sort"
+)
+
+/// How an entry differs between two trees
+type DiffStatus string
+
+const (
+	DiffStatusAdded     DiffStatus = "added"
+	DiffStatusRemoved   DiffStatus = "removed"
+	DiffStatusGrown     DiffStatus = "grown"
+	DiffStatusShrunk    DiffStatus = "shrunk"
+	DiffStatusUnchanged DiffStatus = "unchanged"
+
+	/// The size is the same, but the contents differ: the digests of files
+	/// or the entries of directories
+	DiffStatusModified DiffStatus = "modified"
+)
+
+/// The difference of a single file between two trees
+type FileDiff struct {
+	Name   string     `json:"name"`
+	Status DiffStatus `json:"status"`
+
+	/// Size in the old tree in bytes, 0 if the file was added
+	OldSize int64 `json:"old_size"`
+
+	/// Size in the new tree in bytes, 0 if the file was removed
+	NewSize int64 `json:"new_size"`
+
+	/// NewSize - OldSize
+	Delta int64 `json:"delta"`
+}
+
+/// Number of files with each status in a directory including all of its
+/// subdirectories
+type DiffCounts struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Grown     int `json:"grown"`
+	Shrunk    int `json:"shrunk"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+/// Returns true if any file was added, removed or changed
+func (c *DiffCounts) Changed() bool {
+	return c.Added+c.Removed+c.Grown+c.Shrunk+c.Modified > 0
+}
+
+func (c *DiffCounts) add(status DiffStatus) {
+	switch status {
+	case DiffStatusAdded:
+		c.Added++
+	case DiffStatusRemoved:
+		c.Removed++
+	case DiffStatusGrown:
+		c.Grown++
+	case DiffStatusShrunk:
+		c.Shrunk++
+	case DiffStatusModified:
+		c.Modified++
+	default:
+		c.Unchanged++
+	}
+}
+
+func (c *DiffCounts) addCounts(other DiffCounts) {
+	c.Added += other.Added
+	c.Removed += other.Removed
+	c.Grown += other.Grown
+	c.Shrunk += other.Shrunk
+	c.Modified += other.Modified
+	c.Unchanged += other.Unchanged
+}
+
+/// The difference of a directory between two trees, rolled up over all of
+/// its subdirectories
+type DirDiff struct {
+	DirName string     `json:"dirname"`
+	Status  DiffStatus `json:"status"`
+
+	/// Total size in the old tree in bytes, 0 if the directory was added
+	OldSize int64 `json:"old_size"`
+
+	/// Total size in the new tree in bytes, 0 if the directory was removed
+	NewSize int64 `json:"new_size"`
+
+	/// NewSize - OldSize
+	Delta int64 `json:"delta"`
+
+	Counts DiffCounts `json:"counts"`
+
+	/// The files of this immediate directory sorted by their name
+	Files []FileDiff `json:"files"`
+
+	/// The immediate subdirectories sorted by their name
+	Directories []DirDiff `json:"directories"`
+}
+
+/// Compares the tree `oldDir` to `newDir`, either of which may be nil.
+///
+/// Unchanged files and directories are only included in the lists of entries
+/// if `includeUnchanged` is true, they are always included in the counts.
+func DiffDirs(oldDir *Dir, newDir *Dir, includeUnchanged bool) DirDiff {
+	diff := DirDiff{Files: make([]FileDiff, 0), Directories: make([]DirDiff, 0)}
+	if oldDir != nil {
+		diff.DirName = oldDir.DirName
+		diff.OldSize = oldDir.TotalSize
+	}
+	if newDir != nil {
+		diff.DirName = newDir.DirName
+		diff.NewSize = newDir.TotalSize
+	}
+	diff.Delta = diff.NewSize - diff.OldSize
+
+	for _, fname := range unionOfNames(oldDir, newDir, (*Dir).fileNames) {
+		oldSize, inOld := filesOf(oldDir)[fname]
+		newSize, inNew := filesOf(newDir)[fname]
+
+		status := sizeDiffStatus(inOld, inNew, oldSize, newSize)
+		if status == DiffStatusUnchanged && oldDir.FileInfos[fname].Digest != newDir.FileInfos[fname].Digest {
+			status = DiffStatusModified
+		}
+		diff.Counts.add(status)
+		if status != DiffStatusUnchanged || includeUnchanged {
+			diff.Files = append(diff.Files, FileDiff{
+				Name: fname, Status: status, OldSize: oldSize, NewSize: newSize, Delta: newSize - oldSize,
+			})
+		}
+	}
+
+	for _, dirname := range unionOfNames(oldDir, newDir, (*Dir).subdirNames) {
+		var oldSubdir, newSubdir *Dir
+		if d, ok := subdirsOf(oldDir)[dirname]; ok {
+			oldSubdir = &d
+		}
+		if d, ok := subdirsOf(newDir)[dirname]; ok {
+			newSubdir = &d
+		}
+
+		subdiff := DiffDirs(oldSubdir, newSubdir, includeUnchanged)
+		diff.Counts.addCounts(subdiff.Counts)
+		if subdiff.Status != DiffStatusUnchanged || includeUnchanged {
+			diff.Directories = append(diff.Directories, subdiff)
+		}
+	}
+
+	diff.Status = sizeDiffStatus(oldDir != nil, newDir != nil, diff.OldSize, diff.NewSize)
+	if diff.Status == DiffStatusUnchanged && diff.Counts.Changed() {
+		diff.Status = DiffStatusModified
+	}
+	return diff
+}
+
+/// Compares the final root filesystems of the history entries `oldEntry` and
+/// `newEntry`, see DiffDirs
+func DiffHistoryEntries(oldEntry *ImageHistoryEntry, newEntry *ImageHistoryEntry, includeUnchanged bool) DirDiff {
+	return DiffDirs(
+		oldEntry.mergedRoot(oldEntry.orderedLayerDigests()),
+		newEntry.mergedRoot(newEntry.orderedLayerDigests()),
+		includeUnchanged,
+	)
+}
+
+func sizeDiffStatus(inOld bool, inNew bool, oldSize int64, newSize int64) DiffStatus {
+	switch {
+	case !inOld:
+		return DiffStatusAdded
+	case !inNew:
+		return DiffStatusRemoved
+	case newSize > oldSize:
+		return DiffStatusGrown
+	case newSize < oldSize:
+		return DiffStatusShrunk
+	default:
+		return DiffStatusUnchanged
+	}
+}
+
+func filesOf(d *Dir) map[string]int64 {
+	if d == nil {
+		return nil
+	}
+	return d.Files
+}
+
+func subdirsOf(d *Dir) map[string]Dir {
+	if d == nil {
+		return nil
+	}
+	return d.Directiories
+}
+
+/// Returns the names that `names` returns for `a` or `b` in lexicographical
+/// order, each only once. Either directory may be nil.
+func unionOfNames(a *Dir, b *Dir, names func(d *Dir) []string) []string {
+	seen := make(map[string]bool)
+	for _, d := range []*Dir{a, b} {
+		if d == nil {
+			continue
+		}
+		for _, name := range names(d) {
+			seen[name] = true
+		}
+	}
+
+	union := make([]string, 0, len(seen))
+	for name := range seen {
+		union = append(union, name)
+	}
+	sort.Strings(union)
+	return union
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffDirs(t *testing.T) {
+	oldDir := MakeDir("/")
+	oldDir.InsertIntoDir("/usr/bin/bash", 1000)
+	oldDir.InsertIntoDir("/usr/bin/zsh", 800)
+	oldDir.InsertIntoDir("/usr/lib/libc.so", 2000)
+	oldDir.InsertIntoDir("/etc/os-release", 100)
+	oldDir.InsertIntoDir("/opt/legacy/tool", 300)
+
+	newDir := MakeDir("/")
+	newDir.InsertIntoDir("/usr/bin/bash", 1200)
+	newDir.InsertIntoDir("/usr/lib/libc.so", 1500)
+	newDir.InsertIntoDir("/usr/lib/libm.so", 100)
+	newDir.InsertIntoDir("/etc/os-release", 100)
+	newDir.InsertIntoDir("/app/main", 512)
+
+	diff := DiffDirs(&oldDir, &newDir, false)
+	assert.Equal(t, "/", diff.DirName)
+	assert.Equal(t, DiffStatusShrunk, diff.Status)
+	assert.Equal(t, int64(4200), diff.OldSize)
+	assert.Equal(t, int64(3412), diff.NewSize)
+	assert.Equal(t, int64(-788), diff.Delta)
+	assert.Equal(t, DiffCounts{Added: 2, Removed: 2, Grown: 1, Shrunk: 1, Unchanged: 1}, diff.Counts)
+
+	// unchanged directories are omitted
+	require.Len(t, diff.Directories, 3)
+	app, opt, usr := diff.Directories[0], diff.Directories[1], diff.Directories[2]
+
+	assert.Equal(t, "app", app.DirName)
+	assert.Equal(t, DiffStatusAdded, app.Status)
+	assert.Equal(t, []FileDiff{{Name: "main", Status: DiffStatusAdded, NewSize: 512, Delta: 512}}, app.Files)
+
+	assert.Equal(t, DiffStatusRemoved, opt.Status)
+	assert.Equal(t, int64(-300), opt.Delta)
+	assert.Equal(t, DiffStatusRemoved, opt.Directories[0].Files[0].Status)
+
+	assert.Equal(t, DiffStatusShrunk, usr.Status)
+	assert.Equal(t, int64(-1000), usr.Delta)
+	assert.Equal(t, DiffCounts{Added: 1, Removed: 1, Grown: 1, Shrunk: 1}, usr.Counts)
+	assert.Equal(t, []FileDiff{
+		{Name: "bash", Status: DiffStatusGrown, OldSize: 1000, NewSize: 1200, Delta: 200},
+		{Name: "zsh", Status: DiffStatusRemoved, OldSize: 800, Delta: -800},
+	}, usr.Directories[0].Files)
+	assert.Equal(t, []FileDiff{
+		{Name: "libc.so", Status: DiffStatusShrunk, OldSize: 2000, NewSize: 1500, Delta: -500},
+		{Name: "libm.so", Status: DiffStatusAdded, NewSize: 100, Delta: 100},
+	}, usr.Directories[1].Files)
+
+	withUnchanged := DiffDirs(&oldDir, &newDir, true)
+	assert.Equal(t, diff.Counts, withUnchanged.Counts)
+	require.Len(t, withUnchanged.Directories, 4)
+	assert.Equal(t, "etc", withUnchanged.Directories[1].DirName)
+	assert.Equal(t, DiffStatusUnchanged, withUnchanged.Directories[1].Status)
+	assert.Equal(t, []FileDiff{{Name: "os-release", Status: DiffStatusUnchanged, OldSize: 100, NewSize: 100}}, withUnchanged.Directories[1].Files)
+}
+
+func TestDiffDirsComparesDigests(t *testing.T) {
+	oldDir := MakeDir("/")
+	oldDir.InsertFileIntoDir("/etc/config", 100, FileInfo{Type: FileTypeRegular, Digest: "sha256:aaa"})
+	newDir := MakeDir("/")
+	newDir.InsertFileIntoDir("/etc/config", 100, FileInfo{Type: FileTypeRegular, Digest: "sha256:bbb"})
+
+	diff := DiffDirs(&oldDir, &newDir, false)
+	assert.Equal(t, DiffStatusModified, diff.Status)
+	assert.Equal(t, DiffCounts{Modified: 1}, diff.Counts)
+	assert.Equal(t, DiffStatusModified, diff.Directories[0].Files[0].Status)
+
+	assert.Equal(t, DiffStatusUnchanged, DiffDirs(&oldDir, &oldDir, false).Status)
+}
+
+func TestDiffHistoryEntries(t *testing.T) {
+	base := NewLayer()
+	base.InsertIntoDir("/usr/bin/bash", 1000)
+	top := NewLayer()
+	top.InsertIntoDir("/usr/bin/.wh.bash", 0)
+	top.InsertIntoDir("/usr/bin/dash", 200)
+
+	oldEntry := ImageHistoryEntry{Contents: LayerSizes{"base": base}, History: []HistoryStep{{Layer: "base"}}}
+	newEntry := ImageHistoryEntry{
+		Contents: LayerSizes{"base": base, "top": top},
+		History:  []HistoryStep{{Layer: "base"}, {Index: 1, Layer: "top"}},
+	}
+
+	diff := DiffHistoryEntries(&oldEntry, &newEntry, false)
+	assert.Equal(t, int64(-800), diff.Delta)
+	assert.Equal(t, DiffCounts{Added: 1, Removed: 1}, diff.Counts)
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"os"
 	"path"
+	"sort"
 	"strings"
 )
 
@@ -19,8 +20,30 @@ type Dir struct {
 	/// Each file is a single entry in the map and the corresponding value is its size in bytes
 	Files map[string]int64 `json:"files"`
 
+	/// Metadata of the files in this immediate directory, the keys are the same
+	/// as in `Files`.
+	///
+	/// This map is nil for trees that were created without metadata.
+	FileInfos map[string]FileInfo `json:"file_info,omitempty"`
+
 	/// Map of all immediate subdirectories of this directory.
 	Directiories map[string]Dir `json:"directories"`
+
+	/// Number of hardlinks in this directory including all of its subdirectories
+	Hardlinks int64 `json:"hardlinks,omitempty"`
+
+	/// Number of bytes that the hardlinks in this directory including all of
+	/// its subdirectories save compared to copies of their targets
+	HardlinkSavedBytes int64 `json:"hardlink_saved_bytes,omitempty"`
+
+	/// Estimated contribution of this directory including all of its
+	/// subdirectories to the size of the compressed layer
+	EstimatedCompressedSize int64 `json:"estimated_compressed_size,omitempty"`
+
+	/// Total size of the files of each category in this directory including
+	/// all of its subdirectories, nil for trees that were created without
+	/// metadata
+	CategorySizes map[FileCategory]int64 `json:"category_sizes,omitempty"`
 }
 
 /// Creates an empty directory with the given directory name `dirname`.
@@ -47,21 +70,153 @@ func dropEmptyStrings(sl []string) []string {
 /// Any non-existing directories leading up to `filePath` are created and the file is inserted into the correct spot.
 /// The total size of all directories is adjusted accordingly.
 func (d *Dir) InsertIntoDir(filePath string, size int64) {
+	d.insert(filePath, size, nil)
+}
+
+/// Insert the file with the given path `filePath` and its metadata `info` into
+/// the directory structure starting at `d`, analogously to `InsertIntoDir`.
+func (d *Dir) InsertFileIntoDir(filePath string, size int64, info FileInfo) {
+	d.insert(filePath, size, &info)
+}
+
+func (d *Dir) insert(filePath string, size int64, info *FileInfo) {
 	fname := path.Base(filePath)
 	dirname := path.Dir(filePath)
 
 	dirs := dropEmptyStrings(strings.Split(dirname, string(os.PathSeparator)))
 
 	d.TotalSize += size
+	if info != nil {
+		d.EstimatedCompressedSize += info.EstimatedCompressedSize
+		d.addCategorySize(info.Category, size)
+	}
 
 	if dirname == path.Base(d.DirName) || dirname == "." {
 		d.Files[fname] = size
+		if info != nil {
+			d.setFileInfo(fname, *info)
+		}
 	} else {
 		if _, ok := d.Directiories[dirs[0]]; !ok {
 			d.Directiories[dirs[0]] = MakeDir(dirs[0])
 		}
 		subdir := d.Directiories[dirs[0]]
-		subdir.InsertIntoDir(strings.Join(append(dirs[1:], fname), string(os.PathSeparator)), size)
+		subdir.insert(strings.Join(append(dirs[1:], fname), string(os.PathSeparator)), size, info)
 		d.Directiories[dirs[0]] = subdir
 	}
 }
+
+/// Sets the metadata of the file `fname` in this directory
+func (d *Dir) setFileInfo(fname string, info FileInfo) {
+	if d.FileInfos == nil {
+		d.FileInfos = make(map[string]FileInfo)
+	}
+	d.FileInfos[fname] = info
+}
+
+/// Removes the file `fname` including its metadata from this directory,
+/// without updating the total size.
+func (d *Dir) removeFile(fname string) {
+	delete(d.Files, fname)
+	delete(d.FileInfos, fname)
+}
+
+/// Returns the subdirectory with the path `dirPath` relative to `d` or nil if
+/// no such directory exists.
+///
+/// Modifications of the returned directory are not propagated to `d`.
+func (d *Dir) FindSubdir(dirPath string) *Dir {
+	cur := d
+	for _, dirname := range dropEmptyStrings(strings.Split(dirPath, string(os.PathSeparator))) {
+		subdir, ok := cur.Directiories[dirname]
+		if !ok {
+			return nil
+		}
+		cur = &subdir
+	}
+	return cur
+}
+
+/// Returns the size and the metadata of the file with the path `filePath`
+/// relative to `d`. `ok` is false if the file does not exist.
+func (d *Dir) FindFile(filePath string) (size int64, info FileInfo, ok bool) {
+	subdir := d.FindSubdir(path.Dir(filePath))
+	if subdir == nil {
+		return 0, info, false
+	}
+	fname := path.Base(filePath)
+	size, ok = subdir.Files[fname]
+	return size, subdir.FileInfos[fname], ok
+}
+
+/// Calls `fn` for `d` and all of its subdirectories with the full path of each
+/// directory.
+///
+/// Modifications of the maps of each directory are propagated to `d`, all
+/// other modifications are not.
+func (d *Dir) WalkDirs(fn func(dirPath string, dir *Dir)) {
+	d.walkDirs(d.DirName, fn)
+}
+
+func (d *Dir) walkDirs(dirPath string, fn func(dirPath string, dir *Dir)) {
+	fn(dirPath, d)
+	for _, dirname := range d.subdirNames() {
+		subdir := d.Directiories[dirname]
+		subdir.walkDirs(path.Join(dirPath, dirname), fn)
+	}
+}
+
+/// Calls `fn` for every file in `d` and all of its subdirectories with the
+/// full path of the file and its size.
+///
+/// Files and directories are visited in lexicographical order.
+func (d *Dir) WalkFiles(fn func(filePath string, size int64)) {
+	d.walkFiles(d.DirName, fn)
+}
+
+func (d *Dir) walkFiles(dirPath string, fn func(filePath string, size int64)) {
+	for _, fname := range d.fileNames() {
+		fn(path.Join(dirPath, fname), d.Files[fname])
+	}
+
+	for _, dirname := range d.subdirNames() {
+		subdir := d.Directiories[dirname]
+		subdir.walkFiles(path.Join(dirPath, dirname), fn)
+	}
+}
+
+/// Calls `fn` like `WalkFiles` with the metadata of each file in addition.
+func (d *Dir) walkFileInfos(fn func(filePath string, size int64, info FileInfo)) {
+	d.walkFileInfosOfDir(d.DirName, fn)
+}
+
+func (d *Dir) walkFileInfosOfDir(dirPath string, fn func(filePath string, size int64, info FileInfo)) {
+	for _, fname := range d.fileNames() {
+		fn(path.Join(dirPath, fname), d.Files[fname], d.FileInfos[fname])
+	}
+
+	for _, dirname := range d.subdirNames() {
+		subdir := d.Directiories[dirname]
+		subdir.walkFileInfosOfDir(path.Join(dirPath, dirname), fn)
+	}
+}
+
+/// Returns the names of all files in this directory in lexicographical order.
+func (d *Dir) fileNames() []string {
+	fnames := make([]string, 0, len(d.Files))
+	for fname := range d.Files {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	return fnames
+}
+
+/// Returns the names of all immediate subdirectories in lexicographical order.
+func (d *Dir) subdirNames() []string {
+	dirnames := make([]string, 0, len(d.Directiories))
+	for dirname := range d.Directiories {
+		dirnames = append(dirnames, dirname)
+	}
+	sort.Strings(dirnames)
+	return dirnames
+}
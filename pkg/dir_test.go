@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -121,3 +124,90 @@ func TestInsertMultiple(t *testing.T) {
 		t.Errorf("Invalid total size of /etc, got: %d, expected: %d", eS, osReleaseSize)
 	}
 }
+
+func TestWalkFiles(t *testing.T) {
+	root := MakeDir("/")
+	root.InsertIntoDir("/usr/bin/cat", 16)
+	root.InsertIntoDir("/etc/os-release", 5)
+	root.InsertIntoDir("/etc/hosts", 2)
+	root.InsertIntoDir("/vmlinuz", 1024)
+
+	var paths []string
+	var total int64
+	root.WalkFiles(func(filePath string, size int64) {
+		paths = append(paths, filePath)
+		total += size
+	})
+
+	expectedPaths := []string{"/vmlinuz", "/etc/hosts", "/etc/os-release", "/usr/bin/cat"}
+	if len(paths) != len(expectedPaths) {
+		t.Fatalf("Expected to visit %d files, but visited %d", len(expectedPaths), len(paths))
+	}
+	for i, p := range expectedPaths {
+		if paths[i] != p {
+			t.Errorf("Expected to visit %s at position %d, but got %s", p, i, paths[i])
+		}
+	}
+	if total != root.TotalSize {
+		t.Errorf("Sum of the visited files %d does not match the total size %d", total, root.TotalSize)
+	}
+}
+
+func TestInsertFileWithMetadata(t *testing.T) {
+	root := MakeDir("/")
+	info := FileInfo{Type: FileTypeSymlink, Mode: 0777, LinkTarget: "../lib64/libc.so.6"}
+
+	root.InsertFileIntoDir("/usr/lib/libc.so.6", 18, info)
+	root.InsertIntoDir("/usr/lib/libm.so.6", 42)
+
+	lib := root.Directiories["usr"].Directiories["lib"]
+	if lib.Files["libc.so.6"] != 18 {
+		t.Errorf("Invalid size of libc.so.6: %d", lib.Files["libc.so.6"])
+	}
+	if got := lib.FileInfos["libc.so.6"]; got != info {
+		t.Errorf("Invalid metadata of libc.so.6: %v, expected %v", got, info)
+	}
+	if _, ok := lib.FileInfos["libm.so.6"]; ok {
+		t.Error("libm.so.6 was inserted without metadata, but got some")
+	}
+	if root.TotalSize != 60 {
+		t.Errorf("Invalid total size of '/': %d, expected 60", root.TotalSize)
+	}
+}
+
+func TestDirJsonIsBackwardsCompatible(t *testing.T) {
+	root := MakeDir("/")
+	root.InsertIntoDir("/etc/os-release", 5)
+
+	j, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "file_info") {
+		t.Errorf("Directory without metadata must not contain the file_info key, got: %s", j)
+	}
+
+	var d Dir
+	oldJson := `{"dirname":"/","total_size":5,"files":{},"directories":{"etc":{"dirname":"etc","total_size":5,"files":{"os-release":5},"directories":{}}}}`
+	if err := json.Unmarshal([]byte(oldJson), &d); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(root, d) {
+		t.Errorf("Unmarshaled directory %v does not match %v", d, root)
+	}
+}
+
+func TestFindSubdir(t *testing.T) {
+	root := MakeDir("/")
+	root.InsertIntoDir("/usr/lib64/libc.so.6", 2048)
+
+	if d := root.FindSubdir("/"); d == nil || d.DirName != "/" {
+		t.Errorf("Expected to find the root directory, got %v", d)
+	}
+	if d := root.FindSubdir("/usr/lib64"); d == nil || d.Files["libc.so.6"] != 2048 {
+		t.Errorf("Expected to find /usr/lib64, got %v", d)
+	}
+	if d := root.FindSubdir("usr/share"); d != nil {
+		t.Errorf("Expected to not find /usr/share, got %v", d)
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+/// A copy of a file in a layer
+type DuplicateFile struct {
+	/// Full path of the file
+	Path string `json:"path"`
+
+	/// Digest of the layer containing this copy
+	Layer string `json:"layer"`
+
+	/// true if this copy is present in the final image, false if it is
+	/// overwritten or removed by a subsequent layer
+	InFinalImage bool `json:"in_final_image"`
+}
+
+/// Files with identical contents
+type DuplicateGroup struct {
+	/// Digest of the contents of the files
+	Digest string `json:"digest"`
+
+	/// Size of a single file in bytes
+	Size int64 `json:"size"`
+
+	/// All copies of the file in the order of the layers and their paths
+	Files []DuplicateFile `json:"files"`
+
+	/// Number of bytes that could be saved by storing the contents only once
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+/// All files of an image whose contents are stored more than once
+type DuplicateReport struct {
+	/// The groups of identical files, the one with the most reclaimable bytes
+	/// first
+	Groups []DuplicateGroup `json:"groups"`
+
+	/// Number of bytes that could be saved by storing each file only once
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+/// Finds regular files with identical contents in `layers`, either at
+/// different paths or added again verbatim in several layers.
+///
+/// `layerDigests` are the digests of the layers in `layers` ordered from the
+/// lowest to the topmost layer. Only files whose contents have been hashed
+/// are considered, see `LayerAnalysisOptions`. Hardlinks are not duplicates,
+/// as they share the contents of their target.
+func FindDuplicates(layerDigests []string, layers LayerSizes) DuplicateReport {
+	groups := make(map[string]*DuplicateGroup)
+	order := make([]string, 0)
+
+	for i, digest := range layerDigests {
+		l := layers[digest]
+
+		l.walkFileInfos(func(filePath string, size int64, info FileInfo) {
+			if info.Type != FileTypeRegular || info.Digest == "" || IsWhiteout(path.Base(filePath)) {
+				return
+			}
+
+			inFinalImage := true
+			for _, upperDigest := range layerDigests[i+1:] {
+				upper := layers[upperDigest]
+				if hidden, _ := upper.hides(filePath); hidden {
+					inFinalImage = false
+					break
+				}
+			}
+
+			group, ok := groups[info.Digest]
+			if !ok {
+				group = &DuplicateGroup{Digest: info.Digest, Size: size}
+				groups[info.Digest] = group
+				order = append(order, info.Digest)
+			}
+			group.Files = append(group.Files, DuplicateFile{
+				Path:         filePath,
+				Layer:        digest,
+				InFinalImage: inFinalImage,
+			})
+		})
+	}
+
+	report := DuplicateReport{Groups: make([]DuplicateGroup, 0)}
+	for _, contentDigest := range order {
+		group := groups[contentDigest]
+		if len(group.Files) < 2 {
+			continue
+		}
+		group.ReclaimableBytes = group.Size * int64(len(group.Files)-1)
+		report.ReclaimableBytes += group.ReclaimableBytes
+		report.Groups = append(report.Groups, *group)
+	}
+
+	sort.SliceStable(report.Groups, func(i, j int) bool {
+		return report.Groups[i].ReclaimableBytes > report.Groups[j].ReclaimableBytes
+	})
+
+	return report
+}
+
+/// Finds the duplicate files in the layers of this history entry, see
+/// `FindDuplicates`.
+///
+/// The layers are ordered as in the inspect info of the image, layers that are
+/// missing there are appended in lexicographical order.
+func (e *ImageHistoryEntry) Duplicates() DuplicateReport {
+	return FindDuplicates(e.orderedLayerDigests(), e.Contents)
+}
+
+/// Returns the digests of the layers in `e.Contents` in the order of the
+/// image's history, or of its inspect info for entries that were stored
+/// without a history.
+func (e *ImageHistoryEntry) orderedLayerDigests() []string {
+	digests := make([]string, 0, len(e.Contents))
+	seen := make(map[string]bool, len(e.Contents))
+
+	ordered := layerDigestsOfHistory(e.History)
+	if e.History == nil {
+		for _, layerDigest := range e.InspectInfo.Layers {
+			d := strings.Split(layerDigest, ":")
+			ordered = append(ordered, d[len(d)-1])
+		}
+	}
+	for _, hex := range ordered {
+		if _, ok := e.Contents[hex]; ok && !seen[hex] {
+			digests = append(digests, hex)
+			seen[hex] = true
+		}
+	}
+
+	remaining := make([]string, 0)
+	for hex := range e.Contents {
+		if !seen[hex] {
+			remaining = append(remaining, hex)
+		}
+	}
+	sort.Strings(remaining)
+
+	return append(digests, remaining...)
+}
+
+/// Returns the final root filesystem of this history entry, entries that
+/// were stored without it are merged from their layers in the order
+/// `layerDigests`.
+func (e *ImageHistoryEntry) mergedRoot(layerDigests []string) *Dir {
+	if e.MergedContents != nil {
+		return e.MergedContents
+	}
+
+	orderedLayers := make([]Dir, 0, len(layerDigests))
+	for _, d := range layerDigests {
+		orderedLayers = append(orderedLayers, e.Contents[d].Dir)
+	}
+	merged := MergeLayers(orderedLayers)
+	return &merged
+}
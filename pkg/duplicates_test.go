@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/// Inserts a regular file with the contents digest `digest` into `l`
+func insertHashedFile(l *Layer, filePath string, size int64, digest string) {
+	l.InsertFileIntoDir(filePath, size, FileInfo{Type: FileTypeRegular, Digest: digest})
+	l.ContentsHashed = true
+}
+
+func TestFindDuplicates(t *testing.T) {
+	base := NewLayer()
+	insertHashedFile(&base, "/usr/lib/libfoo.so", 1000, "sha256:foo")
+	insertHashedFile(&base, "/usr/lib64/libfoo.so", 1000, "sha256:foo")
+	insertHashedFile(&base, "/etc/config", 10, "sha256:config")
+	insertHashedFile(&base, "/usr/bin/unique", 500, "sha256:unique")
+	// hardlinks share the contents of their target
+	base.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/lib/libfoo.so.1", Linkname: "usr/lib/libfoo.so"})
+
+	// re-adds the config verbatim and copies the library once more
+	top := NewLayer()
+	insertHashedFile(&top, "/etc/config", 10, "sha256:config")
+	insertHashedFile(&top, "/opt/libfoo.so", 1000, "sha256:foo")
+	top.InsertIntoDir("/usr/lib64/.wh.libfoo.so", 0)
+
+	layers := LayerSizes{"base": base, "top": top}
+	report := FindDuplicates([]string{"base", "top"}, layers)
+
+	assert.Equal(t, DuplicateReport{
+		Groups: []DuplicateGroup{
+			{
+				Digest: "sha256:foo",
+				Size:   1000,
+				Files: []DuplicateFile{
+					{Path: "/usr/lib/libfoo.so", Layer: "base", InFinalImage: true},
+					{Path: "/usr/lib64/libfoo.so", Layer: "base", InFinalImage: false},
+					{Path: "/opt/libfoo.so", Layer: "top", InFinalImage: true},
+				},
+				ReclaimableBytes: 2000,
+			},
+			{
+				Digest: "sha256:config",
+				Size:   10,
+				Files: []DuplicateFile{
+					{Path: "/etc/config", Layer: "base", InFinalImage: false},
+					{Path: "/etc/config", Layer: "top", InFinalImage: true},
+				},
+				ReclaimableBytes: 10,
+			},
+		},
+		ReclaimableBytes: 2010,
+	}, report)
+}
+
+func TestFindDuplicatesWithoutHashes(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/foo", 100)
+	l.InsertIntoDir("/bar", 100)
+
+	assert.Equal(t, DuplicateReport{Groups: []DuplicateGroup{}}, FindDuplicates([]string{"l"}, LayerSizes{"l": l}))
+}
+
+func TestImageHistoryEntryDuplicates(t *testing.T) {
+	lower := NewLayer()
+	insertHashedFile(&lower, "/foo", 100, "sha256:foo")
+	upper := NewLayer()
+	insertHashedFile(&upper, "/foo", 100, "sha256:foo")
+
+	entry := ImageHistoryEntry{
+		Contents: LayerSizes{"bbbb": lower, "aaaa": upper},
+	}
+	entry.InspectInfo.Layers = []string{"sha256:bbbb", "sha256:aaaa"}
+
+	report := entry.Duplicates()
+	assert.Equal(t, int64(100), report.ReclaimableBytes)
+	assert.Equal(t, []DuplicateFile{
+		{Path: "/foo", Layer: "bbbb", InFinalImage: false},
+		{Path: "/foo", Layer: "aaaa", InFinalImage: true},
+	}, report.Groups[0].Files)
+
+	// without the order of the layers, they are sorted by their digest
+	entry.InspectInfo.Layers = nil
+	assert.Equal(t, "aaaa", entry.Duplicates().Groups[0].Files[0].Layer)
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInefficientImage = errors.New("The image efficiency is below the threshold")
+)
+
+/// A file that is present in a layer, but not in the final image
+type WastedFile struct {
+	/// Full path of the file
+	Path string `json:"path"`
+
+	/// Size of the file in bytes
+	Size int64 `json:"size"`
+
+	/// Digest of the layer that overwrote or removed this file
+	RemovedBy string `json:"removed_by"`
+
+	/// true if the file got removed via a whiteout, false if it got
+	/// overwritten by a file with the same path
+	Deleted bool `json:"deleted"`
+}
+
+/// The wasted space of a single layer
+type LayerEfficiency struct {
+	/// Digest of the layer
+	Digest string `json:"digest"`
+
+	/// Total size of all files in this layer in bytes
+	TotalSize int64 `json:"total_size"`
+
+	/// Number of bytes in this layer that are overwritten or removed by a
+	/// subsequent layer
+	WastedBytes int64 `json:"wasted_bytes"`
+
+	/// All files of this layer that are overwritten or removed later, the
+	/// largest first
+	WastedFiles []WastedFile `json:"wasted_files"`
+}
+
+/// The wasted space of a whole image
+type EfficiencyReport struct {
+	/// Sum of the sizes of all layers in bytes
+	TotalBytes int64 `json:"total_bytes"`
+
+	/// Number of bytes that are present in a layer but not in the final image
+	WastedBytes int64 `json:"wasted_bytes"`
+
+	/// Fraction of the bytes of all layers that end up in the final image,
+	/// 1 for an image without any wasted space
+	Efficiency float64 `json:"efficiency"`
+
+	/// The report of each layer in the order of the manifest
+	Layers []LayerEfficiency `json:"layers"`
+}
+
+/// Calculates how many bytes of each layer are overwritten or deleted by a
+/// subsequent layer.
+///
+/// `layerDigests` are the digests of the layers in `layers` ordered from the
+/// lowest to the topmost layer.
+func CalculateEfficiency(layerDigests []string, layers LayerSizes) EfficiencyReport {
+	report := EfficiencyReport{
+		Efficiency: 1,
+		Layers:     make([]LayerEfficiency, 0, len(layerDigests)),
+	}
+
+	for i, digest := range layerDigests {
+		l := layers[digest]
+		layerReport := LayerEfficiency{
+			Digest:      digest,
+			TotalSize:   l.TotalSize,
+			WastedFiles: make([]WastedFile, 0),
+		}
+
+		l.WalkFiles(func(filePath string, size int64) {
+			if IsWhiteout(path.Base(filePath)) {
+				return
+			}
+
+			for _, upperDigest := range layerDigests[i+1:] {
+				upper := layers[upperDigest]
+				if hidden, deleted := upper.hides(filePath); hidden {
+					layerReport.WastedBytes += size
+					layerReport.WastedFiles = append(layerReport.WastedFiles, WastedFile{
+						Path:      filePath,
+						Size:      size,
+						RemovedBy: upperDigest,
+						Deleted:   deleted,
+					})
+					return
+				}
+			}
+		})
+
+		sort.SliceStable(layerReport.WastedFiles, func(i, j int) bool {
+			return layerReport.WastedFiles[i].Size > layerReport.WastedFiles[j].Size
+		})
+
+		report.TotalBytes += layerReport.TotalSize
+		report.WastedBytes += layerReport.WastedBytes
+		report.Layers = append(report.Layers, layerReport)
+	}
+
+	if report.TotalBytes > 0 {
+		report.Efficiency = float64(report.TotalBytes-report.WastedBytes) / float64(report.TotalBytes)
+	}
+
+	return report
+}
+
+/// Returns an error wrapping `ErrInefficientImage` if the efficiency of the
+/// image is below `minEfficiency`.
+func (r *EfficiencyReport) CheckThreshold(minEfficiency float64) error {
+	if r.Efficiency < minEfficiency {
+		return fmt.Errorf(
+			"%w: efficiency is %.2f%%, expected at least %.2f%% (%d bytes wasted)",
+			ErrInefficientImage,
+			r.Efficiency*100,
+			minEfficiency*100,
+			r.WastedBytes,
+		)
+	}
+	return nil
+}
+
+/// Checks whether the file with the path `filePath` from a lower layer is
+/// hidden by the layer `d`.
+///
+/// `hidden` is true if the file is overwritten or removed, `deleted` is true if
+/// it is removed via a whiteout or an opaque directory.
+func (d *Dir) hides(filePath string) (hidden bool, deleted bool) {
+	components := dropEmptyStrings(strings.Split(filePath, "/"))
+
+	cur := d
+	for i, c := range components {
+		if _, ok := cur.Files[OpaqueWhiteout]; ok {
+			return true, true
+		}
+		if _, ok := cur.Files[WhiteoutPrefix+c]; ok {
+			return true, true
+		}
+		if _, ok := cur.Files[c]; ok {
+			// either the file itself or a file replacing a parent directory
+			return true, i < len(components)-1
+		}
+
+		subdir, ok := cur.Directiories[c]
+		if !ok {
+			return false, false
+		}
+		if i == len(components)-1 {
+			// the file got replaced by a directory
+			return true, true
+		}
+		cur = &subdir
+	}
+	return false, false
+}
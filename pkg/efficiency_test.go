@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEfficiencyWithoutWaste(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/usr/bin/cat", 128)
+
+	report := CalculateEfficiency([]string{"a"}, LayerSizes{"a": l})
+
+	assert.Equal(t, int64(128), report.TotalBytes)
+	assert.Equal(t, int64(0), report.WastedBytes)
+	assert.Equal(t, 1.0, report.Efficiency)
+	require.Len(t, report.Layers, 1)
+	assert.Empty(t, report.Layers[0].WastedFiles)
+	assert.NoError(t, report.CheckThreshold(1))
+}
+
+func TestEfficiencyOfEmptyImage(t *testing.T) {
+	report := CalculateEfficiency([]string{}, LayerSizes{})
+	assert.Equal(t, 1.0, report.Efficiency)
+}
+
+func TestEfficiencyOverwrittenAndDeletedFiles(t *testing.T) {
+	base := NewLayer()
+	base.InsertIntoDir("/etc/os-release", 100)
+	base.InsertIntoDir("/usr/bin/cat", 200)
+
+	install := NewLayer()
+	install.InsertIntoDir("/var/cache/zypp/packages/foo.rpm", 500)
+	install.InsertIntoDir("/var/cache/zypp/solv/solv", 100)
+	install.InsertIntoDir("/etc/os-release", 100)
+
+	cleanup := NewLayer()
+	cleanup.InsertIntoDir("/var/cache/.wh.zypp", 0)
+
+	layers := LayerSizes{"base": base, "install": install, "cleanup": cleanup}
+	report := CalculateEfficiency([]string{"base", "install", "cleanup"}, layers)
+
+	assert.Equal(t, int64(1000), report.TotalBytes)
+	assert.Equal(t, int64(700), report.WastedBytes)
+	assert.InDelta(t, 0.3, report.Efficiency, 1e-9)
+
+	require.Len(t, report.Layers, 3)
+	assert.Equal(t, "base", report.Layers[0].Digest)
+	assert.Equal(t, int64(100), report.Layers[0].WastedBytes)
+	assert.Equal(t, []WastedFile{
+		{Path: "/etc/os-release", Size: 100, RemovedBy: "install", Deleted: false},
+	}, report.Layers[0].WastedFiles)
+
+	assert.Equal(t, int64(600), report.Layers[1].WastedBytes)
+	assert.Equal(t, []WastedFile{
+		{Path: "/var/cache/zypp/packages/foo.rpm", Size: 500, RemovedBy: "cleanup", Deleted: true},
+		{Path: "/var/cache/zypp/solv/solv", Size: 100, RemovedBy: "cleanup", Deleted: true},
+	}, report.Layers[1].WastedFiles)
+
+	assert.Equal(t, int64(0), report.Layers[2].WastedBytes)
+
+	err := report.CheckThreshold(0.9)
+	assert.True(t, errors.Is(err, ErrInefficientImage))
+	assert.NoError(t, report.CheckThreshold(0.3))
+}
+
+func TestEfficiencyOpaqueWhiteout(t *testing.T) {
+	lower := NewLayer()
+	lower.InsertIntoDir("/app/node_modules/foo/index.js", 64)
+	lower.InsertIntoDir("/app/package.json", 8)
+
+	upper := NewLayer()
+	upper.InsertIntoDir("/app/node_modules/"+OpaqueWhiteout, 0)
+	upper.InsertIntoDir("/app/node_modules/bar/index.js", 32)
+
+	report := CalculateEfficiency([]string{"lower", "upper"}, LayerSizes{"lower": lower, "upper": upper})
+
+	assert.Equal(t, int64(64), report.WastedBytes)
+	assert.Equal(t, []WastedFile{
+		{Path: "/app/node_modules/foo/index.js", Size: 64, RemovedBy: "upper", Deleted: true},
+	}, report.Layers[0].WastedFiles)
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ExportFormatNcdu       = "ncdu"
+	ExportFormatCSV        = "csv"
+	ExportFormatFolded     = "folded"
+	ExportFormatPrometheus = "prometheus"
+)
+
+/// The data of an analyzed image that is passed to an exporter
+type ExportedImage struct {
+	/// Name of the image including its tag
+	Name string
+
+	/// Digest of the layer that is exported on its own, empty if the whole
+	/// image is exported
+	Layer string
+
+	/// Digests of the layers ordered from the lowest to the topmost layer
+	LayerDigests []string
+
+	Layers LayerSizes
+
+	/// The tree that is exported, either the final root filesystem or the
+	/// tree of `Layer`
+	Root *Dir
+
+	/// Time of the export
+	Timestamp time.Time
+}
+
+/// Writes an image in a specific format
+type Exporter struct {
+	/// MIME type of the written data
+	ContentType string
+
+	Export func(w io.Writer, image ExportedImage) error
+}
+
+/// All exporters, the keys are the names of their formats
+var Exporters = map[string]Exporter{
+	ExportFormatNcdu: {
+		ContentType: "application/json",
+		Export: func(w io.Writer, image ExportedImage) error {
+			name := image.Name
+			if image.Layer != "" {
+				name = image.Layer
+			}
+			return WriteNcduExport(w, image.Root, name, image.Timestamp)
+		},
+	},
+	ExportFormatCSV:        {ContentType: "text/csv", Export: WriteCSVExport},
+	ExportFormatFolded:     {ContentType: "text/plain", Export: WriteFoldedExport},
+	ExportFormatPrometheus: {ContentType: "text/plain; version=0.0.4", Export: WritePrometheusExport},
+}
+
+/// Returns the names of all export formats in lexicographical order
+func ExportFormats() []string {
+	formats := make([]string, 0, len(Exporters))
+	for f := range Exporters {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+/// Returns the digests of all layers of `image` in their order, each only once
+func (image *ExportedImage) uniqueLayerDigests() []string {
+	digests := make([]string, 0, len(image.LayerDigests))
+	seen := make(map[string]bool, len(image.LayerDigests))
+	for _, digest := range image.LayerDigests {
+		if _, ok := image.Layers[digest]; ok && !seen[digest] {
+			seen[digest] = true
+			digests = append(digests, digest)
+		}
+	}
+	return digests
+}
+
+/// Writes a row with the columns layer, path, size and type for every file of
+/// every layer of `image` to `w`, or only of `image.Layer` if it is set.
+///
+/// Whiteout files have the type whiteout, the type is empty for files without
+/// metadata.
+func WriteCSVExport(w io.Writer, image ExportedImage) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"layer", "path", "size", "type"}); err != nil {
+		return err
+	}
+
+	digests := image.uniqueLayerDigests()
+	if image.Layer != "" {
+		digests = []string{image.Layer}
+	}
+	for _, digest := range digests {
+		l := image.Layers[digest]
+		var err error
+		l.walkFileInfos(func(filePath string, size int64, info FileInfo) {
+			if err != nil {
+				return
+			}
+			fileType := string(info.Type)
+			if IsWhiteout(path.Base(filePath)) {
+				fileType = "whiteout"
+			}
+			err = cw.Write([]string{digest, filePath, fmt.Sprint(size), fileType})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+/// Writes the files of `image.Root` in the folded stack format of flamegraph
+/// tools to `w`: one line per non-empty file with its path segments separated
+/// by semicolons followed by its size.
+func WriteFoldedExport(w io.Writer, image ExportedImage) error {
+	bw := bufio.NewWriter(w)
+	image.Root.WalkFiles(func(filePath string, size int64) {
+		if size == 0 {
+			return
+		}
+		frames := dropEmptyStrings(strings.Split(filePath, "/"))
+		for i, f := range frames {
+			// semicolons separate the frames
+			frames[i] = strings.ReplaceAll(f, ";", "_")
+		}
+		fmt.Fprintf(bw, "%s %d\n", strings.Join(frames, ";"), size)
+	})
+	return bw.Flush()
+}
+
+/// Writes the sizes of `image` as gauges in the Prometheus text exposition
+/// format to `w`: the total and compressed size of the image and of each of
+/// its layers and the size of each top level directory of `image.Root`.
+func WritePrometheusExport(w io.Writer, image ExportedImage) error {
+	bw := bufio.NewWriter(w)
+	imageLabel := fmt.Sprintf(`image="%s"`, escapePrometheusLabel(image.Name))
+
+	digests := image.uniqueLayerDigests()
+	var totalSize, compressedSize int64
+	for _, digest := range digests {
+		totalSize += image.Layers[digest].TotalSize
+		compressedSize += image.Layers[digest].CompressedSize
+	}
+
+	writeGauge := func(name string, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	writeGauge("container_image_size_bytes", "Sum of the uncompressed sizes of all layers of the image")
+	fmt.Fprintf(bw, "container_image_size_bytes{%s} %d\n", imageLabel, totalSize)
+	writeGauge("container_image_compressed_size_bytes", "Sum of the compressed sizes of all layers of the image")
+	fmt.Fprintf(bw, "container_image_compressed_size_bytes{%s} %d\n", imageLabel, compressedSize)
+
+	writeGauge("container_layer_size_bytes", "Uncompressed size of a layer")
+	for _, digest := range digests {
+		fmt.Fprintf(bw, "container_layer_size_bytes{%s,layer=\"%s\"} %d\n", imageLabel, digest, image.Layers[digest].TotalSize)
+	}
+	writeGauge("container_layer_compressed_size_bytes", "Compressed size of a layer")
+	for _, digest := range digests {
+		fmt.Fprintf(bw, "container_layer_compressed_size_bytes{%s,layer=\"%s\"} %d\n", imageLabel, digest, image.Layers[digest].CompressedSize)
+	}
+
+	writeGauge("container_directory_size_bytes", "Size of a top level directory of the image")
+	for _, dirname := range image.Root.subdirNames() {
+		fmt.Fprintf(
+			bw, "container_directory_size_bytes{%s,path=\"%s\"} %d\n",
+			imageLabel, escapePrometheusLabel(path.Join("/", dirname)), image.Root.Directiories[dirname].TotalSize,
+		)
+	}
+
+	return bw.Flush()
+}
+
+/// Escapes backslashes, double quotes and line feeds in the label value `v`
+func escapePrometheusLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/// Returns an image with a base layer and a layer that removes a file of it
+func testExportedImage() ExportedImage {
+	base := NewLayer()
+	base.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/bash", Size: 4096})
+	base.InsertTarEntry(&tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/sh", Linkname: "bash"})
+	base.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/a;b", Size: 100})
+	base.CompressedSize = 2000
+
+	top := NewLayer()
+	top.InsertIntoDir("/etc/.wh.a;b", 0)
+	top.InsertIntoDir("/app/main", 512)
+	top.CompressedSize = 300
+
+	layers := LayerSizes{"base": base, "top": top}
+	merged := MergeLayers([]Dir{base.Dir, top.Dir})
+	return ExportedImage{
+		Name:         `registry.example.com/"app":1`,
+		LayerDigests: []string{"base", "top", "top"},
+		Layers:       layers,
+		Root:         &merged,
+		Timestamp:    time.Unix(0, 0),
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	assert.Equal(t, []string{ExportFormatCSV, ExportFormatFolded, ExportFormatNcdu, ExportFormatPrometheus}, ExportFormats())
+}
+
+func TestWriteCSVExport(t *testing.T) {
+	image := testExportedImage()
+
+	var out bytes.Buffer
+	require.NoError(t, WriteCSVExport(&out, image))
+	assert.Equal(t, `layer,path,size,type
+base,/etc/a;b,100,regular
+base,/usr/bin/bash,4096,regular
+base,/usr/bin/sh,0,symlink
+top,/app/main,512,
+top,/etc/.wh.a;b,0,whiteout
+`, out.String())
+
+	out.Reset()
+	image.Layer = "top"
+	require.NoError(t, WriteCSVExport(&out, image))
+	assert.Equal(t, `layer,path,size,type
+top,/app/main,512,
+top,/etc/.wh.a;b,0,whiteout
+`, out.String())
+}
+
+func TestWriteFoldedExport(t *testing.T) {
+	image := testExportedImage()
+
+	var out bytes.Buffer
+	require.NoError(t, WriteFoldedExport(&out, image))
+	assert.Equal(t, "app;main 512\nusr;bin;bash 4096\n", out.String())
+
+	out.Reset()
+	base := image.Layers["base"]
+	image.Root = &base.Dir
+	require.NoError(t, WriteFoldedExport(&out, image))
+	assert.Equal(t, "etc;a_b 100\nusr;bin;bash 4096\n", out.String())
+}
+
+func TestWritePrometheusExport(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, WritePrometheusExport(&out, testExportedImage()))
+	assert.Equal(t, `# HELP container_image_size_bytes Sum of the uncompressed sizes of all layers of the image
+# TYPE container_image_size_bytes gauge
+container_image_size_bytes{image="registry.example.com/\"app\":1"} 4708
+# HELP container_image_compressed_size_bytes Sum of the compressed sizes of all layers of the image
+# TYPE container_image_compressed_size_bytes gauge
+container_image_compressed_size_bytes{image="registry.example.com/\"app\":1"} 2300
+# HELP container_layer_size_bytes Uncompressed size of a layer
+# TYPE container_layer_size_bytes gauge
+container_layer_size_bytes{image="registry.example.com/\"app\":1",layer="base"} 4196
+container_layer_size_bytes{image="registry.example.com/\"app\":1",layer="top"} 512
+# HELP container_layer_compressed_size_bytes Compressed size of a layer
+# TYPE container_layer_compressed_size_bytes gauge
+container_layer_compressed_size_bytes{image="registry.example.com/\"app\":1",layer="base"} 2000
+container_layer_compressed_size_bytes{image="registry.example.com/\"app\":1",layer="top"} 300
+# HELP container_directory_size_bytes Size of a top level directory of the image
+# TYPE container_directory_size_bytes gauge
+container_directory_size_bytes{image="registry.example.com/\"app\":1",path="/app"} 512
+container_directory_size_bytes{image="registry.example.com/\"app\":1",path="/etc"} 0
+container_directory_size_bytes{image="registry.example.com/\"app\":1",path="/usr"} 4096
+`, out.String())
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"path"
+	"strings"
+)
+
+/// The kind of contents of a file
+type FileCategory string
+
+const (
+	FileCategoryExecutable     FileCategory = "executable"
+	FileCategorySharedLibrary  FileCategory = "shared_library"
+	FileCategoryStaticLibrary  FileCategory = "static_library"
+	FileCategoryPythonBytecode FileCategory = "python_bytecode"
+	FileCategoryDocumentation  FileCategory = "documentation"
+	FileCategoryLocale         FileCategory = "locale"
+	FileCategoryFont           FileCategory = "font"
+	FileCategoryImage          FileCategory = "image"
+	FileCategoryArchive        FileCategory = "archive"
+	FileCategoryCache          FileCategory = "cache"
+	FileCategoryLog            FileCategory = "log"
+	FileCategoryOther          FileCategory = "other"
+)
+
+/// Number of bytes at the start of a file that are used to determine its
+/// category, large enough to include the magic of a tar archive
+const fileCategorySniffLength = 264
+
+/// Directories whose contents belong to a category regardless of their
+/// contents, checked in this order
+var fileCategoryDirs = []struct {
+	category FileCategory
+	dirs     []string
+}{
+	{category: FileCategoryLog, dirs: []string{"/var/log"}},
+	{category: FileCategoryCache, dirs: []string{"/var/cache", "/root/.cache", "/tmp", "/var/tmp"}},
+	{category: FileCategoryDocumentation, dirs: []string{
+		"/usr/share/man", "/usr/share/info", "/usr/share/doc", "/usr/share/gtk-doc",
+		"/usr/share/help", "/usr/local/share/man", "/usr/local/share/doc",
+	}},
+	{category: FileCategoryLocale, dirs: []string{"/usr/share/locale", "/usr/lib/locale", "/usr/share/i18n"}},
+	{category: FileCategoryFont, dirs: []string{"/usr/share/fonts", "/usr/local/share/fonts"}},
+}
+
+/// Magic bytes at the start of a file and the category that they identify
+var fileCategoryMagics = []struct {
+	magic    []byte
+	category FileCategory
+}{
+	{magic: []byte("!<arch>\n"), category: FileCategoryStaticLibrary},
+	// fonts
+	{magic: []byte{0x00, 0x01, 0x00, 0x00, 0x00}, category: FileCategoryFont},
+	{magic: []byte("OTTO"), category: FileCategoryFont},
+	{magic: []byte("ttcf"), category: FileCategoryFont},
+	{magic: []byte("wOFF"), category: FileCategoryFont},
+	{magic: []byte("wOF2"), category: FileCategoryFont},
+	// images
+	{magic: []byte("\x89PNG\r\n\x1a\n"), category: FileCategoryImage},
+	{magic: []byte{0xff, 0xd8, 0xff}, category: FileCategoryImage},
+	{magic: []byte("GIF87a"), category: FileCategoryImage},
+	{magic: []byte("GIF89a"), category: FileCategoryImage},
+	{magic: []byte{0x00, 0x00, 0x01, 0x00}, category: FileCategoryImage},
+	// compressed archives
+	{magic: gzipMagic, category: FileCategoryArchive},
+	{magic: zstdMagic, category: FileCategoryArchive},
+	{magic: []byte("BZh"), category: FileCategoryArchive},
+	{magic: []byte("\xfd7zXZ\x00"), category: FileCategoryArchive},
+	{magic: []byte("PK\x03\x04"), category: FileCategoryArchive},
+	{magic: []byte("7z\xbc\xaf\x27\x1c"), category: FileCategoryArchive},
+	{magic: []byte{0xed, 0xab, 0xee, 0xdb}, category: FileCategoryArchive},
+}
+
+/// File extensions that identify a category if the contents do not
+var fileCategoryExtensions = map[string]FileCategory{
+	".pyc":  FileCategoryPythonBytecode,
+	".pyo":  FileCategoryPythonBytecode,
+	".log":  FileCategoryLog,
+	".mo":   FileCategoryLocale,
+	".ttf":  FileCategoryFont,
+	".otf":  FileCategoryFont,
+	".pcf":  FileCategoryFont,
+	".svg":  FileCategoryImage,
+	".svgz": FileCategoryImage,
+	".a":    FileCategoryStaticLibrary,
+}
+
+/// Returns the category of the file with the absolute path `filePath`,
+/// whose contents start with `head`.
+///
+/// The location of a file takes precedence over its contents, so that e.g.
+/// compressed man pages are documentation and not archives. `head` may be
+/// empty, then the file is only classified by its path.
+func ClassifyFile(filePath string, head []byte) FileCategory {
+	for _, c := range fileCategoryDirs {
+		for _, dir := range c.dirs {
+			if strings.HasPrefix(filePath, dir+"/") {
+				return c.category
+			}
+		}
+	}
+	if strings.Contains(filePath, "/.cache/") {
+		return FileCategoryCache
+	}
+
+	if category, ok := classifyElf(filePath, head); ok {
+		return category
+	}
+	if isPythonBytecode(head) {
+		return FileCategoryPythonBytecode
+	}
+	for _, m := range fileCategoryMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.category
+		}
+	}
+	if bytes.HasPrefix(head, []byte("RIFF")) && len(head) >= 12 && string(head[8:12]) == "WEBP" {
+		return FileCategoryImage
+	}
+	if len(head) >= 262 && string(head[257:262]) == "ustar" {
+		return FileCategoryArchive
+	}
+
+	if category, ok := fileCategoryExtensions[path.Ext(filePath)]; ok {
+		return category
+	}
+	return FileCategoryOther
+}
+
+/// Classifies ELF files by the type in their header, `ok` is false if `head`
+/// is not the start of an ELF file.
+///
+/// Position independent executables and shared libraries have the same
+/// type, the latter are recognized by their name.
+func classifyElf(filePath string, head []byte) (category FileCategory, ok bool) {
+	if len(head) < 18 || !bytes.HasPrefix(head, []byte("\x7fELF")) {
+		return "", false
+	}
+
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if head[5] == 2 {
+		byteOrder = binary.BigEndian
+	}
+
+	const (
+		elfTypeRelocatable = 1
+		elfTypeExecutable  = 2
+		elfTypeShared      = 3
+	)
+	switch byteOrder.Uint16(head[16:]) {
+	case elfTypeRelocatable:
+		return FileCategoryStaticLibrary, true
+	case elfTypeShared:
+		name := path.Base(filePath)
+		if strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.") {
+			return FileCategorySharedLibrary, true
+		}
+		return FileCategoryExecutable, true
+	case elfTypeExecutable:
+		return FileCategoryExecutable, true
+	default:
+		return FileCategoryOther, true
+	}
+}
+
+/// Maximum size of an ELF file whose sections are checked for debug
+/// information, as the whole file has to be kept in memory
+const maxElfDebugInfoFileSize = 64 << 20
+
+/// Checks whether `head` is the start of an ELF file
+func isElf(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(elf.ELFMAG))
+}
+
+/// Returns the size of the debug information (the `.debug_*` sections) and of
+/// the symbol table of the ELF file `contents`, 0 if the file is stripped or
+/// not a valid ELF file.
+func elfDebugInfoSize(contents []byte) int64 {
+	f, err := elf.NewFile(bytes.NewReader(contents))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var size int64
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOBITS && (strings.HasPrefix(s.Name, ".debug_") || s.Name == ".symtab") {
+			size += int64(s.FileSize)
+		}
+	}
+	return size
+}
+
+/// Checks whether `head` is the start of a compiled Python module, whose
+/// magic number consists of a version dependent number followed by \r\n
+func isPythonBytecode(head []byte) bool {
+	if len(head) < 4 || head[2] != '\r' || head[3] != '\n' {
+		return false
+	}
+	// Python 3 uses the numbers 3000 and above, Python 2.7 uses 62211
+	version := binary.LittleEndian.Uint16(head)
+	return (version >= 3000 && version < 4000) || version == 62211
+}
+
+/// Adds `size` bytes of files of the category `category` to the category
+/// totals of `d`
+func (d *Dir) addCategorySize(category FileCategory, size int64) {
+	if category == "" || size == 0 {
+		return
+	}
+	if d.CategorySizes == nil {
+		d.CategorySizes = make(map[FileCategory]int64)
+	}
+	d.CategorySizes[category] += size
+}
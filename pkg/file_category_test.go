@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/// Returns the start of an ELF file of the type `elfType`
+func elfHeader(elfType byte) []byte {
+	head := make([]byte, 64)
+	copy(head, "\x7fELF\x02\x01\x01")
+	head[16] = elfType
+	return head
+}
+
+func TestClassifyFile(t *testing.T) {
+	var tarHead bytes.Buffer
+	tw := tar.NewWriter(&tarHead)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "foo", Size: 0}))
+
+	for _, c := range []struct {
+		filePath string
+		head     []byte
+		expected FileCategory
+	}{
+		{filePath: "/usr/bin/bash", head: elfHeader(3), expected: FileCategoryExecutable},
+		{filePath: "/usr/bin/static", head: elfHeader(2), expected: FileCategoryExecutable},
+		{filePath: "/usr/lib64/libc.so.6", head: elfHeader(3), expected: FileCategorySharedLibrary},
+		{filePath: "/usr/lib64/libfoo.so", head: elfHeader(3), expected: FileCategorySharedLibrary},
+		{filePath: "/usr/lib64/crt1.o", head: elfHeader(1), expected: FileCategoryStaticLibrary},
+		{filePath: "/usr/lib64/libc.a", head: []byte("!<arch>\nfoo"), expected: FileCategoryStaticLibrary},
+		{filePath: "/app/__pycache__/main.cpython-310.pyc", head: []byte{0x6f, 0x0d, '\r', '\n', 0, 0}, expected: FileCategoryPythonBytecode},
+		{filePath: "/app/main.pyc", expected: FileCategoryPythonBytecode},
+		{filePath: "/usr/share/man/man1/bash.1.gz", head: gzipMagic, expected: FileCategoryDocumentation},
+		{filePath: "/usr/share/doc/bash/README", head: []byte("Bash"), expected: FileCategoryDocumentation},
+		{filePath: "/usr/share/locale/de/LC_MESSAGES/bash.mo", expected: FileCategoryLocale},
+		{filePath: "/usr/lib/locale/locale-archive", expected: FileCategoryLocale},
+		{filePath: "/usr/share/fonts/dejavu/DejaVuSans.ttf", expected: FileCategoryFont},
+		{filePath: "/app/static/font.woff2", head: []byte("wOF2...."), expected: FileCategoryFont},
+		{filePath: "/app/static/logo", head: []byte("\x89PNG\r\n\x1a\n...."), expected: FileCategoryImage},
+		{filePath: "/app/static/photo.webp", head: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), expected: FileCategoryImage},
+		{filePath: "/app/static/icon.svg", head: []byte("<svg"), expected: FileCategoryImage},
+		{filePath: "/app/lib/app.jar", head: []byte("PK\x03\x04"), expected: FileCategoryArchive},
+		{filePath: "/app/data.tar.xz", head: []byte("\xfd7zXZ\x00"), expected: FileCategoryArchive},
+		{filePath: "/app/data.tar", head: tarHead.Bytes(), expected: FileCategoryArchive},
+		{filePath: "/var/cache/zypp/packages/bash.rpm", head: []byte{0xed, 0xab, 0xee, 0xdb}, expected: FileCategoryCache},
+		{filePath: "/root/.cache/pip/http/abc", expected: FileCategoryCache},
+		{filePath: "/home/user/.cache/go-build/00/abc", expected: FileCategoryCache},
+		{filePath: "/var/log/zypper.log", expected: FileCategoryLog},
+		{filePath: "/app/server.log", head: []byte("started"), expected: FileCategoryLog},
+		{filePath: "/etc/os-release", head: []byte("NAME=openSUSE"), expected: FileCategoryOther},
+		{filePath: "/etc/empty", expected: FileCategoryOther},
+	} {
+		assert.Equal(t, c.expected, ClassifyFile(c.filePath, c.head), c.filePath)
+	}
+}
+
+func TestElfDebugInfoSize(t *testing.T) {
+	assert.Equal(t, int64(0), elfDebugInfoSize(elfHeader(2)))
+	assert.Equal(t, int64(0), elfDebugInfoSize([]byte("not an ELF file")))
+}
+
+func TestAnalyzeLayerCategorizesFiles(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "usr/bin/app", contents: elfHeader(2)},
+		{name: "usr/lib/libapp.so.1", contents: elfHeader(3)},
+		{name: "usr/share/doc/app/README", contents: bytes.Repeat([]byte("a"), 100)},
+		{name: "usr/share/doc/app/empty", contents: nil},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.contents)), Mode: 0644,
+		}))
+		_, err := tw.Write(f.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeLink, Name: "usr/bin/app2", Linkname: "usr/bin/app", Mode: 0755,
+	}))
+	require.NoError(t, tw.Close())
+
+	l, err := AnalyzeLayer(context.Background(), &layer, CompressionNone, LayerAnalysisOptions{})
+	require.NoError(t, err)
+	AccountHardlinks([]*Dir{&l.Dir})
+
+	_, info, _ := l.FindFile("/usr/bin/app")
+	assert.Equal(t, FileCategoryExecutable, info.Category)
+	_, info, _ = l.FindFile("/usr/bin/app2")
+	assert.Equal(t, FileCategoryExecutable, info.Category)
+	_, info, _ = l.FindFile("/usr/share/doc/app/empty")
+	assert.Equal(t, FileCategoryDocumentation, info.Category)
+
+	assert.Equal(t, map[FileCategory]int64{
+		FileCategoryExecutable:    64,
+		FileCategorySharedLibrary: 64,
+		FileCategoryDocumentation: 100,
+	}, l.CategorySizes)
+	assert.Equal(t, map[FileCategory]int64{FileCategoryExecutable: 64}, l.FindSubdir("/usr/bin").CategorySizes)
+	assert.Equal(t, map[FileCategory]int64{FileCategoryDocumentation: 100}, l.FindSubdir("/usr/share").CategorySizes)
+}
+
+func TestMergeLayersRecalculatesCategories(t *testing.T) {
+	base := MakeDir("/")
+	base.InsertFileIntoDir("/usr/bin/app", 1000, FileInfo{Type: FileTypeRegular, Category: FileCategoryExecutable})
+	base.InsertFileIntoDir("/usr/share/doc/app/README", 100, FileInfo{Type: FileTypeRegular, Category: FileCategoryDocumentation})
+
+	top := MakeDir("/")
+	top.InsertFileIntoDir("/usr/share/doc/.wh.app", 0, FileInfo{Type: FileTypeRegular})
+
+	merged := MergeLayers([]Dir{base, top})
+	assert.Equal(t, map[FileCategory]int64{FileCategoryExecutable: 1000}, merged.CategorySizes)
+	assert.Nil(t, merged.FindSubdir("/usr/share").CategorySizes)
+}
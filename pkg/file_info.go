@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"archive/tar"
+	"os"
+	"time"
+)
+
+/// The type of a file in a layer
+type FileType string
+
+const (
+	FileTypeRegular     FileType = "regular"
+	FileTypeSymlink     FileType = "symlink"
+	FileTypeHardlink    FileType = "hardlink"
+	FileTypeCharDevice  FileType = "char_device"
+	FileTypeBlockDevice FileType = "block_device"
+	FileTypeFifo        FileType = "fifo"
+)
+
+/// Metadata of a single file in a layer
+type FileInfo struct {
+	/// The type of this file
+	Type FileType `json:"type"`
+
+	/// Permission bits of this file including the setuid, setgid and sticky bits
+	Mode os.FileMode `json:"mode"`
+
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+
+	/// Modification time of this file
+	ModTime time.Time `json:"mtime"`
+
+	/// The target of a symbolic or hard link, empty for all other file types
+	LinkTarget string `json:"link_target,omitempty"`
+
+	/// Number of paths in the same tree that share the contents of this file
+	/// via hardlinks including this one, 0 if the file has no hardlinks
+	Links int `json:"links,omitempty"`
+
+	/// Size of the contents that a hardlink points to
+	LinkedSize int64 `json:"linked_size,omitempty"`
+
+	/// Estimated size of the contents of this file in the compressed layer
+	EstimatedCompressedSize int64 `json:"estimated_compressed_size,omitempty"`
+
+	/// Digest of the contents of a regular file, only present if the contents
+	/// have been hashed, see `LayerAnalysisOptions`
+	Digest string `json:"digest,omitempty"`
+
+	/// The kind of contents of a regular file or of the target of a hardlink
+	Category FileCategory `json:"category,omitempty"`
+
+	/// Size of the debug information and of the symbol table of an unstripped
+	/// ELF file
+	DebugInfoSize int64 `json:"debug_info_size,omitempty"`
+}
+
+/// Creates the metadata of a file from its tar header
+func FileInfoFromTarHeader(hdr *tar.Header) FileInfo {
+	mode := hdr.FileInfo().Mode()
+	info := FileInfo{
+		Type:    FileTypeRegular,
+		Mode:    mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		Uid:     hdr.Uid,
+		Gid:     hdr.Gid,
+		ModTime: hdr.ModTime.UTC(),
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		info.Type = FileTypeSymlink
+		info.LinkTarget = hdr.Linkname
+	case tar.TypeLink:
+		info.Type = FileTypeHardlink
+		info.LinkTarget = hdr.Linkname
+	case tar.TypeChar:
+		info.Type = FileTypeCharDevice
+	case tar.TypeBlock:
+		info.Type = FileTypeBlockDevice
+	case tar.TypeFifo:
+		info.Type = FileTypeFifo
+	}
+
+	return info
+}
+
+/// Inserts the file described by the tar header `hdr` including its metadata
+/// into `d`.
+///
+/// Hardlinks are inserted without a size, `AccountHardlinks` attributes the
+/// bytes of their targets once all layers have been inserted.
+func (d *Dir) InsertTarEntry(hdr *tar.Header) {
+	d.insertTarEntry(hdr, FileInfoFromTarHeader(hdr))
+}
+
+func (d *Dir) insertTarEntry(hdr *tar.Header, info FileInfo) {
+	size := hdr.Size
+	if hdr.Typeflag == tar.TypeLink {
+		size = 0
+	}
+	d.InsertFileIntoDir(hdr.Name, size, info)
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"archive/tar"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileInfoFromTarHeader(t *testing.T) {
+	mtime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		hdr      tar.Header
+		expected FileInfo
+	}{
+		{
+			hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/su", Mode: 04755, Uid: 0, Gid: 0, ModTime: mtime},
+			expected: FileInfo{
+				Type: FileTypeRegular, Mode: os.ModeSetuid | 0755, ModTime: mtime,
+			},
+		},
+		{
+			hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/vi", Linkname: "vim", Mode: 0777, Uid: 1000, Gid: 100, ModTime: mtime},
+			expected: FileInfo{
+				Type: FileTypeSymlink, Mode: 0777, Uid: 1000, Gid: 100, ModTime: mtime, LinkTarget: "vim",
+			},
+		},
+		{
+			hdr: tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/perl5.34", Linkname: "usr/bin/perl", Mode: 0755, ModTime: mtime},
+			expected: FileInfo{
+				Type: FileTypeHardlink, Mode: 0755, ModTime: mtime, LinkTarget: "usr/bin/perl",
+			},
+		},
+		{
+			hdr:      tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, ModTime: mtime},
+			expected: FileInfo{Type: FileTypeCharDevice, Mode: 0666, ModTime: mtime},
+		},
+		{
+			hdr:      tar.Header{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Gid: 6, ModTime: mtime},
+			expected: FileInfo{Type: FileTypeBlockDevice, Mode: 0660, Gid: 6, ModTime: mtime},
+		},
+		{
+			hdr:      tar.Header{Typeflag: tar.TypeFifo, Name: "run/initctl", Mode: 0600, ModTime: mtime},
+			expected: FileInfo{Type: FileTypeFifo, Mode: 0600, ModTime: mtime},
+		},
+	} {
+		assert.Equalf(t, tc.expected, FileInfoFromTarHeader(&tc.hdr), "Invalid file info of %s", tc.hdr.Name)
+	}
+}
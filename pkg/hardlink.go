@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"path"
+)
+
+/// Attributes the bytes of hardlinks in the layer trees `layers`, which must be
+/// ordered from the lowest to the topmost layer.
+///
+/// A hardlink to a file in the same layer does not occupy any space, the bytes
+/// belong to its target and are counted as saved in the directory of the
+/// hardlink. A hardlink to a file from a lower layer has the size of its
+/// target, as the target has to be copied into the layer on extraction.
+func AccountHardlinks(layers []*Dir) {
+	lower := MakeDir("/")
+	for _, l := range layers {
+		l.accountHardlinks(&lower)
+		lower.applyLayer(l)
+	}
+}
+
+type hardlink struct {
+	dir   *Dir
+	fname string
+}
+
+/// Sets the sizes of all hardlinks in the tree `d` and updates the hardlink
+/// statistics and total sizes of all directories.
+///
+/// Hardlinks whose target is not present in `d` are looked up in `lower`, if it
+/// is not nil. If the target cannot be found at all, the hardlink retains the
+/// size of its contents.
+func (d *Dir) accountHardlinks(lower *Dir) {
+	links := make(map[string][]hardlink)
+
+	d.WalkDirs(func(dirPath string, dir *Dir) {
+		for fname, info := range dir.FileInfos {
+			if info.Type != FileTypeHardlink {
+				continue
+			}
+
+			target := path.Clean("/" + info.LinkTarget)
+			if size, targetInfo, ok := d.FindFile(target); ok && targetInfo.Type != FileTypeHardlink {
+				dir.Files[fname] = 0
+				info.LinkedSize = size
+				info.Category = targetInfo.Category
+				links[target] = append(links[target], hardlink{dir: dir, fname: fname})
+			} else if size, targetInfo, ok := lower.findFileIfNotNil(target); ok {
+				dir.Files[fname] = size
+				info.LinkedSize = size
+				info.Category = targetInfo.Category
+			} else {
+				dir.Files[fname] = info.LinkedSize
+			}
+			dir.FileInfos[fname] = info
+		}
+	})
+
+	for target, targetLinks := range links {
+		linkCount := len(targetLinks) + 1
+
+		if targetDir := d.FindSubdir(path.Dir(target)); targetDir != nil {
+			if info, ok := targetDir.FileInfos[path.Base(target)]; ok {
+				info.Links = linkCount
+				targetDir.FileInfos[path.Base(target)] = info
+			}
+		}
+		for _, l := range targetLinks {
+			info := l.dir.FileInfos[l.fname]
+			info.Links = linkCount
+			l.dir.FileInfos[l.fname] = info
+		}
+	}
+
+	d.recalculateTotalSize()
+	d.recalculateHardlinkStats()
+}
+
+func (d *Dir) findFileIfNotNil(filePath string) (int64, FileInfo, bool) {
+	if d == nil {
+		return 0, FileInfo{}, false
+	}
+	return d.FindFile(filePath)
+}
+
+/// Recalculates the number of hardlinks and the bytes saved by them of `d` and
+/// all its subdirectories.
+func (d *Dir) recalculateHardlinkStats() (hardlinks int64, savedBytes int64) {
+	d.Hardlinks = 0
+	d.HardlinkSavedBytes = 0
+
+	for fname, info := range d.FileInfos {
+		if info.Type == FileTypeHardlink {
+			d.Hardlinks++
+			d.HardlinkSavedBytes += info.LinkedSize - d.Files[fname]
+		}
+	}
+	for name, subdir := range d.Directiories {
+		links, saved := subdir.recalculateHardlinkStats()
+		d.Hardlinks += links
+		d.HardlinkSavedBytes += saved
+		d.Directiories[name] = subdir
+	}
+	return d.Hardlinks, d.HardlinkSavedBytes
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardlinksInSameLayer(t *testing.T) {
+	l := MakeDir("/")
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/perl", Size: 4096, Mode: 0755})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/perl5.34.0", Linkname: "usr/bin/perl", Size: 4096, Mode: 0755})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/lib/perl5/perl", Linkname: "./usr/bin/perl", Mode: 0755})
+
+	AccountHardlinks([]*Dir{&l})
+
+	assert.Equal(t, int64(4096), l.TotalSize)
+	assert.Equal(t, int64(2), l.Hardlinks)
+	assert.Equal(t, int64(8192), l.HardlinkSavedBytes)
+
+	bin := l.FindSubdir("/usr/bin")
+	assert.Equal(t, int64(0), bin.Files["perl5.34.0"])
+	assert.Equal(t, int64(1), bin.Hardlinks)
+	assert.Equal(t, int64(4096), bin.HardlinkSavedBytes)
+	assert.Equal(t, 3, bin.FileInfos["perl"].Links)
+	assert.Equal(t, 3, bin.FileInfos["perl5.34.0"].Links)
+	assert.Equal(t, int64(4096), bin.FileInfos["perl5.34.0"].LinkedSize)
+
+	lib := l.FindSubdir("/usr/lib/perl5")
+	assert.Equal(t, int64(0), lib.TotalSize)
+	assert.Equal(t, int64(4096), lib.HardlinkSavedBytes)
+}
+
+func TestHardlinkIntoLowerLayer(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/git", Size: 2048})
+
+	upper := MakeDir("/")
+	upper.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/libexec/git-core/git", Linkname: "usr/bin/git"})
+
+	AccountHardlinks([]*Dir{&lower, &upper})
+
+	assert.Equal(t, int64(2048), lower.TotalSize)
+	assert.Equal(t, int64(2048), upper.TotalSize)
+	assert.Equal(t, int64(1), upper.Hardlinks)
+	assert.Equal(t, int64(0), upper.HardlinkSavedBytes)
+
+	// both paths share the same contents in the final image
+	merged := MergeLayers([]Dir{lower, upper})
+	assert.Equal(t, int64(2048), merged.TotalSize)
+	assert.Equal(t, int64(2048), merged.HardlinkSavedBytes)
+}
+
+func TestHardlinkWithRemovedTarget(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "bin/coreutils", Size: 1024})
+	lower.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "bin/ls", Linkname: "bin/coreutils"})
+
+	upper := MakeDir("/")
+	upper.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "bin/.wh.coreutils"})
+
+	AccountHardlinks([]*Dir{&lower, &upper})
+	assert.Equal(t, int64(1024), lower.TotalSize)
+
+	// the contents are still present via bin/ls
+	merged := MergeLayers([]Dir{lower, upper})
+	assert.Equal(t, int64(1024), merged.TotalSize)
+	assert.Equal(t, int64(1024), merged.FindSubdir("/bin").Files["ls"])
+	assert.Equal(t, int64(0), merged.HardlinkSavedBytes)
+}
+
+func TestDanglingHardlink(t *testing.T) {
+	l := MakeDir("/")
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "foo", Linkname: "bar", Size: 42})
+
+	AccountHardlinks([]*Dir{&l})
+	assert.Equal(t, int64(0), l.TotalSize)
+	assert.Equal(t, int64(1), l.Hardlinks)
+}
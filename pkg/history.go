@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+/// A single step of the build history of an image
+type HistoryStep struct {
+	/// The position of this step in the history of the image, starting at 0
+	Index int `json:"index"`
+
+	/// The time at which this step was performed, nil if unknown
+	Created *time.Time `json:"created,omitempty"`
+
+	/// The command that was used to perform this step
+	CreatedBy string `json:"created_by,omitempty"`
+
+	/// A free form comment of this step
+	Comment string `json:"comment,omitempty"`
+
+	/// true if this step did not create a layer, e.g. ENV, LABEL or WORKDIR
+	EmptyLayer bool `json:"empty_layer"`
+
+	/// The hex encoded digest of the layer that was created by this step,
+	/// empty for empty layers
+	Layer string `json:"layer,omitempty"`
+}
+
+/// Creates the ordered list of the build steps of an image from the history
+/// `history` of its configuration and the hex encoded digests of its layers
+/// `layerDigests` in the order in which they appear in the manifest.
+///
+/// Each entry of the history that is not an empty layer is matched with the
+/// next layer, so that layers sharing the same digest are still attributed
+/// to their own step. Layers without a history entry get a step without any
+/// metadata appended, entries beyond the last layer get no layer.
+func NewHistory(history []ispec.History, layerDigests []string) []HistoryStep {
+	steps := make([]HistoryStep, 0, len(history))
+
+	i := 0
+	for _, h := range history {
+		step := HistoryStep{
+			Index:      len(steps),
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer && i < len(layerDigests) {
+			step.Layer = layerDigests[i]
+			i++
+		}
+		steps = append(steps, step)
+	}
+	for ; i < len(layerDigests); i++ {
+		steps = append(steps, HistoryStep{Index: len(steps), Layer: layerDigests[i]})
+	}
+
+	return steps
+}
+
+/// Returns the hex encoded digests of the layers created by the steps of
+/// `history` in their order.
+func layerDigestsOfHistory(history []HistoryStep) []string {
+	digests := make([]string, 0, len(history))
+	for _, step := range history {
+		if step.Layer != "" {
+			digests = append(digests, step.Layer)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHistory(t *testing.T) {
+	created := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	history := []ispec.History{
+		{Created: &created, CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /app", Comment: "buildkit.dockerfile.v0"},
+		{CreatedBy: "LABEL foo=bar", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /app"},
+	}
+
+	// the last step creates the same layer as the second one
+	assert.Equal(t, []HistoryStep{
+		{Index: 0, Created: &created, CreatedBy: "ADD rootfs.tar /", Layer: "base"},
+		{Index: 1, CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{Index: 2, CreatedBy: "RUN mkdir /app", Comment: "buildkit.dockerfile.v0", Layer: "app"},
+		{Index: 3, CreatedBy: "LABEL foo=bar", EmptyLayer: true},
+		{Index: 4, CreatedBy: "RUN mkdir /app", Layer: "app"},
+	}, NewHistory(history, []string{"base", "app", "app"}))
+
+	// layers without a history entry
+	assert.Equal(t, []HistoryStep{
+		{Index: 0, Created: &created, CreatedBy: "ADD rootfs.tar /", Layer: "base"},
+		{Index: 1, CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{Index: 2, Layer: "app"},
+	}, NewHistory(history[:2], []string{"base", "app"}))
+
+	// history entries without a layer
+	assert.Equal(t, []HistoryStep{
+		{Index: 0, Created: &created, CreatedBy: "ADD rootfs.tar /", Layer: "base"},
+		{Index: 1, CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{Index: 2, CreatedBy: "RUN mkdir /app", Comment: "buildkit.dockerfile.v0"},
+	}, NewHistory(history[:3], []string{"base"}))
+}
+
+func TestOrderedLayerDigestsFollowHistory(t *testing.T) {
+	entry := ImageHistoryEntry{
+		Contents: LayerSizes{"base": NewLayer(), "app": NewLayer()},
+		History: []HistoryStep{
+			{Index: 0, Layer: "app"},
+			{Index: 1, EmptyLayer: true},
+			{Index: 2, Layer: "base"},
+			{Index: 3, Layer: "app"},
+		},
+	}
+	assert.Equal(t, []string{"app", "base"}, entry.orderedLayerDigests())
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	archiver "github.com/mholt/archiver/v4"
+	"github.com/opencontainers/go-digest"
+)
+
+/// The compression algorithm of a layer blob
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+/// Detects the compression of the blob read from `r` from its magic bytes
+/// without consuming them.
+///
+/// Blobs that are neither gzip nor zstd compressed are assumed to be
+/// uncompressed.
+func DetectCompression(r *bufio.Reader) (Compression, error) {
+	magic, err := r.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return CompressionGzip, nil
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		return CompressionZstd, nil
+	}
+	return CompressionNone, nil
+}
+
+/// Returns a reader that decompresses `r`
+func (c Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return archiver.Gz{}.OpenReader(r)
+	case CompressionZstd:
+		return archiver.Zstd{}.OpenReader(r)
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid compression: %s", c))
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+/// Estimates the compressed size of individual files by compressing them with
+/// the compression algorithm of their layer.
+type compressionEstimator struct {
+	counter countingWriter
+	gzip    *gzip.Writer
+	zstd    *zstd.Encoder
+}
+
+func newCompressionEstimator(c Compression) (*compressionEstimator, error) {
+	e := &compressionEstimator{}
+
+	var err error
+	switch c {
+	case CompressionNone:
+	case CompressionGzip:
+		e.gzip = gzip.NewWriter(&e.counter)
+	case CompressionZstd:
+		e.zstd, err = zstd.NewWriter(&e.counter, zstd.WithEncoderConcurrency(1))
+	default:
+		err = errors.New(fmt.Sprintf("Invalid compression: %s", c))
+	}
+	return e, err
+}
+
+/// Returns the number of bytes of the compressed contents of `r`
+func (e *compressionEstimator) estimate(r io.Reader) (int64, error) {
+	e.counter.n = 0
+
+	var w io.WriteCloser
+	if e.gzip != nil {
+		e.gzip.Reset(&e.counter)
+		w = e.gzip
+	} else if e.zstd != nil {
+		e.zstd.Reset(&e.counter)
+		w = e.zstd
+	} else {
+		n, err := io.Copy(ioutil.Discard, r)
+		return n, err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return e.counter.n, nil
+}
+
+/// Optional parts of the analysis of a layer
+type LayerAnalysisOptions struct {
+	/// Record the sha256 digest of the contents of each non-empty regular
+	/// file, which is required to find duplicate files
+	HashContents bool
+}
+
+/// Calculates the directory tree of the layer whose blob is read from `blob`
+/// and compressed with `compression`.
+///
+/// Besides the directory tree, the size of the compressed blob, of the
+/// uncompressed tar archive and of the file contents are recorded. The
+/// compressed size of each file is estimated by compressing it on its own.
+///
+/// Each regular file is categorized by its path and the start of its
+/// contents, see `ClassifyFile`, and the sections of ELF files are checked for
+/// debug information. The files of the package databases and the
+/// manifests of the language dependencies in the layer are parsed, see
+/// `PackageDatabaseManager` and `DependencyManifestEcosystem`. Hardlinks are
+/// inserted without a size, see `AccountHardlinks`.
+func AnalyzeLayer(ctx context.Context, blob io.Reader, compression Compression, opts LayerAnalysisOptions) (Layer, error) {
+	return analyzeLayer(ctx, blob, compression, compression, opts)
+}
+
+/// Calculates the directory tree of a layer like `AnalyzeLayer`, but for a
+/// blob compressed with `compression` that has been recompressed from the
+/// original blob of the layer, which is compressed with `original`.
+///
+/// The compressed size of each file is estimated with `original`. The
+/// compressed size of the layer is the size of the recompressed blob and has
+/// to be replaced with the size of the original blob by the caller.
+func AnalyzeRecompressedLayer(ctx context.Context, blob io.Reader, compression Compression, original Compression, opts LayerAnalysisOptions) (Layer, error) {
+	return analyzeLayer(ctx, blob, compression, original, opts)
+}
+
+func analyzeLayer(ctx context.Context, blob io.Reader, compression Compression, estimateCompression Compression, opts LayerAnalysisOptions) (Layer, error) {
+	layer := NewLayer()
+	layer.ContentsHashed = opts.HashContents
+
+	estimator, err := newCompressionEstimator(estimateCompression)
+	if err != nil {
+		return layer, err
+	}
+
+	compressed := &countingReader{r: blob}
+	decompressed, err := compression.NewReader(compressed)
+	if err != nil {
+		return layer, err
+	}
+	defer decompressed.Close()
+	uncompressed := &countingReader{r: decompressed}
+
+	err = archiver.Tar{}.Extract(ctx, uncompressed, nil, func(ctx context.Context, f archiver.File) error {
+		if f.IsDir() {
+			return nil
+		}
+
+		hdr, ok := f.Header.(*tar.Header)
+		if !ok {
+			return errors.New(fmt.Sprintf("Got an invalid header for %s", f.NameInArchive))
+		}
+
+		info := FileInfoFromTarHeader(hdr)
+		filePath := path.Clean("/" + hdr.Name)
+		_, isPackageDatabase := PackageDatabaseManager(filePath)
+		_, isDependencyManifest := DependencyManifestEcosystem(filePath)
+
+		var contents *bytes.Buffer
+		if info.Type == FileTypeRegular && (isPackageDatabase || isDependencyManifest) {
+			contents = &bytes.Buffer{}
+		}
+
+		if info.Type == FileTypeRegular && hdr.Size > 0 {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			buffered := bufio.NewReader(rc)
+			head, err := buffered.Peek(fileCategorySniffLength)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			info.Category = ClassifyFile(filePath, head)
+
+			var r io.Reader = buffered
+			var digester digest.Digester
+			if opts.HashContents {
+				digester = digest.Canonical.Digester()
+				r = io.TeeReader(r, digester.Hash())
+			}
+			if contents != nil {
+				r = io.TeeReader(r, contents)
+			}
+			var elfContents *bytes.Buffer
+			if isElf(head) && hdr.Size <= maxElfDebugInfoFileSize {
+				elfContents = bytes.NewBuffer(make([]byte, 0, hdr.Size))
+				r = io.TeeReader(r, elfContents)
+			}
+
+			if info.EstimatedCompressedSize, err = estimator.estimate(r); err != nil {
+				return err
+			}
+			if digester != nil {
+				info.Digest = digester.Digest().String()
+			}
+			if elfContents != nil {
+				info.DebugInfoSize = elfDebugInfoSize(elfContents.Bytes())
+			}
+			layer.PayloadSize += hdr.Size
+		} else if info.Type == FileTypeRegular || info.Type == FileTypeHardlink {
+			info.Category = ClassifyFile(filePath, nil)
+		}
+
+		if contents != nil && isPackageDatabase {
+			if layer.PackageDatabases == nil {
+				layer.PackageDatabases = make(map[string]PackageDatabaseFile)
+			}
+			layer.PackageDatabases[filePath] = ParsePackageDatabaseFile(filePath, contents.Bytes())
+		}
+		if contents != nil && isDependencyManifest {
+			if layer.DependencyManifests == nil {
+				layer.DependencyManifests = make(map[string]DependencyManifest)
+			}
+			layer.DependencyManifests[filePath] = ParseDependencyManifest(filePath, contents.Bytes())
+		}
+
+		layer.insertTarEntry(hdr, info)
+		return nil
+	})
+	if err != nil {
+		return layer, err
+	}
+
+	// the tar reader stops at the end of archive marker, but we want to know
+	// the size of the whole blob including the trailing padding
+	if _, err := io.Copy(ioutil.Discard, uncompressed); err != nil {
+		return layer, err
+	}
+	if _, err := io.Copy(ioutil.Discard, compressed); err != nil {
+		return layer, err
+	}
+
+	layer.CompressedSize = compressed.n
+	layer.UncompressedSize = uncompressed.n
+	layer.TarOverhead = layer.UncompressedSize - layer.PayloadSize
+
+	return layer, nil
+}
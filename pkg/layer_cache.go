@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/// Version of the format of the cached layers.
+///
+/// This has to be increased whenever the results of `AnalyzeLayer` change,
+/// e.g. when new fields are added to `Layer`, `Dir` or `FileInfo`, so that
+/// stale entries are no longer used.
+const LayerCacheFormatVersion = 6
+
+/// Persistent cache of the analysis results of layers, keyed by the digest of
+/// the layer blob.
+///
+/// The cache is backed by a sqlite database. Once the cached layers exceed the
+/// maximum size, the least recently used layers are evicted.
+type LayerCache struct {
+	con *sql.DB
+
+	// maximum size of the cached layers in bytes, the cache is unlimited if
+	// this is not positive
+	maxSize int64
+
+	// serializes the access to the database, so that evictions and updates of
+	// the last use are not interleaved
+	mu sync.Mutex
+}
+
+/// Opens the layer cache in the sqlite database `dbFileName`, which stores up
+/// to `maxSize` bytes.
+///
+/// Entries that were created with a different `LayerCacheFormatVersion` are
+/// removed.
+func CreateLayerCache(dbFileName string, maxSize int64) (*LayerCache, error) {
+	con, err := sql.Open("sqlite3", dbFileName)
+	if err != nil {
+		return nil, err
+	}
+	cache := &LayerCache{con: con, maxSize: maxSize}
+
+	if err := cache.migrate(); err != nil {
+		con.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (c *LayerCache) migrate() error {
+	query := `
+    CREATE TABLE IF NOT EXISTS layer_cache(
+        digest TEXT PRIMARY KEY,
+        format_version INTEGER NOT NULL,
+        contents TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        last_used INTEGER NOT NULL
+    );
+    `
+	if _, err := c.con.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := c.con.Exec("DELETE FROM layer_cache WHERE format_version != ?", LayerCacheFormatVersion)
+	return err
+}
+
+func (c *LayerCache) Destroy() error {
+	return c.con.Close()
+}
+
+/// Returns the cached analysis of the layer with the digest `digest`.
+///
+/// `ok` is false if the layer is not in the cache.
+func (c *LayerCache) Get(digest string) (layer Layer, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var contents string
+	row := c.con.QueryRow(
+		"SELECT contents FROM layer_cache WHERE digest = ? AND format_version = ?",
+		digest, LayerCacheFormatVersion,
+	)
+	if err := row.Scan(&contents); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewLayer(), false, nil
+		}
+		return NewLayer(), false, err
+	}
+
+	if err := json.Unmarshal([]byte(contents), &layer); err != nil {
+		return NewLayer(), false, err
+	}
+
+	if err := c.touch(digest); err != nil {
+		return NewLayer(), false, err
+	}
+	return layer, true, nil
+}
+
+/// Returns whether the layer with the digest `digest` is in the cache, without
+/// marking it as used.
+func (c *LayerCache) Has(digest string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var count int
+	err := c.con.QueryRow(
+		"SELECT COUNT(*) FROM layer_cache WHERE digest = ? AND format_version = ?",
+		digest, LayerCacheFormatVersion,
+	).Scan(&count)
+	return count > 0, err
+}
+
+/// Stores the analysis of the layer with the digest `digest` in the cache and
+/// evicts the least recently used layers if the cache grows too large.
+///
+/// The `CreatedBy` field is not stored, as it belongs to the image and not to
+/// the layer. Layers that are larger than the whole cache are not stored.
+func (c *LayerCache) Put(digest string, layer Layer) error {
+	layer.CreatedBy = ""
+	contents, err := json.Marshal(layer)
+	if err != nil {
+		return err
+	}
+	size := int64(len(contents))
+	if c.maxSize > 0 && size > c.maxSize {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.con.Exec(
+		`INSERT OR REPLACE INTO layer_cache(digest, format_version, contents, size, last_used)
+         VALUES(?, ?, ?, ?, (SELECT COALESCE(MAX(last_used), 0) + 1 FROM layer_cache))`,
+		digest, LayerCacheFormatVersion, contents, size,
+	); err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+/// Returns the size of all cached layers in bytes
+func (c *LayerCache) Size() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size()
+}
+
+/// Removes all layers from the cache
+func (c *LayerCache) Purge() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.con.Exec("DELETE FROM layer_cache")
+	return err
+}
+
+func (c *LayerCache) size() (int64, error) {
+	var size int64
+	err := c.con.QueryRow("SELECT COALESCE(SUM(size), 0) FROM layer_cache").Scan(&size)
+	return size, err
+}
+
+/// Marks the layer with the digest `digest` as the most recently used one
+func (c *LayerCache) touch(digest string) error {
+	_, err := c.con.Exec(
+		"UPDATE layer_cache SET last_used = (SELECT MAX(last_used) + 1 FROM layer_cache) WHERE digest = ?",
+		digest,
+	)
+	return err
+}
+
+/// Removes the least recently used layers until the cache is no longer larger
+/// than its maximum size
+func (c *LayerCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+
+	size, err := c.size()
+	if err != nil {
+		return err
+	}
+
+	for size > c.maxSize {
+		var digest string
+		var entrySize int64
+		if err := c.con.QueryRow(
+			"SELECT digest, size FROM layer_cache ORDER BY last_used ASC LIMIT 1",
+		).Scan(&digest, &entrySize); err != nil {
+			return err
+		}
+
+		res, err := c.con.Exec("DELETE FROM layer_cache WHERE digest = ?", digest)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return errors.New(fmt.Sprintf("Failed to evict the layer %s from the cache", digest))
+		}
+		size -= entrySize
+	}
+	return nil
+}
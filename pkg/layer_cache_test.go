@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/// Creates a layer with a single file of the size `size` at `path`
+func cacheTestLayer(path string, size int64) Layer {
+	l := NewLayer()
+	l.InsertFileIntoDir(path, size, FileInfo{
+		Type:    FileTypeRegular,
+		Mode:    0644,
+		ModTime: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+	})
+	l.CompressedSize = size / 2
+	l.UncompressedSize = size + 1024
+	l.PayloadSize = size
+	l.TarOverhead = 1024
+	return l
+}
+
+/// Returns the number of bytes that `layer` occupies in the cache
+func cachedSize(t *testing.T, layer Layer) int64 {
+	layer.CreatedBy = ""
+	contents, err := json.Marshal(layer)
+	require.NoError(t, err)
+	return int64(len(contents))
+}
+
+func TestLayerCacheRoundtrip(t *testing.T) {
+	cache, err := CreateLayerCache(filepath.Join(t.TempDir(), "cache.sqlite3"), 0)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	_, ok, err := cache.Get("sha256:aaaa")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	layer := cacheTestLayer("/usr/bin/foo", 4096)
+	layer.CreatedBy = "RUN make install"
+	require.NoError(t, cache.Put("sha256:aaaa", layer))
+
+	ok, err = cache.Has("sha256:aaaa")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	cached, ok, err := cache.Get("sha256:aaaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the command belongs to the image and not to the layer
+	layer.CreatedBy = ""
+	assert.Equal(t, layer, cached)
+
+	size, err := cache.Size()
+	require.NoError(t, err)
+	assert.Equal(t, cachedSize(t, layer), size)
+}
+
+func TestLayerCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	layers := make([]Layer, 4)
+	for i := range layers {
+		layers[i] = cacheTestLayer(fmt.Sprintf("/file%d", i), 100)
+	}
+	entrySize := cachedSize(t, layers[0])
+
+	// room for three layers
+	cache, err := CreateLayerCache(filepath.Join(t.TempDir(), "cache.sqlite3"), 3*entrySize+entrySize/2)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cache.Put(fmt.Sprintf("sha256:%d", i), layers[i]))
+	}
+
+	// layer 0 is now more recently used than layer 1
+	_, ok, err := cache.Get("sha256:0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, cache.Put("sha256:3", layers[3]))
+
+	for i, expected := range []bool{true, false, true, true} {
+		_, ok, err := cache.Get(fmt.Sprintf("sha256:%d", i))
+		require.NoError(t, err)
+		assert.Equalf(t, expected, ok, "unexpected presence of layer %d", i)
+	}
+
+	size, err := cache.Size()
+	require.NoError(t, err)
+	assert.Equal(t, 3*entrySize, size)
+}
+
+func TestLayerCacheSkipsLayersLargerThanTheCache(t *testing.T) {
+	cache, err := CreateLayerCache(filepath.Join(t.TempDir(), "cache.sqlite3"), 10)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	require.NoError(t, cache.Put("sha256:aaaa", cacheTestLayer("/foo", 100)))
+
+	_, ok, err := cache.Get("sha256:aaaa")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestLayerCacheDropsOutdatedFormatVersions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "cache.sqlite3")
+
+	cache, err := CreateLayerCache(dbPath, 0)
+	require.NoError(t, err)
+	require.NoError(t, cache.Put("sha256:current", cacheTestLayer("/foo", 100)))
+	require.NoError(t, cache.Put("sha256:outdated", cacheTestLayer("/bar", 100)))
+	require.NoError(t, cache.Destroy())
+
+	con, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	_, err = con.Exec(
+		"UPDATE layer_cache SET format_version = ? WHERE digest = ?",
+		LayerCacheFormatVersion-1, "sha256:outdated",
+	)
+	require.NoError(t, err)
+	require.NoError(t, con.Close())
+
+	cache, err = CreateLayerCache(dbPath, 0)
+	require.NoError(t, err)
+	defer cache.Destroy()
+
+	_, ok, err := cache.Get("sha256:outdated")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = cache.Get("sha256:current")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	size, err := cache.Size()
+	require.NoError(t, err)
+	assert.Equal(t, cachedSize(t, cacheTestLayer("/foo", 100)), size)
+
+	require.NoError(t, cache.Purge())
+	size, err = cache.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeLayer(t *testing.T) {
+	contents := bytes.Repeat([]byte("container"), 1000)
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "usr/bin/app", Size: int64(len(contents)), Mode: 0755},
+		{Typeflag: tar.TypeLink, Name: "usr/bin/app2", Linkname: "usr/bin/app", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "usr/bin/app3", Linkname: "app", Mode: 0777},
+	} {
+		hdr := hdr
+		require.NoError(t, tw.WriteHeader(&hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(contents)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	var blob bytes.Buffer
+	gz := gzip.NewWriter(&blob)
+	_, err := gz.Write(layer.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	blobSize := int64(blob.Len())
+
+	l, err := AnalyzeLayer(context.Background(), &blob, CompressionGzip, LayerAnalysisOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, blobSize, l.CompressedSize)
+	assert.Equal(t, int64(layer.Len()), l.UncompressedSize)
+	assert.Equal(t, int64(len(contents)), l.PayloadSize)
+	assert.Equal(t, l.UncompressedSize-l.PayloadSize, l.TarOverhead)
+	assert.Equal(t, int64(len(contents)), l.TotalSize)
+
+	bin := l.FindSubdir("/usr/bin")
+	require.NotNil(t, bin)
+	assert.Equal(t, FileTypeHardlink, bin.FileInfos["app2"].Type)
+	assert.Equal(t, FileTypeSymlink, bin.FileInfos["app3"].Type)
+	assert.Equal(t, int64(0), bin.Files["app2"])
+
+	appCompressed := bin.FileInfos["app"].EstimatedCompressedSize
+	assert.Greater(t, appCompressed, int64(0))
+	assert.Less(t, appCompressed, int64(len(contents)))
+	assert.Equal(t, appCompressed, l.EstimatedCompressedSize)
+	assert.Equal(t, appCompressed, bin.EstimatedCompressedSize)
+}
+
+func TestAnalyzeLayerHashContents(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, f := range []struct {
+		name     string
+		contents string
+	}{
+		{name: "etc/os-release", contents: "NAME=test"},
+		{name: "usr/share/os-release", contents: "NAME=test"},
+		{name: "etc/empty", contents: ""},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.contents)), Mode: 0644,
+		}))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	l, err := AnalyzeLayer(context.Background(), bytes.NewReader(layer.Bytes()), CompressionNone, LayerAnalysisOptions{})
+	require.NoError(t, err)
+	assert.False(t, l.ContentsHashed)
+	_, info, ok := l.FindFile("/etc/os-release")
+	require.True(t, ok)
+	assert.Equal(t, "", info.Digest)
+
+	l, err = AnalyzeLayer(context.Background(), bytes.NewReader(layer.Bytes()), CompressionNone, LayerAnalysisOptions{HashContents: true})
+	require.NoError(t, err)
+	assert.True(t, l.ContentsHashed)
+
+	expected := digest.FromString("NAME=test").String()
+	_, info, _ = l.FindFile("/etc/os-release")
+	assert.Equal(t, expected, info.Digest)
+	_, info, _ = l.FindFile("/usr/share/os-release")
+	assert.Equal(t, expected, info.Digest)
+
+	// empty files are not hashed
+	_, info, _ = l.FindFile("/etc/empty")
+	assert.Equal(t, "", info.Digest)
+
+	// hashing must not change the estimate
+	assert.Equal(t, int64(18), l.EstimatedCompressedSize)
+}
+
+func TestAnalyzeLayerParsesPackageDatabasesAndManifests(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, f := range []struct {
+		name     string
+		contents string
+	}{
+		{name: "./var/lib/dpkg/status", contents: "Package: bash\nStatus: install ok installed\nVersion: 5.1\n"},
+		{name: "var/lib/dpkg/info/bash.list", contents: "/bin/bash\n"},
+		{name: "var/lib/dpkg/info/bash.md5sums", contents: "abc  bin/bash\n"},
+		{name: "lib/apk/db/installed", contents: "invalid\n"},
+		{name: "app/node_modules/ms/package.json", contents: `{"name": "ms", "version": "2.1.3"}`},
+		{name: "app/package.json", contents: `{"name": "app", "version": "1.0.0"}`},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.contents)), Mode: 0644,
+		}))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	l, err := AnalyzeLayer(context.Background(), &layer, CompressionNone, LayerAnalysisOptions{})
+	require.NoError(t, err)
+
+	assert.Len(t, l.PackageDatabases, 3)
+	assert.Equal(t, []Package{
+		{PackageRef: PackageRef{Manager: PackageManagerDpkg, Name: "bash", Version: "5.1"}},
+	}, l.PackageDatabases["/var/lib/dpkg/status"].Packages)
+	assert.Equal(t, []string{"/bin/bash"}, l.PackageDatabases["/var/lib/dpkg/info/bash.list"].Files)
+	assert.NotEmpty(t, l.PackageDatabases["/lib/apk/db/installed"].Error)
+
+	assert.Equal(t, map[string]DependencyManifest{
+		"/app/node_modules/ms/package.json": {Ecosystem: EcosystemNpm, Name: "ms", Version: "2.1.3"},
+	}, l.DependencyManifests)
+}
+
+func TestAnalyzeLayerInvalidCompression(t *testing.T) {
+	_, err := AnalyzeLayer(context.Background(), &bytes.Buffer{}, Compression("bzip2"), LayerAnalysisOptions{})
+	assert.Error(t, err)
+}
+
+func TestDetectCompression(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err := gz.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	for _, tc := range []struct {
+		blob     []byte
+		expected Compression
+	}{
+		{blob: gzipped.Bytes(), expected: CompressionGzip},
+		{blob: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, expected: CompressionZstd},
+		{blob: []byte("usr/bin/foo"), expected: CompressionNone},
+		{blob: []byte{}, expected: CompressionNone},
+	} {
+		r := bufio.NewReader(bytes.NewReader(tc.blob))
+		c, err := DetectCompression(r)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, c)
+
+		// the magic bytes must not be consumed
+		rest, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, tc.blob, rest)
+	}
+}
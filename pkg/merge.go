@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"strings"
+)
+
+const (
+	/// Prefix of a whiteout file, `.wh.foo` removes `foo` from all lower layers
+	WhiteoutPrefix = ".wh."
+
+	/// Marker file that hides all contents of its directory in lower layers
+	OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+/// Returns true if the file with the name `fname` is a whiteout or an opaque
+/// whiteout marker.
+func IsWhiteout(fname string) bool {
+	return strings.HasPrefix(fname, WhiteoutPrefix)
+}
+
+/// Creates the effective root filesystem as seen by a container from the
+/// layer trees `layers`, which must be ordered from the lowest to the
+/// topmost layer.
+///
+/// Files in upper layers replace files in lower layers, whiteout files remove
+/// the corresponding entry from the lower layers and opaque whiteouts hide
+/// the whole contents of their directory in lower layers. Whiteouts
+/// themselves are not present in the resulting tree. Hardlinks whose target
+/// got removed retain the size of their contents.
+func MergeLayers(layers []Dir) Dir {
+	root := MakeDir("/")
+	for _, l := range layers {
+		root.applyLayer(&l)
+	}
+	root.accountHardlinks(nil)
+	return root
+}
+
+/// Applies the directory `upper` of a layer onto `d`, without updating the
+/// total sizes.
+func (d *Dir) applyLayer(upper *Dir) {
+	if _, ok := upper.Files[OpaqueWhiteout]; ok {
+		d.Files = make(map[string]int64)
+		d.FileInfos = nil
+		d.Directiories = make(map[string]Dir)
+	}
+
+	for fname := range upper.Files {
+		if IsWhiteout(fname) && fname != OpaqueWhiteout {
+			removed := strings.TrimPrefix(fname, WhiteoutPrefix)
+			d.removeFile(removed)
+			delete(d.Directiories, removed)
+		}
+	}
+
+	for fname, size := range upper.Files {
+		if IsWhiteout(fname) {
+			continue
+		}
+		delete(d.Directiories, fname)
+		d.removeFile(fname)
+		d.Files[fname] = size
+		if info, ok := upper.FileInfos[fname]; ok {
+			d.setFileInfo(fname, info)
+		}
+	}
+
+	for dirname, upperSubdir := range upper.Directiories {
+		d.removeFile(dirname)
+
+		subdir, ok := d.Directiories[dirname]
+		if !ok {
+			subdir = MakeDir(dirname)
+		}
+		subdir.applyLayer(&upperSubdir)
+		d.Directiories[dirname] = subdir
+	}
+}
+
+/// Recalculates the total size, the estimated compressed size and the sizes of
+/// the file categories of `d` and all its subdirectories from the contained
+/// files and returns the new total size.
+func (d *Dir) recalculateTotalSize() int64 {
+	d.TotalSize = 0
+	d.EstimatedCompressedSize = 0
+	d.CategorySizes = nil
+	for fname, size := range d.Files {
+		d.TotalSize += size
+		d.EstimatedCompressedSize += d.FileInfos[fname].EstimatedCompressedSize
+		d.addCategorySize(d.FileInfos[fname].Category, size)
+	}
+	for name, subdir := range d.Directiories {
+		d.TotalSize += subdir.recalculateTotalSize()
+		d.EstimatedCompressedSize += subdir.EstimatedCompressedSize
+		for category, size := range subdir.CategorySizes {
+			d.addCategorySize(category, size)
+		}
+		d.Directiories[name] = subdir
+	}
+	return d.TotalSize
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeOverridesFiles(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertIntoDir("/etc/os-release", 16)
+	lower.InsertIntoDir("/usr/bin/cat", 128)
+
+	upper := MakeDir("/")
+	upper.InsertIntoDir("/etc/os-release", 32)
+
+	expected := MakeDir("/")
+	expected.InsertIntoDir("/etc/os-release", 32)
+	expected.InsertIntoDir("/usr/bin/cat", 128)
+
+	assert.Equal(t, expected, MergeLayers([]Dir{lower, upper}))
+}
+
+func TestMergeWhiteout(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertIntoDir("/etc/os-release", 16)
+	lower.InsertIntoDir("/var/cache/zypp/raw/repomd.xml", 4096)
+	lower.InsertIntoDir("/var/cache/zypp/solv/solv", 8192)
+
+	upper := MakeDir("/")
+	upper.InsertIntoDir("/etc/.wh.os-release", 0)
+	upper.InsertIntoDir("/var/cache/.wh.zypp", 0)
+
+	expected := MakeDir("/")
+	expected.Directiories["etc"] = MakeDir("etc")
+	cache := MakeDir("cache")
+	expected.Directiories["var"] = Dir{
+		DirName:      "var",
+		Files:        map[string]int64{},
+		Directiories: map[string]Dir{"cache": cache},
+	}
+
+	assert.Equal(t, expected, MergeLayers([]Dir{lower, upper}))
+}
+
+func TestMergeOpaqueWhiteout(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertIntoDir("/app/old/file", 16)
+	lower.InsertIntoDir("/app/config", 8)
+	lower.InsertIntoDir("/etc/hosts", 4)
+
+	upper := MakeDir("/")
+	upper.InsertIntoDir("/app/"+OpaqueWhiteout, 0)
+	upper.InsertIntoDir("/app/new", 64)
+
+	expected := MakeDir("/")
+	expected.InsertIntoDir("/app/new", 64)
+	expected.InsertIntoDir("/etc/hosts", 4)
+
+	assert.Equal(t, expected, MergeLayers([]Dir{lower, upper}))
+}
+
+func TestMergeDoesNotModifyLayers(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertIntoDir("/usr/lib/libfoo.so", 1024)
+
+	upper := MakeDir("/")
+	upper.InsertIntoDir("/usr/lib/.wh.libfoo.so", 0)
+	upper.InsertIntoDir("/usr/lib/libbar.so", 512)
+
+	expectedLower := MakeDir("/")
+	expectedLower.InsertIntoDir("/usr/lib/libfoo.so", 1024)
+
+	merged := MergeLayers([]Dir{lower, upper})
+	assert.Equal(t, int64(512), merged.TotalSize)
+	assert.Equal(t, expectedLower, lower)
+}
+
+func TestMergeFileReplacesDirectory(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertIntoDir("/opt/app/bin", 256)
+
+	upper := MakeDir("/")
+	upper.InsertIntoDir("/opt/app", 42)
+
+	expected := MakeDir("/")
+	expected.InsertIntoDir("/opt/app", 42)
+
+	assert.Equal(t, expected, MergeLayers([]Dir{lower, upper}))
+}
+
+func TestMergeKeepsMetadataOfTopmostFile(t *testing.T) {
+	lower := MakeDir("/")
+	lower.InsertFileIntoDir("/usr/bin/vi", 1024, FileInfo{Type: FileTypeRegular, Mode: 0755})
+
+	upper := MakeDir("/")
+	upper.InsertFileIntoDir("/usr/bin/vi", 3, FileInfo{Type: FileTypeSymlink, Mode: 0777, LinkTarget: "vim"})
+
+	merged := MergeLayers([]Dir{lower, upper})
+	assert.Equal(
+		t,
+		FileInfo{Type: FileTypeSymlink, Mode: 0777, LinkTarget: "vim"},
+		merged.Directiories["usr"].Directiories["bin"].FileInfos["vi"],
+	)
+	assert.Equal(t, int64(3), merged.TotalSize)
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+/// Version of the ncdu JSON export format that is written by WriteNcduExport
+const (
+	ncduMajorVersion = 1
+	ncduMinorVersion = 2
+)
+
+/// The header of an ncdu JSON export
+type ncduMetadata struct {
+	ProgName  string `json:"progname"`
+	ProgVer   string `json:"progver"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+/// A single file or directory in an ncdu JSON export
+type ncduEntry struct {
+	Name string `json:"name"`
+
+	/// The apparent size in bytes
+	Asize int64 `json:"asize,omitempty"`
+
+	/// The disk usage in bytes, the same as the apparent size as the block
+	/// size of the extracted layer is unknown
+	Dsize int64 `json:"dsize,omitempty"`
+
+	/// Inode number shared by all hardlinks of the same file
+	Ino uint64 `json:"ino,omitempty"`
+
+	/// true if this file has more than one hardlink
+	Hlnkc bool `json:"hlnkc,omitempty"`
+
+	/// Number of hardlinks of this file
+	Nlink int `json:"nlink,omitempty"`
+
+	/// true for files that are neither regular files nor directories
+	Notreg bool `json:"notreg,omitempty"`
+
+	Uid   *int    `json:"uid,omitempty"`
+	Gid   *int    `json:"gid,omitempty"`
+	Mode  *uint32 `json:"mode,omitempty"`
+	Mtime *int64  `json:"mtime,omitempty"`
+}
+
+/// File type bits of st_mode as expected by ncdu
+var ncduFileTypeBits = map[FileType]uint32{
+	FileTypeRegular:     0100000,
+	FileTypeHardlink:    0100000,
+	FileTypeSymlink:     0120000,
+	FileTypeCharDevice:  0020000,
+	FileTypeBlockDevice: 0060000,
+	FileTypeFifo:        0010000,
+}
+
+/// Writes the tree `root` in the JSON export format of ncdu to `w`, so that
+/// it can be browsed via `ncdu -f`.
+///
+/// `name` is the name of the root directory shown by ncdu and `timestamp`
+/// the time of the export. The metadata of the files is included if it is
+/// present in the tree. Hardlinks in the same tree share an inode number with
+/// their target, so that ncdu counts their contents only once.
+func WriteNcduExport(w io.Writer, root *Dir, name string, timestamp time.Time) error {
+	bw := bufio.NewWriter(w)
+
+	header, err := json.Marshal([]interface{}{
+		ncduMajorVersion,
+		ncduMinorVersion,
+		ncduMetadata{ProgName: "container-layer-sizes", ProgVer: "1", Timestamp: timestamp.Unix()},
+	})
+	if err != nil {
+		return err
+	}
+	// drop the closing bracket of the header, the root directory follows
+	bw.Write(header[:len(header)-1])
+	bw.WriteString(",\n")
+
+	e := ncduExporter{w: bw, inodes: make(map[string]uint64)}
+	if err := e.writeDir(root, "/", name); err != nil {
+		return err
+	}
+	bw.WriteString("]\n")
+
+	return bw.Flush()
+}
+
+type ncduExporter struct {
+	w *bufio.Writer
+
+	/// the inode numbers of hardlinked files, the keys are the absolute paths
+	/// of the hardlink targets
+	inodes map[string]uint64
+}
+
+func (e *ncduExporter) writeDir(d *Dir, dirPath string, name string) error {
+	if err := e.writeEntry(ncduEntry{Name: name}, "["); err != nil {
+		return err
+	}
+
+	for _, fname := range d.fileNames() {
+		e.w.WriteString(",\n")
+		if err := e.writeEntry(e.fileEntry(d, path.Join(dirPath, fname), fname), ""); err != nil {
+			return err
+		}
+	}
+	for _, dirname := range d.subdirNames() {
+		e.w.WriteString(",\n")
+		subdir := d.Directiories[dirname]
+		if err := e.writeDir(&subdir, path.Join(dirPath, dirname), dirname); err != nil {
+			return err
+		}
+	}
+
+	_, err := e.w.WriteString("]")
+	return err
+}
+
+func (e *ncduExporter) writeEntry(entry ncduEntry, prefix string) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	e.w.WriteString(prefix)
+	_, err = e.w.Write(b)
+	return err
+}
+
+/// Creates the ncdu entry of the file `fname` in `d` with the absolute path
+/// `filePath`
+func (e *ncduExporter) fileEntry(d *Dir, filePath string, fname string) ncduEntry {
+	size := d.Files[fname]
+	entry := ncduEntry{Name: fname, Asize: size, Dsize: size}
+
+	info, ok := d.FileInfos[fname]
+	if !ok {
+		return entry
+	}
+
+	if info.Links > 0 {
+		target := filePath
+		if info.Type == FileTypeHardlink {
+			target = path.Clean("/" + info.LinkTarget)
+			entry.Asize, entry.Dsize = info.LinkedSize, info.LinkedSize
+		}
+		entry.Ino = e.inode(target)
+		entry.Hlnkc = info.Links > 1
+		entry.Nlink = info.Links
+	}
+	entry.Notreg = info.Type != FileTypeRegular && info.Type != FileTypeHardlink
+
+	mode := ncduFileTypeBits[info.Type] | uint32(info.Mode&os.ModePerm)
+	if info.Mode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if info.Mode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if info.Mode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	mtime := info.ModTime.Unix()
+	uid, gid := info.Uid, info.Gid
+	entry.Mode, entry.Mtime, entry.Uid, entry.Gid = &mode, &mtime, &uid, &gid
+
+	return entry
+}
+
+/// Returns the inode number of the hardlink target with the absolute path
+/// `target`, all hardlinks of the same target get the same number
+func (e *ncduExporter) inode(target string) uint64 {
+	if ino, ok := e.inodes[target]; ok {
+		return ino
+	}
+	ino := uint64(len(e.inodes) + 1)
+	e.inodes[target] = ino
+	return ino
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteNcduExport(t *testing.T) {
+	mtime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := MakeDir("/")
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/perl", Size: 4096, Mode: 0755, ModTime: mtime})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/perl5.34.0", Linkname: "usr/bin/perl", Mode: 0755, ModTime: mtime})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/sh", Linkname: "bash", Mode: 0777, ModTime: mtime})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/su", Size: 100, Mode: 04755, Uid: 0, Gid: 0, ModTime: mtime})
+	l.InsertTarEntry(&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, ModTime: mtime})
+	AccountHardlinks([]*Dir{&l})
+
+	var out bytes.Buffer
+	require.NoError(t, WriteNcduExport(&out, &l, "/", time.Unix(1654084800, 0)))
+
+	var export []json.RawMessage
+	require.NoError(t, json.Unmarshal(out.Bytes(), &export))
+	require.Len(t, export, 4)
+	assert.JSONEq(t, "1", string(export[0]))
+	assert.JSONEq(t, "2", string(export[1]))
+	assert.JSONEq(t, `{"progname": "container-layer-sizes", "progver": "1", "timestamp": 1654084800}`, string(export[2]))
+
+	assert.JSONEq(t, `[
+		{"name": "/"},
+		[{"name": "dev"},
+			{"name": "null", "notreg": true, "uid": 0, "gid": 0, "mode": 8630, "mtime": 1654084800}
+		],
+		[{"name": "usr"},
+			[{"name": "bin"},
+				{"name": "perl", "asize": 4096, "dsize": 4096, "ino": 1, "hlnkc": true, "nlink": 2, "uid": 0, "gid": 0, "mode": 33261, "mtime": 1654084800},
+				{"name": "perl5.34.0", "asize": 4096, "dsize": 4096, "ino": 1, "hlnkc": true, "nlink": 2, "uid": 0, "gid": 0, "mode": 33261, "mtime": 1654084800},
+				{"name": "sh", "notreg": true, "uid": 0, "gid": 0, "mode": 41471, "mtime": 1654084800},
+				{"name": "su", "asize": 100, "dsize": 100, "uid": 0, "gid": 0, "mode": 35309, "mtime": 1654084800}
+			]
+		]
+	]`, string(export[3]))
+}
+
+func TestWriteNcduExportWithoutMetadata(t *testing.T) {
+	d := MakeDir("/")
+	d.InsertIntoDir("/etc/os-release", 100)
+
+	var out bytes.Buffer
+	require.NoError(t, WriteNcduExport(&out, &d, "layer", time.Unix(0, 0)))
+	assert.JSONEq(t, `[1, 2, {"progname": "container-layer-sizes", "progver": "1", "timestamp": 0},
+		[{"name": "layer"}, [{"name": "etc"}, {"name": "os-release", "asize": 100, "dsize": 100}]]
+	]`, out.String())
+}
@@ -0,0 +1,596 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/// The package manager that owns a package database
+type PackageManager string
+
+const (
+	PackageManagerRpm  PackageManager = "rpm"
+	PackageManagerDpkg PackageManager = "dpkg"
+	PackageManagerApk  PackageManager = "apk"
+)
+
+const (
+	dpkgStatusPath = "/var/lib/dpkg/status"
+	dpkgInfoDir    = "/var/lib/dpkg/info"
+	apkInstalled   = "/lib/apk/db/installed"
+)
+
+/// Directories that contain the rpm database, /var/lib/rpm is usually a
+/// symlink to /usr/lib/sysimage/rpm on newer distributions
+var rpmDatabaseDirs = []string{"/var/lib/rpm", "/usr/lib/sysimage/rpm"}
+
+/// Identifies a single version of a package
+type PackageRef struct {
+	/// The package manager that installed this package
+	Manager PackageManager `json:"manager"`
+
+	Name string `json:"name"`
+
+	/// The full version of the package including the epoch and the release
+	Version string `json:"version"`
+
+	/// The architecture of the package, may be empty
+	Arch string `json:"arch,omitempty"`
+}
+
+/// Returns a key that identifies the package independently of its version
+func (p *PackageRef) key() string {
+	return fmt.Sprintf("%s/%s/%s", p.Manager, p.Name, p.Arch)
+}
+
+func (p PackageRef) String() string {
+	if p.Arch == "" {
+		return fmt.Sprintf("%s-%s", p.Name, p.Version)
+	}
+	return fmt.Sprintf("%s-%s.%s", p.Name, p.Version, p.Arch)
+}
+
+/// An installed package
+type Package struct {
+	PackageRef
+
+	/// Absolute paths of the files and directories owned by this package
+	Files []string `json:"files,omitempty"`
+}
+
+/// The parsed contents of a file of a package database in a layer
+type PackageDatabaseFile struct {
+	Manager PackageManager `json:"manager"`
+
+	/// The packages recorded in this file
+	Packages []Package `json:"packages,omitempty"`
+
+	/// The files listed in a dpkg `info/*.list` file, which belong to the
+	/// package of the same name in the dpkg status file
+	Files []string `json:"files,omitempty"`
+
+	/// Set if the file could not be parsed
+	Error string `json:"error,omitempty"`
+}
+
+/// Returns the package manager whose database contains the file with the
+/// absolute path `filePath`. `ok` is false if the file is not part of a
+/// supported package database.
+func PackageDatabaseManager(filePath string) (manager PackageManager, ok bool) {
+	switch {
+	case filePath == dpkgStatusPath:
+		return PackageManagerDpkg, true
+	case path.Dir(filePath) == dpkgInfoDir && path.Ext(filePath) == ".list":
+		return PackageManagerDpkg, true
+	case filePath == apkInstalled:
+		return PackageManagerApk, true
+	}
+
+	for _, dir := range rpmDatabaseDirs {
+		if filePath == path.Join(dir, "rpmdb.sqlite") || filePath == path.Join(dir, "Packages.db") {
+			return PackageManagerRpm, true
+		}
+	}
+	return "", false
+}
+
+/// Parses the file with the absolute path `filePath` of a package database
+/// whose contents are `contents`.
+///
+/// Errors are recorded in the returned file instead of aborting the analysis
+/// of the layer, as a broken package database does not affect the sizes.
+func ParsePackageDatabaseFile(filePath string, contents []byte) PackageDatabaseFile {
+	manager, ok := PackageDatabaseManager(filePath)
+	f := PackageDatabaseFile{Manager: manager}
+	if !ok {
+		f.Error = fmt.Sprintf("%s is not part of a package database", filePath)
+		return f
+	}
+
+	var err error
+	switch {
+	case filePath == dpkgStatusPath:
+		f.Packages, err = parseDpkgStatus(contents)
+	case manager == PackageManagerDpkg:
+		f.Files = parseDpkgList(contents)
+	case manager == PackageManagerApk:
+		f.Packages, err = parseApkInstalled(contents)
+	case path.Base(filePath) == "rpmdb.sqlite":
+		f.Packages, err = parseRpmSqlite(contents)
+	default:
+		f.Packages, err = parseRpmNdb(contents)
+	}
+
+	if err != nil {
+		f.Packages = nil
+		f.Error = err.Error()
+	}
+	return f
+}
+
+/// Calls `fn` with the fields of each paragraph of a file in the format of
+/// dpkg's status file, continuation lines are appended to their field.
+func forEachParagraph(contents []byte, fn func(fields map[string]string) error) error {
+	fields := make(map[string]string)
+	lastField := ""
+
+	flush := func() error {
+		if len(fields) == 0 {
+			return nil
+		}
+		err := fn(fields)
+		fields = make(map[string]string)
+		lastField = ""
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastField != "" {
+				fields[lastField] += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		sep := strings.Index(line, ":")
+		if sep < 0 {
+			return errors.New(fmt.Sprintf("Invalid line in package database: %s", line))
+		}
+		lastField = line[:sep]
+		fields[lastField] = strings.TrimSpace(line[sep+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+/// Parses the installed packages from dpkg's status file
+func parseDpkgStatus(contents []byte) ([]Package, error) {
+	pkgs := make([]Package, 0)
+	err := forEachParagraph(contents, func(fields map[string]string) error {
+		// the status consists of the wanted action, an error flag and the
+		// state of the package
+		if status := strings.Fields(fields["Status"]); len(status) == 3 &&
+			(status[2] == "not-installed" || status[2] == "config-files") {
+			return nil
+		}
+		if fields["Package"] == "" {
+			return errors.New("Found a package without a name in the dpkg status")
+		}
+
+		pkgs = append(pkgs, Package{PackageRef: PackageRef{
+			Manager: PackageManagerDpkg,
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Arch:    fields["Architecture"],
+		}})
+		return nil
+	})
+	return pkgs, err
+}
+
+/// Returns the files listed in a dpkg `info/*.list` file
+func parseDpkgList(contents []byte) []string {
+	files := make([]string, 0)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" || line == "/." {
+			continue
+		}
+		files = append(files, line)
+	}
+	return files
+}
+
+/// Returns the path of the `info/*.list` file of the dpkg package `p`.
+///
+/// Packages that can be installed for multiple architectures at once
+/// qualify their list with the architecture, `multiArch` selects this name.
+func dpkgListPath(p *Package, multiArch bool) string {
+	if multiArch {
+		return path.Join(dpkgInfoDir, p.Name+":"+p.Arch+".list")
+	}
+	return path.Join(dpkgInfoDir, p.Name+".list")
+}
+
+/// Parses the installed packages including their files from apk's installed
+/// database
+func parseApkInstalled(contents []byte) ([]Package, error) {
+	pkgs := make([]Package, 0)
+
+	var cur *Package
+	dir := ""
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			cur = nil
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			return nil, errors.New(fmt.Sprintf("Invalid line in the apk database: %s", line))
+		}
+		if cur == nil {
+			pkgs = append(pkgs, Package{PackageRef: PackageRef{Manager: PackageManagerApk}})
+			cur = &pkgs[len(pkgs)-1]
+			dir = ""
+		}
+
+		value := line[2:]
+		switch line[0] {
+		case 'P':
+			cur.Name = value
+		case 'V':
+			cur.Version = value
+		case 'A':
+			cur.Arch = value
+		case 'F':
+			dir = value
+			cur.Files = append(cur.Files, path.Join("/", dir))
+		case 'R':
+			cur.Files = append(cur.Files, path.Join("/", dir, value))
+		}
+	}
+
+	for _, p := range pkgs {
+		if p.Name == "" {
+			return nil, errors.New("Found a package without a name in the apk database")
+		}
+	}
+	return pkgs, nil
+}
+
+/// Parses the packages of an rpm database in the sqlite format
+func parseRpmSqlite(contents []byte) ([]Package, error) {
+	// sqlite can only open databases from the file system
+	tempdir, err := ioutil.TempDir("", "rpmdb")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempdir)
+
+	dbPath := filepath.Join(tempdir, "rpmdb.sqlite")
+	if err := ioutil.WriteFile(dbPath, contents, 0600); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT blob FROM Packages ORDER BY hnum")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pkgs := make([]Package, 0)
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		p, err := parseRpmHeader(blob)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			pkgs = append(pkgs, *p)
+		}
+	}
+	return pkgs, rows.Err()
+}
+
+const (
+	ndbHeaderMagic  = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic    = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic    = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+	ndbPageSize     = 4096
+	ndbSlotSize     = 16
+	ndbBlockSize    = 16
+	ndbBlobHeadSize = 16
+)
+
+/// Parses the packages of an rpm database in the ndb format (Packages.db)
+///
+/// The database starts with a header of two slots, followed by the slots that
+/// point to the blocks with the header blob of each package.
+func parseRpmNdb(contents []byte) ([]Package, error) {
+	le := binary.LittleEndian
+	if len(contents) < 2*ndbSlotSize || le.Uint32(contents) != ndbHeaderMagic {
+		return nil, errors.New("Invalid header of the ndb rpm database")
+	}
+	if version := le.Uint32(contents[4:]); version != 0 {
+		return nil, errors.New(fmt.Sprintf("Unsupported version of the ndb rpm database: %d", version))
+	}
+
+	slotsEnd := int(le.Uint32(contents[12:])) * ndbPageSize
+	if slotsEnd > len(contents) {
+		return nil, errors.New("The slots of the ndb rpm database are truncated")
+	}
+
+	pkgs := make([]Package, 0)
+	for offset := 2 * ndbSlotSize; offset+ndbSlotSize <= slotsEnd; offset += ndbSlotSize {
+		slot := contents[offset : offset+ndbSlotSize]
+		if le.Uint32(slot) != ndbSlotMagic {
+			return nil, errors.New(fmt.Sprintf("Invalid slot at offset %d of the ndb rpm database", offset))
+		}
+		pkgIndex := le.Uint32(slot[4:])
+		if pkgIndex == 0 {
+			continue
+		}
+
+		blobStart := int(le.Uint32(slot[8:])) * ndbBlockSize
+		if blobStart+ndbBlobHeadSize > len(contents) {
+			return nil, errors.New(fmt.Sprintf("The blob of package %d of the ndb rpm database is truncated", pkgIndex))
+		}
+		blobHead := contents[blobStart : blobStart+ndbBlobHeadSize]
+		if le.Uint32(blobHead) != ndbBlobMagic || le.Uint32(blobHead[4:]) != pkgIndex {
+			return nil, errors.New(fmt.Sprintf("Invalid blob of package %d in the ndb rpm database", pkgIndex))
+		}
+		blobEnd := blobStart + ndbBlobHeadSize + int(le.Uint32(blobHead[12:]))
+		if blobEnd > len(contents) {
+			return nil, errors.New(fmt.Sprintf("The blob of package %d of the ndb rpm database is truncated", pkgIndex))
+		}
+
+		p, err := parseRpmHeader(contents[blobStart+ndbBlobHeadSize : blobEnd])
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			pkgs = append(pkgs, *p)
+		}
+	}
+	return pkgs, nil
+}
+
+const (
+	rpmTagName         = 1000
+	rpmTagVersion      = 1001
+	rpmTagRelease      = 1002
+	rpmTagEpoch        = 1003
+	rpmTagArch         = 1022
+	rpmTagOldFilenames = 1027
+	rpmTagDirIndexes   = 1116
+	rpmTagBasenames    = 1117
+	rpmTagDirNames     = 1118
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+type rpmHeaderEntry struct {
+	typ    uint32
+	offset int
+	count  int
+}
+
+/// Parses a package from the header blob of an rpm database.
+///
+/// Returns nil for the pseudo packages of the imported gpg keys, which do not
+/// own any files.
+func parseRpmHeader(blob []byte) (*Package, error) {
+	be := binary.BigEndian
+	if len(blob) < 8 {
+		return nil, errors.New("The rpm header is truncated")
+	}
+	indexCount := int(be.Uint32(blob))
+	dataLength := int(be.Uint32(blob[4:]))
+	dataStart := 8 + indexCount*16
+	if indexCount < 0 || dataLength < 0 || indexCount > len(blob) || dataStart+dataLength > len(blob) {
+		return nil, errors.New("The rpm header is truncated")
+	}
+	data := blob[dataStart : dataStart+dataLength]
+
+	entries := make(map[uint32]rpmHeaderEntry, indexCount)
+	for i := 0; i < indexCount; i++ {
+		e := blob[8+i*16 : 8+(i+1)*16]
+		entries[be.Uint32(e)] = rpmHeaderEntry{
+			typ:    be.Uint32(e[4:]),
+			offset: int(int32(be.Uint32(e[8:]))),
+			count:  int(be.Uint32(e[12:])),
+		}
+	}
+
+	strs := func(tag uint32) ([]string, error) {
+		e, ok := entries[tag]
+		if !ok {
+			return nil, nil
+		}
+		if e.typ != rpmTypeString && e.typ != rpmTypeStringArray && e.typ != rpmTypeI18NString {
+			return nil, errors.New(fmt.Sprintf("The rpm header tag %d is not a string", tag))
+		}
+		if e.typ == rpmTypeString {
+			e.count = 1
+		}
+		// every string occupies at least its terminating null byte
+		if e.count < 0 || e.count > len(data) {
+			return nil, errors.New(fmt.Sprintf("The rpm header tag %d is truncated", tag))
+		}
+
+		res := make([]string, 0, e.count)
+		offset := e.offset
+		for i := 0; i < e.count; i++ {
+			if offset < 0 || offset >= len(data) {
+				return nil, errors.New(fmt.Sprintf("The rpm header tag %d is truncated", tag))
+			}
+			end := bytes.IndexByte(data[offset:], 0)
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("The rpm header tag %d is truncated", tag))
+			}
+			res = append(res, string(data[offset:offset+end]))
+			offset += end + 1
+		}
+		return res, nil
+	}
+	str := func(tag uint32) (string, error) {
+		s, err := strs(tag)
+		if err != nil || len(s) == 0 {
+			return "", err
+		}
+		return s[0], nil
+	}
+	int32s := func(tag uint32) ([]int, error) {
+		e, ok := entries[tag]
+		if !ok {
+			return nil, nil
+		}
+		if e.typ != rpmTypeInt32 {
+			return nil, errors.New(fmt.Sprintf("The rpm header tag %d is not an int32", tag))
+		}
+		if e.offset < 0 || e.count < 0 || e.offset+4*e.count > len(data) {
+			return nil, errors.New(fmt.Sprintf("The rpm header tag %d is truncated", tag))
+		}
+		res := make([]int, e.count)
+		for i := range res {
+			res[i] = int(int32(be.Uint32(data[e.offset+4*i:])))
+		}
+		return res, nil
+	}
+
+	p := Package{PackageRef: PackageRef{Manager: PackageManagerRpm}}
+	var version, release string
+	var err error
+	for tag, dest := range map[uint32]*string{
+		rpmTagName:    &p.Name,
+		rpmTagVersion: &version,
+		rpmTagRelease: &release,
+		rpmTagArch:    &p.Arch,
+	} {
+		if *dest, err = str(tag); err != nil {
+			return nil, err
+		}
+	}
+	if p.Name == "" {
+		return nil, errors.New("Found a package without a name in the rpm database")
+	}
+	if p.Name == "gpg-pubkey" {
+		return nil, nil
+	}
+
+	p.Version = version + "-" + release
+	epoch, err := int32s(rpmTagEpoch)
+	if err != nil {
+		return nil, err
+	}
+	if len(epoch) > 0 {
+		p.Version = fmt.Sprintf("%d:%s", epoch[0], p.Version)
+	}
+
+	basenames, err := strs(rpmTagBasenames)
+	if err != nil {
+		return nil, err
+	}
+	dirnames, err := strs(rpmTagDirNames)
+	if err != nil {
+		return nil, err
+	}
+	dirIndexes, err := int32s(rpmTagDirIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(basenames) > 0 {
+		if len(dirIndexes) != len(basenames) {
+			return nil, errors.New(fmt.Sprintf("The file list of the rpm package %s is inconsistent", p.Name))
+		}
+		p.Files = make([]string, 0, len(basenames))
+		for i, base := range basenames {
+			if dirIndexes[i] < 0 || dirIndexes[i] >= len(dirnames) {
+				return nil, errors.New(fmt.Sprintf("The file list of the rpm package %s is inconsistent", p.Name))
+			}
+			p.Files = append(p.Files, dirnames[dirIndexes[i]]+base)
+		}
+	} else if p.Files, err = strs(rpmTagOldFilenames); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+/// Returns the installed packages including their files from the package
+/// database files `files`, the keys are their absolute paths.
+///
+/// The packages are sorted by their package manager, name and architecture.
+/// A package that is present in multiple databases of the same package
+/// manager is only returned once. The errors of files that could not be
+/// parsed are returned as well.
+func packagesOfDatabases(files map[string]PackageDatabaseFile) (pkgs []Package, errs []string) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	pkgs = make([]Package, 0)
+	seen := make(map[string]bool)
+	for _, dbPath := range paths {
+		f := files[dbPath]
+		if f.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s: %s", dbPath, f.Error))
+		}
+
+		for _, p := range f.Packages {
+			if seen[p.key()] {
+				continue
+			}
+			seen[p.key()] = true
+
+			if p.Manager == PackageManagerDpkg && len(p.Files) == 0 {
+				list, ok := files[dpkgListPath(&p, true)]
+				if !ok {
+					list = files[dpkgListPath(&p, false)]
+				}
+				p.Files = list.Files
+			}
+			pkgs = append(pkgs, p)
+		}
+	}
+
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].key() < pkgs[j].key()
+	})
+	return pkgs, errs
+}
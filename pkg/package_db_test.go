@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageDatabaseManager(t *testing.T) {
+	for filePath, expected := range map[string]PackageManager{
+		"/var/lib/dpkg/status":                   PackageManagerDpkg,
+		"/var/lib/dpkg/info/bash.list":           PackageManagerDpkg,
+		"/var/lib/dpkg/info/libc6:amd64.list":    PackageManagerDpkg,
+		"/lib/apk/db/installed":                  PackageManagerApk,
+		"/var/lib/rpm/rpmdb.sqlite":              PackageManagerRpm,
+		"/usr/lib/sysimage/rpm/rpmdb.sqlite":     PackageManagerRpm,
+		"/usr/lib/sysimage/rpm/Packages.db":      PackageManagerRpm,
+		"/var/lib/dpkg/info/bash.md5sums":        "",
+		"/var/lib/dpkg/status-old":               "",
+		"/usr/share/doc/dpkg/status":             "",
+		"/usr/lib/sysimage/rpm/rpmdb.sqlite-shm": "",
+	} {
+		manager, ok := PackageDatabaseManager(filePath)
+		assert.Equal(t, expected != "", ok, filePath)
+		assert.Equal(t, expected, manager, filePath)
+	}
+}
+
+func TestParseDpkgDatabase(t *testing.T) {
+	status := ParsePackageDatabaseFile("/var/lib/dpkg/status", []byte(`Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.1-2+b3
+Description: GNU Bourne Again SHell
+ Bash is an sh-compatible command language interpreter.
+
+Package: libfoo
+Status: deinstall ok config-files
+Version: 1.0
+
+Package: tzdata
+Status: install ok installed
+Architecture: all
+Version: 2021a-1+deb11u4
+`))
+	assert.Empty(t, status.Error)
+	assert.Equal(t, PackageManagerDpkg, status.Manager)
+	assert.Equal(t, []Package{
+		{PackageRef: PackageRef{Manager: PackageManagerDpkg, Name: "bash", Version: "5.1-2+b3", Arch: "amd64"}},
+		{PackageRef: PackageRef{Manager: PackageManagerDpkg, Name: "tzdata", Version: "2021a-1+deb11u4", Arch: "all"}},
+	}, status.Packages)
+
+	list := ParsePackageDatabaseFile("/var/lib/dpkg/info/bash.list", []byte("/.\n/bin\n/bin/bash\n"))
+	assert.Empty(t, list.Error)
+	assert.Equal(t, []string{"/bin", "/bin/bash"}, list.Files)
+
+	invalid := ParsePackageDatabaseFile("/var/lib/dpkg/status", []byte("this is not a status file\n"))
+	assert.NotEmpty(t, invalid.Error)
+	assert.Empty(t, invalid.Packages)
+}
+
+func TestParseApkDatabase(t *testing.T) {
+	f := ParsePackageDatabaseFile("/lib/apk/db/installed", []byte(`C:Q1abc=
+P:musl
+V:1.2.3-r0
+A:x86_64
+F:lib
+R:ld-musl-x86_64.so.1
+a:0:0:755
+R:libc.musl-x86_64.so.1
+
+P:busybox
+V:1.35.0-r17
+A:x86_64
+F:bin
+R:busybox
+`))
+	assert.Empty(t, f.Error)
+	assert.Equal(t, []Package{
+		{
+			PackageRef: PackageRef{Manager: PackageManagerApk, Name: "musl", Version: "1.2.3-r0", Arch: "x86_64"},
+			Files:      []string{"/lib", "/lib/ld-musl-x86_64.so.1", "/lib/libc.musl-x86_64.so.1"},
+		},
+		{
+			PackageRef: PackageRef{Manager: PackageManagerApk, Name: "busybox", Version: "1.35.0-r17", Arch: "x86_64"},
+			Files:      []string{"/bin", "/bin/busybox"},
+		},
+	}, f.Packages)
+}
+
+/// Creates the header blob of an rpm package as it is stored in the rpm
+/// database
+func rpmHeaderBlob(name string, epoch int32, version string, release string, arch string, files map[string][]string) []byte {
+	type entry struct {
+		tag, typ, offset, count uint32
+	}
+	var entries []entry
+	var data bytes.Buffer
+
+	addStrings := func(tag uint32, typ uint32, strs ...string) {
+		entries = append(entries, entry{tag: tag, typ: typ, offset: uint32(data.Len()), count: uint32(len(strs))})
+		for _, s := range strs {
+			data.WriteString(s)
+			data.WriteByte(0)
+		}
+	}
+	addInt32s := func(tag uint32, values ...int32) {
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+		entries = append(entries, entry{tag: tag, typ: rpmTypeInt32, offset: uint32(data.Len()), count: uint32(len(values))})
+		for _, v := range values {
+			binary.Write(&data, binary.BigEndian, v)
+		}
+	}
+
+	addStrings(rpmTagName, rpmTypeString, name)
+	addStrings(rpmTagVersion, rpmTypeString, version)
+	addStrings(rpmTagRelease, rpmTypeString, release)
+	addStrings(rpmTagArch, rpmTypeString, arch)
+	if epoch > 0 {
+		addInt32s(rpmTagEpoch, epoch)
+	}
+
+	if len(files) > 0 {
+		var dirnames, basenames []string
+		var dirIndexes []int32
+		for _, dir := range []string{"/usr/bin/", "/usr/lib/"} {
+			if len(files[dir]) == 0 {
+				continue
+			}
+			dirnames = append(dirnames, dir)
+			for _, base := range files[dir] {
+				basenames = append(basenames, base)
+				dirIndexes = append(dirIndexes, int32(len(dirnames)-1))
+			}
+		}
+		addStrings(rpmTagBasenames, rpmTypeStringArray, basenames...)
+		addStrings(rpmTagDirNames, rpmTypeStringArray, dirnames...)
+		addInt32s(rpmTagDirIndexes, dirIndexes...)
+	}
+
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, uint32(len(entries)))
+	binary.Write(&blob, binary.BigEndian, uint32(data.Len()))
+	for _, e := range entries {
+		binary.Write(&blob, binary.BigEndian, e)
+	}
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+func testRpmBlobs() [][]byte {
+	return [][]byte{
+		rpmHeaderBlob("bash", 0, "5.1.16", "5.1", "x86_64", map[string][]string{"/usr/bin/": {"bash", "sh"}}),
+		rpmHeaderBlob("gpg-pubkey", 0, "3dbdc284", "53674dd4", "", nil),
+		rpmHeaderBlob("glibc", 2, "2.35", "3.1", "x86_64", map[string][]string{"/usr/lib/": {"libc.so.6"}}),
+	}
+}
+
+func expectedRpmPackages() []Package {
+	return []Package{
+		{
+			PackageRef: PackageRef{Manager: PackageManagerRpm, Name: "bash", Version: "5.1.16-5.1", Arch: "x86_64"},
+			Files:      []string{"/usr/bin/bash", "/usr/bin/sh"},
+		},
+		{
+			PackageRef: PackageRef{Manager: PackageManagerRpm, Name: "glibc", Version: "2:2.35-3.1", Arch: "x86_64"},
+			Files:      []string{"/usr/lib/libc.so.6"},
+		},
+	}
+}
+
+func TestParseRpmSqliteDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rpmdb.sqlite")
+	db, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE Packages(hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB NOT NULL)")
+	require.NoError(t, err)
+	for _, blob := range testRpmBlobs() {
+		_, err = db.Exec("INSERT INTO Packages(blob) VALUES(?)", blob)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	contents, err := ioutil.ReadFile(dbPath)
+	require.NoError(t, err)
+
+	f := ParsePackageDatabaseFile("/usr/lib/sysimage/rpm/rpmdb.sqlite", contents)
+	assert.Empty(t, f.Error)
+	assert.Equal(t, PackageManagerRpm, f.Manager)
+	assert.Equal(t, expectedRpmPackages(), f.Packages)
+
+	invalid := ParsePackageDatabaseFile("/var/lib/rpm/rpmdb.sqlite", []byte("not a database"))
+	assert.NotEmpty(t, invalid.Error)
+}
+
+func TestParseRpmNdbDatabase(t *testing.T) {
+	le := binary.LittleEndian
+	blobs := testRpmBlobs()
+
+	db := make([]byte, ndbPageSize)
+	le.PutUint32(db, ndbHeaderMagic)
+	le.PutUint32(db[12:], 1)
+
+	for i, blob := range blobs {
+		// leave an empty slot between the packages
+		slot := db[(2+2*i)*ndbSlotSize:]
+		le.PutUint32(slot, ndbSlotMagic)
+		le.PutUint32(slot[16:], ndbSlotMagic)
+		le.PutUint32(slot[4:], uint32(i+1))
+		le.PutUint32(slot[8:], uint32(len(db)/ndbBlockSize))
+
+		head := make([]byte, ndbBlobHeadSize)
+		le.PutUint32(head, ndbBlobMagic)
+		le.PutUint32(head[4:], uint32(i+1))
+		le.PutUint32(head[12:], uint32(len(blob)))
+		db = append(db, head...)
+		db = append(db, blob...)
+		for len(db)%ndbBlockSize != 0 {
+			db = append(db, 0)
+		}
+	}
+	// the remaining slots are empty
+	for offset := (2 + 2*len(blobs)) * ndbSlotSize; offset < ndbPageSize; offset += ndbSlotSize {
+		le.PutUint32(db[offset:], ndbSlotMagic)
+	}
+
+	f := ParsePackageDatabaseFile("/usr/lib/sysimage/rpm/Packages.db", db)
+	assert.Empty(t, f.Error)
+	assert.Equal(t, expectedRpmPackages(), f.Packages)
+
+	f = ParsePackageDatabaseFile("/usr/lib/sysimage/rpm/Packages.db", db[:ndbPageSize+20])
+	assert.NotEmpty(t, f.Error)
+	assert.Empty(t, f.Packages)
+}
+
+func TestParseTruncatedRpmHeader(t *testing.T) {
+	blob := testRpmBlobs()[0]
+	for _, l := range []int{0, 7, 20, len(blob) - 1} {
+		_, err := parseRpmHeader(blob[:l])
+		assert.Error(t, err, l)
+	}
+}
+
+func TestParseRpmHeaderWithHugeStringCount(t *testing.T) {
+	blob := testRpmBlobs()[0]
+	indexCount := int(binary.BigEndian.Uint32(blob))
+	for i := 0; i < indexCount; i++ {
+		e := blob[8+i*16 : 8+(i+1)*16]
+		if binary.BigEndian.Uint32(e) == rpmTagBasenames {
+			binary.BigEndian.PutUint32(e[12:], 0xffffffff)
+		}
+	}
+
+	_, err := parseRpmHeader(blob)
+	assert.Error(t, err)
+}
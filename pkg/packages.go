@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+/// Maximum number of symbolic links that are followed when resolving a path
+const maxSymlinkDepth = 40
+
+/// The space that a package occupies in the final image
+type PackageSize struct {
+	PackageRef
+
+	/// Sum of the sizes of the files of this package in the final image
+	Size int64 `json:"size"`
+
+	/// Number of files of this package that are present in the final image
+	FileCount int `json:"file_count"`
+
+	/// Digest of the layer that installed this version of the package
+	Layer string `json:"layer"`
+}
+
+/// The packages that a layer installs or removes
+type LayerPackageChanges struct {
+	/// Digest of the layer
+	Digest string `json:"digest"`
+
+	/// Packages that are installed by this layer, including new versions of
+	/// packages that were already installed
+	Added []PackageRef `json:"added"`
+
+	/// Packages that are removed by this layer, including the previous
+	/// versions of upgraded packages
+	Removed []PackageRef `json:"removed"`
+}
+
+/// A file in the final image that does not belong to any package
+type UnownedFile struct {
+	/// Full path of the file
+	Path string `json:"path"`
+
+	/// Size of the file in bytes
+	Size int64 `json:"size"`
+}
+
+/// The attribution of the files of an image to its installed packages
+type PackageReport struct {
+	/// The installed packages of the final image, the largest first
+	Packages []PackageSize `json:"packages"`
+
+	/// The package changes of each layer in the order of the manifest
+	Layers []LayerPackageChanges `json:"layers"`
+
+	/// Files of the final image that are not owned by any package, the
+	/// largest first
+	UnownedFiles []UnownedFile `json:"unowned_files"`
+
+	/// Sum of the sizes of all unowned files
+	UnownedBytes int64 `json:"unowned_bytes"`
+
+	/// Package database files of the final image that could not be parsed
+	Errors []string `json:"errors,omitempty"`
+}
+
+/// Attributes the files of the final root filesystem `mergedRoot` to the
+/// packages that are installed according to the package databases in
+/// `layers`.
+///
+/// `layerDigests` are the digests of the layers in `layers` ordered from the
+/// lowest to the topmost layer. The package databases are merged like the
+/// file system, so that a database file of an upper layer replaces the one of
+/// a lower layer. A file that is owned by several packages is attributed to
+/// the first of them. Returns nil if the image contains no package database.
+func AnalyzePackages(layerDigests []string, layers LayerSizes, mergedRoot *Dir) *PackageReport {
+	report := PackageReport{
+		Packages:     make([]PackageSize, 0),
+		Layers:       make([]LayerPackageChanges, 0, len(layerDigests)),
+		UnownedFiles: make([]UnownedFile, 0),
+	}
+
+	found := false
+	visible := make(map[string]PackageDatabaseFile)
+	installed := make(map[string]PackageRef)
+	installedBy := make(map[string]string)
+	var pkgs []Package
+
+	for _, digest := range layerDigests {
+		l := layers[digest]
+		changes := LayerPackageChanges{
+			Digest:  digest,
+			Added:   make([]PackageRef, 0),
+			Removed: make([]PackageRef, 0),
+		}
+
+		changed := false
+		for dbPath := range visible {
+			if hidden, _ := l.hides(dbPath); hidden {
+				delete(visible, dbPath)
+				changed = true
+			}
+		}
+		for dbPath, f := range l.PackageDatabases {
+			visible[dbPath] = f
+			changed = true
+			found = true
+		}
+
+		if changed {
+			pkgs, report.Errors = packagesOfDatabases(visible)
+
+			current := make(map[string]PackageRef, len(pkgs))
+			for _, p := range pkgs {
+				current[p.key()] = p.PackageRef
+				if prev, ok := installed[p.key()]; !ok || prev.Version != p.Version {
+					changes.Added = append(changes.Added, p.PackageRef)
+					installedBy[p.key()] = digest
+				}
+			}
+			for key, prev := range installed {
+				if p, ok := current[key]; !ok || p.Version != prev.Version {
+					changes.Removed = append(changes.Removed, prev)
+				}
+			}
+			sort.Slice(changes.Removed, func(i, j int) bool {
+				return changes.Removed[i].key() < changes.Removed[j].key()
+			})
+			installed = current
+		}
+
+		report.Layers = append(report.Layers, changes)
+	}
+
+	if !found {
+		return nil
+	}
+
+	owners := make(map[string]int)
+	for i, p := range pkgs {
+		for _, f := range p.Files {
+			resolved := resolvePath(mergedRoot, f)
+			if _, ok := owners[resolved]; !ok {
+				owners[resolved] = i
+			}
+		}
+	}
+
+	sizes := make([]PackageSize, len(pkgs))
+	for i, p := range pkgs {
+		sizes[i] = PackageSize{PackageRef: p.PackageRef, Layer: installedBy[p.key()]}
+	}
+
+	mergedRoot.WalkFiles(func(filePath string, size int64) {
+		if i, ok := owners[filePath]; ok {
+			sizes[i].Size += size
+			sizes[i].FileCount++
+			return
+		}
+		report.UnownedFiles = append(report.UnownedFiles, UnownedFile{Path: filePath, Size: size})
+		report.UnownedBytes += size
+	})
+
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Size > sizes[j].Size
+	})
+	sort.SliceStable(report.UnownedFiles, func(i, j int) bool {
+		return report.UnownedFiles[i].Size > report.UnownedFiles[j].Size
+	})
+	report.Packages = sizes
+
+	return &report
+}
+
+/// Resolves the symbolic links in the directories leading up to the
+/// absolute path `filePath` in the tree `root`, the file itself is not
+/// resolved.
+///
+/// This is required as package databases record the paths under which the
+/// files got installed, which may point through a symlink like /bin ->
+/// usr/bin.
+func resolvePath(root *Dir, filePath string) string {
+	components := dropEmptyStrings(strings.Split(filePath, "/"))
+
+	for depth := 0; depth < maxSymlinkDepth; depth++ {
+		restarted := false
+
+		dirs := components
+		if len(dirs) > 0 {
+			dirs = dirs[:len(dirs)-1]
+		}
+
+		cur := root
+		for i, c := range dirs {
+			info, ok := cur.FileInfos[c]
+			if !ok || info.Type != FileTypeSymlink {
+				subdir, ok := cur.Directiories[c]
+				if !ok {
+					return path.Join(append([]string{"/"}, components...)...)
+				}
+				cur = &subdir
+				continue
+			}
+
+			target := info.LinkTarget
+			if !path.IsAbs(target) {
+				target = path.Join(append(append([]string{"/"}, components[:i]...), target)...)
+			}
+			components = append(
+				dropEmptyStrings(strings.Split(path.Clean(target), "/")),
+				components[i+1:]...,
+			)
+			restarted = true
+			break
+		}
+
+		if !restarted {
+			break
+		}
+	}
+
+	return path.Join(append([]string{"/"}, components...)...)
+}
+
+/// Attributes the files of this history entry to its packages, see
+/// `AnalyzePackages`.
+///
+/// The layers are ordered like in `Duplicates`.
+func (e *ImageHistoryEntry) Packages() *PackageReport {
+	digests := e.orderedLayerDigests()
+	return AnalyzePackages(digests, e.Contents, e.mergedRoot(digests))
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dpkgPackage(name string, version string) Package {
+	return Package{PackageRef: PackageRef{Manager: PackageManagerDpkg, Name: name, Version: version, Arch: "amd64"}}
+}
+
+func dpkgRef(name string, version string) PackageRef {
+	return dpkgPackage(name, version).PackageRef
+}
+
+func TestAnalyzePackages(t *testing.T) {
+	base := NewLayer()
+	base.InsertFileIntoDir("/bin", 0, FileInfo{Type: FileTypeSymlink, LinkTarget: "usr/bin"})
+	base.InsertIntoDir("/usr/bin/bash", 1000)
+	base.InsertIntoDir("/usr/bin/vim", 3000)
+	base.InsertIntoDir("/etc/motd", 10)
+	base.InsertIntoDir("/var/lib/dpkg/status", 50)
+	base.InsertIntoDir("/var/lib/dpkg/info/bash.list", 5)
+	base.InsertIntoDir("/var/lib/dpkg/info/vim:amd64.list", 5)
+	base.PackageDatabases = map[string]PackageDatabaseFile{
+		"/var/lib/dpkg/status": {
+			Manager:  PackageManagerDpkg,
+			Packages: []Package{dpkgPackage("bash", "5.1"), dpkgPackage("vim", "8.2")},
+		},
+		"/var/lib/dpkg/info/bash.list": {
+			Manager: PackageManagerDpkg,
+			Files:   []string{"/bin", "/bin/bash"},
+		},
+		"/var/lib/dpkg/info/vim:amd64.list": {
+			Manager: PackageManagerDpkg,
+			Files:   []string{"/usr/bin/vim"},
+		},
+	}
+
+	// upgrades bash and removes vim
+	top := NewLayer()
+	top.InsertIntoDir("/usr/bin/bash", 1200)
+	top.InsertIntoDir("/usr/bin/.wh.vim", 0)
+	top.InsertIntoDir("/app/main", 700)
+	top.InsertIntoDir("/var/lib/dpkg/status", 40)
+	top.InsertIntoDir("/var/lib/dpkg/info/.wh.vim:amd64.list", 0)
+	top.PackageDatabases = map[string]PackageDatabaseFile{
+		"/var/lib/dpkg/status": {
+			Manager:  PackageManagerDpkg,
+			Packages: []Package{dpkgPackage("bash", "5.2")},
+		},
+	}
+
+	// does not touch the package database
+	config := NewLayer()
+	config.InsertIntoDir("/etc/app.conf", 20)
+
+	digests := []string{"base", "top", "config"}
+	layers := LayerSizes{"base": base, "top": top, "config": config}
+	merged := MergeLayers([]Dir{base.Dir, top.Dir, config.Dir})
+
+	report := AnalyzePackages(digests, layers, &merged)
+	require.NotNil(t, report)
+
+	assert.Equal(t, []PackageSize{
+		{PackageRef: dpkgRef("bash", "5.2"), Size: 1200, FileCount: 2, Layer: "top"},
+	}, report.Packages)
+
+	assert.Equal(t, []LayerPackageChanges{
+		{Digest: "base", Added: []PackageRef{dpkgRef("bash", "5.1"), dpkgRef("vim", "8.2")}, Removed: []PackageRef{}},
+		{Digest: "top", Added: []PackageRef{dpkgRef("bash", "5.2")}, Removed: []PackageRef{dpkgRef("bash", "5.1"), dpkgRef("vim", "8.2")}},
+		{Digest: "config", Added: []PackageRef{}, Removed: []PackageRef{}},
+	}, report.Layers)
+
+	assert.Equal(t, []UnownedFile{
+		{Path: "/app/main", Size: 700},
+		{Path: "/var/lib/dpkg/status", Size: 40},
+		{Path: "/etc/app.conf", Size: 20},
+		{Path: "/etc/motd", Size: 10},
+		{Path: "/var/lib/dpkg/info/bash.list", Size: 5},
+	}, report.UnownedFiles)
+	assert.Equal(t, int64(775), report.UnownedBytes)
+	assert.Empty(t, report.Errors)
+}
+
+func TestAnalyzePackagesWithoutDatabase(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/app/main", 700)
+	merged := MergeLayers([]Dir{l.Dir})
+
+	assert.Nil(t, AnalyzePackages([]string{"l"}, LayerSizes{"l": l}, &merged))
+}
+
+func TestAnalyzePackagesReportsErrors(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/lib/apk/db/installed", 10)
+	l.PackageDatabases = map[string]PackageDatabaseFile{
+		"/lib/apk/db/installed": {Manager: PackageManagerApk, Error: "Invalid line"},
+	}
+	merged := MergeLayers([]Dir{l.Dir})
+
+	report := AnalyzePackages([]string{"l"}, LayerSizes{"l": l}, &merged)
+	require.NotNil(t, report)
+	assert.Empty(t, report.Packages)
+	assert.Equal(t, []string{"/lib/apk/db/installed: Invalid line"}, report.Errors)
+}
+
+func TestResolvePath(t *testing.T) {
+	root := MakeDir("/")
+	root.InsertFileIntoDir("/bin", 0, FileInfo{Type: FileTypeSymlink, LinkTarget: "usr/bin"})
+	root.InsertFileIntoDir("/lib", 0, FileInfo{Type: FileTypeSymlink, LinkTarget: "/usr/lib64"})
+	root.InsertFileIntoDir("/usr/lib64/loop", 0, FileInfo{Type: FileTypeSymlink, LinkTarget: "../../lib/loop"})
+	root.InsertFileIntoDir("/usr/bin/sh", 0, FileInfo{Type: FileTypeSymlink, LinkTarget: "bash"})
+
+	assert.Equal(t, "/usr/bin/bash", resolvePath(&root, "/bin/bash"))
+	assert.Equal(t, "/usr/bin/sh", resolvePath(&root, "/bin/sh"))
+	assert.Equal(t, "/usr/lib64/libc.so", resolvePath(&root, "/lib/libc.so"))
+	assert.Equal(t, "/etc/os-release", resolvePath(&root, "/etc/os-release"))
+	assert.Equal(t, "/", resolvePath(&root, "/"))
+	// does not loop forever
+	resolvePath(&root, "/lib/loop/file")
+}
+
+func TestImageHistoryEntryPackages(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/usr/bin/bash", 1000)
+	l.PackageDatabases = map[string]PackageDatabaseFile{
+		"/var/lib/rpm/rpmdb.sqlite": {
+			Manager: PackageManagerRpm,
+			Packages: []Package{{
+				PackageRef: PackageRef{Manager: PackageManagerRpm, Name: "bash", Version: "5.1-1", Arch: "x86_64"},
+				Files:      []string{"/usr/bin/bash"},
+			}},
+		},
+	}
+
+	entry := ImageHistoryEntry{Contents: LayerSizes{"abc": l}}
+	report := entry.Packages()
+	require.NotNil(t, report)
+	require.Len(t, report.Packages, 1)
+	assert.Equal(t, "bash", report.Packages[0].Name)
+	assert.Equal(t, int64(1000), report.Packages[0].Size)
+	assert.Equal(t, "abc", report.Packages[0].Layer)
+}
@@ -0,0 +1,365 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+/// The kind of a recommendation how to make an image smaller
+type RecommendationKind string
+
+const (
+	/// Caches of package managers that are left behind in a layer
+	RecommendationPackageManagerCache RecommendationKind = "package_manager_cache"
+
+	/// Compilers and build tools in the final image
+	RecommendationBuildToolchain RecommendationKind = "build_toolchain"
+
+	/// Files that are removed by a later layer
+	RecommendationRemovedLater RecommendationKind = "removed_later"
+
+	/// Debug information in the final image
+	RecommendationDebugInfo RecommendationKind = "debug_info"
+
+	/// Test suites of installed language dependencies
+	RecommendationDependencyTests RecommendationKind = "dependency_tests"
+
+	/// Files that are overwritten by a later layer, so that squashing the
+	/// layers would store them only once
+	RecommendationSquashLayers RecommendationKind = "squash_layers"
+)
+
+/// Maximum number of paths that are listed in a single recommendation
+const maxRecommendationPaths = 20
+
+/// A concrete suggestion how to make an image smaller
+type Recommendation struct {
+	Kind RecommendationKind `json:"kind"`
+
+	/// Digest of the layer that contains the files
+	Layer string `json:"layer"`
+
+	/// The command that created the layer
+	CreatedBy string `json:"created_by,omitempty"`
+
+	/// Digest of the layer that removes or overwrites the files, only set for
+	/// files that are removed or overwritten later
+	RelatedLayer string `json:"related_layer,omitempty"`
+
+	/// The affected files or directories, the largest first and at most
+	/// `maxRecommendationPaths`
+	Paths []string `json:"paths"`
+
+	/// Number of affected files
+	FileCount int `json:"file_count"`
+
+	/// Estimated number of bytes that following the suggestion saves
+	Bytes int64 `json:"bytes"`
+
+	/// What should be changed
+	Suggestion string `json:"suggestion"`
+}
+
+/// All recommendations for an image
+type RecommendationReport struct {
+	/// The recommendations with the largest savings first
+	Recommendations []Recommendation `json:"recommendations"`
+
+	/// Sum of the estimated savings of all recommendations in bytes
+	SavableBytes int64 `json:"savable_bytes"`
+}
+
+/// Directories of package manager caches, which may contain wildcards, and
+/// how to avoid them
+var packageManagerCaches = []struct {
+	pattern    string
+	suggestion string
+}{
+	{pattern: "/var/cache/zypp", suggestion: "Run `zypper clean --all` in the same step that installs the packages"},
+	{pattern: "/var/cache/apt", suggestion: "Run `apt-get clean` in the same step that installs the packages"},
+	{pattern: "/var/lib/apt/lists", suggestion: "Remove /var/lib/apt/lists/* in the same step that runs `apt-get update`"},
+	{pattern: "/var/cache/dnf", suggestion: "Run `dnf clean all` in the same step that installs the packages"},
+	{pattern: "/var/cache/yum", suggestion: "Run `yum clean all` in the same step that installs the packages"},
+	{pattern: "/var/cache/apk", suggestion: "Install the packages via `apk add --no-cache`"},
+	{pattern: "/root/.cache/pip", suggestion: "Install the packages via `pip install --no-cache-dir`"},
+	{pattern: "/home/*/.cache/pip", suggestion: "Install the packages via `pip install --no-cache-dir`"},
+	{pattern: "/root/.npm/_cacache", suggestion: "Run `npm cache clean --force` in the same step that installs the packages"},
+	{pattern: "/home/*/.npm/_cacache", suggestion: "Run `npm cache clean --force` in the same step that installs the packages"},
+	{pattern: "/usr/local/share/.cache/yarn", suggestion: "Run `yarn cache clean` in the same step that installs the packages"},
+	{pattern: "/root/.cache/go-build", suggestion: "Run `go clean -cache` in the same step that builds the application"},
+}
+
+/// Paths of compilers and build tools, which may contain wildcards in their
+/// last component
+var buildToolchains = []struct {
+	name  string
+	paths []string
+}{
+	{name: "gcc", paths: []string{
+		"/usr/bin/gcc*", "/usr/bin/g++*", "/usr/bin/cc", "/usr/bin/c++", "/usr/bin/cpp*",
+		"/usr/lib/gcc", "/usr/lib64/gcc", "/usr/libexec/gcc",
+	}},
+	{name: "clang", paths: []string{"/usr/bin/clang*", "/usr/lib/llvm-*", "/usr/lib64/llvm*"}},
+	{name: "binutils", paths: []string{"/usr/bin/as", "/usr/bin/ld", "/usr/bin/ld.*"}},
+	{name: "make", paths: []string{"/usr/bin/make", "/usr/bin/cmake", "/usr/share/cmake*"}},
+	{name: "go", paths: []string{"/usr/local/go", "/usr/lib/go", "/usr/lib64/go", "/usr/lib/golang"}},
+	{name: "rust", paths: []string{"/root/.rustup", "/usr/local/rustup", "/root/.cargo/bin", "/usr/local/cargo/bin"}},
+}
+
+/// Directories that contain separate debug information
+var debugInfoDirs = []string{"/usr/lib/debug", "/usr/src/debug"}
+
+/// Names of the test directories of language dependencies
+var dependencyTestDirs = map[string]bool{"test": true, "tests": true, "__tests__": true, "spec": true}
+
+/// Directories whose subdirectories contain installed language dependencies
+var dependencyDirs = []string{"/node_modules/", "/site-packages/", "/dist-packages/", "/gems/"}
+
+/// Collects the files of the recommendations, which are grouped by their
+/// kind, layer, related layer and suggestion
+type recommendationCollector struct {
+	recommendations map[string]*Recommendation
+	pathSizes       map[string]map[string]int64
+	order           []string
+}
+
+func newRecommendationCollector() *recommendationCollector {
+	return &recommendationCollector{
+		recommendations: make(map[string]*Recommendation),
+		pathSizes:       make(map[string]map[string]int64),
+	}
+}
+
+/// Adds the file with the size `size` to the recommendation `r`, the file is
+/// listed as `reportedPath`, which may be the directory containing it.
+func (c *recommendationCollector) add(r Recommendation, reportedPath string, size int64) {
+	key := strings.Join([]string{string(r.Kind), r.Layer, r.RelatedLayer, r.Suggestion}, "\x00")
+	rec, ok := c.recommendations[key]
+	if !ok {
+		rec = &r
+		c.recommendations[key] = rec
+		c.pathSizes[key] = make(map[string]int64)
+		c.order = append(c.order, key)
+	}
+	rec.FileCount++
+	rec.Bytes += size
+	c.pathSizes[key][reportedPath] += size
+}
+
+/// Returns the collected recommendations with the largest savings first
+func (c *recommendationCollector) report() RecommendationReport {
+	report := RecommendationReport{Recommendations: make([]Recommendation, 0, len(c.order))}
+
+	for _, key := range c.order {
+		rec := *c.recommendations[key]
+		if rec.Bytes == 0 {
+			continue
+		}
+
+		sizes := c.pathSizes[key]
+		rec.Paths = make([]string, 0, len(sizes))
+		for p := range sizes {
+			rec.Paths = append(rec.Paths, p)
+		}
+		sort.Slice(rec.Paths, func(i, j int) bool {
+			if si, sj := sizes[rec.Paths[i]], sizes[rec.Paths[j]]; si != sj {
+				return si > sj
+			}
+			return rec.Paths[i] < rec.Paths[j]
+		})
+		if len(rec.Paths) > maxRecommendationPaths {
+			rec.Paths = rec.Paths[:maxRecommendationPaths]
+		}
+
+		report.SavableBytes += rec.Bytes
+		report.Recommendations = append(report.Recommendations, rec)
+	}
+
+	sort.SliceStable(report.Recommendations, func(i, j int) bool {
+		return report.Recommendations[i].Bytes > report.Recommendations[j].Bytes
+	})
+	return report
+}
+
+/// Creates recommendations how to make the image with the layers `layers`
+/// smaller.
+///
+/// `layerDigests` are the digests of the layers in `layers` ordered from the
+/// lowest to the topmost layer, `mergedRoot` is the final root filesystem and
+/// `efficiency` the wasted space of the layers. The savings are estimates, as
+/// the files of some recommendations may overlap.
+func Recommend(layerDigests []string, layers LayerSizes, mergedRoot *Dir, efficiency EfficiencyReport) RecommendationReport {
+	c := newRecommendationCollector()
+
+	recommendation := func(kind RecommendationKind, layer string, suggestion string) Recommendation {
+		return Recommendation{Kind: kind, Layer: layer, CreatedBy: layers[layer].CreatedBy, Suggestion: suggestion}
+	}
+
+	// caches that end up in the final image, caches that are removed later
+	// are reported as removed files
+	for i, digest := range layerDigests {
+		l := layers[digest]
+		l.WalkDirs(func(dirPath string, dir *Dir) {
+			for _, cache := range packageManagerCaches {
+				if matched, _ := path.Match(cache.pattern, dirPath); !matched {
+					continue
+				}
+				dir.WalkFiles(func(filePath string, size int64) {
+					filePath = path.Join(path.Dir(dirPath), filePath)
+					if IsWhiteout(path.Base(filePath)) || hiddenByLayers(layerDigests[i+1:], layers, filePath) {
+						return
+					}
+					c.add(recommendation(RecommendationPackageManagerCache, digest, cache.suggestion), dirPath, size)
+				})
+			}
+		})
+	}
+
+	for _, toolchain := range buildToolchains {
+		suggestion := fmt.Sprintf(
+			"The %s toolchain is only needed for building, use a multi-stage build and copy only the build results into the final image",
+			toolchain.name,
+		)
+		for _, pattern := range toolchain.paths {
+			walkMatchingFiles(mergedRoot, pattern, func(matchedPath string, filePath string, size int64) {
+				layer := topmostLayerOf(layerDigests, layers, filePath)
+				c.add(recommendation(RecommendationBuildToolchain, layer, suggestion), matchedPath, size)
+			})
+		}
+	}
+
+	debugSuggestion := "Do not install debug information into the final image, strip binaries via `strip --strip-debug`"
+	addDebugInfo := func(matchedPath string, filePath string, size int64) {
+		layer := topmostLayerOf(layerDigests, layers, filePath)
+		c.add(recommendation(RecommendationDebugInfo, layer, debugSuggestion), matchedPath, size)
+	}
+	for _, dir := range debugInfoDirs {
+		walkMatchingFiles(mergedRoot, dir, addDebugInfo)
+	}
+	mergedRoot.WalkFiles(func(filePath string, size int64) {
+		if path.Ext(filePath) == ".debug" && !isInDirs(filePath, debugInfoDirs) {
+			addDebugInfo(filePath, filePath, size)
+		}
+	})
+	// stripping an unstripped binary saves the size of its debug sections
+	stripSuggestion := "Strip the debug information and the symbol table from the binaries via `strip`"
+	mergedRoot.walkFileInfos(func(filePath string, size int64, info FileInfo) {
+		if info.DebugInfoSize > 0 && path.Ext(filePath) != ".debug" && !isInDirs(filePath, debugInfoDirs) {
+			layer := topmostLayerOf(layerDigests, layers, filePath)
+			c.add(recommendation(RecommendationDebugInfo, layer, stripSuggestion), filePath, info.DebugInfoSize)
+		}
+	})
+
+	testSuggestion := "Remove the test suites of the installed dependencies, they are not needed at runtime"
+	var testDirs []string
+	mergedRoot.WalkDirs(func(dirPath string, dir *Dir) {
+		if !dependencyTestDirs[path.Base(dirPath)] || isInDirs(dirPath, testDirs) {
+			return
+		}
+		parent := path.Dir(dirPath) + "/"
+		for _, depDir := range dependencyDirs {
+			// the test directory has to be inside of a dependency and not
+			// directly in the directory containing the dependencies
+			if i := strings.Index(parent, depDir); i >= 0 && len(parent) > i+len(depDir) {
+				testDirs = append(testDirs, dirPath)
+				walkMatchingFiles(mergedRoot, dirPath, func(matchedPath string, filePath string, size int64) {
+					layer := topmostLayerOf(layerDigests, layers, filePath)
+					c.add(recommendation(RecommendationDependencyTests, layer, testSuggestion), matchedPath, size)
+				})
+				return
+			}
+		}
+	})
+
+	for _, l := range efficiency.Layers {
+		for _, f := range l.WastedFiles {
+			r := recommendation(
+				RecommendationSquashLayers, l.Digest,
+				"The files are overwritten by a later layer, create them in their final form in one step or squash the layers",
+			)
+			if f.Deleted {
+				r = recommendation(
+					RecommendationRemovedLater, l.Digest,
+					"The files are removed by a later layer but still occupy space in this one, remove them in the same step that creates them",
+				)
+			}
+			r.RelatedLayer = f.RemovedBy
+			c.add(r, f.Path, f.Size)
+		}
+	}
+
+	return c.report()
+}
+
+/// Calls `fn` for every file of `root` that either matches `pattern`, whose
+/// last component may contain wildcards, or is inside a directory matching
+/// it, with the path of the matching file or directory.
+func walkMatchingFiles(root *Dir, pattern string, fn func(matchedPath string, filePath string, size int64)) {
+	parentPath := path.Dir(pattern)
+	parent := root.FindSubdir(parentPath)
+	if parent == nil {
+		return
+	}
+	base := path.Base(pattern)
+
+	for _, fname := range parent.fileNames() {
+		if matched, _ := path.Match(base, fname); matched && !IsWhiteout(fname) {
+			filePath := path.Join(parentPath, fname)
+			fn(filePath, filePath, parent.Files[fname])
+		}
+	}
+	for _, dirname := range parent.subdirNames() {
+		if matched, _ := path.Match(base, dirname); !matched {
+			continue
+		}
+		dirPath := path.Join(parentPath, dirname)
+		subdir := parent.Directiories[dirname]
+		subdir.WalkFiles(func(filePath string, size int64) {
+			fn(dirPath, path.Join(parentPath, filePath), size)
+		})
+	}
+}
+
+/// Returns the digest of the topmost layer of `layerDigests` that contains
+/// the file `filePath`, which is the layer that provides it in the final
+/// image.
+func topmostLayerOf(layerDigests []string, layers LayerSizes, filePath string) string {
+	for i := len(layerDigests) - 1; i >= 0; i-- {
+		l := layers[layerDigests[i]]
+		if _, _, ok := l.FindFile(filePath); ok {
+			return layerDigests[i]
+		}
+	}
+	return ""
+}
+
+/// Checks whether the file `filePath` is overwritten or removed by any of the
+/// layers `upperDigests`.
+func hiddenByLayers(upperDigests []string, layers LayerSizes, filePath string) bool {
+	for _, digest := range upperDigests {
+		upper := layers[digest]
+		if hidden, _ := upper.hides(filePath); hidden {
+			return true
+		}
+	}
+	return false
+}
+
+/// Checks whether `p` is inside of one of the directories `dirs`
+func isInDirs(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+/// Returns recommendations how to make the image of this history entry
+/// smaller.
+func (e *ImageHistoryEntry) Recommendations() RecommendationReport {
+	digests := e.orderedLayerDigests()
+	return Recommend(digests, e.Contents, e.mergedRoot(digests), CalculateEfficiency(digests, e.Contents))
+}
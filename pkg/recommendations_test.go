@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecommend(t *testing.T) {
+	base := NewLayer()
+	base.CreatedBy = "ADD rootfs.tar /"
+	base.InsertIntoDir("/usr/bin/bash", 1000)
+	base.InsertIntoDir("/etc/config", 100)
+	base.InsertIntoDir("/usr/lib/debug/usr/bin/bash.debug", 3000)
+
+	install := NewLayer()
+	install.CreatedBy = "RUN zypper -n in gcc python3-pip && pip install requests"
+	install.InsertIntoDir("/var/cache/zypp/packages/gcc.rpm", 20000)
+	install.InsertIntoDir("/var/cache/zypp/raw/repomd.xml", 500)
+	install.InsertIntoDir("/root/.cache/pip/http/abc", 700)
+	install.InsertIntoDir("/usr/bin/gcc-12", 4000)
+	install.InsertIntoDir("/usr/bin/gccgo", 0)
+	install.InsertIntoDir("/usr/lib64/gcc/x86_64-suse-linux/12/cc1", 9000)
+	install.InsertIntoDir("/usr/lib/python3.10/site-packages/requests/__init__.py", 300)
+	install.InsertIntoDir("/usr/lib/python3.10/site-packages/requests/tests/test_api.py", 800)
+	install.InsertIntoDir("/usr/lib/python3.10/site-packages/requests/tests/data/file", 200)
+	install.InsertIntoDir("/usr/lib/python3.10/site-packages/tests/conftest.py", 50)
+	install.InsertIntoDir("/tmp/build/app.o", 6000)
+	install.InsertIntoDir("/etc/config", 150)
+
+	cleanup := NewLayer()
+	cleanup.CreatedBy = "RUN rm -rf /tmp/build /root/.cache/pip"
+	cleanup.InsertIntoDir("/tmp/.wh.build", 0)
+	cleanup.InsertIntoDir("/root/.cache/.wh.pip", 0)
+
+	digests := []string{"base", "install", "cleanup"}
+	layers := LayerSizes{"base": base, "install": install, "cleanup": cleanup}
+	merged := MergeLayers([]Dir{base.Dir, install.Dir, cleanup.Dir})
+
+	report := Recommend(digests, layers, &merged, CalculateEfficiency(digests, layers))
+
+	byKind := make(map[RecommendationKind][]Recommendation)
+	for _, r := range report.Recommendations {
+		byKind[r.Kind] = append(byKind[r.Kind], r)
+	}
+
+	require.Len(t, byKind[RecommendationPackageManagerCache], 1)
+	cache := byKind[RecommendationPackageManagerCache][0]
+	assert.Equal(t, "install", cache.Layer)
+	assert.Equal(t, install.CreatedBy, cache.CreatedBy)
+	assert.Equal(t, []string{"/var/cache/zypp"}, cache.Paths)
+	assert.Equal(t, int64(20500), cache.Bytes)
+	assert.Equal(t, 2, cache.FileCount)
+	assert.Contains(t, cache.Suggestion, "zypper clean")
+
+	require.Len(t, byKind[RecommendationBuildToolchain], 1)
+	gcc := byKind[RecommendationBuildToolchain][0]
+	assert.Equal(t, "install", gcc.Layer)
+	assert.Equal(t, []string{"/usr/lib64/gcc", "/usr/bin/gcc-12", "/usr/bin/gccgo"}, gcc.Paths)
+	assert.Equal(t, int64(13000), gcc.Bytes)
+	assert.Contains(t, gcc.Suggestion, "gcc")
+
+	assert.Equal(t, []Recommendation{{
+		Kind: RecommendationDebugInfo, Layer: "base", CreatedBy: base.CreatedBy,
+		Paths: []string{"/usr/lib/debug"}, FileCount: 1, Bytes: 3000,
+		Suggestion: byKind[RecommendationDebugInfo][0].Suggestion,
+	}}, byKind[RecommendationDebugInfo])
+
+	// the tests directory directly in site-packages is not part of a dependency
+	require.Len(t, byKind[RecommendationDependencyTests], 1)
+	tests := byKind[RecommendationDependencyTests][0]
+	assert.Equal(t, []string{"/usr/lib/python3.10/site-packages/requests/tests"}, tests.Paths)
+	assert.Equal(t, int64(1000), tests.Bytes)
+	assert.Equal(t, 2, tests.FileCount)
+
+	require.Len(t, byKind[RecommendationRemovedLater], 1)
+	removed := byKind[RecommendationRemovedLater][0]
+	assert.Equal(t, "install", removed.Layer)
+	assert.Equal(t, "cleanup", removed.RelatedLayer)
+	assert.Equal(t, []string{"/tmp/build/app.o", "/root/.cache/pip/http/abc"}, removed.Paths)
+	assert.Equal(t, int64(6700), removed.Bytes)
+
+	require.Len(t, byKind[RecommendationSquashLayers], 1)
+	squash := byKind[RecommendationSquashLayers][0]
+	assert.Equal(t, "base", squash.Layer)
+	assert.Equal(t, "install", squash.RelatedLayer)
+	assert.Equal(t, []string{"/etc/config"}, squash.Paths)
+	assert.Equal(t, int64(100), squash.Bytes)
+
+	assert.Equal(t, int64(20500+13000+3000+1000+6700+100), report.SavableBytes)
+	for i := 1; i < len(report.Recommendations); i++ {
+		assert.GreaterOrEqual(t, report.Recommendations[i-1].Bytes, report.Recommendations[i].Bytes)
+	}
+}
+
+func TestRecommendLimitsPaths(t *testing.T) {
+	l := NewLayer()
+	for i := 0; i < maxRecommendationPaths+5; i++ {
+		l.InsertIntoDir("/usr/lib/debug/"+string(rune('a'+i))+".debug", int64(i+1))
+		l.InsertIntoDir("/app/"+string(rune('a'+i))+".debug", int64(i+1))
+	}
+	merged := MergeLayers([]Dir{l.Dir})
+
+	report := Recommend([]string{"l"}, LayerSizes{"l": l}, &merged, CalculateEfficiency([]string{"l"}, LayerSizes{"l": l}))
+	require.Len(t, report.Recommendations, 1)
+	r := report.Recommendations[0]
+	assert.Equal(t, 2*(maxRecommendationPaths+5), r.FileCount)
+	require.Len(t, r.Paths, maxRecommendationPaths)
+	assert.Equal(t, "/usr/lib/debug", r.Paths[0])
+	assert.Equal(t, "/app/y.debug", r.Paths[1])
+}
+
+func TestRecommendWithoutFindings(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/usr/bin/bash", 1000)
+	merged := MergeLayers([]Dir{l.Dir})
+
+	report := Recommend([]string{"l"}, LayerSizes{"l": l}, &merged, CalculateEfficiency([]string{"l"}, LayerSizes{"l": l}))
+	assert.Empty(t, report.Recommendations)
+	assert.Zero(t, report.SavableBytes)
+}
+
+func TestRecommendStrippingUnstrippedBinaries(t *testing.T) {
+	// built from `void _start(void) { for (;;); }` via
+	// `gcc -g -Os -nostdlib -static -Wl,--build-id=none -Wl,-z,noseparate-code`
+	// and `strip`
+	unstripped, err := os.ReadFile(filepath.Join("testdata", "unstripped.elf"))
+	require.NoError(t, err)
+	stripped, err := os.ReadFile(filepath.Join("testdata", "stripped.elf"))
+	require.NoError(t, err)
+
+	var blob bytes.Buffer
+	tw := tar.NewWriter(&blob)
+	for name, contents := range map[string][]byte{"usr/bin/app": unstripped, "usr/bin/stripped": stripped} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: name, Size: int64(len(contents)), Mode: 0755,
+		}))
+		_, err := tw.Write(contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	l, err := AnalyzeLayer(context.Background(), &blob, CompressionNone, LayerAnalysisOptions{})
+	require.NoError(t, err)
+
+	_, app, _ := l.FindFile("/usr/bin/app")
+	assert.Greater(t, app.DebugInfoSize, int64(0))
+	assert.Less(t, app.DebugInfoSize, int64(len(unstripped)))
+	_, info, _ := l.FindFile("/usr/bin/stripped")
+	assert.Equal(t, int64(0), info.DebugInfoSize)
+
+	digests := []string{"app"}
+	layers := LayerSizes{"app": l}
+	merged := MergeLayers([]Dir{l.Dir})
+	report := Recommend(digests, layers, &merged, CalculateEfficiency(digests, layers))
+
+	require.Len(t, report.Recommendations, 1)
+	r := report.Recommendations[0]
+	assert.Equal(t, RecommendationDebugInfo, r.Kind)
+	assert.Equal(t, "app", r.Layer)
+	assert.Equal(t, []string{"/usr/bin/app"}, r.Paths)
+	assert.Equal(t, app.DebugInfoSize, r.Bytes)
+	assert.Contains(t, r.Suggestion, "strip")
+}
@@ -34,33 +34,86 @@ func (b *SQLiteBackend) Migrate() error {
         name TEXT NOT NULL
     );
     `
-	_, err := b.con.Exec(query)
+	if _, err := b.con.Exec(query); err != nil {
+		return err
+	}
+
+	for _, c := range imageHistoryEntryColumns {
+		if err := b.addColumnIfMissing("image_history_entry", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/// Columns of the image_history_entry table that were added after its initial
+/// creation and have to be added to existing databases.
+var imageHistoryEntryColumns = []struct {
+	name       string
+	definition string
+}{
+	{name: "merged_contents", definition: "TEXT NOT NULL DEFAULT 'null'"},
+	{name: "history", definition: "TEXT NOT NULL DEFAULT 'null'"},
+}
+
+/// Adds the column `column` with the type `definition` to the table
+/// `tableName` unless it already exists.
+func (b *SQLiteBackend) addColumnIfMissing(tableName string, column string, definition string) error {
+	rows, err := b.con.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", tableName))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = b.con.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, column, definition))
 	return err
 }
 
-func imageHistoryEntryToJson(imageHistoryEntry *ImageHistoryEntry) (tagsJson []byte, contentsJson []byte, inspectInfoJson []byte, err error) {
+func imageHistoryEntryToJson(imageHistoryEntry *ImageHistoryEntry) (tagsJson []byte, contentsJson []byte, inspectInfoJson []byte, mergedContentsJson []byte, historyJson []byte, err error) {
 	tagsJson, err = json.Marshal(imageHistoryEntry.Tags)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	contentsJson, err = json.Marshal(imageHistoryEntry.Contents)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	inspectInfoJson, err = json.Marshal(imageHistoryEntry.InspectInfo)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+	mergedContentsJson, err = json.Marshal(imageHistoryEntry.MergedContents)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	historyJson, err = json.Marshal(imageHistoryEntry.History)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 
 	return
 }
 
 func (s *SQLiteBackend) createImageHistoryEntry(imageId int64, hash string, imageHistoryEntry *ImageHistoryEntry) (*ImageHistoryEntry, error) {
-	tagsJson, contentsJson, inspectInfoJson, err := imageHistoryEntryToJson(imageHistoryEntry)
+	tagsJson, contentsJson, inspectInfoJson, mergedContentsJson, historyJson, err := imageHistoryEntryToJson(imageHistoryEntry)
 	if err != nil {
 		return nil, err
 	}
-	res, err := s.con.Exec("INSERT INTO image_history_entry(image_id,hash,tags,contents,inspect_info) values(?,?,?,?,?)", imageId, hash, tagsJson, contentsJson, inspectInfoJson)
+	res, err := s.con.Exec("INSERT INTO image_history_entry(image_id,hash,tags,contents,inspect_info,merged_contents,history) values(?,?,?,?,?,?,?)", imageId, hash, tagsJson, contentsJson, inspectInfoJson, mergedContentsJson, historyJson)
 
 	if err != nil {
 		return nil, err
@@ -71,20 +124,22 @@ func (s *SQLiteBackend) createImageHistoryEntry(imageId int64, hash string, imag
 	}
 
 	return &ImageHistoryEntry{
-		id:          id,
-		Tags:        imageHistoryEntry.Tags,
-		Contents:    imageHistoryEntry.Contents,
-		InspectInfo: imageHistoryEntry.InspectInfo,
+		id:             id,
+		Tags:           imageHistoryEntry.Tags,
+		Contents:       imageHistoryEntry.Contents,
+		InspectInfo:    imageHistoryEntry.InspectInfo,
+		MergedContents: imageHistoryEntry.MergedContents,
+		History:        imageHistoryEntry.History,
 	}, nil
 }
 
 func (s *SQLiteBackend) updateImageHistoryEntry(imageId int64, hash string, imageHistoryEntry *ImageHistoryEntry) (*ImageHistoryEntry, error) {
-	tagsJson, contentsJson, inspectInfoJson, err := imageHistoryEntryToJson(imageHistoryEntry)
+	tagsJson, contentsJson, inspectInfoJson, mergedContentsJson, historyJson, err := imageHistoryEntryToJson(imageHistoryEntry)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := s.con.Exec("UPDATE image_history_entry SET image_id = ?, hash = ?, tags = ?, contents = ?, inspect_info = ? WHERE ID = ?", imageId, hash, tagsJson, contentsJson, inspectInfoJson, imageHistoryEntry.id)
+	res, err := s.con.Exec("UPDATE image_history_entry SET image_id = ?, hash = ?, tags = ?, contents = ?, inspect_info = ?, merged_contents = ?, history = ? WHERE ID = ?", imageId, hash, tagsJson, contentsJson, inspectInfoJson, mergedContentsJson, historyJson, imageHistoryEntry.id)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +155,7 @@ func (s *SQLiteBackend) updateImageHistoryEntry(imageId int64, hash string, imag
 }
 
 func (s *SQLiteBackend) getAllImageHistoryEntries(imageId int64) (map[string]ImageHistoryEntry, error) {
-	rows, err := s.con.Query("SELECT * FROM image_history_entry WHERE image_id = ?", imageId)
+	rows, err := s.con.Query("SELECT id, image_id, hash, tags, contents, inspect_info, merged_contents, history FROM image_history_entry WHERE image_id = ?", imageId)
 	if err != nil {
 		return nil, err
 	}
@@ -111,8 +166,8 @@ func (s *SQLiteBackend) getAllImageHistoryEntries(imageId int64) (map[string]Ima
 	for rows.Next() {
 		var entry ImageHistoryEntry
 		var image_id int64
-		var hash, tagsJson, contentsJson, inspectInfoJson string
-		if err := rows.Scan(&entry.id, &image_id, &hash, &tagsJson, &contentsJson, &inspectInfoJson); err != nil {
+		var hash, tagsJson, contentsJson, inspectInfoJson, mergedContentsJson, historyJson string
+		if err := rows.Scan(&entry.id, &image_id, &hash, &tagsJson, &contentsJson, &inspectInfoJson, &mergedContentsJson, &historyJson); err != nil {
 			return nil, err
 		}
 
@@ -125,6 +180,12 @@ func (s *SQLiteBackend) getAllImageHistoryEntries(imageId int64) (map[string]Ima
 		if err := json.Unmarshal([]byte(inspectInfoJson), &entry.InspectInfo); err != nil {
 			return nil, err
 		}
+		if err := json.Unmarshal([]byte(mergedContentsJson), &entry.MergedContents); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(historyJson), &entry.History); err != nil {
+			return nil, err
+		}
 		res[hash] = entry
 	}
 
@@ -1,9 +1,11 @@
 package internal
 
 import (
+	"database/sql"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/containers/image/v5/types"
 	"github.com/stretchr/testify/assert"
@@ -159,3 +161,92 @@ func TestReadAll(t *testing.T) {
 	assert.Truef(t, findEntry(*h1), "Expected to find the entry h1 in the database")
 	assert.Truef(t, findEntry(*h2), "Expected to find the entry h2 in the database")
 }
+
+func TestMergedContentsRoundTrip(t *testing.T) {
+	l := NewLayer()
+	l.InsertIntoDir("/etc/os-release", 128)
+	merged := MergeLayers([]Dir{l.Dir})
+
+	entry := entryOne
+	entry.MergedContents = &merged
+
+	h := &ImageHistory{History: map[string]ImageHistoryEntry{"merged": entry}}
+	h.Name = "imageWithMergedContents"
+
+	h, err := s.Create(h)
+	require.NoError(t, err)
+
+	h2, err := s.ReadById(h.ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, h, h2)
+	assert.Equal(t, merged, *h2.History["merged"].MergedContents)
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	created := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	entry := entryOne
+	entry.History = []HistoryStep{
+		{Index: 0, Created: &created, CreatedBy: "ADD rootfs.tar /", Layer: "aaaa"},
+		{Index: 1, CreatedBy: "ENV VERSION=3.0", EmptyLayer: true},
+		{Index: 2, CreatedBy: "RUN true", Comment: "buildkit.dockerfile.v0", Layer: "aaaa"},
+	}
+
+	h := &ImageHistory{History: map[string]ImageHistoryEntry{"history": entry}}
+	h.Name = "imageWithHistory"
+
+	h, err := s.Create(h)
+	require.NoError(t, err)
+
+	h2, err := s.ReadById(h.ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, h, h2)
+	assert.Equal(t, entry.History, h2.History["history"].History)
+}
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	file, err := ioutil.TempFile("", "testDb.*.sqlite3")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	con, err := sql.Open("sqlite3", file.Name())
+	require.NoError(t, err)
+
+	_, err = con.Exec(`
+    CREATE TABLE image_history_entry(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        image_id INTEGER NOT NULL,
+        hash TEXT NOT NULL,
+        tags TEXT NOT NULL,
+        contents TEXT NOT NULL,
+        inspect_info TEXT NOT NULL,
+        FOREIGN KEY(image_id) REFERENCES image(id)
+    );
+    CREATE TABLE image(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL
+    );
+    INSERT INTO image(name) VALUES('oldImage');
+    INSERT INTO image_history_entry(image_id,hash,tags,contents,inspect_info) VALUES(1,'sha256:asdf','[]','{}','{}');
+    `)
+	require.NoError(t, err)
+	require.NoError(t, con.Close())
+
+	backend, err := CreateSQLiteBackend(file.Name())
+	require.NoError(t, err)
+	defer backend.Destroy()
+
+	// migrating twice must not fail
+	require.NoError(t, backend.Migrate())
+
+	h, err := backend.Read("oldImage")
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+
+	entry, ok := h[0].History["sha256:asdf"]
+	require.True(t, ok)
+	assert.Nil(t, entry.MergedContents)
+	assert.Nil(t, entry.History)
+}
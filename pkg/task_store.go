@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/// Version of the format of the stored task results.
+///
+/// This has to be increased whenever the results change in an incompatible
+/// way, results of other versions are dropped and their tasks are processed
+/// again.
+const TaskStoreFormatVersion = 1
+
+/// The kind of a stored task
+type TaskKind string
+
+const (
+	/// A task analyzing a single image
+	TaskKindImage TaskKind = "image"
+
+	/// A task analyzing every platform of a multi-arch image
+	TaskKindIndex TaskKind = "index"
+)
+
+/// A task of the analyzer as it is stored in the TaskStore
+type TaskRecord struct {
+	ID   string
+	Kind TaskKind
+
+	/// The url of the analyzed image including its transport
+	ImageUrl string
+
+	/// The JSON encoded settings of the task, they must not contain secrets
+	Settings []byte
+
+	State uint
+
+	/// The error message of failed tasks
+	Error string
+
+	/// The JSON encoded result of finished tasks, nil otherwise
+	Result []byte
+
+	Created time.Time
+}
+
+/// Persistent storage of the tasks of the analyzer, so that they survive a
+/// restart.
+///
+/// The store is backed by a sqlite database.
+type TaskStore struct {
+	con *sql.DB
+}
+
+/// Opens the task store in the sqlite database `dbFileName`.
+///
+/// The results of tasks that were stored with a different
+/// `TaskStoreFormatVersion` are dropped.
+func CreateTaskStore(dbFileName string) (*TaskStore, error) {
+	con, err := sql.Open("sqlite3", dbFileName)
+	if err != nil {
+		return nil, err
+	}
+	store := &TaskStore{con: con}
+
+	if err := store.migrate(); err != nil {
+		con.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *TaskStore) migrate() error {
+	query := `
+    CREATE TABLE IF NOT EXISTS task(
+        id TEXT PRIMARY KEY,
+        kind TEXT NOT NULL,
+        image_url TEXT NOT NULL,
+        settings TEXT NOT NULL,
+        state INTEGER NOT NULL,
+        error TEXT NOT NULL,
+        result TEXT,
+        format_version INTEGER NOT NULL,
+        created INTEGER NOT NULL
+    );
+    `
+	if _, err := s.con.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.con.Exec(
+		"UPDATE task SET result = NULL, format_version = ? WHERE format_version != ?",
+		TaskStoreFormatVersion, TaskStoreFormatVersion,
+	)
+	return err
+}
+
+func (s *TaskStore) Destroy() error {
+	return s.con.Close()
+}
+
+/// Inserts the task `record` or replaces the stored task with the same id
+func (s *TaskStore) Put(record TaskRecord) error {
+	var result *string
+	if record.Result != nil {
+		r := string(record.Result)
+		result = &r
+	}
+
+	_, err := s.con.Exec(
+		`INSERT OR REPLACE INTO task(id, kind, image_url, settings, state, error, result, format_version, created)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.ID, string(record.Kind), record.ImageUrl, string(record.Settings), record.State, record.Error,
+		result, TaskStoreFormatVersion, record.Created.UnixNano(),
+	)
+	return err
+}
+
+/// Returns the task with the id `id`, or ErrNonExistent if there is none
+func (s *TaskStore) Get(id string) (TaskRecord, error) {
+	records, err := s.query("WHERE id = ?", id)
+	if err != nil {
+		return TaskRecord{}, err
+	}
+	if len(records) == 0 {
+		return TaskRecord{}, ErrNonExistent
+	}
+	return records[0], nil
+}
+
+/// Returns all stored tasks in the order of their creation
+func (s *TaskStore) List() ([]TaskRecord, error) {
+	return s.query("ORDER BY created ASC, id ASC")
+}
+
+/// Removes the task with the id `id`, removing a task that does not exist is
+/// not an error
+func (s *TaskStore) Delete(id string) error {
+	_, err := s.con.Exec("DELETE FROM task WHERE id = ?", id)
+	return err
+}
+
+func (s *TaskStore) query(clause string, args ...interface{}) ([]TaskRecord, error) {
+	rows, err := s.con.Query(
+		"SELECT id, kind, image_url, settings, state, error, result, created FROM task "+clause, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]TaskRecord, 0)
+	for rows.Next() {
+		var r TaskRecord
+		var kind, settings string
+		var result sql.NullString
+		var created int64
+		if err := rows.Scan(&r.ID, &kind, &r.ImageUrl, &settings, &r.State, &r.Error, &result, &created); err != nil {
+			return nil, err
+		}
+		r.Kind = TaskKind(kind)
+		r.Settings = []byte(settings)
+		if result.Valid {
+			r.Result = []byte(result.String)
+		}
+		r.Created = time.Unix(0, created)
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
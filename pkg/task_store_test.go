@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskStoreRoundtrip(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "tasks.sqlite3")
+	store, err := CreateTaskStore(dbPath)
+	require.NoError(t, err)
+
+	_, err = store.Get("missing")
+	assert.ErrorIs(t, err, ErrNonExistent)
+
+	created := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	queued := TaskRecord{
+		ID: "b", Kind: TaskKindImage, ImageUrl: "docker://alpine:3.15", Settings: []byte(`{"stream":true}`), Created: created.Add(time.Second),
+	}
+	finished := TaskRecord{
+		ID: "a", Kind: TaskKindIndex, ImageUrl: "docker://busybox", Settings: []byte(`{}`), State: 4,
+		Result: []byte(`{"platforms":[]}`), Created: created,
+	}
+	require.NoError(t, store.Put(queued))
+	require.NoError(t, store.Put(finished))
+
+	records, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "a", records[0].ID)
+	assert.Equal(t, "b", records[1].ID)
+	assert.True(t, created.Equal(records[0].Created))
+	records[0].Created, records[1].Created = finished.Created, queued.Created
+	assert.Equal(t, []TaskRecord{finished, queued}, records)
+
+	queued.State, queued.Error = 5, "pull failed"
+	require.NoError(t, store.Put(queued))
+	require.NoError(t, store.Destroy())
+
+	// the tasks survive reopening the database
+	store, err = CreateTaskStore(dbPath)
+	require.NoError(t, err)
+	defer store.Destroy()
+
+	record, err := store.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, uint(5), record.State)
+	assert.Equal(t, "pull failed", record.Error)
+	assert.Nil(t, record.Result)
+
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Delete("b"))
+	records, err = store.List()
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestTaskStoreDropsResultsOfOtherVersions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "tasks.sqlite3")
+	store, err := CreateTaskStore(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(TaskRecord{
+		ID: "a", Kind: TaskKindImage, ImageUrl: "docker://busybox", Settings: []byte(`{}`), State: 4, Result: []byte(`{}`),
+	}))
+	_, err = store.con.Exec("UPDATE task SET format_version = ?", TaskStoreFormatVersion-1)
+	require.NoError(t, err)
+	require.NoError(t, store.Destroy())
+
+	store, err = CreateTaskStore(dbPath)
+	require.NoError(t, err)
+	defer store.Destroy()
+
+	record, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Nil(t, record.Result)
+	assert.Equal(t, uint(4), record.State)
+}
@@ -1,4 +1,12 @@
-import type { ContainerImage, DataRouteReply, ImageInspectInfo } from "./types";
+import type { Dir } from "./fs-tree";
+import type {
+  AnalysisRouteReply,
+  ContainerImage,
+  DataRouteReply,
+  DirDiff,
+  HistoryStep,
+  ImageInspectInfo
+} from "./types";
 
 export interface ImageEntry {
   readonly ID: number;
@@ -9,6 +17,8 @@ interface ImageHistoryEntry {
   readonly Tags: string[];
   readonly Contents: DataRouteReply;
   readonly InspectInfo: ImageInspectInfo;
+  readonly MergedContents?: Dir | null;
+  readonly History?: readonly HistoryStep[] | null;
 }
 
 type HistoryT = Record<string, ImageHistoryEntry>;
@@ -55,9 +65,38 @@ export class BackendStorage {
     return await resp.json();
   }
 
+  /** Compares the final root filesystems of two stored history entries, the
+   * most recent entry of an image is used if the digest is omitted. */
+  public async fetchDiff(
+    oldId: number,
+    newId: number,
+    oldDigest?: string,
+    newDigest?: string
+  ): Promise<DirDiff> {
+    const params = new URLSearchParams({
+      old_id: oldId.toString(),
+      new_id: newId.toString()
+    });
+    if (oldDigest !== undefined) {
+      params.set("old_digest", oldDigest);
+    }
+    if (newDigest !== undefined) {
+      params.set("new_digest", newDigest);
+    }
+
+    const resp = await fetch(`${this.addr}/diff?${params.toString()}`);
+    if (resp.status !== 200) {
+      const msg = await resp.text();
+      throw new Error(
+        `Failed to fetch the diff, got status ${resp.status} and body: ${msg}`
+      );
+    }
+    return await resp.json();
+  }
+
   public async saveHistory(
     image: ContainerImage,
-    data: DataRouteReply
+    analysis: AnalysisRouteReply
   ): Promise<void> {
     let historyWithMatchingName: ImageHistory[] | undefined = undefined;
 
@@ -77,8 +116,10 @@ export class BackendStorage {
 
     let newHistEntry: ImageHistoryEntry = {
       Tags: image.Tag === "" ? [] : [image.Tag],
-      Contents: data,
-      InspectInfo: image.ImageInfo
+      Contents: analysis.layers,
+      InspectInfo: image.ImageInfo,
+      MergedContents: analysis.merged_root,
+      History: analysis.history
     };
 
     let entries: HistoryT; // = existingHistory?.History ?? {};
@@ -88,11 +129,10 @@ export class BackendStorage {
       existingHistory.History[currentEntryKey] !== undefined
     ) {
       const oldEntry = existingHistory.History[currentEntryKey];
-      const { Contents, InspectInfo } = newHistEntry;
       existingHistory.History[currentEntryKey] = {
-        Tags: [...new Set([...oldEntry.Tags, ...newHistEntry.Tags])],
-        Contents,
-        InspectInfo
+        ...oldEntry,
+        ...newHistEntry,
+        Tags: [...new Set([...oldEntry.Tags, ...newHistEntry.Tags])]
       };
       entries = existingHistory.History;
     } else {
@@ -9,11 +9,92 @@ export interface Dir {
   readonly dirname: string;
   readonly total_size: number;
   readonly files: Record<string, number>;
+  readonly file_info?: Record<string, FileInfo>;
   readonly directories: Record<string, Dir>;
+  readonly hardlinks?: number;
+  readonly hardlink_saved_bytes?: number;
+  readonly estimated_compressed_size?: number;
+  readonly category_sizes?: Partial<Record<FileCategory, number>>;
+}
+
+/** Equivalent of the FileCategory type from `file_category.go` */
+export type FileCategory =
+  | "executable"
+  | "shared_library"
+  | "static_library"
+  | "python_bytecode"
+  | "documentation"
+  | "locale"
+  | "font"
+  | "image"
+  | "archive"
+  | "cache"
+  | "log"
+  | "other";
+
+/** Equivalent of the FileInfo struct from `file_info.go` */
+export interface FileInfo {
+  readonly type:
+    | "regular"
+    | "symlink"
+    | "hardlink"
+    | "char_device"
+    | "block_device"
+    | "fifo";
+  readonly mode: number;
+  readonly uid: number;
+  readonly gid: number;
+  readonly mtime: string;
+  readonly link_target?: string;
+  readonly links?: number;
+  readonly linked_size?: number;
+  readonly estimated_compressed_size?: number;
+  readonly digest?: string;
+  readonly category?: FileCategory;
+  readonly debug_info_size?: number;
 }
 
 export interface Layer extends Dir {
   readonly CreatedBy: string;
+  readonly compressed_size?: number;
+  readonly uncompressed_size?: number;
+  readonly tar_overhead?: number;
+  readonly payload_size?: number;
+  readonly contents_hashed?: boolean;
+  readonly package_databases?: Record<string, PackageDatabaseFile>;
+  readonly dependency_manifests?: Record<string, DependencyManifest>;
+}
+
+export type Ecosystem = "npm" | "python" | "ruby" | "maven" | "gradle" | "go";
+
+/** Equivalent of the DependencyManifest struct from `dependencies.go` */
+export interface DependencyManifest {
+  readonly ecosystem: Ecosystem;
+  readonly name?: string;
+  readonly version?: string;
+  readonly files?: readonly string[];
+  readonly error?: string;
+}
+
+/** Equivalent of the PackageRef struct from `package_db.go` */
+export interface PackageRef {
+  readonly manager: "rpm" | "dpkg" | "apk";
+  readonly name: string;
+  readonly version: string;
+  readonly arch?: string;
+}
+
+/** Equivalent of the Package struct from `package_db.go` */
+export interface Package extends PackageRef {
+  readonly files?: readonly string[];
+}
+
+/** Equivalent of the PackageDatabaseFile struct from `package_db.go` */
+export interface PackageDatabaseFile {
+  readonly manager: PackageRef["manager"];
+  readonly packages?: readonly Package[];
+  readonly files?: readonly string[];
+  readonly error?: string;
 }
 
 const colorOfSizeDif = (
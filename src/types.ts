@@ -1,4 +1,4 @@
-import type { Layer } from "./fs-tree";
+import type { Dir, Ecosystem, Layer, PackageRef } from "./fs-tree";
 
 // this is the json.Marshall of github.com/containers/image/v5/types.ImageInspectInfo
 export interface ImageInspectInfo {
@@ -54,17 +54,208 @@ export interface ContainerImage {
   readonly ImageInfo: ImageInspectInfo | undefined | null;
 }
 
+// json.Marshall of main.VerifiedSignature
+export interface VerifiedSignature {
+  readonly docker_reference: string;
+  readonly manifest_digest: string;
+  readonly key_identifier: string;
+  readonly creator?: string;
+  readonly timestamp?: string;
+}
+
+// json.Marshall of main.SignatureVerification
+export interface SignatureVerification {
+  readonly policy: string;
+  readonly allowed: boolean;
+  readonly verified: boolean;
+  readonly manifest_digest: string;
+  readonly signatures: readonly VerifiedSignature[];
+}
+
 export interface Task {
   readonly Image: ContainerImage;
   readonly state: TaskState;
   readonly error: string;
+  readonly threshold_error: string;
   readonly pull_progress: PullProgress | undefined | null;
+  readonly signature: SignatureVerification | null;
 }
 
 export interface DataRouteReply {
   string: Layer;
 }
 
+// json.Marshall of internal.DuplicateFile
+export interface DuplicateFile {
+  readonly path: string;
+  readonly layer: string;
+  readonly in_final_image: boolean;
+}
+
+// json.Marshall of internal.DuplicateGroup
+export interface DuplicateGroup {
+  readonly digest: string;
+  readonly size: number;
+  readonly files: readonly DuplicateFile[];
+  readonly reclaimable_bytes: number;
+}
+
+// json.Marshall of internal.DuplicateReport
+export interface DuplicateReport {
+  readonly groups: readonly DuplicateGroup[];
+  readonly reclaimable_bytes: number;
+}
+
+// json.Marshall of internal.PackageSize
+export interface PackageSize extends PackageRef {
+  readonly size: number;
+  readonly file_count: number;
+  readonly layer: string;
+}
+
+// json.Marshall of internal.LayerPackageChanges
+export interface LayerPackageChanges {
+  readonly digest: string;
+  readonly added: readonly PackageRef[];
+  readonly removed: readonly PackageRef[];
+}
+
+// json.Marshall of internal.UnownedFile
+export interface UnownedFile {
+  readonly path: string;
+  readonly size: number;
+}
+
+// json.Marshall of internal.PackageReport
+export interface PackageReport {
+  readonly packages: readonly PackageSize[];
+  readonly layers: readonly LayerPackageChanges[];
+  readonly unowned_files: readonly UnownedFile[];
+  readonly unowned_bytes: number;
+  readonly errors?: readonly string[];
+}
+
+// json.Marshall of internal.Dependency
+export interface Dependency {
+  readonly ecosystem: Ecosystem;
+  readonly name: string;
+  readonly version: string;
+  readonly size: number;
+  readonly file_count: number;
+  readonly paths: readonly string[];
+}
+
+// json.Marshall of internal.EcosystemSize
+export interface EcosystemSize {
+  readonly ecosystem: Ecosystem;
+  readonly size: number;
+  readonly dependencies: number;
+}
+
+// json.Marshall of internal.DependencyBreakdown
+export interface DependencyBreakdown {
+  readonly ecosystems: readonly EcosystemSize[];
+  readonly dependencies: readonly Dependency[];
+}
+
+// json.Marshall of internal.LayerDependencies
+export interface LayerDependencies extends DependencyBreakdown {
+  readonly digest: string;
+}
+
+// json.Marshall of internal.DependencyReport
+export interface DependencyReport {
+  readonly merged: DependencyBreakdown;
+  readonly layers: readonly LayerDependencies[];
+  readonly errors?: readonly string[];
+}
+
+// json.Marshall of internal.HistoryStep
+export interface HistoryStep {
+  readonly index: number;
+  readonly created?: string;
+  readonly created_by?: string;
+  readonly comment?: string;
+  readonly empty_layer: boolean;
+  readonly layer?: string;
+}
+
+export type RecommendationKind =
+  | "package_manager_cache"
+  | "build_toolchain"
+  | "removed_later"
+  | "debug_info"
+  | "dependency_tests"
+  | "squash_layers";
+
+// json.Marshall of internal.Recommendation
+export interface Recommendation {
+  readonly kind: RecommendationKind;
+  readonly layer: string;
+  readonly created_by?: string;
+  readonly related_layer?: string;
+  readonly paths: readonly string[];
+  readonly file_count: number;
+  readonly bytes: number;
+  readonly suggestion: string;
+}
+
+// json.Marshall of internal.RecommendationReport
+export interface RecommendationReport {
+  readonly recommendations: readonly Recommendation[];
+  readonly savable_bytes: number;
+}
+
+export type DiffStatus =
+  | "added"
+  | "removed"
+  | "grown"
+  | "shrunk"
+  | "unchanged"
+  | "modified";
+
+// json.Marshall of internal.FileDiff
+export interface FileDiff {
+  readonly name: string;
+  readonly status: DiffStatus;
+  readonly old_size: number;
+  readonly new_size: number;
+  readonly delta: number;
+}
+
+// json.Marshall of internal.DiffCounts
+export interface DiffCounts {
+  readonly added: number;
+  readonly removed: number;
+  readonly grown: number;
+  readonly shrunk: number;
+  readonly modified: number;
+  readonly unchanged: number;
+}
+
+// json.Marshall of internal.DirDiff
+export interface DirDiff {
+  readonly dirname: string;
+  readonly status: DiffStatus;
+  readonly old_size: number;
+  readonly new_size: number;
+  readonly delta: number;
+  readonly counts: DiffCounts;
+  readonly files: readonly FileDiff[];
+  readonly directories: readonly DirDiff[];
+}
+
+// json.Marshall of internal.ImageAnalysis
+export interface AnalysisRouteReply {
+  readonly layers: DataRouteReply;
+  readonly merged_root: Dir;
+  readonly duplicates?: DuplicateReport;
+  readonly packages?: PackageReport;
+  readonly dependencies?: DependencyReport;
+  readonly recommendations: RecommendationReport;
+  readonly history: readonly HistoryStep[] | null;
+}
+
 export const enum PageState {
   New,
   Pulling,
@@ -81,3 +272,46 @@ export const enum TaskState {
   Finished,
   Error
 }
+
+// json.Marshall of main.IndexTask
+export interface IndexTask {
+  readonly image_url: string;
+  readonly state: TaskState;
+  readonly error: string;
+  readonly manifests: readonly ExtractedDigest[] | null;
+  readonly platforms: readonly Task[] | null;
+  readonly stream: boolean;
+  readonly hash_files: boolean;
+}
+
+// json.Marshall of main.PlatformSizes
+export interface PlatformSizes {
+  readonly platform: Platform;
+  readonly digest: string;
+  readonly layers: number;
+  readonly compressed_size: number;
+  readonly layers_size: number;
+  readonly merged_size: number;
+  readonly wasted_bytes: number;
+}
+
+// json.Marshall of main.IndexFootprint
+export interface IndexFootprint {
+  readonly total_size: number;
+  readonly unshared_size: number;
+  readonly shared_blobs: number;
+}
+
+// json.Marshall of main.PlatformAnalysis
+export interface PlatformAnalysis {
+  readonly platform: Platform;
+  readonly digest: string;
+  readonly analysis: AnalysisRouteReply;
+}
+
+// json.Marshall of main.IndexAnalysis
+export interface IndexAnalysisRouteReply {
+  readonly platforms: readonly PlatformAnalysis[];
+  readonly sizes: readonly PlatformSizes[];
+  readonly footprint: IndexFootprint;
+}